@@ -0,0 +1,80 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// captureStart implements StartAndCapture. It starts s, waits until d has
+// passed, s has stopped after running or ctx is cancelled, and returns the
+// output read returns then. read must have been set up before calling, so
+// it only returns what the service wrote since.
+func captureStart(ctx context.Context, s Service, d time.Duration, read func() (string, error)) (string, error) {
+	err := s.Start()
+	if err != nil {
+		// The service may have failed to start because it exited.
+		output, _ := read()
+		return output, err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	statuses, err := s.WatchStatus(waitCtx)
+	if err != nil {
+		return "", err
+	}
+	running := false
+	for status := range statuses {
+		if status == StatusStopped && running {
+			cancel()
+		}
+		running = status == StatusRunning
+	}
+	output, err := read()
+	if err != nil {
+		return output, err
+	}
+	return output, ctx.Err()
+}
+
+// fileOutput returns a function that reads what has been appended to the
+// output file path since fileOutput was called. A file that has shrunk in
+// the meantime, because it was rotated, is read from the start.
+func fileOutput(path string) (func() (string, error), error) {
+	var offset int64
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		offset = info.Size()
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("Unable to stat %s: %v", path, err)
+	}
+	return func() (string, error) {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("Unable to open %s: %v", path, err)
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && info.Size() >= offset {
+			_, err = f.Seek(offset, io.SeekStart)
+			if err != nil {
+				return "", fmt.Errorf("Unable to read %s: %v", path, err)
+			}
+		}
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read %s: %v", path, err)
+		}
+		return string(b), nil
+	}, nil
+}
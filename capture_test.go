@@ -0,0 +1,91 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// processService is a Service whose Start runs this test binary as a
+// process that fails at startup, appending its output to path.
+type processService struct {
+	Service
+	path string
+	done chan struct{}
+}
+
+func (s *processService) Start() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCaptureHelper$")
+	cmd.Env = append(os.Environ(), "SERVICE_CAPTURE_HELPER=1")
+	cmd.Stdout, cmd.Stderr = f, f
+	if err := cmd.Start(); err != nil {
+		f.Close()
+		return err
+	}
+	go func() {
+		cmd.Wait()
+		f.Close()
+		close(s.done)
+	}()
+	return nil
+}
+
+func (s *processService) WatchStatus(ctx context.Context) (<-chan Status, error) {
+	statuses := make(chan Status, 2)
+	statuses <- StatusRunning
+	go func() {
+		defer close(statuses)
+		select {
+		case <-s.done:
+			statuses <- StatusStopped
+		case <-ctx.Done():
+		}
+	}()
+	return statuses, nil
+}
+
+// TestCaptureHelper is the process processService starts.
+func TestCaptureHelper(t *testing.T) {
+	if os.Getenv("SERVICE_CAPTURE_HELPER") == "" {
+		return
+	}
+	fmt.Println("starting")
+	fmt.Fprintln(os.Stderr, "listen tcp :80: bind: permission denied")
+	os.Exit(1)
+}
+
+func TestStartAndCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	if err := ioutil.WriteFile(path, []byte("previous run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &processService{path: path, done: make(chan struct{})}
+	read, err := fileOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	output, err := captureStart(context.Background(), s, time.Minute, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "starting\nlisten tcp :80: bind: permission denied\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("capture didn't end when the process exited, took %v", elapsed)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+var errEmptyCommand = errors.New("Command is empty.")
+
+// ParseCommand splits the command line cmd into the program and arguments
+// for Config.Program and Config.Arguments. On Windows it follows the rules
+// of CommandLineToArgvW; elsewhere it splits words as a POSIX shell does,
+// honouring single and double quotes and backslash escapes, but without
+// expanding variables or globs.
+func ParseCommand(cmd string) (program string, args []string, err error) {
+	var words []string
+	if runtime.GOOS == "windows" {
+		words = splitWindowsCommand(cmd)
+	} else {
+		words, err = splitShellWords(cmd)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if len(words) == 0 {
+		return "", nil, errEmptyCommand
+	}
+	return words[0], words[1:], nil
+}
+
+// splitShellWords splits cmd into words as a POSIX shell does.
+func splitShellWords(cmd string) ([]string, error) {
+	var (
+		words []string
+		word  strings.Builder
+		// inWord is set once the current word has started, so quoted
+		// empty strings count as words.
+		inWord bool
+		quote  rune
+	)
+	runes := []rune(cmd)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			if i+1 == len(runes) {
+				return nil, fmt.Errorf("Unable to parse command %q: trailing backslash", cmd)
+			}
+			next := runes[i+1]
+			i++
+			switch {
+			case next == '\n':
+				// A backslash-newline joins lines.
+				continue
+			case quote == '"' && !strings.ContainsRune("$`\"\\", next):
+				word.WriteRune(c)
+				word.WriteRune(next)
+			default:
+				word.WriteRune(next)
+			}
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unable to parse command %q: unterminated %c quote", cmd, quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// splitWindowsCommand splits cmd into words with the rules of
+// CommandLineToArgvW. The program name ends at the next space, or at the
+// closing quote if it starts with one, and backslashes in it are literal.
+// In the arguments, 2n backslashes followed by a quote become n backslashes
+// and the quote opens or closes a quoted part, 2n+1 backslashes followed by
+// a quote become n backslashes and a literal quote, and "" within a quoted
+// part is a literal quote that also ends the quoted part.
+func splitWindowsCommand(cmd string) []string {
+	cmd = strings.TrimLeft(cmd, " \t")
+	if cmd == "" {
+		return nil
+	}
+	var program string
+	if cmd[0] == '"' {
+		program, cmd, _ = strings.Cut(cmd[1:], `"`)
+	} else if i := strings.IndexAny(cmd, " \t"); i >= 0 {
+		program, cmd = cmd[:i], cmd[i:]
+	} else {
+		program, cmd = cmd, ""
+	}
+	words := []string{program}
+
+	var (
+		word    strings.Builder
+		inWord  bool
+		inQuote bool
+		slashes int
+	)
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch c {
+		case '\\':
+			slashes++
+			inWord = true
+			continue
+		case '"':
+			word.WriteString(strings.Repeat(`\`, slashes/2))
+			if slashes%2 == 1 {
+				word.WriteByte('"')
+			} else if inQuote && i+1 < len(cmd) && cmd[i+1] == '"' {
+				word.WriteByte('"')
+				inQuote = false
+				i++
+			} else {
+				inQuote = !inQuote
+			}
+			slashes = 0
+			inWord = true
+			continue
+		case ' ', '\t':
+			if !inQuote {
+				word.WriteString(strings.Repeat(`\`, slashes))
+				slashes = 0
+				if inWord {
+					words = append(words, word.String())
+					word.Reset()
+					inWord = false
+				}
+				continue
+			}
+		}
+		word.WriteString(strings.Repeat(`\`, slashes))
+		slashes = 0
+		word.WriteByte(c)
+		inWord = true
+	}
+	word.WriteString(strings.Repeat(`\`, slashes))
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	for _, tt := range []struct {
+		cmd  string
+		want []string
+	}{
+		{"/usr/bin/test -v", []string{"/usr/bin/test", "-v"}},
+		{"  /usr/bin/test \t -v\n", []string{"/usr/bin/test", "-v"}},
+		{`"/opt/my app/bin" --name 'it''s' "a \"b\" \$c \d"`, []string{"/opt/my app/bin", "--name", "its", `a "b" $c \d`}},
+		{`/usr/bin/test 'it'\''s here' ""`, []string{"/usr/bin/test", "it's here", ""}},
+		{`/opt/my\ app/bin --flag=a\ b`, []string{"/opt/my app/bin", "--flag=a b"}},
+		{"/usr/bin/test \\\n -v", []string{"/usr/bin/test", "-v"}},
+		{`/usr/bin/test '$HOME' "*"`, []string{"/usr/bin/test", "$HOME", "*"}},
+		{"", nil},
+	} {
+		words, err := splitShellWords(tt.cmd)
+		if err != nil || !reflect.DeepEqual(words, tt.want) {
+			t.Errorf("splitShellWords(%q) = %q, %v; want %q", tt.cmd, words, err, tt.want)
+		}
+	}
+	for _, cmd := range []string{`/usr/bin/test "-v`, `/usr/bin/test 'a`, `/usr/bin/test \`} {
+		if words, err := splitShellWords(cmd); err == nil {
+			t.Errorf("splitShellWords(%q) = %q, want an error", cmd, words)
+		}
+	}
+}
+
+func TestSplitWindowsCommand(t *testing.T) {
+	for _, tt := range []struct {
+		cmd  string
+		want []string
+	}{
+		{`C:\test\test.exe -v`, []string{`C:\test\test.exe`, "-v"}},
+		{`"C:\Program Files\test\test.exe" "-v" "a b"`, []string{`C:\Program Files\test\test.exe`, "-v", "a b"}},
+		{`"C:\Program Files\test\" a\\b c\"d`, []string{`C:\Program Files\test\`, `a\\b`, `c"d`}},
+		{`test.exe "a\\" b "c\\\"d" e\\\\"f g"`, []string{"test.exe", `a\`, "b", `c\"d`, `e\\f g`}},
+		{`test.exe "a""b c`, []string{"test.exe", `a"b`, "c"}},
+		{`test.exe "" "a b`, []string{"test.exe", "", "a b"}},
+		{"   ", nil},
+	} {
+		if words := splitWindowsCommand(tt.cmd); !reflect.DeepEqual(words, tt.want) {
+			t.Errorf("splitWindowsCommand(%q) = %q, want %q", tt.cmd, words, tt.want)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	program, args, err := ParseCommand(`"/opt/my app/bin/server" --config "/etc/my app.conf"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program != "/opt/my app/bin/server" || !reflect.DeepEqual(args, []string{"--config", "/etc/my app.conf"}) {
+		t.Errorf("ParseCommand = %q, %q", program, args)
+	}
+	if _, _, err := ParseCommand(" "); err != errEmptyCommand {
+		t.Errorf("ParseCommand of a blank command = %v, want errEmptyCommand", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DesiredState is the state Ensure brings a service into.
+type DesiredState struct {
+	Installed bool // Installed with the service's Config
+	Enabled   bool // Starts at boot; requires Installed
+	Running   bool // Running now; requires Installed
+}
+
+// Ensure brings s into the desired state with as few operations as
+// possible and returns a description of each change it made, such as
+// "installed" or "started". An installed service is always updated to
+// match its Config. When the platform can't report whether the service is
+// running, Start or Stop is called regardless.
+func Ensure(s Service, state DesiredState) ([]string, error) {
+	if !state.Installed && (state.Enabled || state.Running) {
+		return nil, errors.New("DesiredState.Enabled and DesiredState.Running require DesiredState.Installed.")
+	}
+
+	var changes []string
+	apply := func(change string, op func() error) error {
+		if err := op(); err != nil {
+			return err
+		}
+		changes = append(changes, change)
+		return nil
+	}
+
+	current, err := s.Export()
+	if err != nil {
+		return nil, err
+	}
+	if !state.Installed {
+		if !current.Installed {
+			return changes, nil
+		}
+		if current.Status == StatusRunning {
+			if err := apply("stopped", s.Stop); err != nil {
+				return changes, err
+			}
+		} else if current.Status == StatusUnknown {
+			// Uninstalling a running service can leave it orphaned.
+			s.Stop()
+		}
+		return changes, apply("uninstalled", s.Uninstall)
+	}
+
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		return changes, err
+	}
+	if result.Installed {
+		changes = append(changes, "installed")
+	} else if result.Updated {
+		changes = append(changes, "updated")
+	}
+	if result.Changed() {
+		// Installing may enable or start the service, depending on the
+		// platform.
+		current, err = s.Export()
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	if state.Enabled && !current.Enabled {
+		err = apply("enabled", s.Enable)
+	} else if !state.Enabled && current.Enabled {
+		err = apply("disabled", s.Disable)
+	}
+	if err != nil {
+		return changes, err
+	}
+
+	running := current.Status == StatusRunning
+	stopped := current.Status == StatusStopped
+	if state.Running && !running {
+		err = apply("started", s.Start)
+	} else if !state.Running && !stopped {
+		err = apply("stopped", s.Stop)
+	}
+	return changes, err
+}
+
+// healthPollInterval is how often InstallOrUpdateWithRollback calls the
+// health check.
+var healthPollInterval = time.Second
+
+// installWithRollback implements InstallOrUpdateWithRollback. snapshot
+// saves the installed configuration and returns a function that restores
+// it, or nil if the service isn't installed.
+func installWithRollback(s Service, snapshot func() (func() error, error), healthy func() error, timeout time.Duration) error {
+	restore, err := snapshot()
+	if err != nil {
+		return fmt.Errorf("Unable to save the installed configuration: %v", err)
+	}
+	err = installAndCheck(s, restore != nil, healthy, timeout)
+	if err == nil {
+		return nil
+	}
+	var rollbackErr error
+	if restore == nil {
+		rollbackErr = s.UninstallIfPresent()
+	} else if rollbackErr = restore(); rollbackErr == nil {
+		rollbackErr = s.Restart()
+	}
+	if rollbackErr != nil {
+		return fmt.Errorf("%w; rolling back also failed: %v", err, rollbackErr)
+	}
+	return fmt.Errorf("%w; rolled back", err)
+}
+
+// installAndCheck installs or updates s, starts it, restarting an existing
+// service so it runs the new configuration, and waits for healthy to pass.
+func installAndCheck(s Service, existed bool, healthy func() error, timeout time.Duration) error {
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		return err
+	}
+	switch {
+	case existed:
+		err = s.Restart()
+	case !result.Started:
+		err = s.Start()
+	}
+	if err != nil {
+		return err
+	}
+	deadline := now().Add(timeout)
+	for {
+		err = healthy()
+		if err == nil {
+			return nil
+		}
+		if !now().Before(deadline) {
+			return fmt.Errorf("Service is not healthy after %v: %w", timeout, err)
+		}
+		sleep(healthPollInterval)
+	}
+}
+
+// fileSnapshot is the snapshot of installWithRollback for services whose
+// configuration is a file: it is restored with EditConfig.
+func fileSnapshot(s Service) func() (func() error, error) {
+	return func() (func() error, error) {
+		saved, err := s.InstalledConfig()
+		if err == ErrNotInstalled {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return s.EditConfig(func([]byte) ([]byte, error) {
+				return saved, nil
+			})
+		}, nil
+	}
+}
+
+// Reconcile keeps the service described by desired installed with that
+// Config, enabled and running, until ctx is cancelled. Every interval it
+// calls Ensure, which reinstalls the service if its configuration has
+// drifted, and logs each correction through the logger set with
+// SetLogger. Failures are logged too and retried at the next interval, so
+// Reconcile only returns an error for an invalid Config or, once ctx is
+// cancelled, ctx.Err().
+func Reconcile(ctx context.Context, interval time.Duration, desired Config) error {
+	if interval <= 0 {
+		return errors.New("Reconcile interval must be positive.")
+	}
+	s, err := New(desired)
+	if err != nil {
+		return err
+	}
+	return reconcile(ctx, s, desired.Name, interval)
+}
+
+func reconcile(ctx context.Context, s Service, name string, interval time.Duration) error {
+	state := DesiredState{Installed: true, Enabled: true, Running: true}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changes, err := Ensure(s, state)
+		for _, change := range changes {
+			logf("Reconciled %s: %s", name, change)
+		}
+		if err != nil {
+			logf("Unable to reconcile %s: %v", name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stateService is a Service that only tracks whether it is installed,
+// enabled and running, and records the operations called on it.
+type stateService struct {
+	installed, enabled, running bool
+	calls                       []string
+}
+
+func (s *stateService) record(call string) {
+	s.calls = append(s.calls, call)
+}
+
+func (s *stateService) Start() error {
+	s.record("Start")
+	s.running = true
+	return nil
+}
+
+func (s *stateService) Stop() error {
+	s.record("Stop")
+	s.running = false
+	return nil
+}
+
+func (s *stateService) ResetFailed() error {
+	return ErrNotSupported
+}
+
+func (s *stateService) Restart() error {
+	s.record("Restart")
+	s.running = true
+	return nil
+}
+
+func (s *stateService) InstallOrUpdateRequired() (bool, error) {
+	return !s.installed, nil
+}
+
+func (s *stateService) NeedsElevation() bool {
+	return false
+}
+
+// InstallOrUpdate behaves like systemd: installing enables the service but
+// doesn't start it.
+func (s *stateService) InstallOrUpdate() (InstallResult, error) {
+	s.record("InstallOrUpdate")
+	if s.installed {
+		return InstallResult{}, nil
+	}
+	s.installed, s.enabled = true, true
+	return InstallResult{Installed: true}, nil
+}
+
+func (s *stateService) ForceReinstall() error {
+	s.record("ForceReinstall")
+	s.installed = true
+	return nil
+}
+
+func (s *stateService) Uninstall() error {
+	s.record("Uninstall")
+	s.installed, s.enabled = false, false
+	return nil
+}
+
+func (s *stateService) UninstallIfPresent() error {
+	return s.Uninstall()
+}
+
+func (s *stateService) UpdateProgram(newPath string) error {
+	s.record("UpdateProgram")
+	return nil
+}
+
+func (s *stateService) UpdateArguments(args []string) error {
+	s.record("UpdateArguments")
+	return nil
+}
+
+func (s *stateService) EffectiveConfig() Config {
+	return Config{}
+}
+
+func (s *stateService) Validate() error {
+	return nil
+}
+
+func (s *stateService) InstalledVersion() (string, error) {
+	return "", nil
+}
+
+func (s *stateService) WriteConfig(w io.Writer) error {
+	return nil
+}
+
+func (s *stateService) Enable() error {
+	s.record("Enable")
+	s.enabled = true
+	return nil
+}
+
+func (s *stateService) IsEnabled() (bool, error) {
+	return s.installed && s.enabled, nil
+}
+
+func (s *stateService) Disable() error {
+	s.record("Disable")
+	s.enabled = false
+	return nil
+}
+
+func (s *stateService) Drain() error {
+	return ErrNotSupported
+}
+
+func (s *stateService) Undrain() error {
+	return ErrNotSupported
+}
+
+func (s *stateService) Run() error {
+	return nil
+}
+
+func (s *stateService) RunContext(ctx context.Context) error {
+	return nil
+}
+
+func (s *stateService) LastExitStatus() (int, error) {
+	return 0, ErrNoExitStatus
+}
+
+func (s *stateService) EditConfig(edit func([]byte) ([]byte, error)) error {
+	return ErrNotSupported
+}
+
+func (s *stateService) WatchStatus(ctx context.Context) (<-chan Status, error) {
+	return watchStatus(ctx, s.Export)
+}
+
+func (s *stateService) PlatformHandle() (interface{}, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *stateService) RotateLogs() error {
+	return ErrNotSupported
+}
+
+func (s *stateService) InstallOrUpdateWithRollback(healthy func() error, timeout time.Duration) error {
+	return ErrNotSupported
+}
+
+func (s *stateService) Processes() ([]int, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *stateService) StartAndCapture(ctx context.Context, d time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (s *stateService) UpdateWillRestart() (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (s *stateService) InstalledConfig() ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *stateService) CommandLine() (string, error) {
+	return "", ErrNotSupported
+}
+
+func (s *stateService) Kill() error {
+	return ErrNotSupported
+}
+
+func (s *stateService) Wait(ctx context.Context) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *stateService) ResourceUsage() (ResourceUsage, error) {
+	return ResourceUsage{}, ErrNotSupported
+}
+
+func (s *stateService) Capabilities() Capability {
+	return 0
+}
+
+func (s *stateService) Export() (ServiceDefinition, error) {
+	def := ServiceDefinition{Installed: s.installed, Enabled: s.enabled}
+	if s.installed {
+		def.Status = StatusStopped
+		if s.running {
+			def.Status = StatusRunning
+		}
+	}
+	return def, nil
+}
+
+func TestEnsure(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		current stateService
+		desired DesiredState
+		calls   []string
+		changes []string
+	}{
+		{
+			name:    "fresh install",
+			desired: DesiredState{Installed: true, Enabled: true, Running: true},
+			calls:   []string{"InstallOrUpdate", "Start"},
+			changes: []string{"installed", "started"},
+		},
+		{
+			name:    "install disabled and stopped",
+			desired: DesiredState{Installed: true},
+			calls:   []string{"InstallOrUpdate", "Disable"},
+			changes: []string{"installed", "disabled"},
+		},
+		{
+			name:    "already in state",
+			current: stateService{installed: true, enabled: true, running: true},
+			desired: DesiredState{Installed: true, Enabled: true, Running: true},
+			calls:   []string{"InstallOrUpdate"},
+		},
+		{
+			name:    "stop and enable",
+			current: stateService{installed: true, running: true},
+			desired: DesiredState{Installed: true, Enabled: true},
+			calls:   []string{"InstallOrUpdate", "Enable", "Stop"},
+			changes: []string{"enabled", "stopped"},
+		},
+		{
+			name:    "uninstall running",
+			current: stateService{installed: true, enabled: true, running: true},
+			desired: DesiredState{},
+			calls:   []string{"Stop", "Uninstall"},
+			changes: []string{"stopped", "uninstalled"},
+		},
+		{
+			name:    "already absent",
+			desired: DesiredState{},
+		},
+	} {
+		s := tt.current
+		changes, err := Ensure(&s, tt.desired)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.calls, tt.calls) {
+			t.Errorf("%s: calls = %q, want %q", tt.name, s.calls, tt.calls)
+		}
+		if !reflect.DeepEqual(changes, tt.changes) {
+			t.Errorf("%s: changes = %q, want %q", tt.name, changes, tt.changes)
+		}
+		if s.installed != tt.desired.Installed || s.enabled != tt.desired.Enabled || s.running != tt.desired.Running {
+			t.Errorf("%s: ended in %+v, want %+v", tt.name, s, tt.desired)
+		}
+	}
+
+	if _, err := Ensure(&stateService{}, DesiredState{Running: true}); err == nil {
+		t.Error("expected an error for Running without Installed")
+	}
+}
+
+// driftingService is a stateService whose state can be changed behind its
+// back, from the goroutine using it, and that reports each start.
+type driftingService struct {
+	*stateService
+	drift   chan func(s *stateService)
+	started chan struct{}
+}
+
+func (s *driftingService) Export() (ServiceDefinition, error) {
+	select {
+	case drift := <-s.drift:
+		drift(s.stateService)
+	default:
+	}
+	return s.stateService.Export()
+}
+
+func (s *driftingService) Start() error {
+	err := s.stateService.Start()
+	s.started <- struct{}{}
+	return err
+}
+
+func TestReconcile(t *testing.T) {
+	var logs bytes.Buffer
+	SetLogger(log.New(&logs, "", 0))
+	defer SetLogger(nil)
+
+	s := &driftingService{
+		stateService: &stateService{},
+		drift:        make(chan func(s *stateService)),
+		started:      make(chan struct{}, 10),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error)
+	go func() { errc <- reconcile(ctx, s, "test", time.Millisecond) }()
+
+	<-s.started
+	// The configuration is removed and the service dies.
+	s.drift <- func(s *stateService) {
+		s.installed, s.enabled, s.running = false, false, false
+	}
+	select {
+	case <-s.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drift not repaired")
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("reconcile = %v, want %v", err, context.Canceled)
+	}
+
+	want := []string{"InstallOrUpdate", "Start", "InstallOrUpdate", "Start"}
+	// Passes without drift only call InstallOrUpdate, so repeats are
+	// collapsed.
+	var calls []string
+	for _, call := range s.calls {
+		if len(calls) == 0 || calls[len(calls)-1] != call {
+			calls = append(calls, call)
+		}
+	}
+	if len(calls) < len(want) || !reflect.DeepEqual(calls[:len(want)], want) {
+		t.Errorf("calls = %q, want %q", s.calls, want)
+	}
+	wantLogs := "Reconciled test: installed\nReconciled test: started\nReconciled test: installed\nReconciled test: started\n"
+	if logs.String() != wantLogs {
+		t.Errorf("logs =\n%s\nwant\n%s", logs.String(), wantLogs)
+	}
+}
+
+func TestReconcileInterval(t *testing.T) {
+	if err := Reconcile(context.Background(), 0, Config{Name: "test"}); err == nil {
+		t.Error("Reconcile accepted a zero interval")
+	}
+}
+
+// fakeClock makes sleep advance now instead of waiting.
+func fakeClock(t *testing.T) {
+	oldNow, oldSleep := now, sleep
+	t.Cleanup(func() { now, sleep = oldNow, oldSleep })
+	current := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	sleep = func(d time.Duration) { current = current.Add(d) }
+}
+
+func TestInstallWithRollback(t *testing.T) {
+	errUnhealthy := errors.New("not responding")
+	errRestore := errors.New("disk full")
+	for _, tt := range []struct {
+		name       string
+		installed  bool
+		healthyAt  int // call of healthy that passes, 0 for never
+		restoreErr error
+		calls      []string
+		restored   bool
+		err        string
+	}{
+		{
+			name:      "healthy",
+			installed: true,
+			healthyAt: 3,
+			calls:     []string{"InstallOrUpdate", "Restart"},
+		},
+		{
+			name:      "first install healthy",
+			healthyAt: 1,
+			calls:     []string{"InstallOrUpdate", "Start"},
+		},
+		{
+			name:      "unhealthy rolled back",
+			installed: true,
+			calls:     []string{"InstallOrUpdate", "Restart", "Restart"},
+			restored:  true,
+			err:       "Service is not healthy after 5s: not responding; rolled back",
+		},
+		{
+			name:  "unhealthy first install removed",
+			calls: []string{"InstallOrUpdate", "Start", "Uninstall"},
+			err:   "Service is not healthy after 5s: not responding; rolled back",
+		},
+		{
+			name:       "rollback fails",
+			installed:  true,
+			restoreErr: errRestore,
+			calls:      []string{"InstallOrUpdate", "Restart"},
+			restored:   true,
+			err:        "Service is not healthy after 5s: not responding; rolling back also failed: disk full",
+		},
+	} {
+		fakeClock(t)
+		s := &stateService{installed: tt.installed}
+		restored := false
+		snapshot := func() (func() error, error) {
+			if !s.installed {
+				return nil, nil
+			}
+			return func() error {
+				restored = true
+				return tt.restoreErr
+			}, nil
+		}
+		checks := 0
+		healthy := func() error {
+			checks++
+			if checks == tt.healthyAt {
+				return nil
+			}
+			return errUnhealthy
+		}
+		err := installWithRollback(s, snapshot, healthy, 5*time.Second)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+		if tt.err != "" && !errors.Is(err, errUnhealthy) {
+			t.Errorf("%s: err = %v does not wrap the health check error", tt.name, err)
+		}
+		if !reflect.DeepEqual(s.calls, tt.calls) {
+			t.Errorf("%s: calls = %q, want %q", tt.name, s.calls, tt.calls)
+		}
+		if restored != tt.restored {
+			t.Errorf("%s: restored = %v, want %v", tt.name, restored, tt.restored)
+		}
+	}
+}
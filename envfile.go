@@ -0,0 +1,67 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// loadEnvironmentFiles sets the variables in the environment files paths in
+// the process environment, in order, so later files override earlier ones.
+// Missing files are skipped, as systemd does for EnvironmentFile=-.
+func loadEnvironmentFiles(paths []string) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to open environment file: %v", err)
+		}
+		vars, err := parseEnvFile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to read environment file %s: %v", path, err)
+		}
+		for _, kv := range vars {
+			if err := os.Setenv(kv[0], kv[1]); err != nil {
+				return fmt.Errorf("Unable to set %s from %s: %v", kv[0], path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseEnvFile parses KEY=VALUE lines in the format of a systemd
+// EnvironmentFile. Blank lines and lines starting with # or ; are skipped,
+// and a value may be enclosed in single or double quotes.
+func parseEnvFile(r io.Reader) ([][2]string, error) {
+	var vars [][2]string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d is not KEY=VALUE", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d has an invalid key %q", n, key)
+		}
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	return vars, scanner.Err()
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	vars, err := parseEnvFile(strings.NewReader(`# secrets
+API_KEY=abc=123
+; comment
+
+  SPACED = value with spaces  
+QUOTED="a # b"
+SINGLE='it'
+EMPTY=
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{
+		{"API_KEY", "abc=123"},
+		{"SPACED", "value with spaces"},
+		{"QUOTED", "a # b"},
+		{"SINGLE", "it"},
+		{"EMPTY", ""},
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("parseEnvFile = %q, want %q", vars, want)
+	}
+
+	for _, bad := range []string{"NOVALUE\n", "=value\n", "TWO WORDS=x\n"} {
+		if _, err := parseEnvFile(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestLoadEnvironmentFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.env")
+	second := filepath.Join(dir, "second.env")
+	if err := ioutil.WriteFile(first, []byte("SERVICE_TEST_A=1\nSERVICE_TEST_B=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(second, []byte("SERVICE_TEST_B=2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("SERVICE_TEST_A")
+	defer os.Unsetenv("SERVICE_TEST_B")
+
+	err := loadEnvironmentFiles([]string{first, filepath.Join(dir, "missing.env"), second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := os.Getenv("SERVICE_TEST_A"), os.Getenv("SERVICE_TEST_B"); a != "1" || b != "2" {
+		t.Errorf("SERVICE_TEST_A = %q, SERVICE_TEST_B = %q", a, b)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"io"
+	"strings"
+)
+
+// eventSink is a platform log that accepts one record at a time.
+type eventSink interface {
+	info(msg string) error
+	Close() error
+}
+
+// EventLogWriter returns a writer that sends to the platform log under the
+// given name: the event log on Windows, the journal on Linux and the unified
+// log on OS X. Each call to Write becomes one record at info level, which
+// makes it suitable for log.SetOutput.
+func EventLogWriter(name string) (io.WriteCloser, error) {
+	if len(name) == 0 {
+		return nil, errNameFieldRequired
+	}
+	sink, err := openEventSink(name)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogWriter{sink: sink}, nil
+}
+
+type eventLogWriter struct {
+	sink eventSink
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\r\n")
+	if err := w.sink.info(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *eventLogWriter) Close() error {
+	return w.sink.Close()
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"log"
+	"reflect"
+	"testing"
+)
+
+type fakeSink struct {
+	records []string
+	closed  bool
+}
+
+func (s *fakeSink) info(msg string) error {
+	s.records = append(s.records, msg)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestEventLogWriter(t *testing.T) {
+	sink := &fakeSink{}
+	oldOpen := openEventSink
+	defer func() { openEventSink = oldOpen }()
+	var opened string
+	openEventSink = func(name string) (eventSink, error) {
+		opened = name
+		return sink, nil
+	}
+
+	w, err := EventLogWriter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := log.New(w, "", 0)
+	l.Print("first")
+	l.Print("second\nline")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if opened != "test" {
+		t.Errorf("opened %q", opened)
+	}
+	want := []string{"first", "second\nline"}
+	if !reflect.DeepEqual(sink.records, want) {
+		t.Errorf("records = %q, want %q", sink.records, want)
+	}
+	if !sink.closed {
+		t.Error("sink not closed")
+	}
+
+	if _, err := EventLogWriter(""); err != errNameFieldRequired {
+		t.Errorf("empty name: err = %v", err)
+	}
+}
@@ -4,7 +4,6 @@ go 1.20
 
 require (
 	github.com/getlantern/winsvc v0.0.0-20160824205134-8bb3a5dbcc1d
-	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0
 	github.com/kardianos/service v1.2.2
 )
 
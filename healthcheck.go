@@ -0,0 +1,52 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// healthcheckMaxFailures is the number of consecutive failed health checks
+// after which the service is stopped.
+const healthcheckMaxFailures = 3
+
+// startHealthcheck calls c.Healthcheck every c.HealthcheckInterval until the
+// returned stop function is called. feed is called after every passing
+// check. After healthcheckMaxFailures consecutive failures the error is sent
+// on the returned channel and checking stops. Without a Healthcheck the
+// channel never receives.
+func startHealthcheck(c *Config, feed func()) (<-chan error, func()) {
+	if c.Healthcheck == nil || c.HealthcheckInterval <= 0 {
+		return nil, func() {}
+	}
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.HealthcheckInterval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			err := c.Healthcheck()
+			if err == nil {
+				failures = 0
+				feed()
+				continue
+			}
+			failures++
+			logf("Health check failed (%d of %d): %v", failures, healthcheckMaxFailures, err)
+			if failures >= healthcheckMaxFailures {
+				failed <- fmt.Errorf("Health check failed %d times in a row: %v", failures, err)
+				return
+			}
+		}
+	}()
+	return failed, func() { close(done) }
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthcheckInterval(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	checks := make(chan time.Time, 10)
+	fed := make(chan struct{}, 10)
+	c := &Config{
+		Healthcheck: func() error {
+			checks <- time.Now()
+			return nil
+		},
+		HealthcheckInterval: interval,
+	}
+	start := time.Now()
+	_, stop := startHealthcheck(c, func() { fed <- struct{}{} })
+	defer stop()
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case at := <-checks:
+			if elapsed := at.Sub(start); elapsed < time.Duration(i)*interval {
+				t.Errorf("check %d after %v, want at least %v", i, elapsed, time.Duration(i)*interval)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("check %d not called", i)
+		}
+		select {
+		case <-fed:
+		case <-time.After(time.Second):
+			t.Fatalf("watchdog not fed after check %d", i)
+		}
+	}
+}
+
+func TestHealthcheckUnset(t *testing.T) {
+	unhealthy, stop := startHealthcheck(&Config{HealthcheckInterval: time.Millisecond}, func() {
+		t.Error("watchdog fed without a health check")
+	})
+	defer stop()
+	select {
+	case err := <-unhealthy:
+		t.Errorf("unexpected failure: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRunUntilSignalHealthcheckFailure(t *testing.T) {
+	checks := 0
+	stopped := false
+	c := &Config{
+		Start: func() error { return nil },
+		Stop: func() error {
+			stopped = true
+			return nil
+		},
+		Healthcheck: func() error {
+			checks++
+			return errors.New("not responding")
+		},
+		HealthcheckInterval: time.Millisecond,
+	}
+	err := runUntilSignal(context.Background(), c)
+	if err == nil || !strings.Contains(err.Error(), "not responding") {
+		t.Errorf("err = %v, want the health check error", err)
+	}
+	if checks != healthcheckMaxFailures {
+		t.Errorf("checked %d times, want %d", checks, healthcheckMaxFailures)
+	}
+	if !stopped {
+		t.Error("Stop not called after failed health checks")
+	}
+}
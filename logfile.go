@@ -0,0 +1,184 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// rotatingFile is an append-only log file that is rolled over once writing
+// to it would grow it beyond maxSize bytes. Up to maxBackups previous files
+// are kept as path.1 (newest) through path.N.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to stat log file: %v", err)
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+// rotate closes the current file, shifts the backups along and opens a new,
+// empty file. Without backups the current file is simply discarded.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("Unable to close log file: %v", err)
+	}
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(r.backupPath(i), r.backupPath(i+1))
+		}
+		if err := os.Rename(r.path, r.backupPath(1)); err != nil {
+			return fmt.Errorf("Unable to rotate log file: %v", err)
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return fmt.Errorf("Unable to remove log file: %v", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now, regardless of its size. Without backups it
+// closes and reopens the file instead, so a file moved away by another tool
+// such as logrotate is replaced.
+func (r *rotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxBackups > 0 {
+		return r.rotate()
+	}
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("Unable to close log file: %v", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+var (
+	activeLogMu sync.Mutex
+	activeLog   *rotatingFile // Set while redirectOutput is in effect
+)
+
+// rotateActiveLog rotates the file redirectOutput writes to. It returns
+// ErrNotSupported if the output isn't redirected, as then the package
+// doesn't manage a log file.
+func rotateActiveLog() error {
+	activeLogMu.Lock()
+	defer activeLogMu.Unlock()
+	if activeLog == nil {
+		return ErrNotSupported
+	}
+	return activeLog.Rotate()
+}
+
+// redirectOutput sends everything written through os.Stdout, os.Stderr and
+// the log package to c.StdoutPath, rotating it according to c.LogMaxSize and
+// c.LogMaxBackups. The returned function restores the original outputs.
+func redirectOutput(c *Config) (func(), error) {
+	out, err := openRotatingFile(c.StdoutPath, c.LogMaxSize, c.LogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		out.Close()
+		return nil, fmt.Errorf("Unable to create output pipe: %v", err)
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = pw, pw
+	log.SetOutput(pw)
+	activeLogMu.Lock()
+	activeLog = out
+	activeLogMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(out, pr)
+		close(done)
+	}()
+
+	return func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		log.SetOutput(stderr)
+		pw.Close()
+		<-done
+		pr.Close()
+		activeLogMu.Lock()
+		activeLog = nil
+		activeLogMu.Unlock()
+		out.Close()
+	}, nil
+}
+
+// redirectInput replaces os.Stdin with c.StdinPath. The returned function
+// restores the original input.
+func redirectInput(c *Config) (func(), error) {
+	in, err := os.Open(c.StdinPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %v", c.StdinPath, err)
+	}
+	stdin := os.Stdin
+	os.Stdin = in
+	return func() {
+		os.Stdin = stdin
+		in.Close()
+	}, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than LogMaxBackups files kept: %v", err)
+	}
+}
+
+func TestRotatingFileWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	r, err := openRotatingFile(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.Write([]byte("first\n"))
+	r.Write([]byte("second\n"))
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "second\n" {
+		t.Errorf("log = %q, want the first line discarded", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("backup kept without LogMaxBackups: %v", err)
+	}
+}
+
+func TestRotateLogs(t *testing.T) {
+	if err := rotateActiveLog(); err != ErrNotSupported {
+		t.Errorf("without redirected output = %v, want ErrNotSupported", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	r, err := openRotatingFile(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	activeLog = r
+	defer func() { activeLog = nil }()
+
+	r.Write([]byte("old\n"))
+	if err := rotateActiveLog(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("new\n"))
+
+	for name, want := range map[string]string{path: "new\n", path + ".1": "old\n"} {
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+}
+
+func TestRotateReopens(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+	r, err := openRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Another tool moves the file away, then asks for it to be reopened.
+	r.Write([]byte("old\n"))
+	if err := os.Rename(path, filepath.Join(dir, "moved.log")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("new\n"))
+
+	if got, err := ioutil.ReadFile(path); err != nil || string(got) != "new\n" {
+		t.Errorf("reopened log = %q, %v", got, err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "moved.log")); err != nil || string(got) != "old\n" {
+		t.Errorf("moved log = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/getlantern/winsvc/mgr"
+	"github.com/getlantern/winsvc/svc"
+	"github.com/getlantern/winsvc/winapi"
+)
+
+// serviceManager is the part of *mgr.Mgr used by windowsService. It is an
+// interface so tests can substitute a fake service manager.
+type serviceManager interface {
+	CreateService(name, exepath string, c mgr.Config) (managedService, error)
+	OpenService(name string) (managedService, error)
+	Disconnect() error
+}
+
+// managedService is the part of *mgr.Service used by windowsService, plus
+// the settings winsvc doesn't wrap.
+type managedService interface {
+	Config() (mgr.Config, error)
+	UpdateConfig(c mgr.Config) error
+	SetRecoveryActions(actions []RecoveryAction, resetPeriod time.Duration, command string) error
+	Triggers() ([]Trigger, error)
+	SetTriggers(triggers []Trigger) error
+	SidType() (SidType, error)
+	SetSidType(t SidType) error
+	Start(args []string) error
+	Control(c svc.Cmd) (svc.Status, error)
+	Query() (svc.Status, error)
+	QueryStatus() (winapi.SERVICE_STATUS, error)
+	ProcessID() (uint32, error)
+	Delete() error
+	Close() error
+}
+
+// connect connects to the service manager of the computer named host, or
+// of this computer if host is empty. It is a variable so tests can
+// substitute a fake.
+var connect = func(host string) (serviceManager, error) {
+	m, err := mgr.ConnectRemote(host)
+	if err != nil {
+		return nil, err
+	}
+	return scManager{m}, nil
+}
+
+type scManager struct {
+	*mgr.Mgr
+}
+
+func (m scManager) CreateService(name, exepath string, c mgr.Config) (managedService, error) {
+	s, err := m.Mgr.CreateService(name, exepath, c)
+	if err != nil {
+		return nil, err
+	}
+	return scService{s}, nil
+}
+
+func (m scManager) OpenService(name string) (managedService, error) {
+	s, err := m.Mgr.OpenService(name)
+	if err != nil {
+		return nil, err
+	}
+	return scService{s}, nil
+}
+
+type scService struct {
+	*mgr.Service
+}
+
+// QueryStatus returns the full service status, including the exit codes
+// svc.Status leaves out.
+func (s scService) QueryStatus() (winapi.SERVICE_STATUS, error) {
+	var status winapi.SERVICE_STATUS
+	err := winapi.QueryServiceStatus(s.Handle, &status)
+	return status, err
+}
+
+// serviceFailureActions is SERVICE_FAILURE_ACTIONS.
+type serviceFailureActions struct {
+	ResetPeriod  uint32 // seconds
+	RebootMsg    *uint16
+	Command      *uint16
+	ActionsCount uint32
+	Actions      *scAction
+}
+
+// scAction is SC_ACTION.
+type scAction struct {
+	Type  uint32
+	Delay uint32 // milliseconds
+}
+
+func (s scService) SetRecoveryActions(actions []RecoveryAction, resetPeriod time.Duration, command string) error {
+	scActions := make([]scAction, len(actions))
+	for i, action := range actions {
+		scActions[i] = scAction{
+			Type:  uint32(action.Type),
+			Delay: uint32(action.Delay / time.Millisecond),
+		}
+	}
+	fa := serviceFailureActions{
+		ResetPeriod:  uint32(resetPeriod / time.Second),
+		ActionsCount: uint32(len(scActions)),
+	}
+	if len(scActions) > 0 {
+		fa.Actions = &scActions[0]
+	}
+	if command != "" {
+		fa.Command = syscall.StringToUTF16Ptr(command)
+	}
+	return winapi.ChangeServiceConfig2(s.Handle, winapi.SERVICE_CONFIG_FAILURE_ACTIONS, (*byte)(unsafe.Pointer(&fa)))
+}
+
+const (
+	serviceConfigTriggerInfo = 8 // SERVICE_CONFIG_TRIGGER_INFO
+
+	serviceTriggerTypeIPAddressAvailability = 2 // SERVICE_TRIGGER_TYPE_IP_ADDRESS_AVAILABILITY
+	serviceTriggerTypeDomainJoin            = 3 // SERVICE_TRIGGER_TYPE_DOMAIN_JOIN
+
+	serviceTriggerActionServiceStart = 1 // SERVICE_TRIGGER_ACTION_SERVICE_START
+
+	errInsufficientBuffer = syscall.Errno(122) // ERROR_INSUFFICIENT_BUFFER
+)
+
+// serviceTriggerInfo is SERVICE_TRIGGER_INFO.
+type serviceTriggerInfo struct {
+	TriggersCount uint32
+	Triggers      *serviceTrigger
+	Reserved      *byte
+}
+
+// serviceTrigger is SERVICE_TRIGGER.
+type serviceTrigger struct {
+	TriggerType    uint32
+	Action         uint32
+	TriggerSubtype *syscall.GUID
+	DataItemsCount uint32
+	DataItems      uintptr
+}
+
+// triggerEvents maps each Trigger to its SERVICE_TRIGGER type and subtype.
+var triggerEvents = map[Trigger]struct {
+	triggerType uint32
+	subtype     syscall.GUID
+}{
+	// NETWORK_MANAGER_FIRST_IP_ADDRESS_ARRIVAL_GUID
+	TriggerNetworkAvailable: {serviceTriggerTypeIPAddressAvailability, syscall.GUID{Data1: 0x4f27f2de, Data2: 0x14e2, Data3: 0x430b, Data4: [8]byte{0xa5, 0x49, 0x7c, 0xd4, 0x8c, 0xbc, 0x82, 0x45}}},
+	// DOMAIN_JOIN_GUID
+	TriggerDomainJoin: {serviceTriggerTypeDomainJoin, syscall.GUID{Data1: 0x1ce20aba, Data2: 0x9851, Data3: 0x4421, Data4: [8]byte{0x94, 0x30, 0x1d, 0xde, 0xb7, 0x66, 0xe8, 0x09}}},
+}
+
+// Triggers returns the start triggers of the service. Triggers this
+// package doesn't define are left out.
+func (s scService) Triggers() ([]Trigger, error) {
+	var needed uint32
+	err := winapi.QueryServiceConfig2(s.Handle, serviceConfigTriggerInfo, nil, 0, &needed)
+	if err != errInsufficientBuffer {
+		return nil, err
+	}
+	buf := make([]byte, needed)
+	err = winapi.QueryServiceConfig2(s.Handle, serviceConfigTriggerInfo, &buf[0], needed, &needed)
+	if err != nil {
+		return nil, err
+	}
+	info := (*serviceTriggerInfo)(unsafe.Pointer(&buf[0]))
+	if info.TriggersCount == 0 {
+		return nil, nil
+	}
+	var triggers []Trigger
+	for _, st := range unsafe.Slice(info.Triggers, info.TriggersCount) {
+		if st.Action != serviceTriggerActionServiceStart || st.TriggerSubtype == nil {
+			continue
+		}
+		for trigger, event := range triggerEvents {
+			if st.TriggerType == event.triggerType && *st.TriggerSubtype == event.subtype {
+				triggers = append(triggers, trigger)
+			}
+		}
+	}
+	return triggers, nil
+}
+
+// SetTriggers replaces the start triggers of the service. An empty list
+// removes them all.
+func (s scService) SetTriggers(triggers []Trigger) error {
+	subtypes := make([]syscall.GUID, len(triggers))
+	sts := make([]serviceTrigger, len(triggers))
+	for i, trigger := range triggers {
+		event := triggerEvents[trigger]
+		subtypes[i] = event.subtype
+		sts[i] = serviceTrigger{
+			TriggerType:    event.triggerType,
+			Action:         serviceTriggerActionServiceStart,
+			TriggerSubtype: &subtypes[i],
+		}
+	}
+	info := serviceTriggerInfo{TriggersCount: uint32(len(sts))}
+	if len(sts) > 0 {
+		info.Triggers = &sts[0]
+	}
+	return winapi.ChangeServiceConfig2(s.Handle, serviceConfigTriggerInfo, (*byte)(unsafe.Pointer(&info)))
+}
+
+const serviceConfigServiceSidInfo = 5 // SERVICE_CONFIG_SERVICE_SID_INFO
+
+// serviceSidTypes maps each SidType to its SERVICE_SID_TYPE value.
+var serviceSidTypes = map[SidType]uint32{
+	SidTypeNone:         0, // SERVICE_SID_TYPE_NONE
+	SidTypeUnrestricted: 1, // SERVICE_SID_TYPE_UNRESTRICTED
+	SidTypeRestricted:   3, // SERVICE_SID_TYPE_RESTRICTED
+}
+
+// SidType returns the kind of per-service SID of the service.
+func (s scService) SidType() (SidType, error) {
+	var info, needed uint32 // SERVICE_SID_INFO
+	err := winapi.QueryServiceConfig2(s.Handle, serviceConfigServiceSidInfo, (*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), &needed)
+	if err != nil {
+		return SidTypeNone, err
+	}
+	for t, value := range serviceSidTypes {
+		if value == info {
+			return t, nil
+		}
+	}
+	return SidTypeNone, fmt.Errorf("Unknown service SID type %d", info)
+}
+
+// SetSidType sets the kind of per-service SID of the service.
+func (s scService) SetSidType(t SidType) error {
+	info := serviceSidTypes[t] // SERVICE_SID_INFO
+	return winapi.ChangeServiceConfig2(s.Handle, serviceConfigServiceSidInfo, (*byte)(unsafe.Pointer(&info)))
+}
+
+var (
+	procQueryServiceStatusEx = syscall.NewLazyDLL("advapi32.dll").NewProc("QueryServiceStatusEx")
+	procGetProcessMemoryInfo = syscall.NewLazyDLL("psapi.dll").NewProc("GetProcessMemoryInfo")
+)
+
+// serviceStatusProcess is SERVICE_STATUS_PROCESS.
+type serviceStatusProcess struct {
+	winapi.SERVICE_STATUS
+	ProcessID    uint32
+	ServiceFlags uint32
+}
+
+const scStatusProcessInfo = 0 // SC_STATUS_PROCESS_INFO
+
+// ProcessID returns the process ID of the running service, which winsvc
+// doesn't expose.
+func (s scService) ProcessID() (uint32, error) {
+	var status serviceStatusProcess
+	var needed uint32
+	r, _, err := procQueryServiceStatusEx.Call(
+		uintptr(s.Handle),
+		scStatusProcessInfo,
+		uintptr(unsafe.Pointer(&status)),
+		unsafe.Sizeof(status),
+		uintptr(unsafe.Pointer(&needed)),
+	)
+	if r == 0 {
+		return 0, err
+	}
+	return status.ProcessID, nil
+}
+
+// processMemoryCounters is PROCESS_MEMORY_COUNTERS.
+type processMemoryCounters struct {
+	CB                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+// processTree returns pid and its descendants. Windows places a service in
+// no job object of its own, so the tree is built from the parent of each
+// process in a snapshot of the running processes.
+func processTree(pid int) ([]int, error) {
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list processes: %v", err)
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	parents := make(map[int]int)
+	var entry syscall.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	for err = syscall.Process32First(snapshot, &entry); err == nil; err = syscall.Process32Next(snapshot, &entry) {
+		parents[int(entry.ProcessID)] = int(entry.ParentProcessID)
+	}
+	if err != syscall.ERROR_NO_MORE_FILES {
+		return nil, fmt.Errorf("Unable to list processes: %v", err)
+	}
+	return descendants(parents, pid), nil
+}
+
+// descendants returns root and the processes descending from it in
+// ascending order, given the parent of each process. A parent ID may have
+// been reused by a later process, so processes are visited only once.
+func descendants(parents map[int]int, root int) []int {
+	pids := []int{root}
+	seen := map[int]bool{root: true}
+	for i := 0; i < len(pids); i++ {
+		for pid, parent := range parents {
+			if parent == pids[i] && !seen[pid] {
+				seen[pid] = true
+				pids = append(pids, pid)
+			}
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+const processQueryLimitedInformation = 0x1000 // PROCESS_QUERY_LIMITED_INFORMATION
+
+// processUsage returns the working set and CPU time of process pid.
+func processUsage(pid uint32) (ResourceUsage, error) {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, pid)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	defer syscall.CloseHandle(h)
+
+	var creation, exit, kernel, user syscall.Filetime
+	err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	var counters processMemoryCounters
+	counters.CB = uint32(unsafe.Sizeof(counters))
+	r, _, err := procGetProcessMemoryInfo.Call(uintptr(h), uintptr(unsafe.Pointer(&counters)), uintptr(counters.CB))
+	if r == 0 {
+		return ResourceUsage{}, err
+	}
+	return ResourceUsage{
+		PID:     int(pid),
+		RSS:     uint64(counters.WorkingSetSize),
+		CPUTime: filetimeDuration(kernel) + filetimeDuration(user),
+	}, nil
+}
+
+// filetimeDuration converts a FILETIME holding a duration, in 100
+// nanosecond intervals, to a time.Duration.
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	return time.Duration(uint64(ft.HighDateTime)<<32|uint64(ft.LowDateTime)) * 100
+}
+
+const errInvalidParameter = syscall.Errno(87) // ERROR_INVALID_PARAMETER
+
+// waitProcess waits for process pid to exit or ctx to be cancelled. It is
+// a variable so tests can substitute a fake.
+var waitProcess = func(ctx context.Context, pid uint32) error {
+	h, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, pid)
+	if err == errInvalidParameter {
+		// The process has already exited.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to open service process: %v", err)
+	}
+	defer syscall.CloseHandle(h)
+
+	// The wait times out now and then to notice ctx being cancelled.
+	timeout := uint32(statusPollInterval / time.Millisecond)
+	for {
+		event, err := syscall.WaitForSingleObject(h, timeout)
+		switch event {
+		case syscall.WAIT_OBJECT_0:
+			return nil
+		case syscall.WAIT_FAILED:
+			return fmt.Errorf("Unable to wait for service process: %v", err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+const processTerminate = 0x0001 // PROCESS_TERMINATE
+
+// terminateProcess terminates process pid with exit code 1. It is a
+// variable so tests can substitute a fake.
+var terminateProcess = func(pid uint32) error {
+	h, err := syscall.OpenProcess(processTerminate, false, pid)
+	if err == errInvalidParameter {
+		return ErrNotRunning
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to open service process: %v", err)
+	}
+	defer syscall.CloseHandle(h)
+	err = syscall.TerminateProcess(h, 1)
+	if err != nil {
+		return fmt.Errorf("Unable to terminate service process: %v", err)
+	}
+	return nil
+}
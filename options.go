@@ -0,0 +1,113 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import "time"
+
+// Option sets a field of the Config NewWithOptions builds. Any function
+// that edits a Config can be used as an Option.
+type Option func(c *Config)
+
+// NewWithOptions creates a new service named name, configured by opts in
+// order. Fields no option sets keep their zero value, as with New.
+func NewWithOptions(name string, opts ...Option) (Service, error) {
+	c := Config{Name: name}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return New(c)
+}
+
+// WithDisplayName sets Config.DisplayName.
+func WithDisplayName(displayName string) Option {
+	return func(c *Config) { c.DisplayName = displayName }
+}
+
+// WithDescription sets Config.Description.
+func WithDescription(description string) Option {
+	return func(c *Config) { c.Description = description }
+}
+
+// WithVersion sets Config.Version.
+func WithVersion(version string) Option {
+	return func(c *Config) { c.Version = version }
+}
+
+// WithProgram sets Config.Program.
+func WithProgram(program string) Option {
+	return func(c *Config) { c.Program = program }
+}
+
+// WithArguments appends args to Config.Arguments.
+func WithArguments(args ...string) Option {
+	return func(c *Config) { c.Arguments = append(c.Arguments, args...) }
+}
+
+// WithWorkingDirectory sets Config.WorkingDirectory.
+func WithWorkingDirectory(dir string) Option {
+	return func(c *Config) { c.WorkingDirectory = dir }
+}
+
+// WithPrivileged sets Config.Privileged.
+func WithPrivileged() Option {
+	return func(c *Config) { c.Privileged = true }
+}
+
+// WithStart and WithStop set Config.Start and Config.Stop.
+func WithStart(start func() error) Option {
+	return func(c *Config) { c.Start = start }
+}
+
+func WithStop(stop func() error) Option {
+	return func(c *Config) { c.Stop = stop }
+}
+
+// WithEnv sets the environment variable key to value in Config.EnvVars.
+func WithEnv(key, value string) Option {
+	return func(c *Config) {
+		if c.EnvVars == nil {
+			c.EnvVars = make(map[string]string)
+		}
+		c.EnvVars[key] = value
+	}
+}
+
+// WithStdoutPath sets Config.StdoutPath.
+func WithStdoutPath(path string) Option {
+	return func(c *Config) { c.StdoutPath = path }
+}
+
+// WithNetworkState sets Config.NetworkState to up.
+func WithNetworkState(up bool) Option {
+	return func(c *Config) { c.NetworkState = &up }
+}
+
+// WithRunAtLoad sets Config.RunAtLoad to runAtLoad.
+func WithRunAtLoad(runAtLoad bool) Option {
+	return func(c *Config) { c.RunAtLoad = &runAtLoad }
+}
+
+// WithRestartPolicy gives up restarting a crashing service once it has
+// been restarted maxRestarts times within window, using the fields of the
+// current service manager: StartLimitBurst and StartLimitIntervalSec on
+// systemd, MaxRestarts and RestartWindow on launchd, and that many
+// RecoveryRestart actions reset after window on Windows. It does nothing
+// on the other Linux init systems, which have no such limit.
+func WithRestartPolicy(maxRestarts int, window time.Duration) Option {
+	return func(c *Config) {
+		switch managerName() {
+		case managerSystemd:
+			c.StartLimitBurst, c.StartLimitIntervalSec = maxRestarts, window
+		case managerLaunchd:
+			c.MaxRestarts, c.RestartWindow = maxRestarts, window
+		case managerWindows:
+			c.RecoveryActions = make([]RecoveryAction, maxRestarts)
+			for i := range c.RecoveryActions {
+				c.RecoveryActions[i] = RecoveryAction{Type: RecoveryRestart}
+			}
+			c.RecoveryResetPeriod = window
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	s, err := NewWithOptions("test",
+		WithProgram("/usr/bin/test"),
+		WithArguments("-v"),
+		WithArguments("--config", "/etc/test.conf"),
+		WithWorkingDirectory("/var/lib/test"),
+		WithDescription("Test service"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.EffectiveConfig()
+	if c.Name != "test" || c.Program != "/usr/bin/test" || c.WorkingDirectory != "/var/lib/test" || c.Description != "Test service" {
+		t.Errorf("options not applied: %+v", c)
+	}
+	if want := []string{"-v", "--config", "/etc/test.conf"}; !reflect.DeepEqual(c.Arguments, want) {
+		t.Errorf("Arguments = %q, want %q", c.Arguments, want)
+	}
+
+	if _, err := NewWithOptions(""); err != errNameFieldRequired {
+		t.Errorf("NewWithOptions without a name = %v, want %v", err, errNameFieldRequired)
+	}
+}
+
+func TestOptionsConfig(t *testing.T) {
+	var c Config
+	for _, opt := range []Option{
+		WithEnv("A", "1"),
+		WithEnv("B", "2"),
+		WithEnv("A", "3"),
+		WithNetworkState(false),
+		WithRunAtLoad(true),
+		WithPrivileged(),
+		WithVersion("1.2.3"),
+	} {
+		opt(&c)
+	}
+	if want := map[string]string{"A": "3", "B": "2"}; !reflect.DeepEqual(c.EnvVars, want) {
+		t.Errorf("EnvVars = %v, want %v", c.EnvVars, want)
+	}
+	// Optional fields are set rather than left nil.
+	if c.NetworkState == nil || *c.NetworkState || c.RunAtLoad == nil || !*c.RunAtLoad {
+		t.Errorf("NetworkState = %v, RunAtLoad = %v", c.NetworkState, c.RunAtLoad)
+	}
+	if !c.Privileged || c.Version != "1.2.3" {
+		t.Errorf("options not applied: %+v", c)
+	}
+
+	// Any function editing a Config is an Option.
+	opt := Option(func(c *Config) { c.Oneshot = true })
+	opt(&c)
+	if !c.Oneshot {
+		t.Error("custom option not applied")
+	}
+}
+
+func TestWithRestartPolicy(t *testing.T) {
+	var c Config
+	WithRestartPolicy(3, time.Minute)(&c)
+	switch managerName() {
+	case managerSystemd:
+		if c.StartLimitBurst != 3 || c.StartLimitIntervalSec != time.Minute {
+			t.Errorf("StartLimitBurst = %d, StartLimitIntervalSec = %v", c.StartLimitBurst, c.StartLimitIntervalSec)
+		}
+	case managerLaunchd:
+		if c.MaxRestarts != 3 || c.RestartWindow != time.Minute {
+			t.Errorf("MaxRestarts = %d, RestartWindow = %v", c.MaxRestarts, c.RestartWindow)
+		}
+	case managerWindows:
+		if len(c.RecoveryActions) != 3 || c.RecoveryActions[2].Type != RecoveryRestart || c.RecoveryResetPeriod != time.Minute {
+			t.Errorf("RecoveryActions = %v, RecoveryResetPeriod = %v", c.RecoveryActions, c.RecoveryResetPeriod)
+		}
+	}
+	c.Name = "test"
+	if err := Supported(c); err != nil {
+		t.Errorf("Supported = %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writePIDFile writes the process ID to path. A pidfile left behind by a
+// process that is no longer running is overwritten; one naming a live
+// process is an error. The returned function removes the file.
+func writePIDFile(path string) (func(), error) {
+	pid := os.Getpid()
+	if old, err := ioutil.ReadFile(path); err == nil {
+		oldPID, err := strconv.Atoi(strings.TrimSpace(string(old)))
+		if err == nil && oldPID != pid && processAlive(oldPID) {
+			return nil, fmt.Errorf("Pidfile %s belongs to running process %d", path, oldPID)
+		}
+	}
+	err := writeFileAtomic(path, []byte(strconv.Itoa(pid)+"\n"), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to write pidfile: %v", err)
+	}
+	return func() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logf("Unable to remove pidfile: %v", err)
+		}
+	}, nil
+}
+
+// processAlive reports whether a process with the given ID is running.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess opens the process, which fails once it has exited.
+		p.Release()
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
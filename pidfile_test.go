@@ -0,0 +1,56 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pid")
+	remove, err := writePIDFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(os.Getpid()) + "\n"; string(got) != want {
+		t.Errorf("pidfile = %q, want %q", got, want)
+	}
+	remove()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pidfile not removed: %v", err)
+	}
+}
+
+func TestWritePIDFileStale(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.pid")
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remove, err := writePIDFile(path)
+	if err != nil {
+		t.Fatalf("stale pidfile not overwritten: %v", err)
+	}
+	remove()
+
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writePIDFile(path); err == nil {
+		t.Error("expected an error for a pidfile of a running process")
+	}
+}
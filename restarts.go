@@ -0,0 +1,94 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRestartWindow is the Config.RestartWindow used when only
+// MaxRestarts is set.
+const defaultRestartWindow = time.Minute
+
+// restartHistoryDir returns the directory the start times of c are kept
+// in. It must not be writable by other users, who could otherwise fake a
+// crash loop and keep the service from starting: it is the StateDirectory
+// of c if it has one, the root-owned /var/db when running as root and
+// otherwise the temporary directory, which macOS makes private to each
+// user. It is a variable for tests.
+var restartHistoryDir = func(c *Config) string {
+	switch {
+	case c.StateDirectory != "":
+		return filepath.Join(serviceDirBases["STATE_DIRECTORY"], c.StateDirectory)
+	case os.Geteuid() == 0:
+		return "/var/db"
+	default:
+		return os.TempDir()
+	}
+}
+
+// now is time.Now, replaced in tests.
+var now = time.Now
+
+// restartHistoryPath returns the file the start times of c are recorded
+// in.
+func restartHistoryPath(c *Config) string {
+	return filepath.Join(restartHistoryDir(c), c.Name+".restarts")
+}
+
+// recordStart records that the service is being started and returns an
+// error if it has been started more than c.MaxRestarts times before within
+// c.RestartWindow, meaning it keeps crashing. Refused starts aren't
+// recorded, so the service gets another chance once the window has passed
+// without a start. It does nothing without MaxRestarts.
+func recordStart(c *Config) error {
+	if c.MaxRestarts <= 0 {
+		return nil
+	}
+	window := c.RestartWindow
+	if window == 0 {
+		window = defaultRestartWindow
+	}
+	path := restartHistoryPath(c)
+	current := now()
+
+	var starts []string
+	if data, err := ioutil.ReadFile(path); err == nil {
+		for _, line := range strings.Fields(string(data)) {
+			nanos, err := strconv.ParseInt(line, 10, 64)
+			if err == nil && current.Sub(time.Unix(0, nanos)) < window {
+				starts = append(starts, line)
+			}
+		}
+	}
+	if len(starts) > c.MaxRestarts {
+		return fmt.Errorf("Service was restarted %d times within %v, giving up", len(starts)-1, window)
+	}
+
+	starts = append(starts, strconv.FormatInt(current.UnixNano(), 10))
+	err := writeFileAtomic(path, []byte(strings.Join(starts, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to record service start: %v", err)
+	}
+	return nil
+}
+
+// clearStarts forgets the recorded start times after the service stopped
+// cleanly, so only crashes count towards MaxRestarts.
+func clearStarts(c *Config) {
+	if c.MaxRestarts <= 0 {
+		return
+	}
+	err := os.Remove(restartHistoryPath(c))
+	if err != nil && !os.IsNotExist(err) {
+		logf("Unable to clear restart history: %v", err)
+	}
+}
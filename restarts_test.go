@@ -0,0 +1,76 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordStart(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, oldNow := restartHistoryDir, now
+	defer func() { restartHistoryDir, now = oldDir, oldNow }()
+	restartHistoryDir = func(*Config) string { return dir }
+	current := time.Unix(1000, 0)
+	now = func() time.Time { return current }
+
+	c := &Config{Name: "test", MaxRestarts: 2, RestartWindow: 10 * time.Second}
+	// A crash loop: the first start and two restarts a second apart are
+	// allowed, the third restart isn't.
+	for i := 0; i < 3; i++ {
+		if err := recordStart(c); err != nil {
+			t.Fatalf("start %d: %v", i+1, err)
+		}
+		current = current.Add(time.Second)
+	}
+	if err := recordStart(c); err == nil {
+		t.Fatal("expected the fourth start within the window to be refused")
+	}
+
+	// Once the window has passed without a start, it may run again.
+	current = current.Add(10 * time.Second)
+	if err := recordStart(c); err != nil {
+		t.Errorf("start after the window: %v", err)
+	}
+
+	clearStarts(c)
+	if _, err := os.Stat(restartHistoryPath(c)); !os.IsNotExist(err) {
+		t.Errorf("history not cleared: %v", err)
+	}
+
+	c.MaxRestarts = 0
+	for i := 0; i < 5; i++ {
+		if err := recordStart(c); err != nil {
+			t.Fatalf("unlimited start %d: %v", i+1, err)
+		}
+	}
+	if _, err := os.Stat(restartHistoryPath(c)); !os.IsNotExist(err) {
+		t.Errorf("history recorded without MaxRestarts: %v", err)
+	}
+}
+
+func TestRestartHistoryDir(t *testing.T) {
+	oldBase := serviceDirBases["STATE_DIRECTORY"]
+	defer func() { serviceDirBases["STATE_DIRECTORY"] = oldBase }()
+	base := t.TempDir()
+	serviceDirBases["STATE_DIRECTORY"] = base
+
+	c := &Config{Name: "test", MaxRestarts: 2, StateDirectory: "test"}
+	if got, want := restartHistoryPath(c), filepath.Join(base, "test", "test.restarts"); got != want {
+		t.Errorf("restartHistoryPath with StateDirectory = %q, want %q", got, want)
+	}
+
+	c.StateDirectory = ""
+	want := filepath.Join(os.TempDir(), "test.restarts")
+	if os.Geteuid() == 0 {
+		want = "/var/db/test.restarts"
+	}
+	if got := restartHistoryPath(c); got != want {
+		t.Errorf("restartHistoryPath = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how control operations are retried when the service
+// manager reports a transient failure, such as a busy or locked database.
+// Other failures are returned immediately. The zero value uses the
+// defaults; set MaxAttempts to 1 to disable retries.
+type RetryPolicy struct {
+	MaxAttempts int           // Attempts including the first, defaults to 3
+	Delay       time.Duration // Delay before the first retry, defaults to 250ms
+	Backoff     float64       // Factor the delay grows by after each retry, defaults to 2
+}
+
+// sleep waits between retries. It is a variable so tests don't have to.
+var sleep = time.Sleep
+
+// retry calls op until it succeeds, fails with an error that isn't
+// retryable or the policy's attempts are used up.
+func (p RetryPolicy) retry(op func() error) error {
+	attempts, delay, backoff := p.MaxAttempts, p.Delay, p.Backoff
+	if attempts <= 0 {
+		attempts = 3
+	}
+	if delay <= 0 {
+		delay = 250 * time.Millisecond
+	}
+	if backoff < 1 {
+		backoff = 2
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= attempts || !isRetryable(err) {
+			return err
+		}
+		sleep(delay)
+		delay = time.Duration(float64(delay) * backoff)
+	}
+}
+
+// isRetryable reports whether err matches one of the platform's
+// retryableErrors signatures.
+func isRetryable(err error) bool {
+	msg := err.Error()
+	for _, signature := range retryableErrors {
+		if strings.Contains(msg, signature) {
+			return true
+		}
+	}
+	return false
+}
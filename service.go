@@ -7,18 +7,507 @@
 package service // import "github.com/getlantern/service"
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
 )
 
 // Config provides the setup for a Service. The Name field is required.
+//
+// By default the service runs the current program, which calls Run when the
+// service manager starts it. Setting Program to another binary, such as a
+// bundled helper, makes the current program only the installer: the
+// service manager runs Program directly, InstallOrUpdate and the other
+// methods manage it, and Run returns ErrExternalProgram.
 type Config struct {
 	Name             string       // Required name of the service. No spaces suggested.
 	Privileged       bool         // If true, service will run as root/Administrator/etc
 	Program          string       // The name of the program, defaults to the current program
 	Arguments        []string     // Run with arguments.
 	WorkingDirectory string       // Optional, service working directory
-	Start            func() error // Required, function that starts the service (must not block)
-	Stop             func() error // Optional, function that gets called when the service is stopping
+	Start            func() error `json:"-" yaml:"-"` // Required, function that starts the service (must not block)
+	Stop             func() error `json:"-" yaml:"-"` // Optional, function that gets called when the service is stopping
+
+	// Version identifies the build of the program being installed. It is
+	// recorded in the installed configuration, where InstalledVersion reads
+	// it back, so a stale installation can be told apart from a current one.
+	Version string
+
+	// DisplayName is the name shown in the Windows service manager, and
+	// Description describes the service there and in systemd units and
+	// init scripts. Both default to Name. They may be text/template
+	// templates over the Config, such as "MyApp (instance {{.Name}})",
+	// which New renders.
+	DisplayName string
+	Description string
+
+	// ExpandArguments expands $VAR and ${VAR} in Arguments, when New is
+	// called and in UpdateArguments, using ArgumentVariables if it is set
+	// and the environment of the calling process otherwise. The expanded
+	// values are then quoted for the platform as usual. By default
+	// arguments are used literally.
+	ExpandArguments   bool
+	ArgumentVariables map[string]string
+
+	// Healthcheck is called every HealthcheckInterval while Run is running.
+	// Each pass feeds the systemd watchdog, and after three failures in a
+	// row the service is stopped and Run returns the error, so the service
+	// manager can restart it. On systemd, set both when installing too so
+	// the unit gets a WatchdogSec.
+	Healthcheck         func() error `json:"-" yaml:"-"`
+	HealthcheckInterval time.Duration
+
+	// Drain is called while Run is running when the service is asked, with
+	// Service.Drain, to stop accepting new work before it is stopped, and
+	// Undrain when it is asked to resume. On Linux and macOS the requests
+	// arrive as SIGUSR1 and SIGUSR2, and on Windows as pause and continue.
+	Drain   func() error `json:"-" yaml:"-"`
+	Undrain func() error `json:"-" yaml:"-"`
+
+	// CreateWorkingDirectory creates WorkingDirectory during InstallOrUpdate
+	// if it doesn't exist yet. Otherwise a missing directory is an error.
+	CreateWorkingDirectory bool
+
+	// RuntimeDirectory, StateDirectory, CacheDirectory and LogsDirectory
+	// name directories of the service below /run, /var/lib, /var/cache and
+	// /var/log, such as "myapp". systemd creates them owned by the service
+	// user, removes the runtime directory when the service stops and
+	// passes their paths in $RUNTIME_DIRECTORY, $STATE_DIRECTORY,
+	// $CACHE_DIRECTORY and $LOGS_DIRECTORY. On the other Unix platforms Run
+	// creates them and sets the same variables; the runtime directory is
+	// below /var/run on macOS. Ignored on Windows.
+	RuntimeDirectory string
+	StateDirectory   string
+	CacheDirectory   string
+	LogsDirectory    string
+
+	// StdoutPath is the file the service's standard output and error are
+	// appended to. systemd and launchd write it themselves; elsewhere Run
+	// redirects os.Stdout, os.Stderr and the log package to it.
+	StdoutPath string
+
+	// LogMaxSize rotates StdoutPath once it would grow beyond this many
+	// bytes, keeping LogMaxBackups previous files. The rotation is done by
+	// Run, so it applies to output written through os.Stdout, os.Stderr and
+	// the log package. Ignored on systemd, where journald or logrotate
+	// should manage the file.
+	LogMaxSize    int64
+	LogMaxBackups int
+
+	// StdinPath is the file the service reads standard input from. systemd
+	// and launchd open it themselves; elsewhere Run replaces os.Stdin with
+	// it. NullStdin uses the null device when StdinPath is empty.
+	StdinPath string
+	NullStdin bool
+
+	// PIDFile is an absolute path the service's process ID is kept in, for
+	// tools that expect one. systemd is given it as PIDFile=; on launchd and
+	// the other Linux init systems Run writes it on start and removes it on
+	// stop. Ignored on Windows.
+	PIDFile string
+
+	// ControlRetry controls retries of start, stop and install operations
+	// that fail transiently.
+	ControlRetry RetryPolicy
+
+	// StartupTimeout is how long Start may take on Windows. The service
+	// manager is told to expect a start to take this long, and the service
+	// fails to start if Start hasn't returned by then. Defaults to 30
+	// seconds. Ignored on other platforms.
+	StartupTimeout time.Duration
+
+	// StopSignal is the signal the program expects to be stopped with, such
+	// as "SIGINT"; see stopSignals for the supported names. systemd sends it
+	// itself. Elsewhere Run passes it on to the process when the service
+	// manager stops the service with another signal, before calling Stop.
+	// Defaults to SIGTERM.
+	StopSignal string
+
+	// ConditionPathExists lists paths that must exist for the service to
+	// start; prefix a path with "!" to require that it doesn't exist.
+	// systemd checks them itself and launchd keeps the daemon running only
+	// while they hold. Run also checks them and returns without calling
+	// Start if one doesn't hold, which covers the other platforms.
+	ConditionPathExists []string
+
+	// NetworkState, when set, ties the service to the network being up. On
+	// launchd it is the NetworkState condition of KeepAlive, so the daemon
+	// is kept running only while the network is up, or down when false. On
+	// systemd true adds Requires= and After=network-online.target; false
+	// has no systemd equivalent and is ignored. Ignored on other platforms.
+	NetworkState *bool
+
+	// RequireNetwork starts the service once the network is up: systemd
+	// orders it after network-online.target, which it also pulls in;
+	// launchd keeps it running while the network is up, as NetworkState
+	// true does; and Windows starts it with TriggerNetworkAvailable. It is
+	// a softer requirement than NetworkState on systemd, where the service
+	// still starts if the network target fails. Ignored on other
+	// platforms.
+	RequireNetwork bool
+
+	// OtherJobEnabled is the OtherJobEnabled condition of launchd's
+	// KeepAlive: the daemon is kept running only while each listed job
+	// label is loaded, or not loaded when false. Ignored on other
+	// platforms.
+	OtherJobEnabled map[string]bool
+
+	// Architecture runs Program as the given architecture on launchd,
+	// "arm64", "arm64e" or "x86_64", for example to run an Intel binary
+	// under Rosetta on Apple silicon. The plist runs the program through
+	// arch(1). Ignored on other platforms.
+	Architecture string
+
+	// AllowInteractiveRun lets Run be called outside of the service manager,
+	// for example from a terminal while developing. Run then calls Start,
+	// waits for an interrupt and calls Stop.
+	AllowInteractiveRun bool
+
+	// EnvVars are set in the environment of the service process. Supported
+	// by systemd and launchd.
+	EnvVars map[string]string
+
+	// EnvironmentFiles are absolute paths of files of KEY=VALUE lines whose
+	// variables are set in the environment of the service process, for
+	// settings such as secrets kept by another tool. Missing files are
+	// skipped. systemd reads them itself; elsewhere Run loads them before
+	// calling Start.
+	EnvironmentFiles []string
+
+	// MachServices lists the Mach service names launchd registers on behalf
+	// of the daemon. Ignored on other platforms.
+	MachServices []string
+
+	// Sockets are the on-demand sockets launchd listens on and hands to the
+	// daemon. Ignored on other platforms.
+	Sockets []LaunchdSocket
+
+	// RunAtLoad makes launchd start the daemon when it is loaded, at install
+	// and at boot. Defaults to true, or to false when Sockets or a Schedule
+	// are set so the daemon is started on demand. Ignored on other
+	// platforms.
+	RunAtLoad *bool
+
+	// Oneshot installs a job that runs once and is not restarted when it
+	// exits: Type=oneshot on systemd, a launchd job without KeepAlive and a
+	// Windows service that is started by hand. RemainAfterExit keeps a
+	// systemd oneshot unit active after the program has exited.
+	Oneshot         bool
+	RemainAfterExit bool
+
+	// Schedule runs the service periodically instead of keeping it
+	// running, and implies Oneshot. On systemd a companion <Name>.timer
+	// unit is installed and enabled in place of the service; launchd gets
+	// StartInterval and StartCalendarInterval keys. New returns
+	// ErrNotSupported for a Schedule on other platforms and init systems.
+	Schedule Schedule
+
+	// Agent installs a launchd LaunchAgent in ~/Library/LaunchAgents that
+	// runs in the login session of the installing user, rather than a
+	// system daemon. New returns ErrNotSupported for agents on other
+	// platforms.
+	Agent bool
+
+	// Host is the name of the computer whose service manager manages the
+	// service, for managing services on another machine. Program is then
+	// the path of the program on that machine, and operations on the
+	// service's process, such as Kill and ResourceUsage, return
+	// ErrNotSupported. Only supported on Windows; empty for this computer.
+	Host string
+
+	// UserSession installs a Task Scheduler task that runs the program at
+	// logon in the interactive session of the installing user, for programs
+	// such as tray helpers, rather than a Windows service, which can't run
+	// in a user session. Run then just calls Start and waits for Stop. New
+	// returns ErrNotSupported for it on other platforms; see Agent for
+	// macOS.
+	UserSession bool
+
+	// UnitDir is the directory the systemd unit is written to. Defaults to
+	// /etc/systemd/system; use /usr/lib/systemd/system for packaged units or
+	// /run/systemd/system for runtime units, which are not enabled.
+	UnitDir string
+
+	// DropIn makes InstallOrUpdate write the unit as the drop-in override
+	// <UnitDir>/<Name>.service.d/<DropIn>.conf instead of the main unit,
+	// which is left to whoever installed it and isn't enabled or removed.
+	// It holds only the directives of the fields that are set, which
+	// override those of the main unit; ExecStart is reset and overridden
+	// only if Program or Arguments is set. Uninstall removes only the
+	// drop-in. Only supported by systemd.
+	DropIn string
+
+	// RootDir installs into the root filesystem of another system, such as
+	// an image being built, instead of the running one. The init system
+	// to write the configuration for is detected from it. Configuration
+	// files are written below it and nothing is reloaded or loaded into
+	// the running service manager; systemd units are enabled with
+	// systemctl --root. Operations on the running service, such as Start, don't use
+	// it. Not supported on Windows.
+	RootDir string
+
+	// NoEscalate stops the package from acquiring privileges it lacks,
+	// such as prompting for an administrator password on macOS, for
+	// unattended runs such as CI. Windows never escalates.
+	// Operations are attempted with the privileges the process has, and
+	// failures for lack of them are returned with an explanation, wrapping
+	// the underlying error.
+	NoEscalate bool
+
+	// Strict makes New return the error Supported reports for fields the
+	// service manager doesn't support, instead of ignoring them when
+	// installing.
+	Strict bool
+
+	// ConfigFileMode, ConfigOwner and ConfigGroup set the permissions and
+	// ownership of the generated configuration file, for example 0600 for a
+	// unit with secrets in its Environment= lines. The owner and group are
+	// names or numeric IDs. By default systemd units are 0644, init scripts
+	// 0755 and launchd plists 0644 root:wheel, and Linux files keep the
+	// owner of the installing process. Ignored on Windows.
+	ConfigFileMode os.FileMode
+	ConfigOwner    string
+	ConfigGroup    string
+
+	// OnFailure lists systemd units that are activated when the service
+	// enters the failed state, for example a notification service. Ignored on
+	// other platforms.
+	OnFailure []string
+
+	// StartLimitIntervalSec and StartLimitBurst rate-limit restarts by
+	// systemd: once the service has been started more than StartLimitBurst
+	// times within StartLimitIntervalSec, systemd gives up and leaves it
+	// failed until it is started by hand or ResetFailed. Defaults to 10
+	// starts in 5 seconds. Ignored on other platforms.
+	StartLimitIntervalSec time.Duration
+	StartLimitBurst       int
+
+	// AutoResetFailed makes Restart reset a systemd unit that has hit its
+	// start limit before starting it again. Ignored on other platforms.
+	AutoResetFailed bool
+
+	// StopWhenUnneeded makes systemd stop the service once no other active
+	// unit requires or wants it, for services started on demand by their
+	// dependents. RefuseManualStart and RefuseManualStop make systemd
+	// refuse to start or stop the unit other than through a dependency,
+	// so Start, Stop and Restart fail. Ignored on other platforms.
+	StopWhenUnneeded  bool
+	RefuseManualStart bool
+	RefuseManualStop  bool
+
+	// MaxRestarts and RestartWindow stop a crash loop on macOS, where
+	// launchd's KeepAlive restarts the daemon indefinitely. Run records
+	// each start, and once the daemon has been restarted MaxRestarts times
+	// within RestartWindow it returns an error without calling Start, so
+	// the program exits non-zero and launchd's throttling sets in. A clean
+	// stop clears the count. RestartWindow defaults to a minute. Ignored on
+	// other platforms; see StartLimitBurst for systemd.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// Hardening restricts what the service may do. Only applied by systemd.
+	Hardening Hardening
+
+	// CPUSchedulingPolicy is the systemd CPU scheduling policy: "other",
+	// "batch", "idle", "fifo" or "rr". IOSchedulingClass is the IO
+	// scheduling class: "realtime", "best-effort", "idle" or "none". Empty
+	// leaves the default. Ignored on other platforms.
+	CPUSchedulingPolicy string
+	IOSchedulingClass   string
+
+	// KillMode is how systemd stops the service's processes:
+	// "control-group", "mixed", "process" or "none". Use "mixed" or
+	// "process" to let the main process shut down the workers it forked
+	// itself. Empty leaves the default, control-group. Ignored on other
+	// platforms.
+	KillMode string
+
+	// Slice is the systemd slice the service runs in, such as
+	// "batch.slice". CPUQuota limits its CPU time, for example "50%" for
+	// half of one CPU, and TasksMax limits its number of tasks. Zero values
+	// leave the defaults. Ignored on other platforms.
+	Slice    string
+	CPUQuota string
+	TasksMax int
+
+	// OOMScoreAdjust biases the Linux OOM killer for or against the
+	// service, from -1000, never kill it, to 1000, kill it first. Zero
+	// leaves the default. systemd is given it as OOMScoreAdjust=; on the
+	// other init systems Run sets it for its own process before calling
+	// Start, which needs root to lower it. Ignored on other platforms.
+	OOMScoreAdjust int
+
+	// RecoveryActions are taken by the Windows service manager, in order,
+	// each time the service fails. The failure count is reset after
+	// RecoveryResetPeriod without failures. RecoveryCommand is the command
+	// line run by RecoveryRunCommand actions. Ignored on other platforms.
+	RecoveryActions     []RecoveryAction
+	RecoveryResetPeriod time.Duration
+	RecoveryCommand     string
+
+	// Triggers make the Windows service manager start the service when one
+	// of the events happens, rather than at boot; the service is installed
+	// to be started on demand. Ignored on other platforms.
+	Triggers []Trigger
+
+	// ServiceSidType gives the Windows service a per-service SID, which
+	// ACLs can grant access to. A restricted SID also limits the service
+	// to resources that grant that SID or a few well-known ones. Defaults
+	// to SidTypeNone. Ignored on other platforms.
+	ServiceSidType SidType
+
+	// WantedBy lists the systemd targets the unit is installed into when
+	// enabled. Defaults to multi-user.target. Ignored on other platforms.
+	WantedBy []string
+
+	// CustomTarget names a systemd target, such as "myapp.target", that
+	// groups related services. The unit is installed into it instead of
+	// multi-user.target, or in addition to the WantedBy targets if any are
+	// given. InstallOrUpdate creates the target, wanted by
+	// multi-user.target, if it doesn't exist. As other services may share
+	// the target, Uninstall only removes it if RemoveCustomTarget is set.
+	// Ignored on other platforms.
+	CustomTarget       string
+	RemoveCustomTarget bool
+
+	// ExtraDirectives is an advanced escape hatch for systemd directives
+	// this package doesn't model. The lines listed under "Unit", "Service"
+	// and "Install" are appended verbatim to those sections of the unit;
+	// other keys become sections of their own, in sorted order. Nothing is
+	// escaped or checked. Ignored on other platforms.
+	ExtraDirectives map[string][]string
+}
+
+// LaunchdSocket describes a socket launchd listens on for the daemon. Set
+// PathName for a Unix domain socket or ServiceName (and optionally NodeName)
+// for a network socket.
+type LaunchdSocket struct {
+	Name        string // Required, key the daemon looks the socket up by
+	PathName    string // Path of a Unix domain socket
+	NodeName    string // Optional, host or address to listen on
+	ServiceName string // Port number or service name to listen on
+	Type        string // Optional, "stream" (default), "dgram" or "seqpacket"
+	Family      string // Optional, "IPv4" or "IPv6"
+}
+
+// Schedule describes when a scheduled service runs. The service runs each
+// Interval and at every time matching an entry of Calendar.
+type Schedule struct {
+	Interval time.Duration      // Time between runs, at least a second
+	Calendar []CalendarInterval // Wall-clock times to run at
+}
+
+// scheduled reports whether any run time is set.
+func (s Schedule) scheduled() bool {
+	return s.Interval > 0 || len(s.Calendar) > 0
+}
+
+// CalendarInterval matches wall-clock times, like a line of a crontab. The
+// zero Month and Day, and an empty Weekdays, match every month, day and
+// weekday; Hour and Minute always have to match.
+type CalendarInterval struct {
+	Month    int            // 1-12, 0 for every month
+	Day      int            // Day of the month, 1-31, 0 for every day
+	Weekdays []time.Weekday // Days of the week, empty for every day
+	Hour     int            // 0-23
+	Minute   int            // 0-59
+}
+
+// Hardening holds systemd sandboxing directives. Only non-zero fields are
+// written to the unit.
+type Hardening struct {
+	NoNewPrivileges bool     // Prevent the service from gaining privileges through execve
+	ProtectSystem   string   // "true", "full" or "strict" to mount system directories read-only
+	PrivateTmp      bool     // Give the service its own /tmp and /var/tmp
+	ReadWritePaths  []string // Paths that stay writable when ProtectSystem is set
+}
+
+// RecoveryActionType is what the Windows service manager does when the
+// service fails. The values match the SC_ACTION_TYPE constants.
+type RecoveryActionType uint32
+
+const (
+	RecoveryRestart    RecoveryActionType = 1 // Restart the service
+	RecoveryReboot     RecoveryActionType = 2 // Reboot the computer
+	RecoveryRunCommand RecoveryActionType = 3 // Run Config.RecoveryCommand
+)
+
+func (t RecoveryActionType) String() string {
+	switch t {
+	case RecoveryRestart:
+		return "restart"
+	case RecoveryReboot:
+		return "reboot"
+	case RecoveryRunCommand:
+		return "run command"
+	}
+	return fmt.Sprintf("RecoveryActionType(%d)", uint32(t))
+}
+
+// RecoveryAction is a failure action and the delay before it is taken.
+type RecoveryAction struct {
+	Type  RecoveryActionType
+	Delay time.Duration
+}
+
+// Trigger is an event that makes the Windows service manager start the
+// service.
+type Trigger int
+
+const (
+	TriggerNetworkAvailable Trigger = 1 // The first IP address becomes available
+	TriggerDomainJoin       Trigger = 2 // The computer joins a domain
+)
+
+func (t Trigger) String() string {
+	switch t {
+	case TriggerNetworkAvailable:
+		return "network available"
+	case TriggerDomainJoin:
+		return "domain join"
+	}
+	return fmt.Sprintf("Trigger(%d)", int(t))
+}
+
+// SidType is the kind of per-service SID the Windows service manager
+// gives the service.
+type SidType int
+
+const (
+	SidTypeNone         SidType = iota // No per-service SID
+	SidTypeUnrestricted                // A per-service SID is added to the process token
+	SidTypeRestricted                  // The SID is added and the token is write-restricted
+)
+
+func (t SidType) String() string {
+	switch t {
+	case SidTypeNone:
+		return "none"
+	case SidTypeUnrestricted:
+		return "unrestricted"
+	case SidTypeRestricted:
+		return "restricted"
+	}
+	return fmt.Sprintf("SidType(%d)", int(t))
 }
 
 // Service represents a service that can be run or controlled.
@@ -33,37 +522,1162 @@ type Service interface {
 	// then start.
 	Restart() error
 
+	// ResetFailed clears the failed state of a systemd unit, such as one
+	// that hit its start limit, so it can be started again. Returns
+	// ErrNotSupported on other platforms.
+	ResetFailed() error
+
 	// InstalLOrUpdateRequired checks whether the service needs to be installed
 	// or udpated.
 	InstallOrUpdateRequired() (bool, error)
 
+	// UpdateWillRestart reports whether the update InstallOrUpdate would
+	// make only takes effect once the running service restarts: the
+	// program, its arguments or, on Windows, the account it runs as
+	// changed. Other changes are picked up by the service manager when the
+	// configuration is reloaded. It returns false if the service isn't
+	// installed, as there is nothing running to restart.
+	UpdateWillRestart() (bool, error)
+
+	// NeedsElevation reports whether the current process lacks the
+	// privileges needed to install and control the service.
+	NeedsElevation() bool
+
 	// InstallOrUpdate installs or updates the given service to the OS service manager. If
 	// the service doesn't yet exist, it is created. If it already exists, the
 	// existing service is updated. If additional privileges are needed, the
 	// user is prompted with an escalation dialog.
 	//
-	// Returns true if the service was installed or updated, false if it was
-	// left alone.
-	InstallOrUpdate() (bool, error)
+	// The result tells whether the service was installed, updated or left
+	// alone; its Changed method gives the single answer earlier versions
+	// returned as a bool.
+	InstallOrUpdate() (InstallResult, error)
+
+	// InstallOrUpdateWithRollback installs or updates the service, starts
+	// or restarts it and calls healthy until it returns nil. If it doesn't
+	// within timeout, or installing or starting fails, the configuration
+	// installed before is restored and the service restarted with it, or
+	// a service that wasn't installed before is uninstalled. The error then
+	// reports the failure and whether rolling back succeeded.
+	InstallOrUpdateWithRollback(healthy func() error, timeout time.Duration) error
+
+	// ForceReinstall rewrites the service configuration even if it matches
+	// what's installed, reloads it into the OS service manager and restarts
+	// the service. Use it to recover a service that's in a broken state.
+	ForceReinstall() error
 
 	// Uninstall uninstalls the given service from the OS service manager. This may require
 	// greater rights. Will return an error if the service is not present.
 	Uninstall() error
 
+	// UninstallIfPresent is like Uninstall but returns nil if the service is
+	// not present. Other failures, such as insufficient permissions, are
+	// still returned.
+	UninstallIfPresent() error
+
+	// UpdateProgram points the installed service at the program at newPath,
+	// which must be executable, and reloads it, leaving the rest of the
+	// installed configuration untouched. The running service keeps running
+	// the old program until it is restarted.
+	UpdateProgram(newPath string) error
+
+	// UpdateArguments replaces the arguments the installed service runs the
+	// program with and reloads it, leaving the program and the rest of the
+	// installed configuration untouched. Returns ErrNotSupported on System V,
+	// whose init script doesn't pass arguments.
+	UpdateArguments(args []string) error
+
+	// EffectiveConfig returns a copy of the Config the service uses, with
+	// the defaults New and the platform fill in, such as Program.
+	EffectiveConfig() Config
+
+	// Validate checks, without changing anything, that the service can be
+	// installed and started: the program must be executable, the working
+	// directory must exist unless it will be created, and a service with the
+	// same name must not already be installed for a different program. It
+	// returns every problem found, joined with errors.Join.
+	Validate() error
+
+	// InstalledVersion returns the Config.Version recorded in the installed
+	// configuration, or "" if none was recorded. It returns ErrNotInstalled
+	// if the service isn't installed.
+	InstalledVersion() (string, error)
+
+	// WriteConfig writes the configuration InstallOrUpdate would install to
+	// w, without touching the service manager: the systemd unit, init script
+	// or launchd plist, or on Windows a readable listing of the settings.
+	WriteConfig(w io.Writer) error
+
+	// InstalledConfig returns the configuration currently installed, as
+	// WriteConfig writes it, so the two can be compared: the bytes of the
+	// unit, init script or plist, or on Windows a listing of the settings
+	// the service manager reports. Returns ErrNotInstalled if the service
+	// isn't installed.
+	InstalledConfig() ([]byte, error)
+
+	// Enable makes the installed service start at boot, and Disable stops
+	// it from doing so. Neither starts or stops the service now.
+	Enable() error
+	Disable() error
+
+	// IsEnabled reports whether the installed service starts at boot,
+	// regardless of whether it is running now. It returns false if the
+	// service isn't installed.
+	IsEnabled() (bool, error)
+
+	// Drain asks the running service to stop accepting new work, by
+	// calling its Config.Drain, and Undrain asks it to resume. Returns
+	// ErrNotSupported where the service can't be signaled.
+	Drain() error
+	Undrain() error
+
+	// Kill forcibly terminates the running service, for when Stop hangs.
+	// Unlike Stop, the process gets no chance to clean up, and the service
+	// manager may restart it as it would after a crash. Returns
+	// ErrNotRunning if there is no process to kill.
+	Kill() error
+
 	// Run runs the service
 	Run() error
+
+	// RunContext is like Run but also stops the service and returns when
+	// ctx is cancelled, so an embedding supervisor or a test can stop it
+	// without a signal.
+	RunContext(ctx context.Context) error
+
+	// LastExitStatus returns the exit code the service's process last exited
+	// with. A process killed by a signal is reported as 128 plus the signal
+	// number. Returns ErrNoExitStatus if the service has never run.
+	LastExitStatus() (int, error)
+
+	// EditConfig passes the installed configuration file to edit and replaces
+	// it with the result, then reloads the service configuration. Returns
+	// ErrNotSupported on Windows, where the configuration is not a file.
+	EditConfig(edit func(current []byte) ([]byte, error)) error
+
+	// Capabilities reports which optional operations the platform's service
+	// manager supports.
+	Capabilities() Capability
+
+	// Export returns the service's Config together with its installed
+	// state, for backing up or moving the service to another machine.
+	Export() (ServiceDefinition, error)
+
+	// WatchStatus sends the current status of the service, then each change
+	// to it, until ctx is cancelled, when the channel is closed. The service
+	// manager is polled, about once a second.
+	WatchStatus(ctx context.Context) (<-chan Status, error)
+
+	// Wait blocks until the service's process exits or ctx is cancelled,
+	// and returns the exit status as LastExitStatus does. It returns at
+	// once for a service that isn't running. Windows waits on the process
+	// itself; elsewhere the service manager is polled like WatchStatus.
+	// Returns ErrNotSupported on Linux init systems other than systemd.
+	Wait(ctx context.Context) (int, error)
+
+	// CommandLine returns the program and arguments the service manager
+	// starts the service with, escaped as in the installed configuration:
+	// the binary path on Windows, the ExecStart of a systemd unit and the
+	// command line of an init script or Upstart job. launchd runs the
+	// program without a shell, so the words are shell-quoted where needed.
+	CommandLine() (string, error)
+
+	// PlatformHandle is an escape hatch for what this package doesn't
+	// model. It returns the open *mgr.Service on Windows, which the caller
+	// must Close, the plist path on macOS and the unit or init script path
+	// on Linux. The returned type is platform-specific and may change.
+	PlatformHandle() (interface{}, error)
+
+	// Processes returns the PIDs of all processes of the running service,
+	// including workers it started, in ascending order: the processes in
+	// the unit's cgroup on systemd, the process group of the PIDFile
+	// process on the other Linux init systems, the process group of the job
+	// on launchd and the process tree of the service on Windows. Returns
+	// ErrNotRunning if the service isn't running.
+	Processes() ([]int, error)
+
+	// StartAndCapture starts the service and returns what it writes to its
+	// standard output and error within d, returning early once the
+	// service stops, so a failure to start can be explained. The output is
+	// read from StdoutPath, or from the journal on systemd without it.
+	// Returns ErrNotSupported where the output is not kept, such as the
+	// event log on Windows.
+	StartAndCapture(ctx context.Context, d time.Duration) (string, error)
+
+	// RotateLogs rotates the StdoutPath file Run writes to, for use by the
+	// running service, for example after a log-heavy operation. Without
+	// LogMaxBackups the file is closed and reopened. It does nothing on
+	// systemd, where journald or logrotate manage the output, and returns
+	// ErrNotSupported where the service manager writes the file itself or
+	// there is no file.
+	RotateLogs() error
+
+	// ResourceUsage returns the current memory and CPU use of the running
+	// service, or ErrNotRunning. On systemd it covers all processes of the
+	// unit when memory and CPU accounting are on, and otherwise only the
+	// main process. The other Linux init systems need a PIDFile to find
+	// the process.
+	ResourceUsage() (ResourceUsage, error)
+}
+
+// ResourceUsage is the memory and CPU use of a running service.
+type ResourceUsage struct {
+	PID     int           // Main process of the service
+	RSS     uint64        // Resident memory in bytes
+	CPUTime time.Duration // User and system CPU time used since it started
+}
+
+// InstallResult describes what InstallOrUpdate did.
+type InstallResult struct {
+	Installed  bool   // The service wasn't installed before
+	Updated    bool   // The configuration of the existing service was replaced
+	Started    bool   // The service manager started the service as part of the change
+	ConfigPath string // The configuration file written, empty on Windows
+}
+
+// Changed reports whether the service was installed or updated.
+func (r InstallResult) Changed() bool {
+	return r.Installed || r.Updated
+}
+
+// Status is the state of an installed service.
+type Status string
+
+const (
+	StatusUnknown Status = ""        // The service manager can't report the state
+	StatusStopped Status = "stopped" // The service is not running
+	StatusRunning Status = "running" // The service is running
+)
+
+// ServiceDefinition is everything the package knows about a service. It
+// contains no functions, so it can be marshalled as JSON or YAML; Start and
+// Stop have to be set again before the Config is used to Run the service.
+type ServiceDefinition struct {
+	Config    Config
+	Installed bool   // The service is registered with the service manager
+	Enabled   bool   // The service starts at boot
+	Status    Status // StatusUnknown if the service manager can't tell
+	PID       int    // Process ID of the running service, 0 if unknown
+}
+
+// Import creates a Service from an exported definition. Only the Config is
+// used; the installed state is informational. Call InstallOrUpdate on the
+// result to recreate the service.
+func Import(def ServiceDefinition) (Service, error) {
+	return New(def.Config)
 }
 
+// Capability is a set of optional operations a service manager supports.
+type Capability uint32
+
+const (
+	// CapPauseContinue means a running service can be paused and resumed.
+	CapPauseContinue Capability = 1 << iota
+	// CapReload means a running service can be asked to reload its
+	// configuration without restarting.
+	CapReload
+	// CapMask means a service can be masked so it can't be started at all.
+	CapMask
+	// CapResourceLimits means the service manager can enforce resource
+	// limits on the service.
+	CapResourceLimits
+)
+
+// Has reports whether all capabilities in o are present in c.
+func (c Capability) Has(o Capability) bool {
+	return c&o == o
+}
+
+// architectures are the values of Config.Architecture that arch accepts.
+var architectures = []string{"arm64", "arm64e", "x86_64"}
+
 var errNameFieldRequired = errors.New("Config.Name field is required.")
 
+// ErrNotSupported is returned by operations the platform's service manager
+// can't perform.
+var ErrNotSupported = errors.New("Operation not supported on this platform.")
+
+// ErrNotInstalled is returned by Start, Stop and Restart when the service
+// isn't installed.
+var ErrNotInstalled = errors.New("Service is not installed.")
+
+// ErrNoExitStatus is returned by LastExitStatus when the service has not
+// exited since it was installed.
+var ErrNoExitStatus = errors.New("Service has no recorded exit status.")
+
+// ErrNotRunning is returned by ResourceUsage when the service isn't
+// running.
+var ErrNotRunning = errors.New("Service is not running.")
+
+// ErrNotRunningAsService is returned by Run when it is called outside of the
+// service manager and Config.AllowInteractiveRun is not set.
+var ErrNotRunningAsService = errors.New("Not running under the service manager.")
+
+// ErrExternalProgram is returned by Run when Config.Program is a program
+// other than the current one. The service manager runs that program itself.
+var ErrExternalProgram = errors.New("Config.Program is not the current program; the service manager runs it directly.")
+
 // New creates a new service based on a service interface and configuration.
 func New(c Config) (Service, error) {
 	if len(c.Name) == 0 {
 		return nil, errNameFieldRequired
 	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if c.Strict {
+		if err := c.checkSupported(); err != nil {
+			return nil, err
+		}
+	}
+	c = c.Clone()
+	var err error
+	c.DisplayName, err = c.renderField("DisplayName", c.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	c.Description, err = c.renderField("Description", c.Description)
+	if err != nil {
+		return nil, err
+	}
+	c.Arguments = c.expandArguments(c.Arguments)
+	if c.Schedule.scheduled() {
+		c.Oneshot = true
+	}
+	if c.NullStdin && c.StdinPath == "" {
+		c.StdinPath = os.DevNull
+	}
 	return newService(c)
 }
 
+// Clone returns a copy of the Config that shares no slices or maps with the
+// original.
+func (c Config) Clone() Config {
+	c.Arguments = cloneStrings(c.Arguments)
+	c.WantedBy = cloneStrings(c.WantedBy)
+	c.OnFailure = cloneStrings(c.OnFailure)
+	c.Hardening.ReadWritePaths = cloneStrings(c.Hardening.ReadWritePaths)
+	if c.RecoveryActions != nil {
+		c.RecoveryActions = append([]RecoveryAction(nil), c.RecoveryActions...)
+	}
+	if c.Triggers != nil {
+		c.Triggers = append([]Trigger(nil), c.Triggers...)
+	}
+	c.MachServices = cloneStrings(c.MachServices)
+	c.ConditionPathExists = cloneStrings(c.ConditionPathExists)
+	c.EnvironmentFiles = cloneStrings(c.EnvironmentFiles)
+	if c.NetworkState != nil {
+		networkState := *c.NetworkState
+		c.NetworkState = &networkState
+	}
+	if c.RunAtLoad != nil {
+		runAtLoad := *c.RunAtLoad
+		c.RunAtLoad = &runAtLoad
+	}
+	if c.Sockets != nil {
+		c.Sockets = append([]LaunchdSocket(nil), c.Sockets...)
+	}
+	if c.Schedule.Calendar != nil {
+		calendar := make([]CalendarInterval, len(c.Schedule.Calendar))
+		for i, interval := range c.Schedule.Calendar {
+			interval.Weekdays = append([]time.Weekday(nil), interval.Weekdays...)
+			calendar[i] = interval
+		}
+		c.Schedule.Calendar = calendar
+	}
+	c.EnvVars = cloneStringMap(c.EnvVars)
+	c.ArgumentVariables = cloneStringMap(c.ArgumentVariables)
+	if c.OtherJobEnabled != nil {
+		jobs := make(map[string]bool, len(c.OtherJobEnabled))
+		for label, enabled := range c.OtherJobEnabled {
+			jobs[label] = enabled
+		}
+		c.OtherJobEnabled = jobs
+	}
+	if c.ExtraDirectives != nil {
+		directives := make(map[string][]string, len(c.ExtraDirectives))
+		for section, lines := range c.ExtraDirectives {
+			directives[section] = cloneStrings(lines)
+		}
+		c.ExtraDirectives = directives
+	}
+	return c
+}
+
+// Equal reports whether c and o describe the same service. Lists whose
+// order doesn't matter, such as WantedBy, EnvironmentFiles and Sockets, are
+// compared as sets, while Arguments, RecoveryActions and Schedule.Calendar
+// must be in the same order. Nil and empty slices and maps are equal. The
+// function fields can't be compared and are ignored.
+func (c Config) Equal(o Config) bool {
+	return reflect.DeepEqual(c.normalized(), o.normalized())
+}
+
+// normalized returns a copy of c for Equal to compare: unordered lists are
+// sorted, empty slices and maps are nil and the function fields are unset.
+func (c Config) normalized() Config {
+	c = c.Clone()
+	c.Start, c.Stop, c.Healthcheck, c.Drain, c.Undrain = nil, nil, nil, nil, nil
+	c.Arguments = nilIfEmpty(c.Arguments)
+	c.WantedBy = sortedStrings(c.WantedBy)
+	c.OnFailure = sortedStrings(c.OnFailure)
+	c.Hardening.ReadWritePaths = sortedStrings(c.Hardening.ReadWritePaths)
+	c.MachServices = sortedStrings(c.MachServices)
+	c.ConditionPathExists = sortedStrings(c.ConditionPathExists)
+	c.EnvironmentFiles = sortedStrings(c.EnvironmentFiles)
+	if len(c.RecoveryActions) == 0 {
+		c.RecoveryActions = nil
+	}
+	c.Triggers = sortedTriggers(c.Triggers)
+	if len(c.Sockets) == 0 {
+		c.Sockets = nil
+	}
+	sort.Slice(c.Sockets, func(i, j int) bool {
+		return fmt.Sprint(c.Sockets[i]) < fmt.Sprint(c.Sockets[j])
+	})
+	if len(c.Schedule.Calendar) == 0 {
+		c.Schedule.Calendar = nil
+	}
+	for i := range c.Schedule.Calendar {
+		weekdays := c.Schedule.Calendar[i].Weekdays
+		if len(weekdays) == 0 {
+			weekdays = nil
+		}
+		sort.Slice(weekdays, func(i, j int) bool { return weekdays[i] < weekdays[j] })
+		c.Schedule.Calendar[i].Weekdays = weekdays
+	}
+	if len(c.EnvVars) == 0 {
+		c.EnvVars = nil
+	}
+	if len(c.ArgumentVariables) == 0 {
+		c.ArgumentVariables = nil
+	}
+	if len(c.OtherJobEnabled) == 0 {
+		c.OtherJobEnabled = nil
+	}
+	for section, lines := range c.ExtraDirectives {
+		if len(lines) == 0 {
+			delete(c.ExtraDirectives, section)
+		}
+	}
+	if len(c.ExtraDirectives) == 0 {
+		c.ExtraDirectives = nil
+	}
+	return c
+}
+
+// sortedStrings returns s sorted, or nil if it is empty. It sorts in place,
+// so s must not be shared.
+func sortedStrings(s []string) []string {
+	s = nilIfEmpty(s)
+	sort.Strings(s)
+	return s
+}
+
+// sortedTriggers returns triggers sorted, or nil if it is empty. It sorts in
+// place, so triggers must not be shared.
+func sortedTriggers(triggers []Trigger) []Trigger {
+	if len(triggers) == 0 {
+		return nil
+	}
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i] < triggers[j] })
+	return triggers
+}
+
+func nilIfEmpty(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+	return clone
+}
+
+// renderField renders the value of the named Config field as a template
+// over c. Values without template actions are returned as they are.
+func (c *Config) renderField(field, value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	t, err := template.New(field).Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse Config.%s: %v", field, err)
+	}
+	var b strings.Builder
+	err = t.Execute(&b, c)
+	if err != nil {
+		return "", fmt.Errorf("Unable to render Config.%s: %v", field, err)
+	}
+	return b.String(), nil
+}
+
+// expandArguments returns args with variables expanded if ExpandArguments
+// is set, and args unchanged otherwise.
+func (c *Config) expandArguments(args []string) []string {
+	if !c.ExpandArguments {
+		return args
+	}
+	mapping := os.Getenv
+	if c.ArgumentVariables != nil {
+		mapping = func(name string) string { return c.ArgumentVariables[name] }
+	}
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = os.Expand(arg, mapping)
+	}
+	return expanded
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
+
+// unitNamePattern matches systemd unit names such as notify@foo.service.
+var unitNamePattern = regexp.MustCompile(`^[A-Za-z0-9:_.\\@-]+\.(service|socket|device|mount|automount|swap|target|path|timer|slice|scope)$`)
+
+// launchdLabelPattern matches launchd job labels such as com.example.db.
+var launchdLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// cpuQuotaPattern matches systemd CPUQuota values such as 50% or 150%.
+var cpuQuotaPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?%$`)
+
+// validate checks the optional fields of the Config for values that could
+// never produce a working service.
+func (c *Config) validate() error {
+	if c.StdoutPath != "" && !filepath.IsAbs(c.StdoutPath) {
+		return fmt.Errorf("Config.StdoutPath %q is not an absolute path", c.StdoutPath)
+	}
+	if c.LogMaxSize < 0 || c.LogMaxBackups < 0 {
+		return errors.New("Config.LogMaxSize and Config.LogMaxBackups must not be negative.")
+	}
+	if c.StdinPath != "" && c.StdinPath != os.DevNull && !filepath.IsAbs(c.StdinPath) {
+		return fmt.Errorf("Config.StdinPath %q is not an absolute path", c.StdinPath)
+	}
+	for _, path := range c.EnvironmentFiles {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("Config.EnvironmentFiles entry %q is not an absolute path", path)
+		}
+	}
+	if c.ConfigFileMode&^os.ModePerm != 0 {
+		return fmt.Errorf("Config.ConfigFileMode %v has bits other than permissions", c.ConfigFileMode)
+	}
+	if c.ConfigFileMode != 0 && c.ConfigFileMode&0400 == 0 {
+		return fmt.Errorf("Config.ConfigFileMode %v doesn't let the owner read the file", c.ConfigFileMode)
+	}
+	if c.PIDFile != "" && !filepath.IsAbs(c.PIDFile) {
+		return fmt.Errorf("Config.PIDFile %q is not an absolute path", c.PIDFile)
+	}
+	if strings.ContainsAny(c.Version, "\r\n") {
+		return errors.New("Config.Version must be a single line.")
+	}
+	if c.StartupTimeout < 0 {
+		return errors.New("Config.StartupTimeout must not be negative.")
+	}
+	if c.HealthcheckInterval < 0 {
+		return errors.New("Config.HealthcheckInterval must not be negative.")
+	}
+	if c.Healthcheck != nil && c.HealthcheckInterval == 0 {
+		return errors.New("Config.Healthcheck requires Config.HealthcheckInterval.")
+	}
+	if _, ok := stopSignals[c.StopSignal]; c.StopSignal != "" && !ok {
+		return fmt.Errorf("Config.StopSignal %q is not one of SIGHUP, SIGINT, SIGQUIT or SIGTERM", c.StopSignal)
+	}
+	for _, path := range c.ConditionPathExists {
+		if !filepath.IsAbs(strings.TrimPrefix(path, "!")) {
+			return fmt.Errorf("Config.ConditionPathExists entry %q is not an absolute path", path)
+		}
+	}
+	if c.RequireNetwork && c.NetworkState != nil && !*c.NetworkState {
+		return errors.New("Config.RequireNetwork can't be combined with a false Config.NetworkState.")
+	}
+	for field, dir := range map[string]string{
+		"RuntimeDirectory": c.RuntimeDirectory,
+		"StateDirectory":   c.StateDirectory,
+		"CacheDirectory":   c.CacheDirectory,
+		"LogsDirectory":    c.LogsDirectory,
+	} {
+		if !validServiceDir(dir) {
+			return fmt.Errorf("Config.%s %q is not a relative directory name", field, dir)
+		}
+	}
+	if c.Host != "" && c.UserSession {
+		return errors.New("Config.Host is not supported with Config.UserSession.")
+	}
+	if c.Host != "" && c.Program == "" {
+		return errors.New("Config.Host requires Config.Program, the path of the program on that computer.")
+	}
+	if c.Architecture != "" && !containsString(architectures, c.Architecture) {
+		return fmt.Errorf("Config.Architecture %q must be one of %s", c.Architecture, strings.Join(architectures, ", "))
+	}
+	for label := range c.OtherJobEnabled {
+		if !launchdLabelPattern.MatchString(label) {
+			return fmt.Errorf("Config.OtherJobEnabled label %q is not a valid launchd job label", label)
+		}
+	}
+	if c.LogMaxSize > 0 && c.StdoutPath == "" {
+		return errors.New("Config.LogMaxSize requires Config.StdoutPath.")
+	}
+	if c.UnitDir != "" && !filepath.IsAbs(c.UnitDir) {
+		return fmt.Errorf("Config.UnitDir %q is not an absolute path", c.UnitDir)
+	}
+	if c.RootDir != "" && !filepath.IsAbs(c.RootDir) {
+		return fmt.Errorf("Config.RootDir %q is not an absolute path", c.RootDir)
+	}
+	if strings.ContainsAny(c.DropIn, "/\\") || strings.HasPrefix(c.DropIn, ".") {
+		return fmt.Errorf("Config.DropIn %q is not a valid file name", c.DropIn)
+	}
+	if c.DropIn != "" && c.Schedule.scheduled() {
+		return errors.New("Config.DropIn can't be combined with Config.Schedule.")
+	}
+	if c.DropIn != "" && c.CustomTarget != "" {
+		return errors.New("Config.DropIn can't be combined with Config.CustomTarget.")
+	}
+	for _, socket := range c.Sockets {
+		if socket.Name == "" {
+			return errors.New("Config.Sockets entries require a Name.")
+		}
+		if socket.PathName == "" && socket.ServiceName == "" {
+			return fmt.Errorf("Config.Sockets entry %q needs a PathName or ServiceName", socket.Name)
+		}
+	}
+	if c.Schedule.Interval != 0 && c.Schedule.Interval < time.Second {
+		return fmt.Errorf("Config.Schedule.Interval %v is shorter than a second", c.Schedule.Interval)
+	}
+	for _, interval := range c.Schedule.Calendar {
+		if interval.Month < 0 || interval.Month > 12 || interval.Day < 0 || interval.Day > 31 ||
+			interval.Hour < 0 || interval.Hour > 23 || interval.Minute < 0 || interval.Minute > 59 {
+			return fmt.Errorf("Config.Schedule.Calendar entry %+v is out of range", interval)
+		}
+		for _, weekday := range interval.Weekdays {
+			if weekday < time.Sunday || weekday > time.Saturday {
+				return fmt.Errorf("Config.Schedule.Calendar weekday %d is out of range", weekday)
+			}
+		}
+	}
+	if c.MaxRestarts < 0 || c.RestartWindow < 0 {
+		return errors.New("Config.MaxRestarts and Config.RestartWindow must not be negative.")
+	}
+	if c.StartLimitIntervalSec < 0 || c.StartLimitBurst < 0 {
+		return errors.New("Config.StartLimitIntervalSec and Config.StartLimitBurst must not be negative.")
+	}
+	for _, unit := range c.OnFailure {
+		if !unitNamePattern.MatchString(unit) {
+			return fmt.Errorf("Config.OnFailure entry %q is not a systemd unit name", unit)
+		}
+	}
+	switch c.Hardening.ProtectSystem {
+	case "", "true", "false", "full", "strict":
+	default:
+		return fmt.Errorf("Config.Hardening.ProtectSystem %q is not one of true, false, full or strict", c.Hardening.ProtectSystem)
+	}
+	if c.Slice != "" && (!strings.HasSuffix(c.Slice, ".slice") || !unitNamePattern.MatchString(c.Slice)) {
+		return fmt.Errorf("Config.Slice %q is not a systemd slice name", c.Slice)
+	}
+	if c.CPUQuota != "" && !cpuQuotaPattern.MatchString(c.CPUQuota) {
+		return fmt.Errorf("Config.CPUQuota %q is not a percentage", c.CPUQuota)
+	}
+	if c.TasksMax < 0 {
+		return errors.New("Config.TasksMax must not be negative.")
+	}
+	if c.OOMScoreAdjust < -1000 || c.OOMScoreAdjust > 1000 {
+		return fmt.Errorf("Config.OOMScoreAdjust %d is not between -1000 and 1000", c.OOMScoreAdjust)
+	}
+	switch c.CPUSchedulingPolicy {
+	case "", "other", "batch", "idle", "fifo", "rr":
+	default:
+		return fmt.Errorf("Config.CPUSchedulingPolicy %q is not one of other, batch, idle, fifo or rr", c.CPUSchedulingPolicy)
+	}
+	switch c.IOSchedulingClass {
+	case "", "realtime", "best-effort", "idle", "none":
+	default:
+		return fmt.Errorf("Config.IOSchedulingClass %q is not one of realtime, best-effort, idle or none", c.IOSchedulingClass)
+	}
+	switch c.KillMode {
+	case "", "control-group", "mixed", "process", "none":
+	default:
+		return fmt.Errorf("Config.KillMode %q is not one of control-group, mixed, process or none", c.KillMode)
+	}
+	for _, action := range c.RecoveryActions {
+		switch action.Type {
+		case RecoveryRestart, RecoveryReboot:
+		case RecoveryRunCommand:
+			if c.RecoveryCommand == "" {
+				return errors.New("Config.RecoveryActions runs a command but Config.RecoveryCommand is empty.")
+			}
+		default:
+			return fmt.Errorf("Config.RecoveryActions has unknown action type %d", action.Type)
+		}
+	}
+	for _, trigger := range c.Triggers {
+		if trigger != TriggerNetworkAvailable && trigger != TriggerDomainJoin {
+			return fmt.Errorf("Config.Triggers has unknown trigger %d", trigger)
+		}
+	}
+	if c.ServiceSidType < SidTypeNone || c.ServiceSidType > SidTypeRestricted {
+		return fmt.Errorf("Config.ServiceSidType has unknown SID type %d", c.ServiceSidType)
+	}
+	for section := range c.ExtraDirectives {
+		if section == "" || strings.ContainsAny(section, "[]\n") {
+			return fmt.Errorf("Config.ExtraDirectives section %q is not a valid section name", section)
+		}
+	}
+	for _, target := range c.WantedBy {
+		if !strings.HasSuffix(target, ".target") {
+			return fmt.Errorf("Config.WantedBy entry %q is not a systemd target", target)
+		}
+	}
+	if c.CustomTarget != "" && (!strings.HasSuffix(c.CustomTarget, ".target") || strings.ContainsRune(c.CustomTarget, '/')) {
+		return fmt.Errorf("Config.CustomTarget %q is not a systemd target", c.CustomTarget)
+	}
+	if c.RemoveCustomTarget && c.CustomTarget == "" {
+		return errors.New("Config.RemoveCustomTarget requires Config.CustomTarget.")
+	}
+	return nil
+}
+
+// executable returns the path of the current program. It is a variable so
+// tests can substitute a fixed path.
+var executable = os.Executable
+
+// program returns the program the service runs, defaulting to the current
+// executable.
+func (c *Config) program() (string, error) {
+	if c.Program != "" {
+		return c.Program, nil
+	}
+	program, err := executable()
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine program: %v", err)
+	}
+	return program, nil
+}
+
+// stat is os.Stat, replaced in tests.
+var stat = os.Stat
+
+// lookPath is exec.LookPath, replaced in tests.
+var lookPath = exec.LookPath
+
+// toolPaths holds the paths set by SetSystemctlPath and SetLaunchctlPath.
+var toolPaths = struct {
+	sync.Mutex
+	path map[string]string
+}{path: make(map[string]string)}
+
+// SetSystemctlPath makes the package run systemctl from path, for systems
+// where it isn't on PATH, such as NixOS. An empty path restores the PATH
+// lookup.
+func SetSystemctlPath(path string) {
+	setToolPath("systemctl", path)
+}
+
+// SetLaunchctlPath makes the package run launchctl from path. An empty path
+// restores the PATH lookup.
+func SetLaunchctlPath(path string) {
+	setToolPath("launchctl", path)
+}
+
+func setToolPath(name, path string) {
+	toolPaths.Lock()
+	defer toolPaths.Unlock()
+	if path == "" {
+		delete(toolPaths.path, name)
+		return
+	}
+	toolPaths.path[name] = path
+}
+
+// toolPath returns the command to run for the tool name: the path set for
+// it, or name itself to look it up on PATH.
+func toolPath(name string) string {
+	toolPaths.Lock()
+	defer toolPaths.Unlock()
+	if path, ok := toolPaths.path[name]; ok {
+		return path
+	}
+	return name
+}
+
+// toolLookups caches the result of requireTool per tool name.
+var toolLookups = struct {
+	sync.Mutex
+	err map[string]error
+}{err: make(map[string]error)}
+
+// requireTool reports a clear error if the command line tool name, such as
+// launchctl or systemctl, isn't on PATH, instead of the bare exec error
+// returned when running it. The lookup is done once per tool.
+func requireTool(name string) error {
+	toolLookups.Lock()
+	defer toolLookups.Unlock()
+	err, ok := toolLookups.err[name]
+	if !ok {
+		if _, lookErr := lookPath(name); lookErr != nil {
+			where := " in PATH"
+			if strings.ContainsRune(name, os.PathSeparator) {
+				where = ""
+			}
+			err = fmt.Errorf("Unable to find %v%v, which is required to manage %v services: %v", name, where, system, lookErr)
+		}
+		toolLookups.err[name] = err
+	}
+	return err
+}
+
+// chown, lookupUser, lookupGroup and rename are replaced in tests.
+var (
+	chown       = os.Chown
+	lookupUser  = user.Lookup
+	lookupGroup = user.LookupGroup
+	rename      = os.Rename
+)
+
+// noEscalateError explains a failure caused by missing privileges when
+// NoEscalate is set. The returned error wraps err, so errors.Is(err,
+// os.ErrPermission) still holds.
+func (c *Config) noEscalateError(err error) error {
+	if err == nil || !c.NoEscalate || !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	return fmt.Errorf("Insufficient privileges to manage service %v, and NoEscalate is set; run as root or Administrator: %w", c.Name, err)
+}
+
+// configFileMode returns c.ConfigFileMode, or def if it isn't set.
+func (c *Config) configFileMode(def os.FileMode) os.FileMode {
+	if c.ConfigFileMode != 0 {
+		return c.ConfigFileMode
+	}
+	return def
+}
+
+// configFileOwner resolves c.ConfigOwner and c.ConfigGroup to IDs. Unset
+// ones are returned as -1, which chown leaves unchanged.
+func (c *Config) configFileOwner() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if c.ConfigOwner != "" {
+		uid, err = strconv.Atoi(c.ConfigOwner)
+		if err != nil {
+			u, err := lookupUser(c.ConfigOwner)
+			if err != nil {
+				return -1, -1, fmt.Errorf("Unable to look up config owner: %v", err)
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, fmt.Errorf("Unable to use uid %q of %s: %v", u.Uid, c.ConfigOwner, err)
+			}
+		}
+	}
+	if c.ConfigGroup != "" {
+		gid, err = strconv.Atoi(c.ConfigGroup)
+		if err != nil {
+			g, err := lookupGroup(c.ConfigGroup)
+			if err != nil {
+				return -1, -1, fmt.Errorf("Unable to look up config group: %v", err)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, fmt.Errorf("Unable to use gid %q of %s: %v", g.Gid, c.ConfigGroup, err)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// preflight returns the problems with c that would stop the installed
+// service from starting: a program that isn't executable or a missing
+// working directory that won't be created.
+func (c *Config) preflight() []error {
+	var errs []error
+	program, err := c.program()
+	if err == nil {
+		err = checkExecutable(program)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if c.WorkingDirectory != "" && !c.CreateWorkingDirectory {
+		info, err := stat(c.WorkingDirectory)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Unable to stat working directory %v: %v", c.WorkingDirectory, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("Working directory %v is not a directory", c.WorkingDirectory))
+		}
+	}
+	return errs
+}
+
+// checkRunsHere returns ErrExternalProgram if c.Program is set to a program
+// other than the current executable.
+func (c *Config) checkRunsHere() error {
+	if c.Program == "" {
+		return nil
+	}
+	exe, err := executable()
+	if err != nil || exe == c.Program {
+		return nil
+	}
+	exeInfo, err := stat(exe)
+	if err != nil {
+		return nil
+	}
+	programInfo, err := stat(c.Program)
+	if err == nil && os.SameFile(exeInfo, programInfo) {
+		return nil
+	}
+	return ErrExternalProgram
+}
+
+// checkOwner returns an error if a service with the same name is already
+// installed for a program other than program.
+func checkOwner(name, installed, program string) error {
+	if installed == "" || installed == program {
+		return nil
+	}
+	return fmt.Errorf("Service %s is already installed for %s", name, installed)
+}
+
+// matchesDiffer reports whether any of patterns matches a different part
+// of a than of b, or matches in only one of them. Nil patterns are skipped.
+func matchesDiffer(a, b []byte, patterns ...*regexp.Regexp) bool {
+	for _, p := range patterns {
+		if p != nil && !bytes.Equal(p.Find(a), p.Find(b)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExecutable makes sure path is an absolute path to an executable
+// file, so a service isn't pointed at a program that can't start.
+func checkExecutable(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("Program %q is not an absolute path", path)
+	}
+	info, err := stat(path)
+	if err != nil {
+		return fmt.Errorf("Unable to stat program: %v", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("Program %s is a directory", path)
+	}
+	// Windows doesn't have execute permission bits.
+	if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+		return fmt.Errorf("Program %s is not executable", path)
+	}
+	return nil
+}
+
+// checkWorkingDirectory makes sure WorkingDirectory, if set, is an existing
+// directory. Service managers fail to start a service with a missing working
+// directory without saying why.
+func (c *Config) checkWorkingDirectory() error {
+	if c.WorkingDirectory == "" {
+		return nil
+	}
+	info, err := stat(c.WorkingDirectory)
+	if os.IsNotExist(err) && c.CreateWorkingDirectory {
+		if err := os.MkdirAll(c.WorkingDirectory, 0755); err != nil {
+			return fmt.Errorf("Unable to create working directory %v: %v", c.WorkingDirectory, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to stat working directory %v: %v", c.WorkingDirectory, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Working directory %v is not a directory", c.WorkingDirectory)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data. The data is written
+// to a temporary file in the same directory first, so readers never see a
+// partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("Unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("Unable to write temporary file: %v", err)
+	}
+	if err = f.Chmod(perm); err != nil {
+		return fmt.Errorf("Unable to chmod temporary file: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("Unable to close temporary file: %v", err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("Unable to move temporary file to %v: %v", path, err)
+	}
+	return nil
+}
+
+// stopSignals are the signals Config.StopSignal may name.
+var stopSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// forwardStopSignal sends c.StopSignal to the process if it was stopped
+// with a different signal, so the program's own handler sees the signal it
+// expects. sigChan must still be registered for the signal: the program
+// may have no handler for it, and the runtime's default action would then
+// kill the process before Stop runs. Waiting for the signal to arrive on
+// sigChan keeps it from arriving once sigChan is unregistered.
+func (c *Config) forwardStopSignal(received os.Signal, sigChan <-chan os.Signal) {
+	sig, ok := stopSignals[c.StopSignal]
+	if !ok || sig == received {
+		return
+	}
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(sig)
+	}
+	if err != nil {
+		logf("Unable to send %s: %v", c.StopSignal, err)
+		return
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case got := <-sigChan:
+			if got == sig {
+				return
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// conditionsMet reports whether every ConditionPathExists entry holds,
+// logging the first one that doesn't.
+func (c *Config) conditionsMet() bool {
+	for _, path := range c.ConditionPathExists {
+		want := !strings.HasPrefix(path, "!")
+		path = strings.TrimPrefix(path, "!")
+		_, err := os.Stat(path)
+		if exists := err == nil; exists != want {
+			logf("Not starting %s: condition on %s not met", c.Name, path)
+			return false
+		}
+	}
+	return true
+}
+
+// drain calls c.Drain, or c.Undrain if drain is false, if it is set.
+func (c *Config) drain(drain bool) {
+	f, name := c.Drain, "Drain"
+	if !drain {
+		f, name = c.Undrain, "Undrain"
+	}
+	if f == nil {
+		return
+	}
+	if err := f(); err != nil {
+		logf("%s failed: %v", name, err)
+	}
+}
+
+// runUntilSignal calls c.Start, blocks until the process is interrupted,
+// ctx is cancelled or the health check fails and then calls c.Stop, if set.
+// Meanwhile it calls c.Drain and c.Undrain on drainSignal and undrainSignal.
+// It returns immediately if c.ConditionPathExists isn't met.
+func runUntilSignal(ctx context.Context, c *Config) error {
+	var sigChan = make(chan os.Signal, 3)
+
+	// Listen before starting so an interrupt sent during Start isn't lost.
+	// The service manager may stop the program with StopSignal, which
+	// would otherwise kill it without calling Stop.
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	if sig, ok := stopSignals[c.StopSignal]; ok {
+		signals = append(signals, sig)
+	}
+	signal.Notify(sigChan, signals...)
+	defer signal.Stop(sigChan)
+	drainChan := make(chan os.Signal, 1)
+	if drainSignal != nil && (c.Drain != nil || c.Undrain != nil) {
+		signal.Notify(drainChan, drainSignal, undrainSignal)
+		defer signal.Stop(drainChan)
+	}
+
+	if !c.conditionsMet() {
+		return nil
+	}
+	err := c.Start()
+	if err != nil {
+		return err
+	}
+
+	unhealthy, stopHealthcheck := startHealthcheck(c, feedWatchdog)
+loop:
+	for {
+		select {
+		case sig := <-sigChan:
+			c.forwardStopSignal(sig, sigChan)
+			break loop
+		case <-ctx.Done():
+			break loop
+		case err = <-unhealthy:
+			break loop
+		case sig := <-drainChan:
+			c.drain(sig == drainSignal)
+		}
+	}
+	stopHealthcheck()
+
+	if c.Stop == nil {
+		return err
+	}
+
+	if stopErr := c.Stop(); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+var (
+	loggerMu sync.Mutex
+	logger   *log.Logger
+)
+
+// SetLogger routes the package's internal diagnostics to l instead of the
+// log package's standard logger. Pass a logger writing to ioutil.Discard to
+// silence them, or nil to restore the default.
+func SetLogger(l *log.Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+// logf writes an internal diagnostic to the logger set with SetLogger.
+func logf(format string, v ...interface{}) {
+	loggerMu.Lock()
+	l := logger
+	loggerMu.Unlock()
+	if l == nil {
+		log.Output(2, fmt.Sprintf(format, v...))
+		return
+	}
+	l.Output(2, fmt.Sprintf(format, v...))
+}
+
 // Platform returns a description of the OS and service platform.
 func Platform() string {
 	return system.String()
@@ -6,18 +6,24 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/syslog"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"text/template"
 	"time"
-
-	"github.com/kardianos/osext"
 )
 
 const maxPathSize = 32 * 1024
@@ -37,18 +43,33 @@ func isInteractive() (bool, error) {
 	return os.Getppid() != 1, nil
 }
 
+func managerName() string {
+	return managerLaunchd
+}
+
 func newService(c Config) (*darwinLaunchdService, error) {
+	if c.UserSession {
+		return nil, ErrNotSupported
+	}
 	s := &darwinLaunchdService{
 		Config:          c,
 		serviceFilePath: filepath.Join("/Library/LaunchDaemons/", c.Name+".plist"),
 	}
-	if s.Program == "" {
-		program, err := osext.Executable()
+	if c.Agent {
+		home, err := userHomeDir()
 		if err != nil {
-			return nil, fmt.Errorf("Unable to determin program: %v", err)
+			return nil, fmt.Errorf("Unable to determine home directory: %v", err)
 		}
-		s.Program = program
+		s.serviceFilePath = filepath.Join(home, "Library", "LaunchAgents", c.Name+".plist")
+	}
+	if c.RootDir != "" {
+		s.serviceFilePath = filepath.Join(c.RootDir, s.serviceFilePath)
+	}
+	program, err := c.program()
+	if err != nil {
+		return nil, err
 	}
+	s.Program = program
 
 	return s, nil
 }
@@ -59,6 +80,49 @@ type darwinLaunchdService struct {
 	serviceFilePath string
 }
 
+// userHomeDir is os.UserHomeDir, replaced in tests.
+var userHomeDir = os.UserHomeDir
+
+// domain returns the launchd domain the job is loaded into: the system
+// domain for daemons, or the GUI session of the current user for agents.
+func (s *darwinLaunchdService) domain() string {
+	if s.Agent {
+		return "gui/" + strconv.Itoa(geteuid())
+	}
+	return "system"
+}
+
+// target returns the launchd service target of the job in its domain.
+func (s *darwinLaunchdService) target() string {
+	return s.domain() + "/" + s.Name
+}
+
+// load loads the installed plist into the job's domain. A plist installed
+// into RootDir isn't loaded.
+func (s *darwinLaunchdService) load() error {
+	if s.RootDir != "" {
+		return nil
+	}
+	if s.Agent {
+		return s.control(toolPath("launchctl"), "bootstrap", s.domain(), s.serviceFilePath)
+	}
+	return s.control(toolPath("launchctl"), "load", s.serviceFilePath)
+}
+
+// unload unloads the installed plist from the job's domain.
+func (s *darwinLaunchdService) unload() error {
+	if s.RootDir != "" {
+		return nil
+	}
+	if s.Agent {
+		return runUserCommand(toolPath("launchctl"), "bootout", s.domain(), s.serviceFilePath)
+	}
+	if s.NoEscalate {
+		return runUserCommand(toolPath("launchctl"), "unload", s.serviceFilePath)
+	}
+	return runCommand(toolPath("launchctl"), "unload", s.serviceFilePath)
+}
+
 func (s *darwinLaunchdService) InstallOrUpdateRequired() (bool, error) {
 	tmpFile, err := s.prepareTmpFile()
 	if tmpFile != "" {
@@ -71,67 +135,236 @@ func (s *darwinLaunchdService) InstallOrUpdateRequired() (bool, error) {
 	return s.differsFromInstalled(tmpFile)
 }
 
-func (s *darwinLaunchdService) InstallOrUpdate() (bool, error) {
+// UpdateWillRestart compares the Program and ProgramArguments of the
+// installed and new plist.
+func (s *darwinLaunchdService) UpdateWillRestart() (bool, error) {
+	installed, err := s.InstalledConfig()
+	if err == ErrNotInstalled {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var b bytes.Buffer
+	err = s.WriteConfig(&b)
+	if err != nil {
+		return false, err
+	}
+	return matchesDiffer(installed, b.Bytes(), programPattern, argumentsPattern), nil
+}
+
+func (s *darwinLaunchdService) InstallOrUpdate() (InstallResult, error) {
+	result, err := s.installOrUpdate(false)
+	return result, s.noEscalateError(err)
+}
+
+func (s *darwinLaunchdService) InstallOrUpdateWithRollback(healthy func() error, timeout time.Duration) error {
+	return installWithRollback(s, fileSnapshot(s), healthy, timeout)
+}
+
+func (s *darwinLaunchdService) ForceReinstall() error {
+	_, err := s.installOrUpdate(true)
+	if err != nil {
+		return err
+	}
+	return s.Restart()
+}
+
+// installOrUpdate writes and loads the service configuration if it differs
+// from the installed one, or unconditionally if force is set. Loading the
+// plist starts the service unless RunAtLoad is off.
+func (s *darwinLaunchdService) installOrUpdate(force bool) (InstallResult, error) {
+	result := InstallResult{ConfigPath: s.serviceFilePath}
+	err := s.checkWorkingDirectory()
+	if err != nil {
+		return result, err
+	}
+
 	tmpFile, err := s.prepareTmpFile()
 	if tmpFile != "" {
 		defer os.Remove(tmpFile)
 	}
 	if err != nil {
-		return false, err
+		return result, err
 	}
 
 	installOrUpdateRequired, err := s.differsFromInstalled(tmpFile)
 	if err != nil {
-		return installOrUpdateRequired, fmt.Errorf("Unable to determine if new configuration differs from old: %v", err)
+		return result, fmt.Errorf("Unable to determine if new configuration differs from old: %v", err)
+	}
+	if !installOrUpdateRequired && !force {
+		return result, nil
+	}
+
+	// Unload the previous configuration so launchd picks up the new one
+	_, err = os.Stat(s.serviceFilePath)
+	existed := err == nil
+	if existed {
+		s.unload()
+	} else if s.Agent {
+		// ~/Library/LaunchAgents does not exist on fresh accounts.
+		err = os.MkdirAll(filepath.Dir(s.serviceFilePath), 0755)
+		if err != nil {
+			return result, fmt.Errorf("Unable to create %v: %v", filepath.Dir(s.serviceFilePath), err)
+		}
+	}
+
+	err = s.moveIntoPlace(tmpFile)
+	if err != nil {
+		return result, err
+	}
+
+	err = s.load()
+	if err != nil {
+		return result, fmt.Errorf("Unable to load service: %v", err)
+	}
+
+	result.Installed = !existed
+	result.Updated = existed
+	result.Started = s.runAtLoad()
+	return result, nil
+}
+
+// NeedsElevation reports whether installing requires root, which it does
+// for daemons but not for agents in the user's own LaunchAgents.
+func (s *darwinLaunchdService) NeedsElevation() bool {
+	return !s.Agent && geteuid() != 0
+}
+
+// moveIntoPlace moves the configuration at tmpFile to serviceFilePath and
+// makes it owned by root. Without root privileges this is done with
+// elevated commands, which prompt the user for an administrator password,
+// unless NoEscalate is set.
+func (s *darwinLaunchdService) moveIntoPlace(tmpFile string) error {
+	if s.NeedsElevation() && !s.NoEscalate {
+		err := runCommand("mv", tmpFile, s.serviceFilePath)
+		if err != nil {
+			return fmt.Errorf("Unable to move service configuration to %v: %v", s.serviceFilePath, err)
+		}
+		err = runCommand("chown", s.configOwnerSpec(), s.serviceFilePath)
+		if err != nil {
+			return fmt.Errorf("Unable to change owner of %v: %v", s.serviceFilePath, err)
+		}
+		return nil
 	}
 
 	// Move config into place
-	err = os.Rename(tmpFile, s.serviceFilePath)
+	err := moveFile(tmpFile, s.serviceFilePath, s.configFileMode(0644))
 	if err != nil {
-		return false, fmt.Errorf("Unable to move service configuration to: %v", err)
+		return fmt.Errorf("Unable to move service configuration to %v: %w", s.serviceFilePath, err)
+	}
+
+	return s.chownConfig(s.serviceFilePath)
+}
+
+// moveFile renames from to to. If they are on different filesystems, which
+// happens when the temporary file couldn't be created next to to, the data
+// is copied instead and from is removed.
+func moveFile(from, to string, perm os.FileMode) error {
+	err := rename(from, to)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(to, data, perm)
+	if err != nil {
+		return err
 	}
+	return os.Remove(from)
+}
 
-	// Change owner to root
-	err = os.Chown(s.serviceFilePath, 0, 0)
+// configOwnerSpec returns the owner and group of the plist for the chown
+// command, root:wheel by default.
+func (s *darwinLaunchdService) configOwnerSpec() string {
+	owner, group := s.ConfigOwner, s.ConfigGroup
+	if owner == "" {
+		owner = "root"
+	}
+	if group == "" {
+		group = "wheel"
+	}
+	return owner + ":" + group
+}
+
+// chownConfig gives the plist at path the configured owner and group,
+// root:wheel by default for daemons. Agents keep the installing user as
+// owner.
+func (s *darwinLaunchdService) chownConfig(path string) error {
+	uid, gid, err := s.configFileOwner()
 	if err != nil {
-		return false, fmt.Errorf("Unable to change owner to root: %v", err)
+		return err
 	}
+	if s.Agent && uid == -1 && gid == -1 {
+		// Agents belong to the user installing them.
+		return nil
+	}
+	if uid == -1 {
+		uid = 0
+	}
+	if gid == -1 {
+		gid = 0
+	}
+	err = chown(path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("Unable to change owner of %v: %v", path, err)
+	}
+	return nil
+}
 
-	err = commandAsRoot("launchctl", "load", s.serviceFilePath).Run()
+// EffectiveConfig also resolves RunAtLoad.
+func (s *darwinLaunchdService) EffectiveConfig() Config {
+	c := s.Config.Clone()
+	runAtLoad := c.runAtLoad()
+	c.RunAtLoad = &runAtLoad
+	return c
+}
+
+// WriteConfig writes the plist InstallOrUpdate would install to w.
+func (s *darwinLaunchdService) WriteConfig(w io.Writer) error {
+	err := launchdTemplate.Execute(w, s)
 	if err != nil {
-		return false, fmt.Errorf("Unable to load service: %v", err)
+		return fmt.Errorf("Unable to process service configuration template: %v", err)
 	}
+	return nil
+}
 
-	return true, nil
+// InstalledConfig reads the installed plist.
+func (s *darwinLaunchdService) InstalledConfig() ([]byte, error) {
+	b, err := ioutil.ReadFile(s.serviceFilePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotInstalled
+	}
+	return b, err
 }
 
+// prepareTmpFile writes the plist to a temporary file. It is created next
+// to serviceFilePath where possible, so moving it into place is an atomic
+// rename. Without write access to that directory, as when elevated commands
+// do the move, it is created in the system temporary directory instead.
 func (s *darwinLaunchdService) prepareTmpFile() (string, error) {
-	tmpFile, err := ioutil.TempFile("", "service.plist")
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.serviceFilePath), "."+s.Name)
+	if err != nil {
+		tmpFile, err = ioutil.TempFile("", "service.plist")
+	}
 	if err != nil {
 		return "", fmt.Errorf("Unable to create temporary service configuration: %v", err)
 	}
 	defer tmpFile.Close()
 
-	functions := template.FuncMap{
-		"bool": func(v bool) string {
-			if v {
-				return "true"
-			}
-			return "false"
-		},
-	}
-	t := template.Must(template.New("launchdConfig").Funcs(functions).Parse(launchdConfig))
-	err = t.Execute(tmpFile, s)
+	err = s.WriteConfig(tmpFile)
 	if err != nil {
-		return "", fmt.Errorf("Unable to process service configuration template: %v", err)
+		return tmpFile.Name(), err
 	}
-	err = tmpFile.Chmod(0644)
+	err = tmpFile.Chmod(s.configFileMode(0644))
 	if err != nil {
-		return "", fmt.Errorf("Unable to chmod temp file: %v", err)
+		return tmpFile.Name(), fmt.Errorf("Unable to chmod temp file: %v", err)
 	}
 	err = tmpFile.Close()
 	if err != nil {
-		return "", fmt.Errorf("Unable to close temp file: %v", err)
+		return tmpFile.Name(), fmt.Errorf("Unable to close temp file: %v", err)
 	}
 
 	return tmpFile.Name(), nil
@@ -151,66 +384,870 @@ func (s *darwinLaunchdService) differsFromInstalled(tmpFile string) (bool, error
 			return false, fmt.Errorf("Unable to read updated launchd configuration at %v for comparing: %v", tmpFile, err)
 		}
 
-		if bytes.Compare(old, updated) == 0 {
+		if plistEqual(old, updated) {
 			return false, nil
 		}
 
-		log.Printf("Old and new configurations at %v and %v differ", s.serviceFilePath, tmpFile)
-		time.Sleep(5 * time.Hour)
+		logf("Old and new configurations at %v and %v differ", s.serviceFilePath, tmpFile)
 	} else if !os.IsNotExist(err) {
 		return false, fmt.Errorf("Unable to stat existing launchd configuration at %v: %v", s.serviceFilePath, err)
 	} else {
-		log.Println("No old configuration found")
+		logf("No old configuration found")
 	}
 
 	return true, nil
 }
 
+// plistEqual reports whether two plists are the same apart from formatting:
+// whitespace between elements, attribute order, comments and the XML
+// declaration. Plists that can't be parsed are compared byte for byte.
+func plistEqual(a, b []byte) bool {
+	ca, errA := canonicalPlist(a)
+	cb, errB := canonicalPlist(b)
+	if errA != nil || errB != nil {
+		return bytes.Equal(a, b)
+	}
+	return ca == cb
+}
+
+// canonicalPlist returns the elements and text of a plist in a form that
+// ignores formatting. Text is kept as is inside value elements such as
+// <string>, where whitespace is significant.
+func canonicalPlist(data []byte) (string, error) {
+	var out strings.Builder
+	var open []string
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			attrs := make([]string, len(t.Attr))
+			for i, a := range t.Attr {
+				attrs[i] = a.Name.Local + "=" + strconv.Quote(a.Value)
+			}
+			sort.Strings(attrs)
+			fmt.Fprintf(&out, "<%s %s>", t.Name.Local, strings.Join(attrs, " "))
+			open = append(open, t.Name.Local)
+		case xml.EndElement:
+			fmt.Fprintf(&out, "</%s>", t.Name.Local)
+			open = open[:len(open)-1]
+		case xml.CharData:
+			inValue := len(open) > 0 && plistValueElements[open[len(open)-1]]
+			if inValue || len(bytes.TrimSpace(t)) > 0 {
+				out.WriteString(strconv.Quote(string(t)))
+			}
+		}
+	}
+}
+
+// plistValueElements are the plist elements whose text is their value.
+var plistValueElements = map[string]bool{
+	"key":     true,
+	"string":  true,
+	"integer": true,
+	"real":    true,
+	"date":    true,
+	"data":    true,
+}
+
+func (s *darwinLaunchdService) EditConfig(edit func(current []byte) ([]byte, error)) error {
+	current, err := ioutil.ReadFile(s.serviceFilePath)
+	if err != nil {
+		return fmt.Errorf("Unable to read launchd configuration at %v: %v", s.serviceFilePath, err)
+	}
+	updated, err := edit(current)
+	if err != nil {
+		return err
+	}
+
+	s.unload()
+
+	err = writeFileAtomic(s.serviceFilePath, updated, s.configFileMode(0644))
+	if err != nil {
+		return err
+	}
+	err = s.chownConfig(s.serviceFilePath)
+	if err != nil {
+		return err
+	}
+
+	err = s.load()
+	if err != nil {
+		return fmt.Errorf("Unable to load service: %v", err)
+	}
+	return nil
+}
+
+var programPattern = regexp.MustCompile(`<key>Program</key><string>([^<]*)</string>`)
+
+// archPath is the tool the plist runs Program through when Architecture is
+// set.
+const archPath = "/usr/bin/arch"
+
+// launchProgram returns the Program of the plist for c.
+func launchProgram(c Config) string {
+	if c.Architecture != "" {
+		return archPath
+	}
+	return c.Program
+}
+
+// launchArguments returns the ProgramArguments of the plist for c when it
+// runs program with args. With Architecture set they are the full command
+// line of arch, which runs program with args as that architecture.
+func launchArguments(c Config, program string, args []string) []string {
+	if c.Architecture == "" {
+		return args
+	}
+	return append([]string{archPath, "-arch", c.Architecture, program}, args...)
+}
+
+// UpdateProgram points the installed plist at a new program, leaving the
+// rest of it, including manual edits, as it is.
+func (s *darwinLaunchdService) UpdateProgram(newPath string) error {
+	err := checkExecutable(newPath)
+	if err != nil {
+		return err
+	}
+	if s.Architecture != "" {
+		// The program is an argument of arch.
+		err = s.replaceArguments(launchArguments(s.Config, newPath, s.Arguments))
+		if err == nil {
+			s.Program = newPath
+		}
+		return err
+	}
+	err = s.EditConfig(func(current []byte) ([]byte, error) {
+		loc := programPattern.FindIndex(current)
+		if loc == nil {
+			return nil, fmt.Errorf("Unable to find the program in %v", s.serviceFilePath)
+		}
+		program := "<key>Program</key><string>" + template.HTMLEscapeString(newPath) + "</string>"
+		return append(append(current[:loc[0]:loc[0]], program...), current[loc[1]:]...), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Program = newPath
+	return nil
+}
+
+func (s *darwinLaunchdService) Validate() error {
+	errs := s.preflight()
+	installed, err := s.installedProgram()
+	if err == nil {
+		err = checkOwner(s.Name, installed, s.Program)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// installedProgram returns the program the installed plist runs, or "" if
+// the service isn't installed or the program can't be found.
+func (s *darwinLaunchdService) installedProgram() (string, error) {
+	current, err := ioutil.ReadFile(s.serviceFilePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read configuration at %v: %v", s.serviceFilePath, err)
+	}
+	m := programPattern.FindSubmatch(current)
+	if m == nil {
+		return "", nil
+	}
+	program := html.UnescapeString(string(m[1]))
+	if program == archPath {
+		// The program is the fourth of the arguments of arch.
+		args := stringPattern.FindAllSubmatch(argumentsPattern.Find(current), -1)
+		if len(args) >= 4 && string(args[1][1]) == "-arch" {
+			program = html.UnescapeString(string(args[3][1]))
+		}
+	}
+	return program, nil
+}
+
+var stringPattern = regexp.MustCompile(`<string>([^<]*)</string>`)
+
+var argumentsPattern = regexp.MustCompile(`(?s)<key>ProgramArguments</key>\s*<array>.*?</array>`)
+
+// UpdateArguments replaces the ProgramArguments of the installed plist,
+// leaving the rest of it, including manual edits, as it is.
+func (s *darwinLaunchdService) UpdateArguments(args []string) error {
+	args = s.expandArguments(args)
+	err := s.replaceArguments(launchArguments(s.Config, s.Program, args))
+	if err != nil {
+		return err
+	}
+	s.Arguments = append([]string(nil), args...)
+	return nil
+}
+
+// replaceArguments replaces the ProgramArguments of the installed plist
+// with args.
+func (s *darwinLaunchdService) replaceArguments(args []string) error {
+	return s.EditConfig(func(current []byte) ([]byte, error) {
+		loc := argumentsPattern.FindIndex(current)
+		if loc == nil {
+			return nil, fmt.Errorf("Unable to find the arguments in %v", s.serviceFilePath)
+		}
+		var b bytes.Buffer
+		// Written as launchdConfig renders them, so an updated plist
+		// matches a freshly rendered one.
+		b.WriteString("<key>ProgramArguments</key>\n<array>")
+		for _, arg := range args {
+			b.WriteString("\n\t<string>" + template.HTMLEscapeString(arg) + "</string>")
+		}
+		b.WriteString("\n</array>")
+		return append(append(current[:loc[0]:loc[0]], b.Bytes()...), current[loc[1]:]...), nil
+	})
+}
+
+var versionPattern = regexp.MustCompile(`<key>X-Version</key>\s*<string>([^<]*)</string>`)
+
+func (s *darwinLaunchdService) InstalledVersion() (string, error) {
+	current, err := ioutil.ReadFile(s.serviceFilePath)
+	if os.IsNotExist(err) {
+		return "", ErrNotInstalled
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read configuration at %v: %v", s.serviceFilePath, err)
+	}
+	m := versionPattern.FindSubmatch(current)
+	if m == nil {
+		return "", nil
+	}
+	return html.UnescapeString(string(m[1])), nil
+}
+
+// Uninstall unloads the job and removes its plist. Like installing, this
+// is done with elevated commands without root privileges, unless
+// NoEscalate is set.
 func (s *darwinLaunchdService) Uninstall() error {
-	err := exec.Command("sudo", "launchctl", "unload", s.serviceFilePath).Run()
+	err := s.unload()
 	if err != nil {
 		return fmt.Errorf("Unable to unload service prior to uninstalling: %v", err)
 	}
 
-	return os.Remove(s.serviceFilePath)
+	if s.NeedsElevation() && !s.NoEscalate {
+		err = runCommand("rm", s.serviceFilePath)
+		if err != nil {
+			return fmt.Errorf("Unable to remove %v: %v", s.serviceFilePath, err)
+		}
+		return nil
+	}
+	return s.noEscalateError(os.Remove(s.serviceFilePath))
+}
+
+func (s *darwinLaunchdService) UninstallIfPresent() error {
+	_, err := os.Stat(s.serviceFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to stat existing launchd configuration at %v: %v", s.serviceFilePath, err)
+	}
+	return s.Uninstall()
+}
+
+// Enable clears launchd's disabled override for the job, so it is loaded
+// at boot. It does nothing if the job is enabled already. The overrides
+// can't be set for a RootDir, where ErrNotSupported is returned.
+func (s *darwinLaunchdService) Enable() error {
+	if s.RootDir != "" {
+		return ErrNotSupported
+	}
+	if s.inBootState(true) {
+		return nil
+	}
+	return s.control(toolPath("launchctl"), "enable", s.target())
+}
+
+// Disable sets launchd's disabled override for the job, so it isn't
+// loaded at boot. The running job is left alone. It does nothing if the
+// job is disabled already.
+func (s *darwinLaunchdService) Disable() error {
+	if s.RootDir != "" {
+		return ErrNotSupported
+	}
+	if s.inBootState(false) {
+		return nil
+	}
+	return s.control(toolPath("launchctl"), "disable", s.target())
+}
+
+// inBootState reports whether the job is installed and IsEnabled reports
+// enabled. When that can't be told it returns false, so Enable and Disable
+// run their command regardless.
+func (s *darwinLaunchdService) inBootState(enabled bool) bool {
+	if _, err := os.Stat(s.serviceFilePath); err != nil {
+		return false
+	}
+	current, err := s.IsEnabled()
+	return err == nil && current == enabled
+}
+
+// IsEnabled reports whether launchd loads the installed job at boot. The
+// override set by Enable and Disable takes precedence over the Disabled key
+// of the plist.
+func (s *darwinLaunchdService) IsEnabled() (bool, error) {
+	plist, err := ioutil.ReadFile(s.serviceFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Unable to read configuration at %v: %v", s.serviceFilePath, err)
+	}
+	if s.RootDir != "" {
+		// The overrides of the running system don't apply to RootDir.
+		return !plistDisabledPattern.Match(plist), nil
+	}
+	out, err := s.output(toolPath("launchctl"), "print-disabled", s.domain())
+	if err != nil {
+		return false, fmt.Errorf("Unable to query disabled services: %v", err)
+	}
+	if disabled, ok := parseLaunchdDisabled(out, s.Name); ok {
+		return !disabled, nil
+	}
+	return !plistDisabledPattern.Match(plist), nil
+}
+
+var plistDisabledPattern = regexp.MustCompile(`<key>Disabled</key>\s*<true/>`)
+
+// parseLaunchdDisabled finds the override for label in the output of
+// launchctl print-disabled. Older versions of launchctl print true for a
+// disabled job instead of disabled. ok is false if there is no override.
+func parseLaunchdDisabled(out []byte, label string) (disabled, ok bool) {
+	prefix := strconv.Quote(label) + " =>"
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		switch strings.TrimSpace(strings.TrimPrefix(line, prefix)) {
+		case "disabled", "true":
+			return true, true
+		case "enabled", "false":
+			return false, true
+		}
+	}
+	return false, false
 }
 
 func (s *darwinLaunchdService) Start() error {
-	return commandAsRoot("launchctl", "start", s.Name).Run()
+	return s.notInstalled(s.control(toolPath("launchctl"), "start", s.Name))
 }
 
 func (s *darwinLaunchdService) Stop() error {
-	return commandAsRoot("launchctl", "stop", s.Name).Run()
+	return s.notInstalled(s.control(toolPath("launchctl"), "stop", s.Name))
 }
 
-func (s *darwinLaunchdService) Restart() error {
-	err := s.Stop()
+// notInstalled returns ErrNotInstalled in place of the error of a failed
+// launchctl command if the plist isn't installed, which is then why it
+// failed.
+func (s *darwinLaunchdService) notInstalled(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, statErr := os.Stat(s.serviceFilePath); os.IsNotExist(statErr) {
+		return ErrNotInstalled
+	}
+	return err
+}
+
+// drainSignal and undrainSignal ask a running service to drain and undrain.
+var drainSignal, undrainSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
+
+// Drain sends drainSignal to the running job.
+func (s *darwinLaunchdService) Drain() error {
+	return s.control(toolPath("launchctl"), "kill", "SIGUSR1", s.target())
+}
+
+// Undrain sends undrainSignal to the running job.
+func (s *darwinLaunchdService) Undrain() error {
+	return s.control(toolPath("launchctl"), "kill", "SIGUSR2", s.target())
+}
+
+// Kill sends SIGKILL to the running job.
+func (s *darwinLaunchdService) Kill() error {
+	def, err := s.Export()
 	if err != nil {
 		return err
 	}
-	time.Sleep(50 * time.Millisecond)
-	return s.Start()
+	if !def.Installed {
+		return ErrNotInstalled
+	}
+	if def.Status != StatusRunning {
+		return ErrNotRunning
+	}
+	return s.control(toolPath("launchctl"), "kill", "SIGKILL", s.target())
+}
+
+func (s *darwinLaunchdService) ResetFailed() error {
+	return ErrNotSupported
+}
+
+// Restart kills the running job and starts it again with launchctl
+// kickstart -k, which waits for the job to exit first. A stopped job is
+// just started.
+func (s *darwinLaunchdService) Restart() error {
+	return s.notInstalled(s.control(toolPath("launchctl"), "kickstart", "-k", s.target()))
+}
+
+func (s *darwinLaunchdService) LastExitStatus() (int, error) {
+	out, err := s.output(toolPath("launchctl"), "list", s.Name)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to query service: %v", err)
+	}
+	info, err := parseLaunchctlList(out)
+	if err != nil {
+		return 0, err
+	}
+	return info.exitStatus()
+}
+
+// Export reports the service as enabled whenever its plist is installed,
+// since the plist is written with Disabled set to false.
+func (s *darwinLaunchdService) Export() (ServiceDefinition, error) {
+	def := ServiceDefinition{Config: s.Config.Clone()}
+	if _, err := os.Stat(s.serviceFilePath); err != nil {
+		if os.IsNotExist(err) {
+			return def, nil
+		}
+		return def, fmt.Errorf("Unable to stat %s: %v", s.serviceFilePath, err)
+	}
+	def.Installed = true
+	enabled, err := s.IsEnabled()
+	if err != nil {
+		return def, err
+	}
+	def.Enabled = enabled
+	out, err := s.output(toolPath("launchctl"), "list", s.Name)
+	if err != nil {
+		// launchctl list fails for jobs that aren't loaded.
+		def.Status = StatusStopped
+		return def, nil
+	}
+	info, err := parseLaunchctlList(out)
+	if err != nil {
+		return def, err
+	}
+	def.Status, def.PID = info.state()
+	return def, nil
+}
+
+// ResourceUsage measures the process launchd reports for the job with ps.
+func (s *darwinLaunchdService) ResourceUsage() (ResourceUsage, error) {
+	def, err := s.Export()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	if !def.Installed {
+		return ResourceUsage{}, ErrNotInstalled
+	}
+	if def.Status != StatusRunning || def.PID == 0 {
+		return ResourceUsage{}, ErrNotRunning
+	}
+	out, err := userCommandOutput("ps", "-o", "rss=,time=", "-p", strconv.Itoa(def.PID))
+	if err != nil {
+		// ps fails when the process has just exited.
+		return ResourceUsage{}, ErrNotRunning
+	}
+	usage, err := parsePSUsage(out)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	usage.PID = def.PID
+	return usage, nil
+}
+
+// StartAndCapture reads the output from StdoutPath. Without it, launchd
+// discards the output.
+func (s *darwinLaunchdService) StartAndCapture(ctx context.Context, d time.Duration) (string, error) {
+	if s.StdoutPath == "" {
+		return "", ErrNotSupported
+	}
+	read, err := fileOutput(s.StdoutPath)
+	if err != nil {
+		return "", err
+	}
+	return captureStart(ctx, s, d, read)
+}
+
+// Processes lists the process group of the job. launchd starts each job as
+// the leader of its own process group, so the group is the job and the
+// workers it forked.
+func (s *darwinLaunchdService) Processes() ([]int, error) {
+	def, err := s.Export()
+	if err != nil {
+		return nil, err
+	}
+	if !def.Installed {
+		return nil, ErrNotInstalled
+	}
+	if def.Status != StatusRunning || def.PID == 0 {
+		return nil, ErrNotRunning
+	}
+	out, err := userCommandOutput("ps", "-A", "-o", "pid=,pgid=")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list processes: %v", err)
+	}
+	return parseProcessGroup(out, def.PID)
+}
+
+// parseProcessGroup returns the PIDs in the output of ps -o pid=,pgid=
+// whose process group is pgid, in ascending order.
+func parseProcessGroup(out []byte, pgid int) ([]int, error) {
+	var pids []int
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Unable to parse ps output line %q", line)
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse PID %q: %v", fields[0], err)
+		}
+		group, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse process group %q: %v", fields[1], err)
+		}
+		if group == pgid {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// parsePSUsage parses the output of ps -o rss=,time=: the resident memory
+// in kilobytes and the CPU time as [hh:]mm:ss.cc.
+func parsePSUsage(out []byte) (ResourceUsage, error) {
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return ResourceUsage{}, fmt.Errorf("Unable to parse ps output %q", out)
+	}
+	kb, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return ResourceUsage{}, fmt.Errorf("Unable to parse resident memory: %v", err)
+	}
+	var cpu time.Duration
+	for _, part := range strings.Split(fields[1], ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return ResourceUsage{}, fmt.Errorf("Unable to parse CPU time %q: %v", fields[1], err)
+		}
+		cpu = cpu*60 + time.Duration(n*float64(time.Second))
+	}
+	return ResourceUsage{RSS: kb * 1024, CPUTime: cpu}, nil
+}
+
+// CommandLine returns Program and ProgramArguments, each shell-quoted if
+// needed, as launchd passes them to the program verbatim. With
+// Architecture set it is the command line of arch.
+func (s *darwinLaunchdService) CommandLine() (string, error) {
+	args := append([]string{s.Program}, s.Arguments...)
+	if s.Architecture != "" {
+		args = launchArguments(s.Config, s.Program, s.Arguments)
+	}
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = shellQuote(arg)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// shellQuote single-quotes s for a POSIX shell unless it only contains
+// characters the shell takes literally.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// PlatformHandle returns the path of the plist.
+func (s *darwinLaunchdService) PlatformHandle() (interface{}, error) {
+	return s.serviceFilePath, nil
+}
+
+// RotateLogs rotates the file Run writes StdoutPath to when LogMaxSize is
+// set. Otherwise launchd writes it and ErrNotSupported is returned.
+func (s *darwinLaunchdService) RotateLogs() error {
+	return rotateActiveLog()
+}
+
+// WatchStatus polls the status Export reports.
+func (s *darwinLaunchdService) WatchStatus(ctx context.Context) (<-chan Status, error) {
+	return watchStatus(ctx, s.Export)
+}
+
+// Wait polls launchctl list until the job has no PID.
+func (s *darwinLaunchdService) Wait(ctx context.Context) (int, error) {
+	return waitExit(ctx, s.Export, s.LastExitStatus)
+}
+
+// launchInfo is what launchctl list <label> reports about a loaded job.
+type launchInfo struct {
+	label string
+	// pid is the process of the job, or 0 when it isn't running.
+	pid int
+	// lastExitStatus is the raw wait status of the job's last exit, valid
+	// when exited is set. launchd omits it until the job first exits.
+	lastExitStatus int
+	exited         bool
+}
+
+// parseLaunchctlList parses the output of launchctl list <label>, a dict of
+// "Key" = value; lines. Nested values, such as ProgramArguments, are
+// skipped.
+func parseLaunchctlList(out []byte) (launchInfo, error) {
+	var info launchInfo
+	text := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "};") {
+		return info, fmt.Errorf("Unable to parse launchctl list output %q", out)
+	}
+	depth := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasSuffix(line, "{") || strings.HasSuffix(line, "("):
+			depth++
+			continue
+		case line == "};" || line == ");":
+			depth--
+			continue
+		case depth != 1:
+			continue
+		}
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok || !strings.HasSuffix(value, ";") {
+			return info, fmt.Errorf("Unable to parse launchctl list line %q", line)
+		}
+		key = strings.Trim(key, `"`)
+		value = strings.TrimSuffix(value, ";")
+		var err error
+		switch key {
+		case "Label":
+			info.label = strings.Trim(value, `"`)
+		case "PID":
+			info.pid, err = strconv.Atoi(value)
+		case "LastExitStatus":
+			info.lastExitStatus, err = strconv.Atoi(value)
+			info.exited = true
+		}
+		if err != nil {
+			return info, fmt.Errorf("Unable to parse %s %q: %v", key, value, err)
+		}
+	}
+	return info, nil
+}
+
+// state returns the status and PID of the job. The PID is only reported
+// while the job is running.
+func (info launchInfo) state() (Status, int) {
+	if info.pid == 0 {
+		return StatusStopped, 0
+	}
+	return StatusRunning, info.pid
+}
+
+// exitStatus converts the wait status of the job's last exit to an exit
+// code, with 128 plus the signal for a job that was killed.
+func (info launchInfo) exitStatus() (int, error) {
+	if !info.exited {
+		return 0, ErrNoExitStatus
+	}
+	ws := syscall.WaitStatus(info.lastExitStatus)
+	if ws.Signaled() {
+		return 128 + int(ws.Signal()), nil
+	}
+	return ws.ExitStatus(), nil
+}
+
+func (s *darwinLaunchdService) Capabilities() Capability {
+	return CapResourceLimits
 }
 
 func (s *darwinLaunchdService) Run() error {
-	var err error
+	return s.RunContext(context.Background())
+}
+
+func (s *darwinLaunchdService) RunContext(ctx context.Context) error {
+	interactive, err := isInteractive()
+	if err != nil {
+		return err
+	}
+	if interactive && !s.AllowInteractiveRun {
+		return ErrNotRunningAsService
+	}
+	err = s.checkRunsHere()
+	if err != nil {
+		return err
+	}
 
-	err = s.Config.Start()
+	err = createServiceDirs(&s.Config)
+	if err != nil {
+		return err
+	}
+	// launchd appends output to StdoutPath itself unless it needs rotating.
+	if s.StdoutPath != "" && s.LogMaxSize > 0 {
+		restore, err := redirectOutput(&s.Config)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	err = loadEnvironmentFiles(s.EnvironmentFiles)
+	if err != nil {
+		return err
+	}
+	if s.PIDFile != "" {
+		remove, err := writePIDFile(s.PIDFile)
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+	err = recordStart(&s.Config)
 	if err != nil {
 		return err
 	}
 
-	var sigChan = make(chan os.Signal, 3)
+	err = runUntilSignal(ctx, &s.Config)
+	if err == nil {
+		clearStarts(&s.Config)
+	}
+	return err
+}
 
-	signal.Notify(sigChan, os.Interrupt, os.Kill)
+// feedWatchdog does nothing; launchd has no watchdog.
+func feedWatchdog() {}
 
-	<-sigChan
+// geteuid returns the effective user ID of the process. It is a variable so
+// tests can pretend to run with or without root privileges.
+var geteuid = os.Geteuid
 
-	if s.Config.Stop == nil {
-		return nil
+// runCommand runs an external control command as root, prompting for
+// administrator privileges if needed. It is a variable so tests can avoid
+// touching the host's service manager.
+var runCommand = func(name string, args ...string) error {
+	if err := requireTool(name); err != nil {
+		return err
+	}
+	out, err := privilegedCommand(name, args...).CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+// retryableErrors are the messages of launchctl failures that are worth
+// retrying.
+var retryableErrors = []string{
+	"Operation already in progress",
+	"Resource busy",
+	"Resource temporarily unavailable",
+}
+
+// control runs a control command, retrying transient failures according to
+// the ControlRetry policy.
+func (s *darwinLaunchdService) control(name string, args ...string) error {
+	run := runCommand
+	if s.Agent || s.NoEscalate {
+		run = runUserCommand
+	}
+	return s.ControlRetry.retry(func() error {
+		return run(name, args...)
+	})
+}
+
+// output runs a query command as root, or for agents and with NoEscalate as
+// the current user, and returns its standard output.
+func (s *darwinLaunchdService) output(name string, args ...string) ([]byte, error) {
+	if s.Agent || s.NoEscalate {
+		return userCommandOutput(name, args...)
+	}
+	return commandOutput(name, args...)
+}
+
+// runUserCommand and userCommandOutput are like runCommand and
+// commandOutput but run the command as the current user, for agents.
+var runUserCommand = func(name string, args ...string) error {
+	if err := requireTool(name); err != nil {
+		return err
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+var userCommandOutput = func(name string, args ...string) ([]byte, error) {
+	if err := requireTool(name); err != nil {
+		return nil, err
+	}
+	return exec.Command(name, args...).Output()
+}
+
+// commandOutput runs an external command as root and returns its standard
+// output. It is a variable for the same reason as runCommand.
+var commandOutput = func(name string, args ...string) ([]byte, error) {
+	if err := requireTool(name); err != nil {
+		return nil, err
+	}
+	return commandAsRoot(name, args...).Output()
+}
+
+// privilegedCommand returns a command that runs name with root privileges.
+// When the process isn't root the command is run through osascript, which
+// shows the standard administrator authentication dialog.
+func privilegedCommand(name string, args ...string) *exec.Cmd {
+	if geteuid() == 0 {
+		return commandAsRoot(name, args...)
+	}
+	return exec.Command("osascript", "-e", elevatedScript(name, args...))
+}
+
+// elevatedScript returns an AppleScript that runs the command with
+// administrator privileges. Each word is single-quoted for the shell and
+// the whole command is then escaped as an AppleScript string.
+func elevatedScript(name string, args ...string) string {
+	words := make([]string, 0, len(args)+1)
+	for _, word := range append([]string{name}, args...) {
+		words = append(words, "'"+strings.Replace(word, "'", `'\''`, -1)+"'")
+	}
+	command := strings.Join(words, " ")
+	command = strings.Replace(command, `\`, `\\`, -1)
+	command = strings.Replace(command, `"`, `\"`, -1)
+	return `do shell script "` + command + `" with administrator privileges`
+}
+
+// openEventSink logs through syslog, which the unified log collects. It is
+// a variable so tests can substitute a fake backend.
+var openEventSink = func(name string) (eventSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open system log: %v", err)
 	}
+	return syslogSink{w}, nil
+}
+
+type syslogSink struct {
+	*syslog.Writer
+}
 
-	return s.Config.Stop()
+func (s syslogSink) info(msg string) error {
+	return s.Info(msg)
 }
 
 func commandAsRoot(name string, args ...string) *exec.Cmd {
@@ -224,31 +1261,208 @@ func commandAsRoot(name string, args ...string) *exec.Cmd {
 	return cmd
 }
 
+// launchdTemplate renders launchdConfig. Maps must be ranged over directly
+// in the template, which visits keys in sorted order, so the same Config
+// always renders to the same bytes and differsFromInstalled doesn't report
+// spurious changes.
+var launchdTemplate = template.Must(template.New("launchdConfig").Funcs(template.FuncMap{
+	"bool": func(v bool) string {
+		if v {
+			return "true"
+		}
+		return "false"
+	},
+	"runAtLoad": func(c Config) bool {
+		return c.runAtLoad()
+	},
+	"launchProgram":   launchProgram,
+	"launchArguments": launchArguments,
+	// networkState is the NetworkState condition: NetworkState if set,
+	// otherwise true for RequireNetwork.
+	"networkState": func(c Config) *bool {
+		if c.NetworkState == nil && c.RequireNetwork {
+			up := true
+			return &up
+		}
+		return c.NetworkState
+	},
+	// pathState maps each ConditionPathExists path to whether it must
+	// exist.
+	"pathState": func(c Config) map[string]bool {
+		if len(c.ConditionPathExists) == 0 {
+			return nil
+		}
+		state := make(map[string]bool)
+		for _, path := range c.ConditionPathExists {
+			state[strings.TrimPrefix(path, "!")] = !strings.HasPrefix(path, "!")
+		}
+		return state
+	},
+	// calendar expands the calendar intervals of a schedule into
+	// StartCalendarInterval dictionaries, one per weekday since launchd
+	// takes a single Weekday per dictionary.
+	"calendar": launchdCalendar,
+	"intervalSeconds": func(d time.Duration) int64 {
+		return int64(d / time.Second)
+	},
+}).Parse(launchdConfig))
+
+// launchdCalendar converts calendar intervals into StartCalendarInterval
+// dictionaries. Keys that match every value are left out.
+func launchdCalendar(calendar []CalendarInterval) []map[string]int {
+	var dicts []map[string]int
+	for _, c := range calendar {
+		dict := map[string]int{"Hour": c.Hour, "Minute": c.Minute}
+		if c.Month != 0 {
+			dict["Month"] = c.Month
+		}
+		if c.Day != 0 {
+			dict["Day"] = c.Day
+		}
+		if len(c.Weekdays) == 0 {
+			dicts = append(dicts, dict)
+			continue
+		}
+		for _, weekday := range c.Weekdays {
+			perDay := make(map[string]int, len(dict)+1)
+			for k, v := range dict {
+				perDay[k] = v
+			}
+			perDay["Weekday"] = int(weekday)
+			dicts = append(dicts, perDay)
+		}
+	}
+	return dicts
+}
+
+// runAtLoad reports whether launchd starts the daemon when loading it.
+func (c *Config) runAtLoad() bool {
+	if c.RunAtLoad != nil {
+		return *c.RunAtLoad
+	}
+	return len(c.Sockets) == 0 && !c.Schedule.scheduled()
+}
+
+// launchdConfig puts each key on its own line, with its value on the same
+// line unless it is an array or dictionary, whose entries are indented by a
+// tab. Optional keys start with {{- so that absent ones leave no blank
+// line. testdata/launchd holds the expected output.
 var launchdConfig = `<?xml version='1.0' encoding='UTF-8'?>
 <!DOCTYPE plist PUBLIC "-//Apple Computer//DTD PLIST 1.0//EN"
 "http://www.apple.com/DTDs/PropertyList-1.0.dtd" >
 <plist version='1.0'>
 <dict>
 <key>Label</key><string>{{html .Name}}</string>
-<key>Program</key><string>{{html .Program}}</string>
+{{- if .Version}}
+<key>X-Version</key><string>{{html .Version}}</string>
+{{- end}}
+<key>Program</key><string>{{html (launchProgram .Config)}}</string>
 <key>ProgramArguments</key>
-<array>{{range .Config.Arguments}}
-        <string>{{html .}}</string>
-{{end}}</array>
-{{if .WorkingDirectory}}<key>WorkingDirectory</key><string>{{html .WorkingDirectory}}</string>{{end}}
+<array>
+{{- range launchArguments .Config .Program .Arguments}}
+	<string>{{html .}}</string>
+{{- end}}
+</array>
+{{- if .WorkingDirectory}}
+<key>WorkingDirectory</key><string>{{html .WorkingDirectory}}</string>
+{{- end}}
+{{- if and .StdoutPath (not .LogMaxSize)}}
+<key>StandardOutPath</key><string>{{html .StdoutPath}}</string>
+<key>StandardErrorPath</key><string>{{html .StdoutPath}}</string>
+{{- end}}
+{{- if .StdinPath}}
+<key>StandardInPath</key><string>{{html .StdinPath}}</string>
+{{- end}}
+{{- if .EnvVars}}
+<key>EnvironmentVariables</key>
+<dict>
+{{- range $k, $v := .EnvVars}}
+	<key>{{html $k}}</key><string>{{html $v}}</string>
+{{- end}}
+</dict>
+{{- end}}
+{{- if .MachServices}}
+<key>MachServices</key>
+<dict>
+{{- range .MachServices}}
+	<key>{{html .}}</key><true/>
+{{- end}}
+</dict>
+{{- end}}
+{{- if .Sockets}}
+<key>Sockets</key>
+<dict>
+{{- range .Sockets}}
+	<key>{{html .Name}}</key>
+	<dict>
+	{{- if .PathName}}
+		<key>SockPathName</key><string>{{html .PathName}}</string>
+	{{- end}}
+	{{- if .NodeName}}
+		<key>SockNodeName</key><string>{{html .NodeName}}</string>
+	{{- end}}
+	{{- if .ServiceName}}
+		<key>SockServiceName</key><string>{{html .ServiceName}}</string>
+	{{- end}}
+	{{- if .Type}}
+		<key>SockType</key><string>{{html .Type}}</string>
+	{{- end}}
+	{{- if .Family}}
+		<key>SockFamily</key><string>{{html .Family}}</string>
+	{{- end}}
+	</dict>
+{{- end}}
+</dict>
+{{- end}}
+{{- if not .Oneshot}}
 <key>KeepAlive</key>
 <dict>
-	<key>SuccessfulExit</key>
-	<false/>
+	<key>SuccessfulExit</key><false/>
+	{{- with networkState .Config}}
+	<key>NetworkState</key><{{bool .}}/>
+	{{- end}}
+	{{- with pathState .Config}}
+	<key>PathState</key>
+	<dict>
+	{{- range $path, $exists := .}}
+		<key>{{html $path}}</key><{{bool $exists}}/>
+	{{- end}}
+	</dict>
+	{{- end}}
+	{{- with .OtherJobEnabled}}
+	<key>OtherJobEnabled</key>
+	<dict>
+	{{- range $label, $enabled := .}}
+		<key>{{html $label}}</key><{{bool $enabled}}/>
+	{{- end}}
+	</dict>
+	{{- end}}
 </dict>
-<key>RunAtLoad</key><true/>
+{{- end}}
+{{- with .Schedule.Interval}}
+<key>StartInterval</key><integer>{{intervalSeconds .}}</integer>
+{{- end}}
+{{- with .Schedule.Calendar}}
+<key>StartCalendarInterval</key>
+<array>
+{{- range calendar .}}
+	<dict>
+	{{- range $k, $v := .}}
+		<key>{{$k}}</key><integer>{{$v}}</integer>
+	{{- end}}
+	</dict>
+{{- end}}
+</array>
+{{- end}}
+<key>RunAtLoad</key><{{runAtLoad .Config | bool}}/>
 <key>Disabled</key><false/>
-<key>UserName</key>
-<string>root</string>
-<key>GroupName</key>
-<string>wheel</string>
-<key>InitGroups</key>
-<true/>
+{{- if .Agent}}
+<key>LimitLoadToSessionType</key><string>Aqua</string>
+{{- else}}
+<key>UserName</key><string>root</string>
+<key>GroupName</key><string>wheel</string>
+<key>InitGroups</key><true/>
+{{- end}}
 </dict>
 </plist>
 `
@@ -0,0 +1,1441 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func renderLaunchd(t *testing.T, c Config) string {
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := launchdTemplate.Execute(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestLaunchdDeterministic(t *testing.T) {
+	c := Config{
+		Name:    "test",
+		Program: "/usr/bin/test",
+		EnvVars: map[string]string{"B": "2", "A": "1", "C": "3", "D": "4", "E": "5"},
+	}
+	first := renderLaunchd(t, c)
+	for i := 0; i < 100; i++ {
+		if out := renderLaunchd(t, c); out != first {
+			t.Fatalf("render %d differs:\n%s\nvs\n%s", i, out, first)
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestLaunchdGolden compares rendered plists with the files in
+// testdata/launchd, so any change to the bytes of the output, which makes
+// differsFromInstalled reinstall every service, is deliberate. Run with
+// -update to rewrite them.
+func TestLaunchdGolden(t *testing.T) {
+	up := true
+	for _, tt := range []struct {
+		name string
+		c    Config
+	}{
+		{"minimal", Config{Name: "test", Program: "/usr/bin/test"}},
+		{"full", Config{
+			Name:             "test",
+			Version:          "1.2",
+			Program:          "/usr/local/bin/test server",
+			Arguments:        []string{"-config", "/etc/test & co.conf"},
+			WorkingDirectory: "/var/lib/test",
+			StdoutPath:       "/var/log/test.log",
+			StdinPath:        "/dev/null",
+			EnvVars:          map[string]string{"HOME": "/var/lib/test", "GOMAXPROCS": "2"},
+		}},
+		{"sockets", Config{
+			Name:         "test",
+			Program:      "/usr/bin/test",
+			MachServices: []string{"com.example.test"},
+			Sockets: []LaunchdSocket{
+				{Name: "Listener", ServiceName: "8080", Type: "stream"},
+				{Name: "Control", PathName: "/var/run/test.sock"},
+			},
+		}},
+		{"scheduled", Config{
+			Name:    "test",
+			Program: "/usr/bin/test",
+			Oneshot: true,
+			Schedule: Schedule{
+				Interval: time.Hour,
+				Calendar: []CalendarInterval{{Weekdays: []time.Weekday{time.Monday, time.Friday}, Hour: 3, Minute: 30}},
+			},
+		}},
+		{"agent", Config{
+			Name:                "test",
+			Program:             "/usr/bin/test",
+			Agent:               true,
+			NetworkState:        &up,
+			ConditionPathExists: []string{"/var/lib/test", "!/etc/test/disabled"},
+			OtherJobEnabled:     map[string]bool{"com.example.db": true},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := renderLaunchd(t, tt.c)
+			path := filepath.Join("testdata", "launchd", tt.name+".plist")
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, []byte(out), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != string(want) {
+				t.Errorf("rendered plist differs from %s:\n%s", path, out)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	s := &darwinLaunchdService{}
+	if caps := s.Capabilities(); caps != CapResourceLimits {
+		t.Errorf("launchd capabilities = %b", caps)
+	}
+}
+
+func TestLaunchdMachServicesAndSockets(t *testing.T) {
+	out := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "MachServices") || strings.Contains(out, "Sockets") {
+		t.Errorf("empty MachServices/Sockets rendered:\n%s", out)
+	}
+
+	out = renderLaunchd(t, Config{
+		Name:         "test",
+		Program:      "/usr/bin/test",
+		MachServices: []string{"com.example.test"},
+		Sockets: []LaunchdSocket{
+			{Name: "Listener", ServiceName: "8080", Type: "stream"},
+			{Name: "Control", PathName: "/var/run/test.sock"},
+		},
+	})
+	for _, want := range []string{
+		"<key>MachServices</key>\n<dict>\n\t<key>com.example.test</key><true/>\n</dict>",
+		"<key>Listener</key>\n\t<dict>\n\t\t<key>SockServiceName</key><string>8080</string>\n\t\t<key>SockType</key><string>stream</string>\n\t</dict>",
+		"<key>Control</key>\n\t<dict>\n\t\t<key>SockPathName</key><string>/var/run/test.sock</string>\n\t</dict>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestParseLaunchdExitStatus(t *testing.T) {
+	const list = `{
+	"LimitLoadToSessionType" = "System";
+	"Label" = "test";
+	"OnDemand" = false;
+	"LastExitStatus" = %s;
+	"PID" = 412;
+	"Program" = "/usr/bin/test";
+};
+`
+	for _, tt := range []struct {
+		out    string
+		status int
+		err    error
+	}{
+		{strings.Replace(list, "\t\"LastExitStatus\" = %s;\n", "", 1), 0, ErrNoExitStatus},
+		{strings.Replace(list, "%s", "0", 1), 0, nil},
+		{strings.Replace(list, "%s", "256", 1), 1, nil},
+		{strings.Replace(list, "%s", "15", 1), 143, nil},
+	} {
+		info, err := parseLaunchctlList([]byte(tt.out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := info.exitStatus()
+		if status != tt.status || err != tt.err {
+			t.Errorf("%q: got %v, %v; want %v, %v", tt.out, status, err, tt.status, tt.err)
+		}
+	}
+}
+
+func TestDiagnosticsUseSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(log.New(&buf, "", 0))
+	defer SetLogger(nil)
+
+	s := &darwinLaunchdService{serviceFilePath: filepath.Join(t.TempDir(), "test.plist")}
+	if _, err := s.differsFromInstalled(""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "No old configuration found") {
+		t.Errorf("diagnostic not routed to the custom logger: %q", buf.String())
+	}
+}
+
+func TestEditConfig(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing the plist requires root")
+	}
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if err := ioutil.WriteFile(s.serviceFilePath, []byte(renderLaunchd(t, s.Config)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.EditConfig(func(current []byte) ([]byte, error) {
+		return bytes.Replace(current, []byte("<key>Label</key>"), []byte("<key>LABEL</key>"), 1), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited, err := ioutil.ReadFile(s.serviceFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(edited, []byte("<key>LABEL</key><string>test</string>")) {
+		t.Errorf("edit not applied:\n%s", edited)
+	}
+	if len(commands) != 2 || !strings.HasPrefix(commands[1], "launchctl load ") {
+		t.Errorf("commands = %q, want the plist reloaded", commands)
+	}
+}
+
+func TestPrivilegedCommand(t *testing.T) {
+	oldGeteuid := geteuid
+	defer func() { geteuid = oldGeteuid }()
+	s := &darwinLaunchdService{}
+
+	geteuid = func() int { return 0 }
+	if s.NeedsElevation() {
+		t.Error("root reported as needing elevation")
+	}
+	if cmd := privilegedCommand("launchctl", "start", "test"); filepath.Base(cmd.Path) != "launchctl" {
+		t.Errorf("root runs %v, want launchctl directly", cmd.Args)
+	}
+
+	geteuid = func() int { return 501 }
+	if !s.NeedsElevation() {
+		t.Error("unprivileged user not reported as needing elevation")
+	}
+	cmd := privilegedCommand("mv", "/tmp/it's here", `/Library/LaunchDaemons/"x".plist`)
+	want := `do shell script "'mv' '/tmp/it'\\''s here' '/Library/LaunchDaemons/\"x\".plist'" with administrator privileges`
+	if cmd.Args[0] != "osascript" || cmd.Args[len(cmd.Args)-1] != want {
+		t.Errorf("unprivileged user runs %q, want osascript with %q", cmd.Args, want)
+	}
+}
+
+func TestUninstallElevated(t *testing.T) {
+	oldGeteuid, oldRun := geteuid, runCommand
+	defer func() { geteuid, runCommand = oldGeteuid, oldRun }()
+	geteuid = func() int { return 501 }
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if err := ioutil.WriteFile(s.serviceFilePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{toolPath("launchctl") + " unload " + s.serviceFilePath, "rm " + s.serviceFilePath}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+	if _, err := os.Stat(s.serviceFilePath); err != nil {
+		t.Errorf("plist removed without elevation: %v", err)
+	}
+}
+
+func TestLaunchdStdin(t *testing.T) {
+	out := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "StandardInPath") {
+		t.Errorf("unexpected StandardInPath:\n%s", out)
+	}
+	out = renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test", StdinPath: "/dev/null"})
+	if !strings.Contains(out, "<key>StandardInPath</key><string>/dev/null</string>") {
+		t.Errorf("StandardInPath missing:\n%s", out)
+	}
+}
+
+func TestParseLaunchctlList(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		out  string
+		want launchInfo
+		err  bool
+	}{
+		{
+			name: "running",
+			out:  "{\n\t\"LimitLoadToSessionType\" = \"System\";\n\t\"Label\" = \"test\";\n\t\"PID\" = 321;\n\t\"Program\" = \"/usr/bin/test\";\n};\n",
+			want: launchInfo{label: "test", pid: 321},
+		},
+		{
+			name: "loaded but not running",
+			out:  "{\n\t\"Label\" = \"test\";\n\t\"OnDemand\" = true;\n\t\"LastExitStatus\" = 256;\n};\n",
+			want: launchInfo{label: "test", lastExitStatus: 256, exited: true},
+		},
+		{
+			name: "never run",
+			out:  "{\n\t\"Label\" = \"test\";\n};\n",
+			want: launchInfo{label: "test"},
+		},
+		{
+			name: "nested values",
+			out: `{
+	"Label" = "test";
+	"MachServices" = {
+		"com.example.test" = mach-port-object;
+		"PID" = 1;
+	};
+	"ProgramArguments" = (
+		"/usr/bin/test";
+		"--pid(";
+		"PID" = 2;
+	);
+	"PID" = 4242;
+	"LastExitStatus" = 15;
+};
+`,
+			want: launchInfo{label: "test", pid: 4242, lastExitStatus: 15, exited: true},
+		},
+		{
+			name: "not a dict",
+			out:  "Could not find service \"test\" in domain for port\n",
+			err:  true,
+		},
+		{
+			name: "bad PID",
+			out:  "{\n\t\"PID\" = -;\n};\n",
+			err:  true,
+		},
+	} {
+		info, err := parseLaunchctlList([]byte(tt.out))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && info != tt.want {
+			t.Errorf("%s: parsed as %+v, want %+v", tt.name, info, tt.want)
+		}
+	}
+}
+
+func TestLaunchInfoState(t *testing.T) {
+	if status, pid := (launchInfo{pid: 321}).state(); status != StatusRunning || pid != 321 {
+		t.Errorf("running job has state %q, %d", status, pid)
+	}
+	if status, pid := (launchInfo{lastExitStatus: 256, exited: true}).state(); status != StatusStopped || pid != 0 {
+		t.Errorf("stopped job has state %q, %d", status, pid)
+	}
+}
+
+func TestInstallResult(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing the plist requires root")
+	}
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	runCommand = func(name string, args ...string) error {
+		return nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{Installed: true, Started: true, ConfigPath: s.serviceFilePath}); result != want {
+		t.Errorf("fresh install = %+v, want %+v", result, want)
+	}
+
+	result, err = s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Changed() || result.Started {
+		t.Errorf("unchanged install = %+v", result)
+	}
+
+	s.Arguments = []string{"-v"}
+	result, err = s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{Updated: true, Started: true, ConfigPath: s.serviceFilePath}); result != want {
+		t.Errorf("update = %+v, want %+v", result, want)
+	}
+}
+
+func TestLaunchdRunAtLoad(t *testing.T) {
+	on, off := true, false
+	for _, tt := range []struct {
+		c    Config
+		want string
+	}{
+		{Config{}, "<key>RunAtLoad</key><true/>"},
+		{Config{RunAtLoad: &off}, "<key>RunAtLoad</key><false/>"},
+		{Config{Sockets: []LaunchdSocket{{Name: "Listener", ServiceName: "8080"}}}, "<key>RunAtLoad</key><false/>"},
+		{Config{RunAtLoad: &on, Sockets: []LaunchdSocket{{Name: "Listener", ServiceName: "8080"}}}, "<key>RunAtLoad</key><true/>"},
+	} {
+		tt.c.Name, tt.c.Program = "test", "/usr/bin/test"
+		if out := renderLaunchd(t, tt.c); !strings.Contains(out, tt.want) {
+			t.Errorf("missing %q in:\n%s", tt.want, out)
+		}
+	}
+}
+
+func TestUpdateProgram(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing the plist requires root")
+	}
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	runCommand = func(name string, args ...string) error {
+		return nil
+	}
+
+	dir := t.TempDir()
+	newProgram := filepath.Join(dir, "new&program")
+	if err := ioutil.WriteFile(newProgram, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Name: "test", Program: "/usr/bin/old", Arguments: []string{"-v"}}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(dir, "test.plist")
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateProgram(newProgram); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(s.serviceFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Program = newProgram
+	if want := renderLaunchd(t, c); string(got) != want {
+		t.Errorf("plist after UpdateProgram:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	c := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.WriteConfig(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := renderLaunchd(t, c); buf.String() != want {
+		t.Errorf("WriteConfig wrote:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestInstalledConfig(t *testing.T) {
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if _, err := s.InstalledConfig(); err != ErrNotInstalled {
+		t.Errorf("InstalledConfig before install = %v, want ErrNotInstalled", err)
+	}
+	fixture := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/old"})
+	if err := ioutil.WriteFile(s.serviceFilePath, []byte(fixture), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.InstalledConfig()
+	if err != nil || string(got) != fixture {
+		t.Errorf("InstalledConfig = %q, %v, want %q", got, err, fixture)
+	}
+}
+
+func TestUpdateWillRestart(t *testing.T) {
+	installed := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}}
+	s, err := newService(installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if restart, err := s.UpdateWillRestart(); err != nil || restart {
+		t.Errorf("UpdateWillRestart before install = %v, %v", restart, err)
+	}
+	if err := ioutil.WriteFile(s.serviceFilePath, []byte(renderLaunchd(t, installed)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		edit    func(c *Config)
+		restart bool
+	}{
+		{"unchanged", func(c *Config) {}, false},
+		{"environment", func(c *Config) { c.EnvVars = map[string]string{"LEVEL": "debug"} }, false},
+		{"program", func(c *Config) { c.Program = "/usr/local/bin/test" }, true},
+		{"arguments", func(c *Config) { c.Arguments = nil }, true},
+		{"architecture", func(c *Config) { c.Architecture = "x86_64" }, true},
+	} {
+		c := installed.Clone()
+		tt.edit(&c)
+		updated, err := newService(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated.serviceFilePath = s.serviceFilePath
+		if restart, err := updated.UpdateWillRestart(); err != nil || restart != tt.restart {
+			t.Errorf("%s: UpdateWillRestart = %v, %v, want %v", tt.name, restart, err, tt.restart)
+		}
+	}
+}
+
+func TestParseProcessGroup(t *testing.T) {
+	out := []byte("    1     1\n  412   412\n  415   412\n  500   500\n  416   412\n")
+	pids, err := parseProcessGroup(out, 412)
+	if want := []int{412, 415, 416}; err != nil || !reflect.DeepEqual(pids, want) {
+		t.Errorf("parseProcessGroup = %v, %v, want %v", pids, err, want)
+	}
+	if _, err := parseProcessGroup([]byte("412\n"), 412); err == nil {
+		t.Error("expected an error for a line without a process group")
+	}
+}
+
+func TestLaunchdPathState(t *testing.T) {
+	out := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "PathState") {
+		t.Errorf("unexpected PathState:\n%s", out)
+	}
+	out = renderLaunchd(t, Config{
+		Name:                "test",
+		Program:             "/usr/bin/test",
+		ConditionPathExists: []string{"/var/lib/test", "!/etc/test/disabled"},
+	})
+	want := "\t<key>PathState</key>\n\t<dict>\n\t\t<key>/etc/test/disabled</key><false/>\n\t\t<key>/var/lib/test</key><true/>\n\t</dict>\n</dict>"
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %q in:\n%s", want, out)
+	}
+}
+
+func TestLaunchdNetworkState(t *testing.T) {
+	out := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "NetworkState") {
+		t.Errorf("unexpected NetworkState:\n%s", out)
+	}
+	up := true
+	out = renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test", NetworkState: &up})
+	want := "\t<key>SuccessfulExit</key><false/>\n\t<key>NetworkState</key><true/>\n</dict>"
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %q in:\n%s", want, out)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	s, err := New(Config{Name: "test", Sockets: []LaunchdSocket{{Name: "Listener", ServiceName: "8080"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.EffectiveConfig()
+	if c.Program != exe || c.RunAtLoad == nil || *c.RunAtLoad {
+		t.Errorf("defaults not applied: %+v", c)
+	}
+}
+
+func TestPlistEqual(t *testing.T) {
+	plist := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v", "  padded  "}})
+	reindented := strings.Replace(strings.Replace(plist, "\n\t", "\n    ", -1), "<key>", "\n  <key>", -1)
+	if reindented == plist {
+		t.Fatal("test plist not reindented")
+	}
+	if !plistEqual([]byte(plist), []byte(reindented)) {
+		t.Errorf("plists differing in indentation reported as different:\n%s\nvs\n%s", plist, reindented)
+	}
+
+	changed := strings.Replace(plist, "<string>  padded  </string>", "<string>padded</string>", 1)
+	if plistEqual([]byte(plist), []byte(changed)) {
+		t.Error("change to a string value not detected")
+	}
+	changed = strings.Replace(plist, "<false/>", "<true/>", 1)
+	if plistEqual([]byte(plist), []byte(changed)) {
+		t.Error("change to a boolean not detected")
+	}
+}
+
+func TestDiffersFromInstalledIgnoresIndentation(t *testing.T) {
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	s.serviceFilePath = filepath.Join(dir, "test.plist")
+	plist := renderLaunchd(t, s.Config)
+	if err := ioutil.WriteFile(s.serviceFilePath, []byte(strings.Replace(plist, "\n\t", "\n  ", -1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile := filepath.Join(dir, "new.plist")
+	if err := ioutil.WriteFile(tmpFile, []byte(plist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if differs, err := s.differsFromInstalled(tmpFile); err != nil || differs {
+		t.Errorf("differsFromInstalled = %v, %v", differs, err)
+	}
+}
+
+func TestStopSignalMapping(t *testing.T) {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, syscall.SIGINT)
+	defer signal.Stop(received)
+
+	c := &Config{
+		Name:       "test",
+		StopSignal: "SIGINT",
+		Start: func() error {
+			return syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		},
+		Stop: func() error {
+			select {
+			case sig := <-received:
+				if sig != syscall.SIGINT {
+					t.Errorf("program received %v", sig)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("SIGINT not delivered before Stop")
+			}
+			return nil
+		},
+	}
+	if err := runUntilSignal(context.Background(), c); err != nil {
+		t.Errorf("runUntilSignal = %v", err)
+	}
+}
+
+func TestInstalledVersion(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing the plist requires root")
+	}
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	runCommand = func(name string, args ...string) error {
+		return nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", Version: "1.4.2 <beta>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if _, err := s.InstalledVersion(); err != ErrNotInstalled {
+		t.Errorf("InstalledVersion before installing = %v, want ErrNotInstalled", err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := s.InstalledVersion(); err != nil || version != "1.4.2 <beta>" {
+		t.Errorf("InstalledVersion = %q, %v", version, err)
+	}
+	data, err := ioutil.ReadFile(s.serviceFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := canonicalPlist(data); err != nil {
+		t.Errorf("plist with a version does not parse: %v", err)
+	}
+}
+
+func TestUpdateArguments(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing the plist requires root")
+	}
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	runCommand = func(name string, args ...string) error {
+		return nil
+	}
+
+	c := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-config", "/etc/a&b.toml"}
+	if err := s.UpdateArguments(args); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(s.serviceFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Arguments = args
+	if want := renderLaunchd(t, c); string(got) != want {
+		t.Errorf("plist after UpdateArguments:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := s.UpdateArguments(nil); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = ioutil.ReadFile(s.serviceFilePath)
+	c.Arguments = nil
+	if want := renderLaunchd(t, c); string(got) != want {
+		t.Errorf("plist without arguments:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLaunchdOneshot(t *testing.T) {
+	out := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test", Oneshot: true})
+	if strings.Contains(out, "KeepAlive") {
+		t.Errorf("oneshot plist has KeepAlive:\n%s", out)
+	}
+	if !strings.Contains(out, "<key>RunAtLoad</key><true/>") {
+		t.Errorf("oneshot plist doesn't run at load:\n%s", out)
+	}
+	if _, err := canonicalPlist([]byte(out)); err != nil {
+		t.Errorf("oneshot plist does not parse: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing the plist requires root")
+	}
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	runCommand = func(name string, args ...string) error {
+		return nil
+	}
+
+	dir := t.TempDir()
+	program := filepath.Join(dir, "a&b")
+	if err := ioutil.WriteFile(program, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newService(Config{Name: "test", Program: program})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(dir, "test.plist")
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate after installing = %v", err)
+	}
+
+	other, err := newService(Config{Name: "test", Program: "/usr/bin/true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.serviceFilePath = s.serviceFilePath
+	if err := other.Validate(); err == nil || !strings.Contains(err.Error(), "already installed for "+program) {
+		t.Errorf("Validate for another program = %v", err)
+	}
+}
+
+func TestParseLaunchdDisabled(t *testing.T) {
+	out := []byte(`disabled services = {
+	"com.apple.ftpd" => disabled
+	"com.example.enabled" => enabled
+	"com.example.old" => true
+	"com.example.oldenabled" => false
+}
+login item associations = {
+}
+`)
+	for _, tc := range []struct {
+		label        string
+		disabled, ok bool
+	}{
+		{"com.apple.ftpd", true, true},
+		{"com.example.enabled", false, true},
+		{"com.example.old", true, true},
+		{"com.example.oldenabled", false, true},
+		{"com.example.missing", false, false},
+		{"com.apple.ftp", false, false},
+	} {
+		disabled, ok := parseLaunchdDisabled(out, tc.label)
+		if disabled != tc.disabled || ok != tc.ok {
+			t.Errorf("parseLaunchdDisabled(%q) = %v, %v", tc.label, disabled, ok)
+		}
+	}
+}
+
+func TestIsEnabled(t *testing.T) {
+	oldOutput := commandOutput
+	defer func() { commandOutput = oldOutput }()
+	override := ""
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return []byte("disabled services = {\n" + override + "}\n"), nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if enabled, err := s.IsEnabled(); err != nil || enabled {
+		t.Errorf("IsEnabled before installing = %v, %v", enabled, err)
+	}
+	plist := renderLaunchd(t, s.Config)
+	if err := ioutil.WriteFile(s.serviceFilePath, []byte(plist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := s.IsEnabled(); err != nil || !enabled {
+		t.Errorf("IsEnabled = %v, %v", enabled, err)
+	}
+	override = "\t\"test\" => disabled\n"
+	if enabled, err := s.IsEnabled(); err != nil || enabled {
+		t.Errorf("IsEnabled with a disabled override = %v, %v", enabled, err)
+	}
+
+	override = ""
+	plist = strings.Replace(plist, "<key>Disabled</key><false/>", "<key>Disabled</key><true/>", 1)
+	if err := ioutil.WriteFile(s.serviceFilePath, []byte(plist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := s.IsEnabled(); err != nil || enabled {
+		t.Errorf("IsEnabled with Disabled in the plist = %v, %v", enabled, err)
+	}
+	override = "\t\"test\" => enabled\n"
+	if enabled, err := s.IsEnabled(); err != nil || !enabled {
+		t.Errorf("IsEnabled with an enabled override = %v, %v", enabled, err)
+	}
+}
+
+func TestConfigFileModeAndOwner(t *testing.T) {
+	calls := fakeOwners(t)
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if err := ioutil.WriteFile(s.serviceFilePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EditConfig(func([]byte) ([]byte, error) { return []byte(renderLaunchd(t, s.Config)), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.serviceFilePath); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("default mode = %v, %v", info.Mode(), err)
+	}
+	if want := []string{"test.plist 0:0"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("default chown calls = %q, want %q", *calls, want)
+	}
+	if got := s.configOwnerSpec(); got != "root:wheel" {
+		t.Errorf("default owner = %q", got)
+	}
+
+	*calls = nil
+	s.ConfigFileMode, s.ConfigOwner, s.ConfigGroup = 0600, "app", "staff"
+	if err := s.EditConfig(func(current []byte) ([]byte, error) { return current, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.serviceFilePath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("configured mode = %v, %v", info.Mode(), err)
+	}
+	if want := []string{"test.plist 501:20"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("chown calls = %q, want %q", *calls, want)
+	}
+	if got := s.configOwnerSpec(); got != "app:staff" {
+		t.Errorf("owner = %q", got)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"launchctl kill SIGUSR1 system/test", "launchctl kill SIGUSR2 system/test"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+}
+
+func TestLaunchAgent(t *testing.T) {
+	home := t.TempDir()
+	oldHome, oldGeteuid, oldRun, oldUserRun := userHomeDir, geteuid, runCommand, runUserCommand
+	defer func() {
+		userHomeDir, geteuid, runCommand, runUserCommand = oldHome, oldGeteuid, oldRun, oldUserRun
+	}()
+	userHomeDir = func() (string, error) { return home, nil }
+	geteuid = func() int { return 501 }
+	runCommand = func(name string, args ...string) error {
+		t.Errorf("agent ran %s %q as root", name, args)
+		return nil
+	}
+	var commands []string
+	runUserCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", Agent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(home, "Library", "LaunchAgents", "test.plist")
+	if s.serviceFilePath != path {
+		t.Errorf("path = %q, want %q", s.serviceFilePath, path)
+	}
+	if got := s.domain(); got != "gui/501" {
+		t.Errorf("domain = %q, want gui/501", got)
+	}
+	if s.NeedsElevation() {
+		t.Error("agent needs elevation")
+	}
+	plist := renderLaunchd(t, s.Config)
+	if strings.Contains(plist, "<key>UserName</key>") || !strings.Contains(plist, "<key>LimitLoadToSessionType</key>") {
+		t.Errorf("agent plist:\n%s", plist)
+	}
+
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"launchctl bootstrap gui/501 " + path,
+		"launchctl bootout gui/501 " + path,
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("plist not removed: %v", err)
+	}
+}
+
+func TestLaunchdExpandArguments(t *testing.T) {
+	c := Config{
+		Name:              "test",
+		Program:           "/usr/bin/test",
+		Arguments:         []string{"--name=$NAME"},
+		ArgumentVariables: map[string]string{"NAME": "a<b"},
+	}
+	render := func(c Config) string {
+		s, err := New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := launchdTemplate.Execute(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	if out := render(c); !strings.Contains(out, "<string>--name=$NAME</string>") {
+		t.Errorf("literal argument missing in:\n%s", out)
+	}
+	c.ExpandArguments = true
+	if out := render(c); !strings.Contains(out, "<string>--name=a&lt;b</string>") {
+		t.Errorf("expanded argument missing in:\n%s", out)
+	}
+}
+
+func TestLaunchdSchedule(t *testing.T) {
+	s, err := New(Config{
+		Name:    "test",
+		Program: "/usr/bin/test",
+		Schedule: Schedule{
+			Interval: time.Hour,
+			Calendar: []CalendarInterval{
+				{Weekdays: []time.Weekday{time.Monday, time.Friday}, Hour: 3, Minute: 30},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := launchdTemplate.Execute(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	want := `<key>StartInterval</key><integer>3600</integer>
+<key>StartCalendarInterval</key>
+<array>
+	<dict>
+		<key>Hour</key><integer>3</integer>
+		<key>Minute</key><integer>30</integer>
+		<key>Weekday</key><integer>1</integer>
+	</dict>
+	<dict>
+		<key>Hour</key><integer>3</integer>
+		<key>Minute</key><integer>30</integer>
+		<key>Weekday</key><integer>5</integer>
+	</dict>
+</array>
+<key>RunAtLoad</key><false/>`
+	if !strings.Contains(out, want) {
+		t.Errorf("missing\n%s\nin:\n%s", want, out)
+	}
+	if strings.Contains(out, "KeepAlive") {
+		t.Errorf("scheduled job is kept alive:\n%s", out)
+	}
+}
+
+func TestPrepareTmpFileNextToPlist(t *testing.T) {
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	s.serviceFilePath = filepath.Join(dir, "test.plist")
+	tmpFile, err := s.prepareTmpFile()
+	if tmpFile != "" {
+		defer os.Remove(tmpFile)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(tmpFile) != dir {
+		t.Errorf("temporary file %v not created in %v", tmpFile, dir)
+	}
+}
+
+func TestMoveFileAcrossDevices(t *testing.T) {
+	oldRename := rename
+	defer func() { rename = oldRename }()
+	rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+	if err := ioutil.WriteFile(from, []byte("plist"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(from, to, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(to); err != nil || string(data) != "plist" {
+		t.Errorf("moved file = %q, %v", data, err)
+	}
+	if info, err := os.Stat(to); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("moved file mode = %v, %v", info, err)
+	}
+	if _, err := os.Stat(from); !os.IsNotExist(err) {
+		t.Errorf("source not removed: %v", err)
+	}
+
+	rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EACCES}
+	}
+	if err := moveFile(from, to, 0644); err == nil {
+		t.Error("expected other rename errors to be returned")
+	}
+}
+
+func TestPlatformHandle(t *testing.T) {
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := s.PlatformHandle()
+	if path, ok := handle.(string); err != nil || !ok || path != "/Library/LaunchDaemons/test.plist" {
+		t.Errorf("PlatformHandle() = %#v, %v", handle, err)
+	}
+}
+
+func TestEnableIdempotent(t *testing.T) {
+	oldRun, oldOutput := runCommand, commandOutput
+	defer func() { runCommand, commandOutput = oldRun, oldOutput }()
+	disabled := true
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		disabled = args[0] == "disable"
+		return nil
+	}
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return []byte(fmt.Sprintf("disabled services = {\n\t\"test\" => %v\n}\n", disabled)), nil
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if err := ioutil.WriteFile(s.serviceFilePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Enable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Disable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"launchctl enable system/test", "launchctl disable system/test"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+}
+
+func TestRootDir(t *testing.T) {
+	fakeOwners(t)
+	oldRun, oldGeteuid := runCommand, geteuid
+	defer func() { runCommand, geteuid = oldRun, oldGeteuid }()
+	geteuid = func() int { return 0 }
+	runCommand = func(name string, args ...string) error {
+		t.Errorf("ran %s %q for a root directory", name, args)
+		return nil
+	}
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "/Library/LaunchDaemons")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{Name: "test", Program: "/usr/bin/test", RootDir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plist := filepath.Join(dir, "test.plist")
+	if result.ConfigPath != plist {
+		t.Errorf("ConfigPath = %q, want %q", result.ConfigPath, plist)
+	}
+	if _, err := os.Stat(plist); err != nil {
+		t.Errorf("plist not written below the root: %v", err)
+	}
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(plist); !os.IsNotExist(err) {
+		t.Errorf("plist not removed: %v", err)
+	}
+}
+
+func TestControlNotInstalled(t *testing.T) {
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	failed := errors.New("exit status 3")
+	runCommand = func(name string, args ...string) error {
+		return failed
+	}
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	for name, op := range map[string]func() error{"Start": s.Start, "Stop": s.Stop, "Restart": s.Restart} {
+		if err := op(); err != ErrNotInstalled {
+			t.Errorf("%s() = %v, want ErrNotInstalled", name, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(s.serviceFilePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != failed {
+		t.Errorf("Start() of an installed service = %v, want %v", err, failed)
+	}
+}
+
+func TestSupported(t *testing.T) {
+	runAtLoad := false
+	c := Config{Name: "test", Agent: true, RunAtLoad: &runAtLoad, MachServices: []string{"com.example.test"}}
+	if err := Supported(c); err != nil {
+		t.Errorf("launchd config = %v", err)
+	}
+	c.DropIn = "override"
+	c.StartupTimeout = time.Minute
+	err := Supported(c)
+	if err == nil || !strings.Contains(err.Error(), "StartupTimeout requires Windows; DropIn requires systemd") {
+		t.Errorf("systemd and Windows fields = %v", err)
+	}
+}
+
+func TestNoEscalate(t *testing.T) {
+	oldRun, oldGeteuid, oldRename := runCommand, geteuid, rename
+	defer func() { runCommand, geteuid, rename = oldRun, oldGeteuid, oldRename }()
+	geteuid = func() int { return 501 }
+	runCommand = func(name string, args ...string) error {
+		t.Errorf("ran %s %q with elevation", name, args)
+		return nil
+	}
+	rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EACCES}
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", NoEscalate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	_, err = s.InstallOrUpdate()
+	if err == nil || !strings.Contains(err.Error(), "NoEscalate is set; run as root") {
+		t.Errorf("InstallOrUpdate = %v", err)
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("error doesn't wrap the permission error: %v", err)
+	}
+}
+
+func TestParsePSUsage(t *testing.T) {
+	for _, test := range []struct {
+		out  string
+		want ResourceUsage
+	}{
+		{"  5120   0:01.25\n", ResourceUsage{RSS: 5120 * 1024, CPUTime: 1250 * time.Millisecond}},
+		{"123456 12:03.50\n", ResourceUsage{RSS: 123456 * 1024, CPUTime: 12*time.Minute + 3500*time.Millisecond}},
+		{"  64 1:02:03.00\n", ResourceUsage{RSS: 64 * 1024, CPUTime: time.Hour + 2*time.Minute + 3*time.Second}},
+	} {
+		got, err := parsePSUsage([]byte(test.out))
+		if err != nil || got != test.want {
+			t.Errorf("parsePSUsage(%q) = %+v, %v, want %+v", test.out, got, err, test.want)
+		}
+	}
+	if _, err := parsePSUsage(nil); err == nil {
+		t.Error("parsePSUsage of empty output succeeded")
+	}
+}
+
+func TestRestartKickstart(t *testing.T) {
+	oldRun, oldSleep := runCommand, sleep
+	defer func() { runCommand, sleep = oldRun, oldSleep }()
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	sleep = func(d time.Duration) { t.Errorf("Restart slept for %v", d) }
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"launchctl kickstart -k system/test"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+}
+
+func TestSetLaunchctlPath(t *testing.T) {
+	oldRun := runCommand
+	defer func() { runCommand = oldRun }()
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	SetLaunchctlPath("/nix/store/abc-launchctl/bin/launchctl")
+	defer SetLaunchctlPath("")
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/nix/store/abc-launchctl/bin/launchctl kickstart -k system/test"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+}
+
+func TestLaunchdArchitecture(t *testing.T) {
+	c := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}}
+	if out := renderLaunchd(t, c); strings.Contains(out, archPath) {
+		t.Errorf("unexpected arch wrapper:\n%s", out)
+	}
+	c.Architecture = "x86_64"
+	out := renderLaunchd(t, c)
+	want := "<key>Program</key><string>/usr/bin/arch</string>\n<key>ProgramArguments</key>\n<array>\n" +
+		"\t<string>/usr/bin/arch</string>\n\t<string>-arch</string>\n" +
+		"\t<string>x86_64</string>\n\t<string>/usr/bin/test</string>\n" +
+		"\t<string>-v</string>\n</array>"
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %q in:\n%s", want, out)
+	}
+
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if err := ioutil.WriteFile(s.serviceFilePath, []byte(out), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if program, err := s.installedProgram(); err != nil || program != "/usr/bin/test" {
+		t.Errorf("installedProgram = %q, %v, want the program arch runs", program, err)
+	}
+	if got, err := s.CommandLine(); err != nil || got != "/usr/bin/arch -arch x86_64 /usr/bin/test -v" {
+		t.Errorf("CommandLine() = %s, %v", got, err)
+	}
+
+	for _, arch := range []string{"x86-64", "ppc", "ARM64"} {
+		if _, err := New(Config{Name: "test", Architecture: arch}); err == nil {
+			t.Errorf("Architecture %q accepted", arch)
+		}
+	}
+}
+
+func TestLaunchdOtherJobEnabled(t *testing.T) {
+	out := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "OtherJobEnabled") {
+		t.Errorf("unexpected OtherJobEnabled:\n%s", out)
+	}
+	out = renderLaunchd(t, Config{
+		Name:            "test",
+		Program:         "/usr/bin/test",
+		OtherJobEnabled: map[string]bool{"com.example.db": true, "com.example.maintenance": false},
+	})
+	want := "\t<key>OtherJobEnabled</key>\n\t<dict>\n\t\t<key>com.example.db</key><true/>\n\t\t<key>com.example.maintenance</key><false/>\n\t</dict>\n</dict>"
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %q in:\n%s", want, out)
+	}
+
+	for _, label := range []string{"", "com.example.db/x", "com..example", "has space"} {
+		if _, err := New(Config{Name: "test", OtherJobEnabled: map[string]bool{label: true}}); err == nil {
+			t.Errorf("New accepted the label %q", label)
+		}
+	}
+}
+
+func TestKill(t *testing.T) {
+	oldRun, oldOutput := runCommand, commandOutput
+	defer func() { runCommand, commandOutput = oldRun, oldOutput }()
+	var commands []string
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	list := "{\n\t\"LastExitStatus\" = 0;\n\t\"PID\" = 4242;\n};\n"
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return []byte(list), nil
+	}
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serviceFilePath = filepath.Join(t.TempDir(), "test.plist")
+	if err := s.Kill(); err != ErrNotInstalled {
+		t.Errorf("Kill when not installed = %v, want ErrNotInstalled", err)
+	}
+	if err := ioutil.WriteFile(s.serviceFilePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"launchctl kill SIGKILL system/test"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+
+	list = "{\n\t\"LastExitStatus\" = 0;\n};\n"
+	if err := s.Kill(); err != ErrNotRunning {
+		t.Errorf("Kill when stopped = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestLaunchdRequireNetwork(t *testing.T) {
+	out := renderLaunchd(t, Config{Name: "test", Program: "/usr/bin/test", RequireNetwork: true})
+	want := "\t<key>SuccessfulExit</key><false/>\n\t<key>NetworkState</key><true/>\n</dict>"
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %q in:\n%s", want, out)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	s, err := newService(Config{
+		Name:      "test",
+		Program:   "/Applications/My App.app/Contents/MacOS/myapp",
+		Arguments: []string{"-v", "--name=it's", "", "a b", "$HOME"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.CommandLine()
+	want := `'/Applications/My App.app/Contents/MacOS/myapp' -v '--name=it'\''s' '' 'a b' '$HOME'`
+	if err != nil || got != want {
+		t.Errorf("CommandLine() = %s, %v, want %s", got, err, want)
+	}
+}
@@ -5,326 +5,1927 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
-
-	"github.com/kardianos/osext"
 )
 
 const (
 	initSystemV = initFlavor(iota)
 	initUpstart
 	initSystemd
+	initOpenRC
 )
 
-func getFlavor() initFlavor {
+// getFlavor detects the init system of the filesystem rooted at root.
+func getFlavor(root string) initFlavor {
 	flavor := initSystemV
-	if isSystemd() {
+	if isSystemd(root) {
 		flavor = initSystemd
-	} else if isUpstart() {
+	} else if isOpenRC(root) {
+		flavor = initOpenRC
+	} else if isUpstart(root) {
 		flavor = initUpstart
 	}
-	return flavor
+	return flavor
+}
+
+func isUpstart(root string) bool {
+	if _, err := os.Stat(filepath.Join(root, "/sbin/upstart-udev-bridge")); err == nil {
+		return true
+	}
+	return false
+}
+
+// isSystemd reports whether systemd is running, or for another root than
+// "/", such as an image being built, whether it is installed.
+func isSystemd(root string) bool {
+	paths := []string{"/run/systemd/system"}
+	if root != "/" {
+		paths = append(paths, "/lib/systemd/systemd", "/usr/lib/systemd/systemd")
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isOpenRC(root string) bool {
+	for _, path := range [...]string{"/sbin/openrc", "/sbin/rc-service"} {
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type linuxService struct {
+	Config
+
+	configPath string
+	// flavor is the init system the configuration is written for: that of
+	// RootDir if it is set, otherwise the running one. Operations on the
+	// running service use the package-level flavor.
+	flavor initFlavor
+	// execStart is whether Program or Arguments is set, so a drop-in
+	// overrides the ExecStart of the main unit.
+	execStart bool
+}
+
+var flavor = getFlavor("/")
+
+// runCommand runs an external control command. It is a variable so tests
+// can avoid touching the host's service manager.
+var runCommand = func(name string, args ...string) error {
+	if err := requireTool(name); err != nil {
+		return err
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+// retryableErrors are the messages of control command failures that are
+// worth retrying.
+var retryableErrors = []string{
+	"Failed to connect to bus",
+	"Connection timed out",
+	"Resource temporarily unavailable",
+	"Transport endpoint is not connected",
+}
+
+// control runs a control command, retrying transient failures according to
+// the ControlRetry policy.
+func (s *linuxService) control(name string, args ...string) error {
+	return s.ControlRetry.retry(func() error {
+		return runCommand(name, args...)
+	})
+}
+
+// commandOutput runs an external command and returns its standard output.
+// It is a variable for the same reason as runCommand.
+var commandOutput = func(name string, args ...string) ([]byte, error) {
+	if err := requireTool(name); err != nil {
+		return nil, err
+	}
+	return exec.Command(name, args...).Output()
+}
+
+type linuxSystem struct{}
+
+func (ls linuxSystem) String() string {
+	return fmt.Sprintf("Linux %s", flavor.String())
+}
+
+var system = linuxSystem{}
+
+func newService(c Config) (*linuxService, error) {
+	target := flavor
+	if c.RootDir != "" {
+		target = getFlavor(c.RootDir)
+	}
+	if c.Agent || c.UserSession || ((c.Schedule.scheduled() || c.DropIn != "") && target != initSystemd) {
+		return nil, ErrNotSupported
+	}
+	s := &linuxService{
+		Config:     c,
+		configPath: target.ConfigPath(c.Name, c.UnitDir),
+		flavor:     target,
+		execStart:  c.Program != "" || len(c.Arguments) > 0,
+	}
+	if c.DropIn != "" {
+		s.configPath = filepath.Join(s.configPath+".d", c.DropIn+".conf")
+	}
+	if c.RootDir != "" {
+		s.configPath = filepath.Join(c.RootDir, s.configPath)
+	}
+	program, err := c.program()
+	if err != nil {
+		return nil, err
+	}
+	s.Program = program
+	switch {
+	case len(s.WantedBy) == 0 && s.CustomTarget != "":
+		s.WantedBy = []string{s.CustomTarget}
+	case len(s.WantedBy) == 0:
+		s.WantedBy = []string{"multi-user.target"}
+	case s.CustomTarget != "" && !containsString(s.WantedBy, s.CustomTarget):
+		s.WantedBy = append(cloneStrings(s.WantedBy), s.CustomTarget)
+	}
+	// A drop-in leaves the defaults to the main unit.
+	if s.StartLimitIntervalSec == 0 && s.DropIn == "" {
+		s.StartLimitIntervalSec = 5 * time.Second
+	}
+	if s.StartLimitBurst == 0 && s.DropIn == "" {
+		s.StartLimitBurst = 10
+	}
+
+	return s, nil
+}
+
+func (s *linuxService) String() string {
+	return s.Name
+}
+
+type initFlavor uint8
+
+func (f initFlavor) String() string {
+	switch f {
+	case initSystemV:
+		return "System-V"
+	case initUpstart:
+		return "Upstart"
+	case initSystemd:
+		return "systemd"
+	case initOpenRC:
+		return "OpenRC"
+	default:
+		panic("Invalid flavor")
+	}
+}
+
+const (
+	defaultUnitDir = "/etc/systemd/system"
+	runtimeUnitDir = "/run/systemd/system"
+)
+
+// ConfigPath returns the path of the configuration file for the named
+// service. unitDir overrides the directory systemd units are written to.
+func (f initFlavor) ConfigPath(name, unitDir string) string {
+	switch f {
+	case initSystemd:
+		if unitDir == "" {
+			unitDir = defaultUnitDir
+		}
+		return filepath.Join(unitDir, name+".service")
+	case initSystemV, initOpenRC:
+		return "/etc/init.d/" + name
+	case initUpstart:
+		return "/etc/init/" + name + ".conf"
+	default:
+		panic("Invalid flavor")
+	}
+}
+
+// FileMode returns the permissions the flavor's configuration file is
+// installed with. System-V and OpenRC init scripts must be executable.
+func (f initFlavor) FileMode() os.FileMode {
+	if f == initSystemV || f == initOpenRC {
+		return 0755
+	}
+	return 0644
+}
+
+// Template returns the configuration template for the flavor. Maps must be
+// ranged over directly in the templates, which visits keys in sorted order,
+// so the same Config always renders to the same bytes.
+func (f initFlavor) Template() *template.Template {
+	var templ string
+	switch f {
+	case initSystemd:
+		templ = systemdScript + systemdServiceDirectives
+	case initSystemV:
+		templ = systemVScript
+	case initUpstart:
+		templ = upstartScript
+	case initOpenRC:
+		templ = openRCScript
+	}
+	return template.Must(template.New(f.String() + "Script").Funcs(tf).Parse(templ))
+}
+
+// ProgramPattern matches the line of an installed configuration that names
+// the program. The first group is the program, quoted as the template
+// quotes it.
+func (f initFlavor) ProgramPattern() *regexp.Regexp {
+	switch f {
+	case initSystemd:
+		return regexp.MustCompile(`(?m)^ConditionFileIsExecutable=("(?:[^"\\]|\\.)*")$`)
+	case initUpstart:
+		return regexp.MustCompile(`(?m)^exec (\S+)`)
+	case initOpenRC:
+		return regexp.MustCompile(`(?m)^command=("(?:[^"\\]|\\.)*")$`)
+	default:
+		return regexp.MustCompile(`(?m)^# processname: (.*)$`)
+	}
+}
+
+// ProgramSitesPattern matches each line of an installed configuration the
+// template writes the program to. The first group is the program as it is
+// written there, in the one group that matched, quoted if it starts with
+// a quote.
+func (f initFlavor) ProgramSitesPattern() *regexp.Regexp {
+	switch f {
+	case initSystemd:
+		return regexp.MustCompile(`(?m)^(?:ConditionFileIsExecutable|ExecStart)=("(?:[^"\\]|\\.)*")`)
+	case initUpstart:
+		return regexp.MustCompile(`(?m)^(?:    test -x |exec )(\S+)`)
+	case initOpenRC:
+		return regexp.MustCompile(`(?m)^command=("(?:[^"\\]|\\.)*")$`)
+	default:
+		return regexp.MustCompile(`(?m)^(?:# processname: (.*)$|cmd="([^"]*)"$)`)
+	}
+}
+
+// ArgumentsPattern matches the line of an installed configuration that
+// passes the arguments to the program. The first group is the arguments,
+// formatted as FormatArguments formats them. It returns nil for System V,
+// whose script doesn't pass arguments.
+func (f initFlavor) ArgumentsPattern() *regexp.Regexp {
+	switch f {
+	case initSystemd:
+		return regexp.MustCompile(`(?m)^ExecStart="(?:[^"\\]|\\.)*"(.*)$`)
+	case initUpstart:
+		return regexp.MustCompile(`(?m)^exec \S+(.*)$`)
+	case initOpenRC:
+		return regexp.MustCompile(`(?m)^command_args='(.*)'$`)
+	default:
+		return nil
+	}
+}
+
+// FormatArguments formats args the way the flavor's template does.
+func (f initFlavor) FormatArguments(args []string) string {
+	var b strings.Builder
+	for i, arg := range args {
+		if f == initOpenRC {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(sqEscape(cmdQuote(arg)))
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteString(cmdQuote(arg))
+	}
+	return b.String()
+}
+
+// CommandLine returns the command line the configuration runs: the
+// ExecStart of a systemd unit, the command and command_args of an OpenRC
+// script once openrc-run has unquoted them and the exec line of an Upstart
+// job. System V scripts run the program without arguments.
+func (s *linuxService) CommandLine() (string, error) {
+	switch s.flavor {
+	case initSystemd, initOpenRC:
+		return cmdQuote(s.Program) + initSystemd.FormatArguments(s.Arguments), nil
+	case initUpstart:
+		return s.Program + s.flavor.FormatArguments(s.Arguments), nil
+	default:
+		return s.Program, nil
+	}
+}
+
+// isInteractive reports whether the program was started outside the
+// service manager. The program isn't always a child of init: user units
+// run under systemd --user, OpenRC runs it under supervise-daemon and the
+// System V script backgrounds it from a shell. So the init system's own
+// marks are checked instead.
+func isInteractive() (bool, error) {
+	switch flavor {
+	case initSystemd:
+		// systemd sets INVOCATION_ID for every unit it starts, including
+		// those of the per-user manager.
+		return os.Getenv("INVOCATION_ID") == "" && os.Getenv("NOTIFY_SOCKET") == "", nil
+	case initOpenRC:
+		return os.Getenv("RC_SVCNAME") == "", nil
+	case initUpstart:
+		return os.Getenv("UPSTART_JOB") == "" && os.Getppid() != 1, nil
+	default:
+		// Services are started without a controlling terminal.
+		return hasControllingTTY(), nil
+	}
+}
+
+// hasControllingTTY reports whether the process has a controlling
+// terminal, which /dev/tty opens. It is a variable so tests don't depend
+// on how they are run.
+var hasControllingTTY = func() bool {
+	f, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// managerName returns the name of the init system, for Supported.
+func managerName() string {
+	return flavor.String()
+}
+
+func (s *linuxService) NeedsElevation() bool {
+	return os.Geteuid() != 0
+}
+
+func (s *linuxService) InstallOrUpdateRequired() (bool, error) {
+	tmpFile, err := s.prepareTmpFile()
+	if tmpFile != "" {
+		defer os.Remove(tmpFile)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return s.differsFromInstalled(tmpFile)
+}
+
+// UpdateWillRestart compares the lines of the installed and new
+// configuration that pass the program and its arguments.
+func (s *linuxService) UpdateWillRestart() (bool, error) {
+	installed, err := s.InstalledConfig()
+	if err == ErrNotInstalled {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var b bytes.Buffer
+	err = s.WriteConfig(&b)
+	if err != nil {
+		return false, err
+	}
+	return matchesDiffer(installed, b.Bytes(), s.flavor.ProgramPattern(), s.flavor.ArgumentsPattern()), nil
+}
+
+func (s *linuxService) InstallOrUpdate() (InstallResult, error) {
+	result, err := s.installOrUpdate(false)
+	return result, s.noEscalateError(err)
+}
+
+func (s *linuxService) InstallOrUpdateWithRollback(healthy func() error, timeout time.Duration) error {
+	return installWithRollback(s, fileSnapshot(s), healthy, timeout)
+}
+
+func (s *linuxService) ForceReinstall() error {
+	_, err := s.installOrUpdate(true)
+	if err != nil {
+		return err
+	}
+	return s.Restart()
+}
+
+// installOrUpdate writes and activates the service configuration if it
+// differs from the installed one, or unconditionally if force is set. The
+// service isn't started; it starts at the next boot or on Start.
+func (s *linuxService) installOrUpdate(force bool) (InstallResult, error) {
+	result := InstallResult{ConfigPath: s.configPath}
+	err := s.checkWorkingDirectory()
+	if err != nil {
+		return result, err
+	}
+	if s.DropIn != "" {
+		err = os.MkdirAll(filepath.Dir(s.configPath), 0755)
+		if err != nil {
+			return result, fmt.Errorf("Unable to create drop-in directory: %v", err)
+		}
+	}
+
+	tmpFile, err := s.prepareTmpFile()
+	if tmpFile != "" {
+		defer os.Remove(tmpFile)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	installOrUpdateRequired, err := s.differsFromInstalled(tmpFile)
+	if err != nil {
+		return result, fmt.Errorf("Unable to determine if new configuration differs from old: %v", err)
+	}
+	if !installOrUpdateRequired && !force {
+		return result, nil
+	}
+	_, err = os.Stat(s.configPath)
+	existed := err == nil
+
+	// Move config into place
+	err = rename(tmpFile, s.configPath)
+	if err != nil {
+		return result, fmt.Errorf("Unable to move service configuration to %v: %w", s.configPath, err)
+	}
+	if s.Schedule.scheduled() {
+		timer, err := s.renderTimer()
+		if err != nil {
+			return result, err
+		}
+		err = writeFileAtomic(s.timerPath(), timer, s.configFileMode(s.flavor.FileMode()))
+		if err != nil {
+			return result, fmt.Errorf("Unable to write timer to %v: %v", s.timerPath(), err)
+		}
+		err = s.chownConfig(s.timerPath())
+		if err != nil {
+			return result, err
+		}
+	}
+
+	switch s.flavor {
+	case initSystemV:
+		for _, link := range s.rcLinks() {
+			os.Symlink(s.imagePath(), link)
+		}
+	case initSystemd:
+		if s.CustomTarget != "" {
+			err = s.createTarget()
+			if err != nil {
+				return result, err
+			}
+		}
+		err = s.daemonReload()
+		if err != nil {
+			return result, fmt.Errorf("Unable to reload systemd: %v", err)
+		}
+		if s.isRuntimeUnit() || s.DropIn != "" {
+			// Runtime units vanish on reboot, so there's nothing to enable,
+			// and the main unit of a drop-in is enabled by its owner.
+			break
+		}
+		err = s.systemctl("enable", s.bootUnit())
+		if err != nil {
+			return result, fmt.Errorf("Unable to enable service: %v", err)
+		}
+	case initOpenRC:
+		err = s.rcUpdate("add")
+		if err != nil {
+			return result, fmt.Errorf("Unable to add service to the default runlevel: %v", err)
+		}
+	}
+
+	result.Installed = !existed
+	result.Updated = existed
+	return result, nil
+}
+
+// timerPath returns the path of the timer unit of a scheduled service.
+func (s *linuxService) timerPath() string {
+	return strings.TrimSuffix(s.configPath, ".service") + ".timer"
+}
+
+// bootUnit returns the unit that is enabled to start the service at boot:
+// the timer for a scheduled service, otherwise the service itself.
+func (s *linuxService) bootUnit() string {
+	if s.Schedule.scheduled() {
+		return s.Name + ".timer"
+	}
+	return s.Name + ".service"
+}
+
+// targetPath returns the path of the unit of CustomTarget, which is kept
+// next to the service's unit.
+func (s *linuxService) targetPath() string {
+	unitDir := s.UnitDir
+	if unitDir == "" {
+		unitDir = defaultUnitDir
+	}
+	return filepath.Join(s.RootDir, unitDir, s.CustomTarget)
+}
+
+// createTarget writes the unit of CustomTarget and enables it, unless it
+// already exists. An existing target belongs to whoever created it, which
+// may be an administrator or another service, so it is left as it is.
+func (s *linuxService) createTarget() error {
+	path := s.targetPath()
+	_, err := stat(path)
+	if err == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	templ := template.Must(template.New("systemdTarget").Funcs(tf).Parse(systemdTargetScript))
+	err = templ.Execute(&buf, s)
+	if err != nil {
+		return fmt.Errorf("Unable to process target template: %v", err)
+	}
+	err = writeFileAtomic(path, buf.Bytes(), s.configFileMode(0644))
+	if err != nil {
+		return fmt.Errorf("Unable to write target to %v: %v", path, err)
+	}
+	err = s.chownConfig(path)
+	if err != nil {
+		return err
+	}
+	if s.isRuntimeUnit() {
+		return nil
+	}
+	err = s.systemctl("enable", s.CustomTarget)
+	if err != nil {
+		return fmt.Errorf("Unable to enable target: %v", err)
+	}
+	return nil
+}
+
+// removeTarget disables and removes the unit of CustomTarget.
+func (s *linuxService) removeTarget() error {
+	if !s.isRuntimeUnit() {
+		s.systemctl("disable", s.CustomTarget)
+	}
+	err := os.Remove(s.targetPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove target: %v", err)
+	}
+	return nil
+}
+
+// renderTimer renders the timer unit of a scheduled service.
+func (s *linuxService) renderTimer() ([]byte, error) {
+	var buf bytes.Buffer
+	templ := template.Must(template.New("systemdTimer").Funcs(tf).Parse(systemdTimerScript))
+	err := templ.Execute(&buf, s)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to process timer template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// isRuntimeUnit reports whether the unit is written below /run, where it
+// only lasts until the next reboot.
+func (s *linuxService) isRuntimeUnit() bool {
+	return strings.HasSuffix(filepath.Dir(s.configPath), runtimeUnitDir)
+}
+
+func (s *linuxService) EffectiveConfig() Config {
+	return s.Config.Clone()
+}
+
+// WriteConfig writes the unit or init script InstallOrUpdate would install
+// to w.
+func (s *linuxService) WriteConfig(w io.Writer) error {
+	if s.DropIn != "" {
+		return s.writeDropIn(w)
+	}
+	err := s.flavor.Template().Execute(w, s)
+	if err != nil {
+		return fmt.Errorf("Unable to process service configuration template: %v", err)
+	}
+	return nil
+}
+
+// systemdDropIn is what systemdDropInScript is executed with.
+type systemdDropIn struct {
+	*linuxService
+	// ExecStart is whether the drop-in overrides ExecStart.
+	ExecStart bool
+}
+
+// writeDropIn writes the systemd drop-in to w, without the sections that
+// are left empty because none of their fields are set.
+func (s *linuxService) writeDropIn(w io.Writer) error {
+	t := template.Must(template.New("systemdDropInScript").Funcs(tf).Parse(systemdDropInScript + systemdServiceDirectives))
+	var b strings.Builder
+	err := t.Execute(&b, systemdDropIn{s, s.execStart})
+	if err != nil {
+		return fmt.Errorf("Unable to process service configuration template: %v", err)
+	}
+	_, err = io.WriteString(w, dropEmptySections(b.String()))
+	return err
+}
+
+// dropEmptySections removes the sections without directives from a unit
+// and separates the others by a blank line.
+func dropEmptySections(unit string) string {
+	var b strings.Builder
+	header, written := "", false
+	for _, line := range strings.SplitAfter(unit, "\n") {
+		switch {
+		case line == "" || line == "\n":
+		case strings.HasPrefix(line, "["):
+			header = line
+		default:
+			if header != "" {
+				if written {
+					b.WriteString("\n")
+				}
+				b.WriteString(header)
+				header, written = "", true
+			}
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// InstalledConfig reads the installed unit, drop-in or init script.
+func (s *linuxService) InstalledConfig() ([]byte, error) {
+	b, err := ioutil.ReadFile(s.configPath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotInstalled
+	}
+	return b, err
+}
+
+func (s *linuxService) prepareTmpFile() (string, error) {
+	// Create the temporary file next to the final location so that the
+	// rename into place does not cross filesystems.
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.configPath), "."+s.Name)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create temporary service configuration: %v", err)
+	}
+	defer tmpFile.Close()
+
+	err = s.WriteConfig(tmpFile)
+	if err != nil {
+		return tmpFile.Name(), err
+	}
+	err = tmpFile.Chmod(s.configFileMode(s.flavor.FileMode()))
+	if err != nil {
+		return tmpFile.Name(), fmt.Errorf("Unable to chmod temp file: %v", err)
+	}
+	err = s.chownConfig(tmpFile.Name())
+	if err != nil {
+		return tmpFile.Name(), err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return tmpFile.Name(), fmt.Errorf("Unable to close temp file: %v", err)
+	}
+
+	return tmpFile.Name(), nil
+}
+
+// chownConfig gives the configuration file at path the configured owner
+// and group, if set.
+func (s *linuxService) chownConfig(path string) error {
+	uid, gid, err := s.configFileOwner()
+	if err != nil {
+		return err
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	err = chown(path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("Unable to change owner of %v: %v", path, err)
+	}
+	return nil
+}
+
+func (s *linuxService) differsFromInstalled(tmpFile string) (bool, error) {
+	old, err := ioutil.ReadFile(s.configPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to read existing configuration at %v for comparing: %v", s.configPath, err)
+	}
+
+	updated, err := ioutil.ReadFile(tmpFile)
+	if err != nil {
+		return false, fmt.Errorf("Unable to read updated configuration at %v for comparing: %v", tmpFile, err)
+	}
+	if !bytes.Equal(old, updated) || !s.Schedule.scheduled() {
+		return !bytes.Equal(old, updated), nil
+	}
+
+	timer, err := s.renderTimer()
+	if err != nil {
+		return false, err
+	}
+	installed, err := ioutil.ReadFile(s.timerPath())
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to read existing timer at %v for comparing: %v", s.timerPath(), err)
+	}
+	return !bytes.Equal(installed, timer), nil
+}
+
+func (s *linuxService) EditConfig(edit func(current []byte) ([]byte, error)) error {
+	current, err := ioutil.ReadFile(s.configPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read configuration at %v: %v", s.configPath, err)
+	}
+	updated, err := edit(current)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.configPath, updated, s.configFileMode(s.flavor.FileMode()))
+	if err != nil {
+		return err
+	}
+	err = s.chownConfig(s.configPath)
+	if err != nil {
+		return err
+	}
+
+	if s.flavor == initSystemd {
+		err = s.daemonReload()
+		if err != nil {
+			return fmt.Errorf("Unable to reload systemd: %v", err)
+		}
+	}
+	return nil
+}
+
+// UpdateProgram points the installed configuration at a new program,
+// leaving the rest of it, including manual edits, as it is.
+func (s *linuxService) UpdateProgram(newPath string) error {
+	err := checkExecutable(newPath)
+	if err != nil {
+		return err
+	}
+	err = s.EditConfig(func(current []byte) ([]byte, error) {
+		m := s.flavor.ProgramPattern().FindSubmatch(current)
+		if m == nil {
+			return nil, fmt.Errorf("Unable to find the program in %v", s.configPath)
+		}
+		// Only the program in the lines the template writes it to is
+		// replaced, not the same path within arguments or comments.
+		old := m[1]
+		sites := s.flavor.ProgramSitesPattern().FindAllSubmatchIndex(current, -1)
+		for i := len(sites) - 1; i >= 0; i-- {
+			start, end := programSite(sites[i])
+			if !bytes.Equal(current[start:end], old) {
+				continue
+			}
+			replacement := newPath
+			if old[0] == '"' {
+				replacement = cmdQuote(newPath)
+			}
+			current = append(append(current[:start:start], replacement...), current[end:]...)
+		}
+		return current, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Program = newPath
+	return nil
+}
+
+// programSite returns the span of the group that matched in loc, a match
+// of ProgramSitesPattern.
+func programSite(loc []int) (start, end int) {
+	for i := 2; i+1 < len(loc); i += 2 {
+		if loc[i] >= 0 {
+			return loc[i], loc[i+1]
+		}
+	}
+	return loc[0], loc[0]
+}
+
+// versionPattern matches the comment the templates record Config.Version in.
+var versionPattern = regexp.MustCompile(`(?m)^(?:;;|#) version=(.*)$`)
+
+// UpdateArguments replaces the arguments in the installed configuration,
+// leaving the rest of it, including manual edits, as it is.
+func (s *linuxService) UpdateArguments(args []string) error {
+	args = s.expandArguments(args)
+	pattern := s.flavor.ArgumentsPattern()
+	if pattern == nil {
+		return ErrNotSupported
+	}
+	err := s.EditConfig(func(current []byte) ([]byte, error) {
+		loc := pattern.FindSubmatchIndex(current)
+		if loc == nil {
+			return nil, fmt.Errorf("Unable to find the arguments in %v", s.configPath)
+		}
+		formatted := s.flavor.FormatArguments(args)
+		return append(append(current[:loc[2]:loc[2]], formatted...), current[loc[3]:]...), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Arguments = append([]string(nil), args...)
+	return nil
+}
+
+func (s *linuxService) Validate() error {
+	errs := s.preflight()
+	installed, err := s.installedProgram()
+	if err == nil {
+		err = checkOwner(s.Name, installed, s.Program)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// installedProgram returns the program the installed configuration runs,
+// or "" if the service isn't installed or the program can't be found.
+func (s *linuxService) installedProgram() (string, error) {
+	current, err := ioutil.ReadFile(s.configPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read configuration at %v: %v", s.configPath, err)
+	}
+	m := s.flavor.ProgramPattern().FindSubmatch(current)
+	if m == nil {
+		return "", nil
+	}
+	program := string(m[1])
+	if strings.HasPrefix(program, `"`) {
+		program = strings.Replace(program[1:len(program)-1], `\"`, `"`, -1)
+	}
+	return program, nil
+}
+
+func (s *linuxService) InstalledVersion() (string, error) {
+	current, err := ioutil.ReadFile(s.configPath)
+	if os.IsNotExist(err) {
+		return "", ErrNotInstalled
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read configuration at %v: %v", s.configPath, err)
+	}
+	m := versionPattern.FindSubmatch(current)
+	if m == nil {
+		return "", nil
+	}
+	return string(m[1]), nil
+}
+
+func (s *linuxService) Uninstall() error {
+	if s.DropIn != "" {
+		err := os.Remove(s.configPath)
+		if err != nil {
+			return err
+		}
+		// Remove the drop-in directory if this was the last drop-in.
+		os.Remove(filepath.Dir(s.configPath))
+		return s.daemonReload()
+	}
+	switch s.flavor {
+	case initSystemV:
+		for _, link := range s.rcLinks() {
+			os.Remove(link)
+		}
+	case initSystemd:
+		if !s.isRuntimeUnit() {
+			s.systemctl("disable", s.bootUnit())
+		}
+		if s.Schedule.scheduled() {
+			err := os.Remove(s.timerPath())
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Unable to remove timer: %v", err)
+			}
+		}
+		if s.RemoveCustomTarget {
+			err := s.removeTarget()
+			if err != nil {
+				return err
+			}
+		}
+	case initOpenRC:
+		s.rcUpdate("del")
+	}
+
+	return os.Remove(s.configPath)
+}
+
+// rcLinks returns the SysV runlevel links that start the service in
+// runlevels 2-5 and stop it in 0, 1 and 6.
+func (s *linuxService) rcLinks() []string {
+	var links []string
+	for _, i := range [...]string{"2", "3", "4", "5"} {
+		links = append(links, filepath.Join(s.RootDir, "/etc/rc"+i+".d/S50"+s.Name))
+	}
+	for _, i := range [...]string{"0", "1", "6"} {
+		links = append(links, filepath.Join(s.RootDir, "/etc/rc"+i+".d/K02"+s.Name))
+	}
+	return links
+}
+
+// imagePath returns the path of the configuration file as seen from inside
+// RootDir, which is what links to it must point at.
+func (s *linuxService) imagePath() string {
+	return strings.TrimPrefix(s.configPath, s.RootDir)
+}
+
+// systemctlArgs points the systemctl arguments args at RootDir if it is
+// set.
+func (s *linuxService) systemctlArgs(args ...string) []string {
+	if s.RootDir != "" {
+		args = append([]string{"--root=" + s.RootDir}, args...)
+	}
+	return args
+}
+
+// systemctl runs systemctl with args, pointed at RootDir if it is set.
+func (s *linuxService) systemctl(args ...string) error {
+	return s.control(toolPath("systemctl"), s.systemctlArgs(args...)...)
+}
+
+// daemonReload makes systemd reread its units. Nothing is running in
+// RootDir, so there is nothing to reload there.
+func (s *linuxService) daemonReload() error {
+	if s.RootDir != "" {
+		return nil
+	}
+	return s.control(toolPath("systemctl"), "daemon-reload")
+}
+
+// openRCLink returns the link rc-update add creates for the service in
+// the default runlevel.
+func (s *linuxService) openRCLink() string {
+	return filepath.Join(s.RootDir, "/etc/runlevels/default", s.Name)
+}
+
+// rcUpdate adds the service to or deletes it from the default runlevel
+// with rc-update, or by managing the runlevel link itself in RootDir.
+func (s *linuxService) rcUpdate(action string) error {
+	if s.RootDir == "" {
+		return s.control("rc-update", action, s.Name, "default")
+	}
+	if action == "del" {
+		err := os.Remove(s.openRCLink())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(s.openRCLink()), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(s.imagePath(), s.openRCLink())
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Enable makes the installed service start at boot, doing nothing if it
+// does already. Runtime units are enabled until the next reboot only.
+// Upstart jobs always start at boot.
+func (s *linuxService) Enable() error {
+	if s.inBootState(true) {
+		return nil
+	}
+	switch s.flavor {
+	case initSystemd:
+		if s.isRuntimeUnit() {
+			return s.systemctl("enable", "--runtime", s.bootUnit())
+		}
+		return s.systemctl("enable", s.bootUnit())
+	case initOpenRC:
+		return s.rcUpdate("add")
+	case initSystemV:
+		for _, link := range s.rcLinks() {
+			err := os.Symlink(s.imagePath(), link)
+			if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("Unable to enable service: %v", err)
+			}
+		}
+		return nil
+	default:
+		return ErrNotSupported
+	}
+}
+
+// IsEnabled reports whether the installed service starts at boot. Upstart
+// jobs always do.
+func (s *linuxService) IsEnabled() (bool, error) {
+	if _, err := os.Stat(s.configPath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Unable to stat %s: %v", s.configPath, err)
+	}
+	switch s.flavor {
+	case initSystemd:
+		// is-enabled exits non-zero for disabled units, so only fail if it
+		// printed nothing.
+		out, err := commandOutput(toolPath("systemctl"), s.systemctlArgs("is-enabled", s.bootUnit())...)
+		if err != nil && len(bytes.TrimSpace(out)) == 0 {
+			return false, fmt.Errorf("Unable to query service: %v", err)
+		}
+		return systemdEnabled(string(out)), nil
+	case initOpenRC:
+		if s.RootDir != "" {
+			_, err := os.Lstat(s.openRCLink())
+			return err == nil, nil
+		}
+		out, err := commandOutput("rc-update", "show")
+		if err != nil {
+			return false, fmt.Errorf("Unable to query service: %v", err)
+		}
+		return parseRCUpdateShow(out, s.Name), nil
+	case initSystemV:
+		for _, link := range s.rcLinks() {
+			if _, err := os.Lstat(link); err == nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// Disable stops the installed service from starting at boot, without
+// stopping it now. It does nothing if the service doesn't start at boot.
+// Upstart jobs can't be disabled, so ErrNotSupported is returned there.
+func (s *linuxService) Disable() error {
+	if s.inBootState(false) {
+		return nil
+	}
+	switch s.flavor {
+	case initSystemd:
+		if s.isRuntimeUnit() {
+			return s.systemctl("disable", "--runtime", s.bootUnit())
+		}
+		return s.systemctl("disable", s.bootUnit())
+	case initOpenRC:
+		return s.rcUpdate("del")
+	case initSystemV:
+		for _, link := range s.rcLinks() {
+			err := os.Remove(link)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Unable to disable service: %v", err)
+			}
+		}
+		return nil
+	default:
+		return ErrNotSupported
+	}
+}
+
+// inBootState reports whether the service is installed and IsEnabled
+// reports enabled. When that can't be told it returns false, so Enable and
+// Disable run their command regardless.
+func (s *linuxService) inBootState(enabled bool) bool {
+	if _, err := os.Stat(s.configPath); err != nil {
+		return false
+	}
+	current, err := s.IsEnabled()
+	return err == nil && current == enabled
+}
+
+func (s *linuxService) UninstallIfPresent() error {
+	_, err := os.Stat(s.configPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to stat existing configuration at %v: %v", s.configPath, err)
+	}
+	return s.Uninstall()
+}
+
+func (s *linuxService) Run() error {
+	return s.RunContext(context.Background())
+}
+
+func (s *linuxService) RunContext(ctx context.Context) error {
+	interactive, err := isInteractive()
+	if err != nil {
+		return err
+	}
+	if interactive && !s.AllowInteractiveRun {
+		return ErrNotRunningAsService
+	}
+	err = s.checkRunsHere()
+	if err != nil {
+		return err
+	}
+
+	if flavor != initSystemd {
+		err = createServiceDirs(&s.Config)
+		if err != nil {
+			return err
+		}
+	}
+	// systemd appends output to StdoutPath itself.
+	if s.StdoutPath != "" && flavor != initSystemd {
+		restore, err := redirectOutput(&s.Config)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	if s.StdinPath != "" && flavor != initSystemd {
+		restore, err := redirectInput(&s.Config)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	if flavor != initSystemd {
+		err = loadEnvironmentFiles(s.EnvironmentFiles)
+		if err != nil {
+			return err
+		}
+	}
+	if s.PIDFile != "" && flavor != initSystemd {
+		remove, err := writePIDFile(s.PIDFile)
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+	if s.OOMScoreAdjust != 0 && flavor != initSystemd {
+		err = setOOMScoreAdjust(s.OOMScoreAdjust)
+		if err != nil {
+			return err
+		}
+	}
+
+	return runUntilSignal(ctx, &s.Config)
+}
+
+// oomScoreAdjPath is the file the OOM score adjustment of the process is
+// set through. It is a variable so tests don't have to run as root.
+var oomScoreAdjPath = "/proc/self/oom_score_adj"
+
+// setOOMScoreAdjust sets the OOM score adjustment of the current process,
+// which the service's child processes inherit.
+func setOOMScoreAdjust(adj int) error {
+	err := ioutil.WriteFile(oomScoreAdjPath, []byte(strconv.Itoa(adj)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to set OOM score adjustment: %v", err)
+	}
+	return nil
 }
 
-func isUpstart() bool {
-	if _, err := os.Stat("/sbin/upstart-udev-bridge"); err == nil {
-		return true
+func (s *linuxService) Start() error {
+	var err error
+	switch flavor {
+	case initSystemd:
+		err = s.control(toolPath("systemctl"), "start", s.Name+".service")
+	case initUpstart:
+		err = s.control("initctl", "start", s.Name)
+	case initOpenRC:
+		err = s.control("rc-service", s.Name, "start")
+	default:
+		err = s.control("service", s.Name, "start")
 	}
-	return false
+	return s.notInstalled(err)
 }
 
-func isSystemd() bool {
-	if _, err := os.Stat("/run/systemd/system"); err == nil {
-		return true
+func (s *linuxService) Stop() error {
+	var err error
+	switch flavor {
+	case initSystemd:
+		err = s.control(toolPath("systemctl"), "stop", s.Name+".service")
+	case initUpstart:
+		err = s.control("initctl", "stop", s.Name)
+	case initOpenRC:
+		err = s.control("rc-service", s.Name, "stop")
+	default:
+		err = s.control("service", s.Name, "stop")
 	}
-	return false
+	return s.notInstalled(err)
 }
 
-type linuxService struct {
-	i interface{}
-	*Config
-
-	interactive bool
+// notInstalled returns ErrNotInstalled in place of the error of a failed
+// control command if the service isn't installed, which is then why it
+// failed.
+func (s *linuxService) notInstalled(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, statErr := os.Stat(s.configPath); os.IsNotExist(statErr) {
+		return ErrNotInstalled
+	}
+	return err
 }
 
-var flavor = getFlavor()
-
-type linuxSystem struct{}
+func (s *linuxService) LastExitStatus() (int, error) {
+	if flavor != initSystemd {
+		return 0, ErrNotSupported
+	}
+	props, err := s.show("ExecMainStartTimestampMonotonic", "ExecMainCode", "ExecMainStatus")
+	if err != nil {
+		return 0, err
+	}
+	return parseSystemdExitStatus(props)
+}
 
-func (ls linuxSystem) String() string {
-	return fmt.Sprintf("Linux %s", flavor.String())
+// show returns the properties systemctl show reports for the unit.
+func (s *linuxService) show(properties ...string) (map[string]string, error) {
+	out, err := commandOutput(toolPath("systemctl"), "show", "-p", strings.Join(properties, ","), s.Name+".service")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query service: %v", err)
+	}
+	return parseSystemctlShow(out)
 }
 
-func (ls linuxSystem) Interactive() bool {
-	return interactive
+func (s *linuxService) Export() (ServiceDefinition, error) {
+	def := ServiceDefinition{Config: s.Config.Clone()}
+	if _, err := os.Stat(s.configPath); err != nil {
+		if os.IsNotExist(err) {
+			return def, nil
+		}
+		return def, fmt.Errorf("Unable to stat %s: %v", s.configPath, err)
+	}
+	def.Installed = true
+	if flavor != initSystemd {
+		// The other init systems have no reliable way to report the process.
+		enabled, err := s.IsEnabled()
+		def.Enabled = enabled
+		return def, err
+	}
+	props, err := s.show("ActiveState", "MainPID", "UnitFileState")
+	if err != nil {
+		return def, err
+	}
+	def.Status, def.PID, def.Enabled = parseSystemdState(props)
+	if s.Schedule.scheduled() {
+		// The timer, not the service, is enabled.
+		def.Enabled, err = s.IsEnabled()
+	}
+	return def, err
 }
 
-var system = linuxSystem{}
+// PlatformHandle returns the path of the unit or init script.
+func (s *linuxService) PlatformHandle() (interface{}, error) {
+	return s.configPath, nil
+}
 
-func newService(i interface{}, c *Config) (Service, error) {
-	s := &linuxService{
-		i:      i,
-		Config: c,
+// ResourceUsage reads the usage of the unit from systemd, or of the process
+// in PIDFile from /proc on the other init systems.
+func (s *linuxService) ResourceUsage() (ResourceUsage, error) {
+	if flavor == initSystemd {
+		props, err := s.show("ActiveState", "MainPID", "MemoryCurrent", "CPUUsageNSec")
+		if err != nil {
+			return ResourceUsage{}, err
+		}
+		return parseSystemdUsage(props)
 	}
-	var err error
-	s.interactive, err = isInteractive()
-
-	return s, err
+	pid, err := s.readPIDFile()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return procUsage(pid)
 }
 
-func (s *linuxService) String() string {
-	if len(s.DisplayName) > 0 {
-		return s.DisplayName
+// readPIDFile returns the PID in PIDFile. It returns ErrNotSupported
+// without a PIDFile and ErrNotRunning if the file doesn't exist.
+func (s *linuxService) readPIDFile() (int, error) {
+	if s.PIDFile == "" {
+		return 0, ErrNotSupported
 	}
-	return s.Name
+	b, err := ioutil.ReadFile(s.PIDFile)
+	if os.IsNotExist(err) {
+		return 0, ErrNotRunning
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read PID file: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse PID file %s: %v", s.PIDFile, err)
+	}
+	return pid, nil
 }
 
-type initFlavor uint8
+// parseSystemdUsage returns the usage in the MemoryCurrent and CPUUsageNSec
+// properties of a running unit. Without accounting systemd reports them as
+// unset, and the main process is measured through /proc instead.
+func parseSystemdUsage(props map[string]string) (ResourceUsage, error) {
+	status, pid, _ := parseSystemdState(props)
+	if status != StatusRunning || pid == 0 {
+		return ResourceUsage{}, ErrNotRunning
+	}
+	memory, memErr := strconv.ParseUint(props["MemoryCurrent"], 10, 64)
+	cpu, cpuErr := strconv.ParseUint(props["CPUUsageNSec"], 10, 64)
+	if memErr != nil || cpuErr != nil || memory == math.MaxUint64 || cpu == math.MaxUint64 {
+		return procUsage(pid)
+	}
+	return ResourceUsage{PID: pid, RSS: memory, CPUTime: time.Duration(cpu)}, nil
+}
 
-func (f initFlavor) String() string {
-	switch f {
-	case initSystemV:
-		return "System-V"
-	case initUpstart:
-		return "Upstart"
-	case initSystemd:
-		return "systemd"
+// StartAndCapture reads the output from StdoutPath, or from the unit's
+// journal on systemd.
+func (s *linuxService) StartAndCapture(ctx context.Context, d time.Duration) (string, error) {
+	var read func() (string, error)
+	var err error
+	switch {
+	case s.StdoutPath != "":
+		read, err = fileOutput(s.StdoutPath)
+	case flavor == initSystemd:
+		read = s.journalOutput()
 	default:
-		panic("Invalid flavor")
+		return "", ErrNotSupported
+	}
+	if err != nil {
+		return "", err
 	}
+	return captureStart(ctx, s, d, read)
 }
 
-// Systemd services should be supported, but are not currently.
-var errNoUserServiceSystemd = errors.New("User services are not supported on systemd.")
-
-var errNoUserServiceSystemV = errors.New("User services are not supported on SystemV.")
-
-// Upstart has some support for user services in graphical sessions.
-// Due to the mix of actual support for user services over versions, just don't bother.
-// Upstart will be replaced by systemd in most cases anyway.
-var errNoUserServiceUpstart = errors.New("User services are not supported on Upstart.")
+// journalOutput returns a function that reads the messages the unit has
+// logged to the journal since journalOutput was called.
+func (s *linuxService) journalOutput() func() (string, error) {
+	since := fmt.Sprintf("@%d", now().Unix())
+	return func() (string, error) {
+		out, err := commandOutput("journalctl", "--unit", s.Name+".service", "--since", since, "--output", "cat", "--no-pager")
+		if err != nil {
+			return "", fmt.Errorf("Unable to read the journal: %v", err)
+		}
+		return string(out), nil
+	}
+}
 
-func (f initFlavor) ConfigPath(name string, c *Config) (cp string, err error) {
-	if c.UserService {
-		switch f {
-		case initSystemd:
-			err = errNoUserServiceSystemd
-		case initSystemV:
-			err = errNoUserServiceSystemV
-		case initUpstart:
-			err = errNoUserServiceUpstart
-		default:
-			panic("Invalid flavor")
+// Processes lists the unit's cgroup on systemd and the process group of the
+// process in PIDFile on the other init systems.
+func (s *linuxService) Processes() ([]int, error) {
+	if flavor == initSystemd {
+		props, err := s.show("ControlGroup")
+		if err != nil {
+			return nil, err
 		}
-		return
+		if props["ControlGroup"] == "" {
+			// systemd removes the cgroup of a stopped unit.
+			return nil, ErrNotRunning
+		}
+		return cgroupProcesses(props["ControlGroup"])
 	}
-	switch f {
-	case initSystemd:
-		cp = "/etc/systemd/system/" + name + ".service"
-	case initSystemV:
-		cp = "/etc/init.d/" + name
-	case initUpstart:
-		cp = "/etc/init/" + name + ".conf"
-	default:
-		panic("Invalid flavor")
+	pid, err := s.readPIDFile()
+	if err != nil {
+		return nil, err
 	}
-	return
+	return processGroup(pid)
 }
 
-func (f initFlavor) Template() *template.Template {
-	var templ string
-	switch f {
-	case initSystemd:
-		templ = systemdScript
-	case initSystemV:
-		templ = systemVScript
-	case initUpstart:
-		templ = upstartScript
+// cgroupDirs are the cgroup hierarchies a unit's cgroup is looked up in:
+// the unified hierarchy of cgroup v2, then the systemd hierarchy of v1. It
+// is a variable so tests can use a fake one.
+var cgroupDirs = []string{"/sys/fs/cgroup", "/sys/fs/cgroup/systemd"}
+
+// cgroupProcesses returns the processes in cgroup and the cgroups below
+// it, which a unit with Delegate= may create.
+func cgroupProcesses(cgroup string) ([]int, error) {
+	for _, base := range cgroupDirs {
+		dir := filepath.Join(base, cgroup)
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.procs")); err != nil {
+			continue
+		}
+		var pids []int
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.Name() != "cgroup.procs" {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			procs, err := parseCgroupProcs(b)
+			pids = append(pids, procs...)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the processes of cgroup %s: %v", cgroup, err)
+		}
+		sort.Ints(pids)
+		return pids, nil
 	}
-	return template.Must(template.New(f.String() + "Script").Funcs(tf).Parse(templ))
+	return nil, ErrNotRunning
 }
 
-var interactive = false
-
-func init() {
-	var err error
-	interactive, err = isInteractive()
-	if err != nil {
-		panic(err)
+// parseCgroupProcs parses a cgroup.procs file, one PID per line.
+func parseCgroupProcs(b []byte) ([]int, error) {
+	var pids []int
+	for _, line := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse PID %q: %v", line, err)
+		}
+		pids = append(pids, pid)
 	}
+	return pids, nil
 }
 
-func isInteractive() (bool, error) {
-	// TODO: This is not true for user services.
-	return os.Getppid() != 1, nil
+// processGroup returns the processes in the process group of pid, found by
+// reading the stat file of every process in /proc.
+func processGroup(pid int) ([]int, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return nil, err
+	}
+	pgrp := fields[2]
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list processes: %v", err)
+	}
+	var pids []int
+	for _, entry := range entries {
+		other, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Processes may exit while the directory is read.
+		if fields, err := procStat(other); err == nil && fields[2] == pgrp {
+			pids = append(pids, other)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
 }
 
-func (s *linuxService) Install() error {
-	confPath, err := flavor.ConfigPath(s.Name, s.Config)
+// procStat returns the fields of /proc/<pid>/stat that follow the command
+// name, starting with the state. The name in parentheses may contain
+// spaces, so the fields are counted from after it. It returns
+// ErrNotRunning if the process doesn't exist.
+func procStat(pid int) ([]string, error) {
+	path := filepath.Join(procDir, strconv.Itoa(pid), "stat")
+	stat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotRunning
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Unable to read process status: %v", err)
 	}
-	_, err = os.Stat(confPath)
-	if err == nil {
-		return fmt.Errorf("Init already exists: %s", confPath)
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 13 {
+		return nil, fmt.Errorf("Unable to parse %s", path)
 	}
+	return fields, nil
+}
 
-	f, err := os.Create(confPath)
+// procDir is where the proc filesystem is mounted. It is a variable so
+// tests can use a fake one.
+var procDir = "/proc"
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat. It
+// is 100 on every architecture Linux runs on.
+const clockTicks = 100
+
+// procUsage reads the usage of process pid from /proc/<pid>/stat and
+// /proc/<pid>/status.
+func procUsage(pid int) (ResourceUsage, error) {
+	dir := filepath.Join(procDir, strconv.Itoa(pid))
+	fields, err := procStat(pid)
 	if err != nil {
-		return err
+		return ResourceUsage{}, err
 	}
-	defer f.Close()
-
-	path, err := osext.Executable()
+	// utime and stime are fields 14 and 15.
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
 	if err != nil {
-		return err
+		return ResourceUsage{}, fmt.Errorf("Unable to parse utime: %v", err)
 	}
-
-	var to = &struct {
-		Display     string
-		Description string
-		Path        string
-	}{
-		s.DisplayName,
-		s.Description,
-		path,
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return ResourceUsage{}, fmt.Errorf("Unable to parse stime: %v", err)
+	}
+	usage := ResourceUsage{
+		PID:     pid,
+		CPUTime: time.Duration(utime+stime) * time.Second / clockTicks,
 	}
 
-	err = flavor.Template().Execute(f, to)
+	status, err := ioutil.ReadFile(filepath.Join(dir, "status"))
 	if err != nil {
-		return err
+		return ResourceUsage{}, fmt.Errorf("Unable to read process status: %v", err)
 	}
-
-	if flavor == initSystemV {
-		if err = os.Chmod(confPath, 0755); err != nil {
-			return err
-		}
-		for _, i := range [...]string{"2", "3", "4", "5"} {
-			if err = os.Symlink(confPath, "/etc/rc"+i+".d/S50"+s.Name); err != nil {
-				continue
-			}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
 		}
-		for _, i := range [...]string{"0", "1", "6"} {
-			if err = os.Symlink(confPath, "/etc/rc"+i+".d/K02"+s.Name); err != nil {
-				continue
-			}
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(line[len("VmRSS:"):]), " kB"), 10, 64)
+		if err != nil {
+			return ResourceUsage{}, fmt.Errorf("Unable to parse VmRSS: %v", err)
 		}
+		usage.RSS = kb * 1024
 	}
+	return usage, nil
+}
 
+// RotateLogs rotates the file Run writes StdoutPath to. systemd writes the
+// output itself, so there is nothing to do there.
+func (s *linuxService) RotateLogs() error {
 	if flavor == initSystemd {
-		err = exec.Command("systemctl", "enable", s.Name+".service").Run()
-		if err != nil {
-			return err
+		return nil
+	}
+	return rotateActiveLog()
+}
+
+// WatchStatus polls the status Export reports.
+func (s *linuxService) WatchStatus(ctx context.Context) (<-chan Status, error) {
+	return watchStatus(ctx, s.Export)
+}
+
+// Wait polls the ActiveState and MainPID of the unit until it stops.
+func (s *linuxService) Wait(ctx context.Context) (int, error) {
+	if flavor != initSystemd {
+		return 0, ErrNotSupported
+	}
+	return waitExit(ctx, s.Export, s.LastExitStatus)
+}
+
+// parseSystemdState derives the status, main PID and boot enablement from
+// the ActiveState, MainPID and UnitFileState properties of a unit.
+func parseSystemdState(props map[string]string) (status Status, pid int, enabled bool) {
+	switch props["ActiveState"] {
+	case "active", "reloading":
+		status = StatusRunning
+	case "inactive", "failed":
+		status = StatusStopped
+	}
+	pid, _ = strconv.Atoi(props["MainPID"])
+	return status, pid, systemdEnabled(props["UnitFileState"])
+}
+
+// systemdEnabled reports whether a unit file state, as printed by systemctl
+// is-enabled or the UnitFileState property, starts the unit at boot.
+func systemdEnabled(state string) bool {
+	switch strings.TrimSpace(state) {
+	case "enabled", "enabled-runtime":
+		return true
+	}
+	return false
+}
+
+// parseRCUpdateShow reports whether rc-update show lists the named service
+// in a runlevel.
+func parseRCUpdateShow(out []byte, name string) bool {
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, "|", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == name && strings.TrimSpace(fields[1]) != "" {
+			return true
 		}
-		return exec.Command("systemctl", "daemon-reload").Run()
 	}
+	return false
+}
 
-	return nil
+// parseSystemctlShow parses the KEY=VALUE lines printed by systemctl show.
+// Properties systemd doesn't know are left out of its output, so callers
+// treat a missing key as an empty value.
+func parseSystemctlShow(out []byte) (map[string]string, error) {
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Unable to parse systemctl show output line %q", line)
+		}
+		props[key] = value
+	}
+	return props, nil
 }
 
-func (s *linuxService) Uninstall() error {
-	if flavor == initSystemd {
-		exec.Command("systemctl", "disable", s.Name+".service").Run()
+// parseSystemdExitStatus derives the exit status from the ExecMain
+// properties of a unit. ExecMainCode is the si_code of the exited process:
+// 1 means it exited and ExecMainStatus is its exit code, anything else
+// means it was killed and ExecMainStatus is the signal.
+func parseSystemdExitStatus(props map[string]string) (int, error) {
+	if ts := props["ExecMainStartTimestampMonotonic"]; ts == "" || ts == "0" {
+		return 0, ErrNoExitStatus
 	}
-	cp, err := flavor.ConfigPath(s.Name, s.Config)
+	status, err := strconv.Atoi(props["ExecMainStatus"])
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("Unable to parse ExecMainStatus %q: %v", props["ExecMainStatus"], err)
 	}
-	if err := os.Remove(cp); err != nil {
-		return err
+	switch props["ExecMainCode"] {
+	case "0", "1":
+		return status, nil
+	default:
+		return 128 + status, nil
 	}
-	return nil
 }
 
-func (s *linuxService) Logger(errs chan<- error) (Logger, error) {
-	if s.interactive {
-		return ConsoleLogger, nil
+func (s *linuxService) Capabilities() Capability {
+	switch flavor {
+	case initSystemd:
+		return CapReload | CapMask | CapResourceLimits
+	case initUpstart:
+		return CapReload
+	default:
+		return 0
 	}
-	return s.SystemLogger(errs)
 }
-func (s *linuxService) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+
+// feedWatchdog tells systemd the service is healthy, resetting the
+// WatchdogSec timer. Outside of systemd NOTIFY_SOCKET is unset and this
+// does nothing.
+func feedWatchdog() {
+	if err := sdNotify("WATCHDOG=1"); err != nil {
+		logf("Unable to notify systemd: %v", err)
+	}
 }
 
-func (s *linuxService) Run() (err error) {
-	err = s.i.Start(s)
+// sdNotify sends a state update to systemd, as sd_notify(3) does.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// Abstract namespace socket.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// journalSocket is where journald accepts records in its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
 
-	sigChan := make(chan os.Signal, 3)
+// openEventSink sends records to the journal. It is a variable so tests can
+// substitute a fake backend.
+var openEventSink = func(name string) (eventSink, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to journal: %v", err)
+	}
+	return &journalSink{conn: conn, name: name}, nil
+}
 
-	signal.Notify(sigChan, os.Interrupt, os.Kill)
+type journalSink struct {
+	conn net.Conn
+	name string
+}
 
-	<-sigChan
+func (s *journalSink) info(msg string) error {
+	var b bytes.Buffer
+	b.WriteString("PRIORITY=6\n")
+	b.WriteString("SYSLOG_IDENTIFIER=" + s.name + "\n")
+	journalField(&b, "MESSAGE", msg)
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
 
-	return s.i.Stop(s)
+func (s *journalSink) Close() error {
+	return s.conn.Close()
 }
 
-func (s *linuxService) Start() error {
-	switch flavor {
-	case initSystemd:
-		return exec.Command("systemctl", "start", s.Name+".service").Run()
-	case initUpstart:
-		return exec.Command("initctl", "start", s.Name).Run()
-	default:
-		return exec.Command("service", s.Name, "start").Run()
+// journalField appends a field in journald's native format. Values that
+// contain a newline must be sent with an explicit little-endian length.
+func journalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
 	}
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
 }
 
-func (s *linuxService) Stop() error {
+// Restart uses the init system's own restart, which starts a stopped
+// service too. Upstart's restart doesn't reread the job configuration, so
+// there the job is stopped and started instead; initctl stop waits for the
+// job to stop.
+func (s *linuxService) Restart() error {
+	var err error
 	switch flavor {
 	case initSystemd:
-		return exec.Command("systemctl", "stop", s.Name+".service").Run()
+		if s.AutoResetFailed {
+			err = s.ResetFailed()
+			if err != nil {
+				return s.notInstalled(err)
+			}
+		}
+		err = s.control(toolPath("systemctl"), "restart", s.Name+".service")
 	case initUpstart:
-		return exec.Command("initctl", "stop", s.Name).Run()
+		err = s.Stop()
+		if err != nil {
+			return err
+		}
+		err = s.control("initctl", "start", s.Name)
+	case initOpenRC:
+		err = s.control("rc-service", s.Name, "restart")
 	default:
-		return exec.Command("service", s.Name, "stop").Run()
+		err = s.control("service", s.Name, "restart")
 	}
+	return s.notInstalled(err)
 }
 
-func (s *linuxService) Restart() error {
-	err := s.Stop()
+// drainSignal and undrainSignal ask a running service to drain and undrain.
+var drainSignal, undrainSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
+
+// Drain sends drainSignal to the main process of a systemd unit. The other
+// init systems don't know the process, so ErrNotSupported is returned.
+func (s *linuxService) Drain() error {
+	return s.signalMain("SIGUSR1")
+}
+
+// Undrain sends undrainSignal like Drain.
+func (s *linuxService) Undrain() error {
+	return s.signalMain("SIGUSR2")
+}
+
+// killProcess sends SIGKILL to process pid. It is a variable so tests don't
+// kill anything.
+var killProcess = func(pid int) error {
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// Kill sends SIGKILL to every process of a systemd unit. The other init
+// systems don't know the process, so the one in PIDFile is killed, and
+// ErrNotSupported is returned without one.
+func (s *linuxService) Kill() error {
+	if flavor == initSystemd {
+		def, err := s.Export()
+		if err != nil {
+			return err
+		}
+		if !def.Installed {
+			return ErrNotInstalled
+		}
+		if def.Status != StatusRunning {
+			return ErrNotRunning
+		}
+		return s.control(toolPath("systemctl"), "kill", "--signal=SIGKILL", s.Name+".service")
+	}
+	pid, err := s.readPIDFile()
 	if err != nil {
 		return err
 	}
-	time.Sleep(50 * time.Millisecond)
-	return s.Start()
+	err = killProcess(pid)
+	if err == syscall.ESRCH {
+		return ErrNotRunning
+	}
+	return err
+}
+
+func (s *linuxService) signalMain(sig string) error {
+	if flavor != initSystemd {
+		return ErrNotSupported
+	}
+	return s.control(toolPath("systemctl"), "kill", "--kill-who=main", "--signal="+sig, s.Name+".service")
+}
+
+func (s *linuxService) ResetFailed() error {
+	if flavor != initSystemd {
+		return ErrNotSupported
+	}
+	return s.control(toolPath("systemctl"), "reset-failed", s.Name+".service")
+}
+
+// systemdEnvEscaper escapes an Environment= assignment inside double
+// quotes. systemd unescapes C-style escapes in it and expands specifiers
+// starting with %. $ is doubled as well, so the value is never taken as a
+// variable reference.
+var systemdEnvEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"%", "%%",
+	"$", "$$",
+)
+
+// escapeSystemdEnv returns the quoted value of an Environment= line that
+// sets key to value.
+func escapeSystemdEnv(key, value string) string {
+	return `"` + systemdEnvEscaper.Replace(key+"="+value) + `"`
+}
+
+// cmdQuote double-quotes a word for a unit file or shell script.
+func cmdQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
 }
 
 var tf = map[string]interface{}{
-	"cmd": func(s string) string {
-		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+	"cmd":  cmdQuote,
+	"env":  escapeSystemdEnv,
+	"join": strings.Join,
+	// seconds formats a duration as a systemd time span in seconds.
+	"seconds": func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	},
+	// watchdog is the WatchdogSec for a health check interval. It allows
+	// one more interval than the checks Run tolerates failing, so a hung
+	// check is caught too.
+	"watchdog": func(interval time.Duration) time.Duration {
+		return interval * (healthcheckMaxFailures + 1)
 	},
+	"sq":         sqEscape,
+	"onCalendar": onCalendar,
+	// isTrue reports whether an optional flag is set to true.
+	"isTrue": func(b *bool) bool {
+		return b != nil && *b
+	},
+	"extraSections": extraSections,
+}
+
+// extraSections returns the sections of ExtraDirectives that aren't part
+// of the generated unit, in sorted order.
+func extraSections(directives map[string][]string) []string {
+	var sections []string
+	for section := range directives {
+		switch section {
+		case "Unit", "Service", "Install":
+		default:
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+// weekdayNames are the abbreviations systemd calendar events use.
+var weekdayNames = [...]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// onCalendar formats a calendar interval as a systemd calendar event, such
+// as "Mon,Fri *-*-* 03:30:00".
+func onCalendar(c CalendarInterval) string {
+	field := func(v int) string {
+		if v == 0 {
+			return "*"
+		}
+		return fmt.Sprintf("%02d", v)
+	}
+	var b strings.Builder
+	for i, weekday := range c.Weekdays {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(weekdayNames[weekday])
+	}
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	fmt.Fprintf(&b, "*-%s-%s %02d:%02d:00", field(c.Month), field(c.Day), c.Hour, c.Minute)
+	return b.String()
+}
+
+// sqEscape escapes a string for use inside a single-quoted shell string.
+func sqEscape(s string) string {
+	return strings.Replace(s, `'`, `'\''`, -1)
 }
 
 const systemVScript = `#!/bin/sh
-# For RedHat and cousins:
+{{if .Version}}# version={{.Version}}
+{{end}}# For RedHat and cousins:
 # chkconfig: - 99 01
-# description: {{.Description}}
-# processname: {{.Path}}
+# description: {{.Name}}
+# processname: {{.Program}}
 
 ### BEGIN INIT INFO
-# Provides:          {{.Path}}
+# Provides:          {{.Name}}
 # Required-Start:
 # Required-Stop:
 # Default-Start:     2 3 4 5
 # Default-Stop:      0 1 6
-# Short-Description: {{.Display}}
-# Description:       {{.Description}}
+# Short-Description: {{.Name}}
+# Description:       {{or .Description .Name}}
 ### END INIT INFO
 
-cmd="{{.Path}}"
+cmd="{{.Program}}"
 
 name=$(basename $0)
-pid_file="/var/run/$name.pid"
+pid_file="{{if .PIDFile}}{{.PIDFile}}{{else}}/var/run/$name.pid{{end}}"
 stdout_log="/var/log/$name.log"
 stderr_log="/var/log/$name.err"
 
@@ -401,9 +2002,10 @@ exit 0`
 
 // The upstart script should stop with an INT or the Go runtime will terminate
 // the program before the Stop handler can run.
-const upstartScript = `# {{.Description}}
-
-description     "{{.Display}}"
+const upstartScript = `# {{.Name}}
+{{if .Version}}# version={{.Version}}
+{{end}}
+description     "{{or .Description .Name}}"
 
 kill signal INT
 start on filesystem or runlevel [2345]
@@ -418,27 +2020,144 @@ umask 022
 console none
 
 pre-start script
-    test -x {{.Path}} || { stop; exit 0; }
+    test -x {{.Program}} || { stop; exit 0; }
 end script
 
 # Start
-exec {{.Path}}
+exec {{.Program}}{{range .Arguments}} {{.|cmd}}{{end}}
 `
 
-const systemdScript = `[Unit]
-Description={{.Description}}
-ConditionFileIsExecutable={{.Path|cmd}}
-
+const systemdScript = `{{if .Version}};; version={{.Version}}
+{{end}}[Unit]
+Description={{or .Description .Name}}
+ConditionFileIsExecutable={{.Program|cmd}}
+{{range .ConditionPathExists}}ConditionPathExists={{.}}
+{{end}}{{if isTrue .NetworkState}}Requires=network-online.target
+{{end}}{{if .RequireNetwork}}Wants=network-online.target
+{{end}}{{if or (isTrue .NetworkState) .RequireNetwork}}After=network-online.target
+{{end}}{{if .OnFailure}}OnFailure={{join .OnFailure " "}}
+{{end}}StartLimitIntervalSec={{seconds .StartLimitIntervalSec}}
+StartLimitBurst={{.StartLimitBurst}}
+{{if .StopWhenUnneeded}}StopWhenUnneeded=yes
+{{end}}{{if .RefuseManualStart}}RefuseManualStart=yes
+{{end}}{{if .RefuseManualStop}}RefuseManualStop=yes
+{{end}}{{range index .ExtraDirectives "Unit"}}{{.}}
+{{end}}
 [Service]
-StartLimitInterval=5
-StartLimitBurst=10
-ExecStart={{.Path|cmd}}{{range .Arguments}} {{.|cmd}}{{end}}
-{{if .ChRoot}}RootDirectory={{.ChRoot|cmd}}{{end}}
-{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|cmd}}{{end}}
-{{if .UserName}}User={{.UserName}}{{end}}
-Restart=always
+{{if .Oneshot}}Type=oneshot
+{{end}}{{if .RemainAfterExit}}RemainAfterExit=yes
+{{end}}ExecStart={{.Program|cmd}}{{range .Arguments}} {{.|cmd}}{{end}}
+{{template "serviceDirectives" .}}{{if not .Oneshot}}Restart=always
 RestartSec=120
+{{end}}{{range index .ExtraDirectives "Service"}}{{.}}
+{{end}}
+[Install]
+WantedBy={{join .WantedBy " "}}
+{{range index .ExtraDirectives "Install"}}{{.}}
+{{end}}{{range $section := extraSections .ExtraDirectives}}
+[{{$section}}]
+{{range index $.ExtraDirectives $section}}{{.}}
+{{end}}{{end}}`
+
+// systemdServiceDirectives are the [Service] directives of the optional
+// fields, shared by the unit and the drop-in.
+const systemdServiceDirectives = `{{define "serviceDirectives"}}{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|cmd}}
+{{end}}{{if .StdoutPath}}StandardOutput=append:{{.StdoutPath}}
+StandardError=append:{{.StdoutPath}}
+{{end}}{{if .StdinPath}}StandardInput=file:{{.StdinPath}}
+{{end}}{{range .EnvironmentFiles}}EnvironmentFile=-{{.}}
+{{end}}{{range $k, $v := .EnvVars}}Environment={{env $k $v}}
+{{end}}{{if .RuntimeDirectory}}RuntimeDirectory={{.RuntimeDirectory}}
+{{end}}{{if .StateDirectory}}StateDirectory={{.StateDirectory}}
+{{end}}{{if .CacheDirectory}}CacheDirectory={{.CacheDirectory}}
+{{end}}{{if .LogsDirectory}}LogsDirectory={{.LogsDirectory}}
+{{end}}{{with .Hardening}}{{if .NoNewPrivileges}}NoNewPrivileges=yes
+{{end}}{{if .ProtectSystem}}ProtectSystem={{.ProtectSystem}}
+{{end}}{{if .PrivateTmp}}PrivateTmp=yes
+{{end}}{{if .ReadWritePaths}}ReadWritePaths={{join .ReadWritePaths " "}}
+{{end}}{{end}}{{if .CPUSchedulingPolicy}}CPUSchedulingPolicy={{.CPUSchedulingPolicy}}
+{{end}}{{if .IOSchedulingClass}}IOSchedulingClass={{.IOSchedulingClass}}
+{{end}}{{if .PIDFile}}PIDFile={{.PIDFile}}
+{{end}}{{if .KillMode}}KillMode={{.KillMode}}
+{{end}}{{if .StopSignal}}KillSignal={{.StopSignal}}
+{{end}}{{if .Slice}}Slice={{.Slice}}
+{{end}}{{if .CPUQuota}}CPUQuota={{.CPUQuota}}
+{{end}}{{if .TasksMax}}TasksMax={{.TasksMax}}
+{{end}}{{if .OOMScoreAdjust}}OOMScoreAdjust={{.OOMScoreAdjust}}
+{{end}}{{if and .Healthcheck .HealthcheckInterval}}WatchdogSec={{seconds (watchdog .HealthcheckInterval)}}
+{{end}}{{end}}`
+
+// systemdDropInScript is the drop-in written instead of the unit when
+// DropIn is set. It only has the directives of the fields that are set;
+// writeDropIn removes the sections that are left empty.
+const systemdDropInScript = `{{if .Version}};; version={{.Version}}
+{{end}}[Unit]
+{{if .Description}}Description={{.Description}}
+{{end}}{{if .ExecStart}}ConditionFileIsExecutable={{.Program|cmd}}
+{{end}}{{range .ConditionPathExists}}ConditionPathExists={{.}}
+{{end}}{{if isTrue .NetworkState}}Requires=network-online.target
+{{end}}{{if .RequireNetwork}}Wants=network-online.target
+{{end}}{{if or (isTrue .NetworkState) .RequireNetwork}}After=network-online.target
+{{end}}{{if .OnFailure}}OnFailure={{join .OnFailure " "}}
+{{end}}{{if .StartLimitIntervalSec}}StartLimitIntervalSec={{seconds .StartLimitIntervalSec}}
+{{end}}{{if .StartLimitBurst}}StartLimitBurst={{.StartLimitBurst}}
+{{end}}{{if .StopWhenUnneeded}}StopWhenUnneeded=yes
+{{end}}{{if .RefuseManualStart}}RefuseManualStart=yes
+{{end}}{{if .RefuseManualStop}}RefuseManualStop=yes
+{{end}}{{range index .ExtraDirectives "Unit"}}{{.}}
+{{end}}[Service]
+{{if .Oneshot}}Type=oneshot
+{{end}}{{if .RemainAfterExit}}RemainAfterExit=yes
+{{end}}{{if .ExecStart}}ExecStart=
+ExecStart={{.Program|cmd}}{{range .Arguments}} {{.|cmd}}{{end}}
+{{end}}{{template "serviceDirectives" .}}{{if .Oneshot}}Restart=no
+{{end}}{{range index .ExtraDirectives "Service"}}{{.}}
+{{end}}[Install]
+{{range index .ExtraDirectives "Install"}}{{.}}
+{{end}}{{range $section := extraSections .ExtraDirectives}}[{{$section}}]
+{{range index $.ExtraDirectives $section}}{{.}}
+{{end}}{{end}}`
+
+// systemdTimerScript is the timer unit of a scheduled service. An Interval
+// runs the service that long after the timer is started and then that long
+// after each run.
+const systemdTimerScript = `[Unit]
+Description=Schedule of {{.Name}}
+
+[Timer]
+{{range .Schedule.Calendar}}OnCalendar={{onCalendar .}}
+{{end}}{{with .Schedule.Interval}}OnActiveSec={{seconds .}}
+OnUnitActiveSec={{seconds .}}
+{{end}}Unit={{.Name}}.service
+
+[Install]
+WantedBy=timers.target
+`
+
+// systemdTargetScript is the unit of a CustomTarget created by
+// InstallOrUpdate.
+const systemdTargetScript = `[Unit]
+Description={{.CustomTarget}}
 
 [Install]
 WantedBy=multi-user.target
 `
+
+// The OpenRC script runs the program under supervise-daemon, which restarts
+// it if it exits. command_args is eval'ed by openrc-run, so each argument is
+// double-quoted inside the single-quoted assignment.
+const openRCScript = `#!/sbin/openrc-run
+{{if .Version}}# version={{.Version}}
+{{end}}
+name={{.Name|cmd}}
+description={{or .Description .Name|cmd}}
+
+supervisor="supervise-daemon"
+command={{.Program|cmd}}
+command_args='{{range $i, $arg := .Arguments}}{{if $i}} {{end}}{{$arg|cmd|sq}}{{end}}'
+{{if .WorkingDirectory}}directory={{.WorkingDirectory|cmd}}
+{{end}}
+depend() {
+	after net
+}
+`
@@ -0,0 +1,2683 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func renderSystemd(t *testing.T, c Config) string {
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.flavor = initSystemd
+	var buf bytes.Buffer
+	if err := s.WriteConfig(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestSystemdWantedBy(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if !strings.Contains(out, "\nWantedBy=multi-user.target\n") {
+		t.Errorf("default target missing from unit:\n%s", out)
+	}
+
+	out = renderSystemd(t, Config{
+		Name:     "test",
+		Program:  "/usr/bin/test",
+		WantedBy: []string{"graphical.target", "custom.target"},
+	})
+	if !strings.Contains(out, "\nWantedBy=graphical.target custom.target\n") {
+		t.Errorf("custom targets missing from unit:\n%s", out)
+	}
+	if strings.Count(out, "WantedBy=") != 1 {
+		t.Errorf("expected a single WantedBy line:\n%s", out)
+	}
+}
+
+func TestUninstallIfPresent(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.configPath = filepath.Join(dir, "test.service")
+	if err := s.UninstallIfPresent(); err != nil {
+		t.Errorf("expected no error for an absent service, got %v", err)
+	}
+
+	// A path below a regular file can't be stat'ed, which must not be
+	// mistaken for the service being absent.
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.configPath = filepath.Join(file, "test.service")
+	if err := s.UninstallIfPresent(); err == nil {
+		t.Error("expected an error when the configuration can't be checked")
+	}
+}
+
+func TestEscapeSystemdEnv(t *testing.T) {
+	for _, tt := range []struct {
+		key, value string
+		want       string
+	}{
+		{"LEVEL", "debug", `"LEVEL=debug"`},
+		{"GREETING", "hello world", `"GREETING=hello world"`},
+		{"EMPTY", "", `"EMPTY="`},
+		{"HOME_DIR", "$HOME/data", `"HOME_DIR=$$HOME/data"`},
+		{"PRICE", "$5 or $$", `"PRICE=$$5 or $$$$"`},
+		{"QUOTED", `say "hi"`, `"QUOTED=say \"hi\""`},
+		{"PATH_WIN", `C:\data`, `"PATH_WIN=C:\\data"`},
+		{"LINES", "a\nb\tc\r", `"LINES=a\nb\tc\r"`},
+		{"PERCENT", "100%n", `"PERCENT=100%%n"`},
+	} {
+		if got := escapeSystemdEnv(tt.key, tt.value); got != tt.want {
+			t.Errorf("escapeSystemdEnv(%q, %q) = %s, want %s", tt.key, tt.value, got, tt.want)
+		}
+	}
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", EnvVars: map[string]string{"MSG": "a \"b\"\nc"}})
+	if !strings.Contains(out, "\nEnvironment=\"MSG=a \\\"b\\\"\\nc\"\n") {
+		t.Errorf("environment not escaped:\n%s", out)
+	}
+}
+
+func TestSystemdDeterministic(t *testing.T) {
+	c := Config{
+		Name:    "test",
+		Program: "/usr/bin/test",
+		EnvVars: map[string]string{"B": "2", "A": "1", "C": "3", "D": "4", "E": "5"},
+	}
+	first := renderSystemd(t, c)
+	if !strings.Contains(first, "Environment=\"A=1\"\nEnvironment=\"B=2\"\n") {
+		t.Errorf("environment not rendered in key order:\n%s", first)
+	}
+	for i := 0; i < 100; i++ {
+		if out := renderSystemd(t, c); out != first {
+			t.Fatalf("render %d differs:\n%s\nvs\n%s", i, out, first)
+		}
+	}
+}
+
+func TestNewCopiesConfig(t *testing.T) {
+	c := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-a"}}
+	svc, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Arguments[0] = "-b"
+
+	var buf bytes.Buffer
+	if err := initSystemd.Template().Execute(&buf, svc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `ExecStart="/usr/bin/test" "-a"`) {
+		t.Errorf("caller mutation leaked into the service:\n%s", buf.String())
+	}
+}
+
+// fakeSystemd switches the package to the systemd flavor and records the
+// control commands issued instead of running them.
+func fakeSystemd(t *testing.T) *[]string {
+	oldFlavor, oldRun := flavor, runCommand
+	t.Cleanup(func() { flavor, runCommand = oldFlavor, oldRun })
+
+	var commands []string
+	flavor = initSystemd
+	runCommand = func(name string, args ...string) error {
+		commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	return &commands
+}
+
+func TestSetSystemctlPath(t *testing.T) {
+	commands := fakeSystemd(t)
+	SetSystemctlPath("/run/current-system/sw/bin/systemctl")
+	defer SetSystemctlPath("")
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/run/current-system/sw/bin/systemctl start test.service"}; !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+}
+
+func TestInstallUnitDir(t *testing.T) {
+	for _, dir := range []string{"", "/usr/lib/systemd/system", "/run/systemd/system"} {
+		commands := fakeSystemd(t)
+		root := t.TempDir()
+		unitDir := filepath.Join(root, dir)
+		if dir == "" {
+			unitDir = filepath.Join(root, defaultUnitDir)
+		}
+		if err := os.MkdirAll(unitDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: unitDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.InstallOrUpdate()
+		if err != nil || !result.Installed {
+			t.Fatalf("%s: InstallOrUpdate() = %+v, %v", unitDir, result, err)
+		}
+		if _, err := os.Stat(filepath.Join(unitDir, "test.service")); err != nil {
+			t.Errorf("%s: unit not written: %v", unitDir, err)
+		}
+		required, err := s.InstallOrUpdateRequired()
+		if err != nil || required {
+			t.Errorf("%s: InstallOrUpdateRequired() after install = %v, %v", unitDir, required, err)
+		}
+
+		enabled := strings.Contains(strings.Join(*commands, "\n"), "systemctl enable test.service")
+		if runtime := dir == runtimeUnitDir; enabled == runtime {
+			t.Errorf("%s: enabled = %v, commands: %q", unitDir, enabled, *commands)
+		}
+
+		if err := s.Uninstall(); err != nil {
+			t.Errorf("%s: Uninstall() = %v", unitDir, err)
+		}
+		if _, err := os.Stat(filepath.Join(unitDir, "test.service")); !os.IsNotExist(err) {
+			t.Errorf("%s: unit not removed: %v", unitDir, err)
+		}
+	}
+}
+
+func TestRunOutsideServiceManager(t *testing.T) {
+	fakeSystemd(t)
+	t.Setenv("INVOCATION_ID", "")
+	t.Setenv("NOTIFY_SOCKET", "")
+	started := false
+	s, err := newService(Config{
+		Name:    "test",
+		Program: "/usr/bin/test",
+		Start:   func() error { started = true; return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != ErrNotRunningAsService {
+		t.Errorf("Run() = %v, want ErrNotRunningAsService", err)
+	}
+	if started {
+		t.Error("Start called outside of the service manager")
+	}
+}
+
+func TestIsInteractive(t *testing.T) {
+	oldFlavor, oldTTY := flavor, hasControllingTTY
+	defer func() { flavor, hasControllingTTY = oldFlavor, oldTTY }()
+	for _, name := range []string{"INVOCATION_ID", "NOTIFY_SOCKET", "RC_SVCNAME", "UPSTART_JOB"} {
+		t.Setenv(name, "")
+	}
+	for _, tt := range []struct {
+		name        string
+		flavor      initFlavor
+		env         string
+		tty         bool
+		interactive bool
+	}{
+		{"systemd shell", initSystemd, "", true, true},
+		// A user unit runs under systemd --user, not init.
+		{"systemd user unit", initSystemd, "INVOCATION_ID", false, false},
+		{"systemd notify", initSystemd, "NOTIFY_SOCKET", false, false},
+		{"OpenRC shell", initOpenRC, "", true, true},
+		// OpenRC runs the program under supervise-daemon.
+		{"OpenRC service", initOpenRC, "RC_SVCNAME", false, false},
+		{"Upstart job", initUpstart, "UPSTART_JOB", false, false},
+		{"System V shell", initSystemV, "", true, true},
+		{"System V service", initSystemV, "", false, false},
+	} {
+		flavor = tt.flavor
+		hasControllingTTY = func() bool { return tt.tty }
+		if tt.env != "" {
+			os.Setenv(tt.env, "test")
+		}
+		interactive, err := isInteractive()
+		if tt.env != "" {
+			os.Setenv(tt.env, "")
+		}
+		if err != nil || interactive != tt.interactive {
+			t.Errorf("%s: isInteractive() = %v, %v, want %v", tt.name, interactive, err, tt.interactive)
+		}
+	}
+}
+
+func TestRunInteractive(t *testing.T) {
+	stopped := make(chan struct{})
+	s, err := newService(Config{
+		Name:                "test",
+		AllowInteractiveRun: true,
+		Start: func() error {
+			return syscall.Kill(os.Getpid(), syscall.SIGINT)
+		},
+		Stop: func() error {
+			close(stopped)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("Stop not called after interrupt")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	fakeSystemd(t)
+	s := &linuxService{}
+	if caps := s.Capabilities(); !caps.Has(CapReload|CapMask|CapResourceLimits) || caps.Has(CapPauseContinue) {
+		t.Errorf("systemd capabilities = %b", caps)
+	}
+	flavor = initSystemV
+	if caps := s.Capabilities(); caps != 0 {
+		t.Errorf("System-V capabilities = %b", caps)
+	}
+}
+
+func TestForceReinstall(t *testing.T) {
+	commands := fakeSystemd(t)
+	dir := t.TempDir()
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(s.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err := s.InstallOrUpdate(); err != nil || result.Changed() {
+		t.Fatalf("InstallOrUpdate() with unchanged config = %+v, %v", result, err)
+	}
+	*commands = nil
+	if err := s.ForceReinstall(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(s.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Error("ForceReinstall didn't rewrite the unchanged configuration")
+	}
+	want := []string{
+		"systemctl daemon-reload",
+		"systemctl enable test.service",
+		"systemctl restart test.service",
+	}
+	if strings.Join(*commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+}
+
+func TestGetFlavor(t *testing.T) {
+	for _, tt := range []struct {
+		paths  []string
+		flavor initFlavor
+	}{
+		{nil, initSystemV},
+		{[]string{"sbin/upstart-udev-bridge"}, initUpstart},
+		{[]string{"sbin/openrc"}, initOpenRC},
+		{[]string{"sbin/rc-service"}, initOpenRC},
+		{[]string{"sbin/openrc", "run/systemd/system"}, initSystemd},
+	} {
+		root := t.TempDir()
+		for _, path := range tt.paths {
+			if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f := getFlavor(root); f != tt.flavor {
+			t.Errorf("getFlavor(%v) = %v, want %v", tt.paths, f, tt.flavor)
+		}
+	}
+}
+
+func TestOpenRCScript(t *testing.T) {
+	s, err := newService(Config{
+		Name:             "test",
+		Program:          "/usr/bin/test",
+		Arguments:        []string{"-a", "it's here"},
+		WorkingDirectory: "/var/lib/test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := initOpenRC.Template().Execute(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"#!/sbin/openrc-run\n",
+		"\nsupervisor=\"supervise-daemon\"\n",
+		"\ncommand=\"/usr/bin/test\"\n",
+		"\ncommand_args='\"-a\" \"it'\\''s here\"'\n",
+		"\ndirectory=\"/var/lib/test\"\n\ndepend() {\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestSystemdNoBlankLinesInSections(t *testing.T) {
+	for _, c := range []Config{
+		{Name: "test", Program: "/usr/bin/test"},
+		{Name: "test", Program: "/usr/bin/test", WorkingDirectory: "/var/lib/test", StdoutPath: "/var/log/test.log"},
+		{Name: "test", Program: "/usr/bin/test", WorkingDirectory: "/var/lib/test", StdoutPath: "/var/log/test.log", StdinPath: "/dev/null", Oneshot: true},
+	} {
+		out := renderSystemd(t, c)
+		lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		for i, line := range lines {
+			if line == "" && (i+1 == len(lines) || !strings.HasPrefix(lines[i+1], "[")) {
+				t.Errorf("blank line %d inside a section:\n%s", i+1, out)
+			}
+		}
+	}
+}
+
+func TestParseSystemdExitStatus(t *testing.T) {
+	for _, tt := range []struct {
+		out    string
+		status int
+		err    error
+	}{
+		{"ExecMainStartTimestampMonotonic=0\nExecMainCode=0\nExecMainStatus=0\n", 0, ErrNoExitStatus},
+		{"ExecMainStartTimestampMonotonic=81273\nExecMainCode=0\nExecMainStatus=0\n", 0, nil},
+		{"ExecMainStartTimestampMonotonic=81273\nExecMainCode=1\nExecMainStatus=3\n", 3, nil},
+		{"ExecMainStartTimestampMonotonic=81273\nExecMainCode=2\nExecMainStatus=9\n", 137, nil},
+	} {
+		props, err := parseSystemctlShow([]byte(tt.out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := parseSystemdExitStatus(props)
+		if status != tt.status || err != tt.err {
+			t.Errorf("%q: got %v, %v; want %v, %v", tt.out, status, err, tt.status, tt.err)
+		}
+	}
+}
+
+func TestParseSystemctlShow(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		out  string
+		want map[string]string
+		err  bool
+	}{
+		{
+			name: "running",
+			out:  "ActiveState=active\nMainPID=812\nUnitFileState=enabled\n",
+			want: map[string]string{"ActiveState": "active", "MainPID": "812", "UnitFileState": "enabled"},
+		},
+		{
+			name: "loaded but not running",
+			out:  "ActiveState=inactive\nMainPID=0\nUnitFileState=disabled\n",
+			want: map[string]string{"ActiveState": "inactive", "MainPID": "0", "UnitFileState": "disabled"},
+		},
+		{
+			name: "unknown property left out",
+			out:  "ActiveState=active\nMainPID=812\n",
+			want: map[string]string{"ActiveState": "active", "MainPID": "812"},
+		},
+		{
+			name: "empty and embedded equals",
+			out:  "MemoryCurrent=\nExecStart={ path=/usr/bin/test ; argv[]=/usr/bin/test -v }\n",
+			want: map[string]string{"MemoryCurrent": "", "ExecStart": "{ path=/usr/bin/test ; argv[]=/usr/bin/test -v }"},
+		},
+		{
+			name: "no output",
+			out:  "",
+			want: map[string]string{},
+		},
+		{
+			name: "not key=value",
+			out:  "Failed to connect to bus: No such file or directory\n",
+			err:  true,
+		},
+	} {
+		props, err := parseSystemctlShow([]byte(tt.out))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(props, tt.want) {
+			t.Errorf("%s: parsed as %v, want %v", tt.name, props, tt.want)
+		}
+	}
+}
+
+func TestControlRetry(t *testing.T) {
+	commands := fakeSystemd(t)
+	oldSleep := sleep
+	defer func() { sleep = oldSleep }()
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	failures := 2
+	runCommand = func(name string, args ...string) error {
+		*commands = append(*commands, name)
+		if failures > 0 {
+			failures--
+			return errors.New("exit status 1: Failed to connect to bus: Connection refused")
+		}
+		return nil
+	}
+
+	s := &linuxService{Config: Config{Name: "test", ControlRetry: RetryPolicy{Delay: time.Second}}}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	if len(*commands) != 3 {
+		t.Errorf("ran %d commands, want 3", len(*commands))
+	}
+	if len(delays) != 2 || delays[0] != time.Second || delays[1] != 2*time.Second {
+		t.Errorf("delays = %v, want [1s 2s]", delays)
+	}
+
+	*commands = nil
+	runCommand = func(name string, args ...string) error {
+		*commands = append(*commands, name)
+		return errors.New("exit status 5: Unit test.service not found.")
+	}
+	if err := s.Start(); err == nil {
+		t.Error("expected the permanent failure to be returned")
+	}
+	if len(*commands) != 1 {
+		t.Errorf("permanent failure retried %d times", len(*commands)-1)
+	}
+}
+
+func TestSystemdOnFailure(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "OnFailure=") {
+		t.Errorf("OnFailure rendered without units:\n%s", out)
+	}
+	if !strings.Contains(out, "ConditionFileIsExecutable=\"/usr/bin/test\"\nStartLimitIntervalSec=") {
+		t.Errorf("blank line left in [Unit] without OnFailure:\n%s", out)
+	}
+
+	out = renderSystemd(t, Config{
+		Name:      "test",
+		Program:   "/usr/bin/test",
+		OnFailure: []string{"notify@test.service", "alert.target"},
+	})
+	unit := out[:strings.Index(out, "[Service]")]
+	if !strings.Contains(unit, "\nOnFailure=notify@test.service alert.target\nStartLimitIntervalSec=") {
+		t.Errorf("OnFailure missing from [Unit]:\n%s", out)
+	}
+}
+
+func TestSystemdHardening(t *testing.T) {
+	directives := []string{"NoNewPrivileges=", "ProtectSystem=", "PrivateTmp=", "ReadWritePaths="}
+	for _, tt := range []struct {
+		hardening Hardening
+		want      []string
+	}{
+		{Hardening{}, nil},
+		{Hardening{NoNewPrivileges: true, PrivateTmp: true}, []string{"NoNewPrivileges=yes", "PrivateTmp=yes"}},
+		{
+			Hardening{ProtectSystem: "strict", ReadWritePaths: []string{"/var/lib/test", "/var/log/test"}},
+			[]string{"ProtectSystem=strict", "ReadWritePaths=/var/lib/test /var/log/test"},
+		},
+	} {
+		out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", Hardening: tt.hardening})
+		var got []string
+		for _, line := range strings.Split(out, "\n") {
+			for _, d := range directives {
+				if strings.HasPrefix(line, d) {
+					got = append(got, line)
+				}
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%+v: got %q, want %q", tt.hardening, got, tt.want)
+		}
+	}
+}
+
+func TestJournalField(t *testing.T) {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", "one line")
+	journalField(&b, "MESSAGE", "two\nlines")
+	want := "MESSAGE=one line\nMESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "StandardInput=") {
+		t.Errorf("unexpected StandardInput:\n%s", out)
+	}
+
+	s, err := New(Config{Name: "test", Program: "/usr/bin/test", NullStdin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := initSystemd.Template().Execute(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\nStandardInput=file:/dev/null\n") {
+		t.Errorf("null stdin missing from unit:\n%s", buf.String())
+	}
+
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", StdinPath: "/etc/input", NullStdin: true})
+	if !strings.Contains(out, "\nStandardInput=file:/etc/input\n") {
+		t.Errorf("StdinPath missing from unit:\n%s", out)
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	oldFlavor := flavor
+	defer func() { flavor = oldFlavor }()
+	flavor = initSystemV
+
+	path := filepath.Join(t.TempDir(), "input")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	var read string
+	s, err := newService(Config{
+		Name:                "test",
+		AllowInteractiveRun: true,
+		StdinPath:           path,
+		Start: func() error {
+			b, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			read = string(b)
+			return syscall.Kill(os.Getpid(), syscall.SIGINT)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if read != "hello" {
+		t.Errorf("service read %q from stdin", read)
+	}
+	if os.Stdin != stdin {
+		t.Error("os.Stdin not restored")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	fakeSystemd(t)
+	oldOutput := commandOutput
+	defer func() { commandOutput = oldOutput }()
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return []byte("MainPID=4321\nActiveState=active\nUnitFileState=enabled\n"), nil
+	}
+
+	c := Config{
+		Name:      "test",
+		Program:   "/usr/bin/test",
+		Arguments: []string{"-v"},
+		UnitDir:   t.TempDir(),
+		EnvVars:   map[string]string{"A": "1"},
+		Start:     func() error { return nil },
+	}
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Installed || def.Enabled || def.Status != StatusUnknown || def.PID != 0 {
+		t.Errorf("uninstalled service exported as %+v", def)
+	}
+
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	def, err = s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !def.Installed || !def.Enabled || def.Status != StatusRunning || def.PID != 4321 {
+		t.Errorf("installed service exported as %+v", def)
+	}
+
+	data, err := json.Marshal(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored ServiceDefinition
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := Import(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := def.Config
+	want.Start = nil
+	if got := imported.(*linuxService).Config; !reflect.DeepEqual(got, want) {
+		t.Errorf("imported config = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseSystemdState(t *testing.T) {
+	for _, tc := range []struct {
+		props   map[string]string
+		status  Status
+		pid     int
+		enabled bool
+	}{
+		{map[string]string{"ActiveState": "active", "MainPID": "42", "UnitFileState": "enabled"}, StatusRunning, 42, true},
+		{map[string]string{"ActiveState": "failed", "MainPID": "0", "UnitFileState": "disabled"}, StatusStopped, 0, false},
+		{map[string]string{"ActiveState": "activating", "MainPID": "0", "UnitFileState": "enabled-runtime"}, StatusUnknown, 0, true},
+	} {
+		status, pid, enabled := parseSystemdState(tc.props)
+		if status != tc.status || pid != tc.pid || enabled != tc.enabled {
+			t.Errorf("parseSystemdState(%v) = %q, %d, %v", tc.props, status, pid, enabled)
+		}
+	}
+}
+
+func TestSystemdStartLimit(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	unit := out[:strings.Index(out, "[Service]")]
+	if !strings.Contains(unit, "\nStartLimitIntervalSec=5\n") || !strings.Contains(unit, "\nStartLimitBurst=10\n") {
+		t.Errorf("default rate limit missing from [Unit]:\n%s", out)
+	}
+
+	out = renderSystemd(t, Config{
+		Name:                  "test",
+		Program:               "/usr/bin/test",
+		StartLimitIntervalSec: 90 * time.Second,
+		StartLimitBurst:       3,
+	})
+	unit = out[:strings.Index(out, "[Service]")]
+	if !strings.Contains(unit, "\nStartLimitIntervalSec=90\n") || !strings.Contains(unit, "\nStartLimitBurst=3\n") {
+		t.Errorf("rate limit missing from [Unit]:\n%s", out)
+	}
+	if strings.Contains(out, "StartLimitInterval=") {
+		t.Errorf("deprecated StartLimitInterval rendered:\n%s", out)
+	}
+}
+
+func TestSystemdWatchdog(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "WatchdogSec=") {
+		t.Errorf("unexpected WatchdogSec:\n%s", out)
+	}
+	out = renderSystemd(t, Config{
+		Name:                "test",
+		Program:             "/usr/bin/test",
+		Healthcheck:         func() error { return nil },
+		HealthcheckInterval: 15 * time.Second,
+	})
+	if !strings.Contains(out, "\nWatchdogSec=60\n") {
+		t.Errorf("WatchdogSec missing:\n%s", out)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", addr)
+
+	feedWatchdog()
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "WATCHDOG=1" {
+		t.Errorf("got %q, want WATCHDOG=1", got)
+	}
+}
+
+func TestSystemdScheduling(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "SchedulingPolicy=") || strings.Contains(out, "SchedulingClass=") {
+		t.Errorf("unexpected scheduling directives:\n%s", out)
+	}
+	out = renderSystemd(t, Config{
+		Name:                "test",
+		Program:             "/usr/bin/test",
+		CPUSchedulingPolicy: "idle",
+		IOSchedulingClass:   "best-effort",
+	})
+	if !strings.Contains(out, "\nCPUSchedulingPolicy=idle\n") || !strings.Contains(out, "\nIOSchedulingClass=best-effort\n") {
+		t.Errorf("scheduling directives missing:\n%s", out)
+	}
+}
+
+func TestInstallResult(t *testing.T) {
+	fakeSystemd(t)
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "test.service")
+	c := Config{Name: "test", Program: "/usr/bin/test", UnitDir: dir}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{Installed: true, ConfigPath: configPath}); result != want {
+		t.Errorf("fresh install = %+v, want %+v", result, want)
+	}
+
+	result, err = s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{ConfigPath: configPath}); result != want || result.Changed() {
+		t.Errorf("unchanged install = %+v, want %+v", result, want)
+	}
+
+	c.Arguments = []string{"-v"}
+	s, err = newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{Updated: true, ConfigPath: configPath}); result != want {
+		t.Errorf("update = %+v, want %+v", result, want)
+	}
+}
+
+func TestEnableDisable(t *testing.T) {
+	commands := fakeSystemd(t)
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"systemctl enable test.service", "systemctl disable test.service"}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+
+	*commands = nil
+	s.configPath = filepath.Join("/tmp", runtimeUnitDir, "test.service")
+	if err := s.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"systemctl enable --runtime test.service"}; !reflect.DeepEqual(*commands, want) {
+		t.Errorf("runtime unit commands = %q, want %q", *commands, want)
+	}
+}
+
+func TestEnableIdempotent(t *testing.T) {
+	commands := fakeSystemd(t)
+	oldOutput := commandOutput
+	defer func() { commandOutput = oldOutput }()
+	enabled := false
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		if enabled {
+			return []byte("enabled\n"), nil
+		}
+		return []byte("disabled\n"), errors.New("exit status 1")
+	}
+	runCommand = func(name string, args ...string) error {
+		*commands = append(*commands, strings.Join(append([]string{name}, args...), " "))
+		enabled = args[0] == "enable"
+		return nil
+	}
+
+	dir := t.TempDir()
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.configPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Enable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Disable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"systemctl enable test.service", "systemctl disable test.service"}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+}
+
+func TestUpdateProgram(t *testing.T) {
+	fakeSystemd(t)
+	dir := t.TempDir()
+	newProgram := filepath.Join(dir, "new program")
+	if err := ioutil.WriteFile(newProgram, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Name: "test", Program: "/usr/bin/old", Arguments: []string{"-v"}, UnitDir: dir}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	edited := func(current []byte) ([]byte, error) {
+		return append(current, "# local change\n"...), nil
+	}
+	if err := s.EditConfig(edited); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.UpdateProgram(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing program")
+	}
+	if err := s.UpdateProgram(newProgram); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(s.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Program = newProgram
+	want, _ := edited([]byte(renderSystemd(t, c)))
+	if string(got) != string(want) {
+		t.Errorf("unit after UpdateProgram:\n%s\nwant:\n%s", got, want)
+	}
+	if s.Program != newProgram {
+		t.Errorf("Program = %q", s.Program)
+	}
+}
+
+func TestUpdateProgramArgumentPrefix(t *testing.T) {
+	fakeSystemd(t)
+	oldFlavor := flavor
+	defer func() { flavor = oldFlavor }()
+	dir := t.TempDir()
+	newProgram := filepath.Join(dir, "app")
+	if err := ioutil.WriteFile(newProgram, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Name: "test", Program: "/opt/app/bin/app", Arguments: []string{"--config=/opt/app/bin/app.conf"}}
+	render := func(f initFlavor, c Config) []byte {
+		s, err := newService(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := f.Template().Execute(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for _, f := range []initFlavor{initSystemd, initSystemV, initUpstart, initOpenRC} {
+		flavor = f
+		s, err := newService(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.configPath = filepath.Join(dir, f.String())
+		if err := ioutil.WriteFile(s.configPath, render(f, c), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProgram(newProgram); err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		got, err := ioutil.ReadFile(s.configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated := c
+		updated.Program = newProgram
+		if want := render(f, updated); string(got) != string(want) {
+			t.Errorf("%v: configuration after UpdateProgram:\n%s\nwant:\n%s", f, got, want)
+		}
+	}
+}
+
+func TestProgramPattern(t *testing.T) {
+	c := Config{Name: "test", Program: "/opt/app/bin", Arguments: []string{"-v"}}
+	for _, f := range []initFlavor{initSystemd, initSystemV, initUpstart, initOpenRC} {
+		s, err := newService(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := f.Template().Execute(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		m := f.ProgramPattern().FindSubmatch(buf.Bytes())
+		if m == nil {
+			t.Errorf("%v: program not found in:\n%s", f, buf.String())
+			continue
+		}
+		if got := string(m[1]); got != c.Program && got != cmdQuote(c.Program) {
+			t.Errorf("%v: matched %q", f, got)
+		}
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	fakeSystemd(t)
+	c := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}, UnitDir: t.TempDir()}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.WriteConfig(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := renderSystemd(t, c); buf.String() != want {
+		t.Errorf("WriteConfig wrote:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if _, err := os.Stat(s.configPath); !os.IsNotExist(err) {
+		t.Errorf("WriteConfig touched %s: %v", s.configPath, err)
+	}
+}
+
+func TestInstalledConfig(t *testing.T) {
+	fakeSystemd(t)
+	c := Config{Name: "test", Program: "/usr/bin/test", UnitDir: t.TempDir()}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstalledConfig(); err != ErrNotInstalled {
+		t.Errorf("InstalledConfig before install = %v, want ErrNotInstalled", err)
+	}
+	fixture := "[Unit]\nDescription=edited by hand\n"
+	if err := ioutil.WriteFile(s.configPath, []byte(fixture), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.InstalledConfig()
+	if err != nil || string(got) != fixture {
+		t.Errorf("InstalledConfig = %q, %v, want %q", got, err, fixture)
+	}
+}
+
+func TestUpdateWillRestart(t *testing.T) {
+	fakeSystemd(t)
+	installed := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}, UnitDir: t.TempDir()}
+	s, err := newService(installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restart, err := s.UpdateWillRestart(); err != nil || restart {
+		t.Errorf("UpdateWillRestart before install = %v, %v", restart, err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		edit    func(c *Config)
+		restart bool
+	}{
+		{"unchanged", func(c *Config) {}, false},
+		{"description", func(c *Config) { c.Description = "Test service" }, false},
+		{"start limit", func(c *Config) { c.StartLimitBurst = 3 }, false},
+		{"program", func(c *Config) { c.Program = "/usr/local/bin/test" }, true},
+		{"arguments", func(c *Config) { c.Arguments = []string{"-v", "-debug"} }, true},
+	} {
+		c := installed.Clone()
+		tt.edit(&c)
+		s, err := newService(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restart, err := s.UpdateWillRestart(); err != nil || restart != tt.restart {
+			t.Errorf("%s: UpdateWillRestart = %v, %v, want %v", tt.name, restart, err, tt.restart)
+		}
+	}
+}
+
+func TestInstallOrUpdateWithRollback(t *testing.T) {
+	commands := fakeSystemd(t)
+	fakeClock(t)
+	unitDir := t.TempDir()
+	old, err := newService(Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}, UnitDir: unitDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	oldUnit, err := ioutil.ReadFile(old.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-broken"}, UnitDir: unitDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	*commands = nil
+	err = s.InstallOrUpdateWithRollback(func() error { return errors.New("not responding") }, time.Minute)
+	if err == nil || !strings.HasSuffix(err.Error(), "; rolled back") {
+		t.Fatalf("InstallOrUpdateWithRollback = %v, want a rolled back failure", err)
+	}
+	if unit, err := ioutil.ReadFile(s.configPath); err != nil || !bytes.Equal(unit, oldUnit) {
+		t.Errorf("unit after rollback:\n%s\nwant:\n%s", unit, oldUnit)
+	}
+	restarts := 0
+	for _, command := range *commands {
+		if command == "systemctl restart test.service" {
+			restarts++
+		}
+	}
+	if restarts != 2 {
+		t.Errorf("service restarted %d times, want once for the update and once for the rollback: %q", restarts, *commands)
+	}
+}
+
+func TestSystemdConditionPathExists(t *testing.T) {
+	out := renderSystemd(t, Config{
+		Name:                "test",
+		Program:             "/usr/bin/test",
+		ConditionPathExists: []string{"/var/lib/test", "!/etc/test/disabled"},
+	})
+	unit := out[:strings.Index(out, "[Service]")]
+	if !strings.Contains(unit, "\nConditionPathExists=/var/lib/test\nConditionPathExists=!/etc/test/disabled\n") {
+		t.Errorf("conditions missing from [Unit]:\n%s", out)
+	}
+}
+
+func TestSystemdDescription(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if !strings.Contains(out, "\nDescription=test\n") {
+		t.Errorf("default description missing:\n%s", out)
+	}
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", Description: "Test service"})
+	if !strings.Contains(out, "\nDescription=Test service\n") {
+		t.Errorf("description missing:\n%s", out)
+	}
+}
+
+func TestSystemdNetworkState(t *testing.T) {
+	down := false
+	for _, state := range []*bool{nil, &down} {
+		out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", NetworkState: state})
+		if strings.Contains(out, "network-online.target") {
+			t.Errorf("NetworkState %v: unexpected network dependency:\n%s", state, out)
+		}
+	}
+	up := true
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", NetworkState: &up})
+	unit := out[:strings.Index(out, "[Service]")]
+	if !strings.Contains(unit, "\nRequires=network-online.target\nAfter=network-online.target\n") {
+		t.Errorf("network dependency missing from [Unit]:\n%s", out)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	s, err := New(Config{Name: "test", NullStdin: true, Arguments: []string{"-v"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.EffectiveConfig()
+	if c.Program != exe || c.StdinPath != os.DevNull || !reflect.DeepEqual(c.WantedBy, []string{"multi-user.target"}) ||
+		c.StartLimitIntervalSec != 5*time.Second || c.StartLimitBurst != 10 {
+		t.Errorf("defaults not applied: %+v", c)
+	}
+	c.Arguments[0] = "-q"
+	if s.EffectiveConfig().Arguments[0] != "-v" {
+		t.Error("EffectiveConfig shares state with the service")
+	}
+}
+
+func TestSystemdSlice(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	for _, directive := range []string{"Slice=", "CPUQuota=", "TasksMax="} {
+		if strings.Contains(out, directive) {
+			t.Errorf("unexpected %s in:\n%s", directive, out)
+		}
+	}
+	out = renderSystemd(t, Config{
+		Name:     "test",
+		Program:  "/usr/bin/test",
+		Slice:    "batch.slice",
+		CPUQuota: "50%",
+		TasksMax: 64,
+	})
+	if !strings.Contains(out, "\nSlice=batch.slice\nCPUQuota=50%\nTasksMax=64\n") {
+		t.Errorf("slice directives missing:\n%s", out)
+	}
+}
+
+func TestSystemdStopSignal(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "KillSignal=") {
+		t.Errorf("unexpected KillSignal in:\n%s", out)
+	}
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", StopSignal: "SIGINT"})
+	if !strings.Contains(out, "\nKillSignal=SIGINT\n") {
+		t.Errorf("KillSignal missing:\n%s", out)
+	}
+	if _, err := New(Config{Name: "test", StopSignal: "SIGSTOP"}); err == nil {
+		t.Error("expected an error for an unsupported stop signal")
+	}
+}
+
+func TestInstalledVersion(t *testing.T) {
+	fakeSystemd(t)
+	c := Config{Name: "test", Program: "/usr/bin/test", Version: "1.4.2", UnitDir: t.TempDir()}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstalledVersion(); err != ErrNotInstalled {
+		t.Errorf("InstalledVersion before installing = %v, want ErrNotInstalled", err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := s.InstalledVersion(); err != nil || version != "1.4.2" {
+		t.Errorf("InstalledVersion = %q, %v", version, err)
+	}
+
+	c.Version = ""
+	if s, err = newService(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := s.InstalledVersion(); err != nil || version != "" {
+		t.Errorf("InstalledVersion without a version = %q, %v", version, err)
+	}
+}
+
+func TestVersionPattern(t *testing.T) {
+	c := Config{Name: "test", Program: "/opt/app/bin", Version: "2.0.0-rc.1"}
+	for _, f := range []initFlavor{initSystemd, initSystemV, initUpstart, initOpenRC} {
+		s, err := newService(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := f.Template().Execute(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		m := versionPattern.FindSubmatch(buf.Bytes())
+		if m == nil || string(m[1]) != c.Version {
+			t.Errorf("%v: version not found in:\n%s", f, buf.String())
+		}
+		if (f == initSystemV || f == initOpenRC) && !strings.HasPrefix(buf.String(), "#!") {
+			t.Errorf("%v: script no longer starts with its interpreter:\n%s", f, buf.String())
+		}
+	}
+}
+
+func TestSystemdPIDFile(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", PIDFile: "/run/test.pid"})
+	if !strings.Contains(out, "\nPIDFile=/run/test.pid\n") {
+		t.Errorf("PIDFile missing:\n%s", out)
+	}
+	if _, err := New(Config{Name: "test", PIDFile: "test.pid"}); err == nil {
+		t.Error("expected an error for a relative pidfile path")
+	}
+}
+
+func TestUpdateArguments(t *testing.T) {
+	fakeSystemd(t)
+	c := Config{Name: "test", Program: "/usr/bin/test", Arguments: []string{"-v"}, UnitDir: t.TempDir()}
+	s, err := newService(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	edited := func(current []byte) ([]byte, error) {
+		return append(current, "# local change\n"...), nil
+	}
+	if err := s.EditConfig(edited); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"-config", `/etc/my "app".toml`}
+	if err := s.UpdateArguments(args); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(s.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Arguments = args
+	want, _ := edited([]byte(renderSystemd(t, c)))
+	if string(got) != string(want) {
+		t.Errorf("unit after UpdateArguments:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestArgumentsPattern(t *testing.T) {
+	c := Config{Name: "test", Program: "/opt/app/bin", Arguments: []string{"-v", "it's \"quoted\""}}
+	for _, f := range []initFlavor{initSystemd, initUpstart, initOpenRC} {
+		s, err := newService(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := f.Template().Execute(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		m := f.ArgumentsPattern().FindSubmatch(buf.Bytes())
+		if m == nil {
+			t.Errorf("%v: arguments not found in:\n%s", f, buf.String())
+			continue
+		}
+		if got, want := string(m[1]), f.FormatArguments(c.Arguments); got != want {
+			t.Errorf("%v: matched %q, formatted %q", f, got, want)
+		}
+	}
+	if initSystemV.ArgumentsPattern() != nil {
+		t.Error("System V script unexpectedly has an arguments pattern")
+	}
+}
+
+func TestSystemdOneshot(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "Type=oneshot") || !strings.Contains(out, "\nRestart=always\n") {
+		t.Errorf("unexpected service type in:\n%s", out)
+	}
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", Oneshot: true, RemainAfterExit: true})
+	if !strings.Contains(out, "[Service]\nType=oneshot\nRemainAfterExit=yes\nExecStart=") {
+		t.Errorf("oneshot directives missing:\n%s", out)
+	}
+	if strings.Contains(out, "Restart=") {
+		t.Errorf("oneshot unit is restarted:\n%s", out)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	fakeSystemd(t)
+	dir := t.TempDir()
+	program := filepath.Join(dir, "my program")
+	if err := ioutil.WriteFile(program, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newService(Config{Name: "test", Program: program, UnitDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate before installing = %v", err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate after installing = %v", err)
+	}
+
+	other, err := newService(Config{Name: "test", Program: "/usr/bin/missing", WorkingDirectory: filepath.Join(dir, "missing"), UnitDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Validate()
+	if err == nil {
+		t.Fatal("expected errors for another program")
+	}
+	for _, want := range []string{"Unable to stat program", "Unable to stat working directory", "already installed for " + program} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestSystemdKillMode(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "KillMode=") {
+		t.Errorf("unexpected KillMode in:\n%s", out)
+	}
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", KillMode: "mixed", StopSignal: "SIGINT"})
+	if !strings.Contains(out, "\nKillMode=mixed\nKillSignal=SIGINT\n") {
+		t.Errorf("KillMode missing:\n%s", out)
+	}
+}
+
+func TestResetFailed(t *testing.T) {
+	commands := fakeSystemd(t)
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetFailed(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"systemctl reset-failed test.service", "systemctl restart test.service"}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+
+	*commands = nil
+	s.AutoResetFailed = true
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"systemctl reset-failed test.service", "systemctl restart test.service"}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands with AutoResetFailed = %q, want %q", *commands, want)
+	}
+
+	flavor = initUpstart
+	if err := s.ResetFailed(); err != ErrNotSupported {
+		t.Errorf("ResetFailed on upstart = %v", err)
+	}
+}
+
+func TestSystemdEnvironmentFiles(t *testing.T) {
+	out := renderSystemd(t, Config{
+		Name:             "test",
+		Program:          "/usr/bin/test",
+		EnvironmentFiles: []string{"/etc/test/secrets.env", "/etc/test/local.env"},
+	})
+	if !strings.Contains(out, "\nEnvironmentFile=-/etc/test/secrets.env\nEnvironmentFile=-/etc/test/local.env\n") {
+		t.Errorf("EnvironmentFile missing:\n%s", out)
+	}
+	if _, err := New(Config{Name: "test", EnvironmentFiles: []string{"secrets.env"}}); err == nil {
+		t.Error("expected an error for a relative environment file")
+	}
+}
+
+func TestExternalProgram(t *testing.T) {
+	commands := fakeSystemd(t)
+	started := false
+	s, err := newService(Config{
+		Name:                "sleeper",
+		Program:             "/bin/sleep",
+		Arguments:           []string{"infinity"},
+		AllowInteractiveRun: true,
+		UnitDir:             t.TempDir(),
+		Start:               func() error { started = true; return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Installed {
+		t.Errorf("result = %+v", result)
+	}
+	unit, err := ioutil.ReadFile(s.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "\nExecStart=\"/bin/sleep\" \"infinity\"\n") {
+		t.Errorf("unit doesn't run the external program:\n%s", unit)
+	}
+	if want := []string{"systemctl daemon-reload", "systemctl enable sleeper.service"}; !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q", *commands)
+	}
+
+	if err := s.Run(); err != ErrExternalProgram || started {
+		t.Errorf("Run() = %v, started = %v, want ErrExternalProgram", err, started)
+	}
+}
+
+func TestCheckRunsHere(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(exe, link); err != nil {
+		t.Fatal(err)
+	}
+	for program, want := range map[string]error{
+		"":         nil,
+		exe:        nil,
+		link:       nil,
+		"/bin/sh":  ErrExternalProgram,
+		"/missing": ErrExternalProgram,
+	} {
+		c := Config{Name: "test", Program: program}
+		if err := c.checkRunsHere(); err != want {
+			t.Errorf("checkRunsHere(%q) = %v, want %v", program, err, want)
+		}
+	}
+}
+
+func TestIsEnabled(t *testing.T) {
+	fakeSystemd(t)
+	oldOutput := commandOutput
+	defer func() { commandOutput = oldOutput }()
+	var state string
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		if name != "systemctl" || args[0] != "is-enabled" {
+			t.Errorf("unexpected command %s %q", name, args)
+		}
+		if state == "enabled" || state == "enabled-runtime" {
+			return []byte(state + "\n"), nil
+		}
+		return []byte(state + "\n"), errors.New("exit status 1")
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := s.IsEnabled(); err != nil || enabled {
+		t.Errorf("IsEnabled before installing = %v, %v", enabled, err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		state   string
+		enabled bool
+	}{
+		{"enabled", true},
+		{"enabled-runtime", true},
+		{"disabled", false},
+		{"static", false},
+		{"masked", false},
+	} {
+		state = tc.state
+		if enabled, err := s.IsEnabled(); err != nil || enabled != tc.enabled {
+			t.Errorf("IsEnabled with %s = %v, %v", tc.state, enabled, err)
+		}
+	}
+	state = ""
+	if _, err := s.IsEnabled(); err == nil {
+		t.Error("expected an error when systemctl prints nothing")
+	}
+}
+
+func TestParseRCUpdateShow(t *testing.T) {
+	out := []byte(` acpid | default
+ sshd | default
+ test-helper |
+ local |      default nonetwork
+`)
+	for name, want := range map[string]bool{
+		"sshd":        true,
+		"local":       true,
+		"test-helper": false,
+		"ssh":         false,
+	} {
+		if got := parseRCUpdateShow(out, name); got != want {
+			t.Errorf("parseRCUpdateShow(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestConfigFileModeAndOwner(t *testing.T) {
+	fakeSystemd(t)
+	calls := fakeOwners(t)
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.configPath); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("default mode = %v, %v", info.Mode(), err)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("chown called without an owner: %q", *calls)
+	}
+
+	s.ConfigFileMode = 0600
+	s.ConfigOwner = "app"
+	s.ConfigGroup = "staff"
+	if err := s.ForceReinstall(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.configPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("configured mode = %v, %v", info.Mode(), err)
+	}
+	if len(*calls) != 1 || !strings.HasSuffix((*calls)[0], " 501:20") {
+		t.Errorf("chown calls = %q", *calls)
+	}
+
+	*calls = nil
+	if err := s.EditConfig(func(current []byte) ([]byte, error) { return current, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.configPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mode after EditConfig = %v, %v", info.Mode(), err)
+	}
+	if want := []string{"test.service 501:20"}; !reflect.DeepEqual(*calls, want) {
+		t.Errorf("chown calls after EditConfig = %q, want %q", *calls, want)
+	}
+}
+
+func TestStopSignalHandled(t *testing.T) {
+	for _, tt := range []struct {
+		stopSignal string
+		sig        syscall.Signal
+	}{
+		// systemd stops the program with KillSignal=StopSignal.
+		{"SIGQUIT", syscall.SIGQUIT},
+		{"SIGHUP", syscall.SIGHUP},
+		// launchd stops it with SIGTERM, and StopSignal is forwarded to a
+		// program that has no handler for it.
+		{"SIGQUIT", syscall.SIGTERM},
+		{"SIGHUP", syscall.SIGTERM},
+	} {
+		stopped := false
+		c := &Config{
+			Name:       "test",
+			StopSignal: tt.stopSignal,
+			Start: func() error {
+				return syscall.Kill(os.Getpid(), tt.sig)
+			},
+			Stop: func() error {
+				stopped = true
+				return nil
+			},
+		}
+		if err := runUntilSignal(context.Background(), c); err != nil {
+			t.Errorf("%s, %v: runUntilSignal = %v", tt.stopSignal, tt.sig, err)
+		}
+		if !stopped {
+			t.Errorf("%s, %v: Stop not called", tt.stopSignal, tt.sig)
+		}
+	}
+	// A forwarded signal left pending would kill the test binary now.
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestDrainSignals(t *testing.T) {
+	calls := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// runUntilSignal listens for the signals before calling Start.
+	started := make(chan struct{})
+	c := &Config{
+		Name:    "test",
+		Start:   func() error { close(started); return nil },
+		Drain:   func() error { calls <- "drain"; return nil },
+		Undrain: func() error { calls <- "undrain"; return nil },
+	}
+	done := make(chan error)
+	go func() { done <- runUntilSignal(ctx, c) }()
+
+	<-started
+	for _, tc := range []struct {
+		sig  syscall.Signal
+		call string
+	}{{syscall.SIGUSR1, "drain"}, {syscall.SIGUSR2, "undrain"}} {
+		if err := syscall.Kill(os.Getpid(), tc.sig); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case call := <-calls:
+			if call != tc.call {
+				t.Errorf("%v called %s, want %s", tc.sig, call, tc.call)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v didn't call %s", tc.sig, tc.call)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("runUntilSignal = %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	commands := fakeSystemd(t)
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"systemctl kill --kill-who=main --signal=SIGUSR1 test.service",
+		"systemctl kill --kill-who=main --signal=SIGUSR2 test.service",
+	}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+	flavor = initSystemV
+	if err := s.Drain(); err != ErrNotSupported {
+		t.Errorf("Drain on System V = %v", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	fakeSystemd(t)
+	c := Config{Name: "test", Program: "/usr/bin/test", Triggers: []Trigger{TriggerNetworkAvailable}}
+	if _, err := New(c); err != nil {
+		t.Errorf("lenient New = %v", err)
+	}
+	c.Strict = true
+	_, err := New(c)
+	if err == nil || !strings.Contains(err.Error(), "Triggers requires Windows") {
+		t.Errorf("strict New = %v, want an error naming Triggers", err)
+	}
+	c.Triggers = nil
+	c.Hardening.PrivateTmp = true
+	if _, err := New(c); err != nil {
+		t.Errorf("strict New with supported fields = %v", err)
+	}
+}
+
+func TestAgentNotSupported(t *testing.T) {
+	if _, err := New(Config{Name: "test", Agent: true}); err != ErrNotSupported {
+		t.Errorf("New = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestSystemdExpandArguments(t *testing.T) {
+	c := Config{
+		Name:              "test",
+		Program:           "/usr/bin/test",
+		Arguments:         []string{"--data-dir=$HOME/data", `--name=${NAME}`},
+		ArgumentVariables: map[string]string{"HOME": "/home/a b", "NAME": `x"y`},
+	}
+	render := func(c Config) string {
+		s, err := New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := initSystemd.Template().Execute(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	literal := `ExecStart="/usr/bin/test" "--data-dir=$HOME/data" "--name=${NAME}"` + "\n"
+	if out := render(c); !strings.Contains(out, literal) {
+		t.Errorf("missing %q in:\n%s", literal, out)
+	}
+	c.ExpandArguments = true
+	expanded := `ExecStart="/usr/bin/test" "--data-dir=/home/a b/data" "--name=x\"y"` + "\n"
+	if out := render(c); !strings.Contains(out, expanded) {
+		t.Errorf("missing %q in:\n%s", expanded, out)
+	}
+}
+
+func TestSystemdSchedule(t *testing.T) {
+	commands := fakeSystemd(t)
+	unitDir := t.TempDir()
+	s, err := New(Config{
+		Name:    "test",
+		Program: "/usr/bin/test",
+		UnitDir: unitDir,
+		Schedule: Schedule{
+			Interval: 15 * time.Minute,
+			Calendar: []CalendarInterval{
+				{Weekdays: []time.Weekday{time.Monday, time.Friday}, Hour: 3, Minute: 30},
+				{Month: 1, Day: 1},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	unit, err := ioutil.ReadFile(filepath.Join(unitDir, "test.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "\nType=oneshot\n") || strings.Contains(string(unit), "Restart=") {
+		t.Errorf("scheduled service isn't a oneshot unit:\n%s", unit)
+	}
+	timer, err := ioutil.ReadFile(filepath.Join(unitDir, "test.timer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[Unit]
+Description=Schedule of test
+
+[Timer]
+OnCalendar=Mon,Fri *-*-* 03:30:00
+OnCalendar=*-01-01 00:00:00
+OnActiveSec=900
+OnUnitActiveSec=900
+Unit=test.service
+
+[Install]
+WantedBy=timers.target
+`
+	if string(timer) != want {
+		t.Errorf("timer =\n%s\nwant\n%s", timer, want)
+	}
+	if required, err := s.InstallOrUpdateRequired(); err != nil || required {
+		t.Errorf("InstallOrUpdateRequired() after install = %v, %v", required, err)
+	}
+
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test.service", "test.timer"} {
+		if _, err := os.Stat(filepath.Join(unitDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", name, err)
+		}
+	}
+	wantCommands := []string{"systemctl daemon-reload", "systemctl enable test.timer", "systemctl disable test.timer"}
+	if !reflect.DeepEqual(*commands, wantCommands) {
+		t.Errorf("commands = %q, want %q", *commands, wantCommands)
+	}
+}
+
+func TestScheduleNotSupported(t *testing.T) {
+	oldFlavor := flavor
+	defer func() { flavor = oldFlavor }()
+	flavor = initSystemV
+	_, err := New(Config{Name: "test", Schedule: Schedule{Interval: time.Hour}})
+	if err != ErrNotSupported {
+		t.Errorf("New = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestPlatformHandle(t *testing.T) {
+	fakeSystemd(t)
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := s.PlatformHandle()
+	if path, ok := handle.(string); err != nil || !ok || path != "/etc/systemd/system/test.service" {
+		t.Errorf("PlatformHandle() = %#v, %v", handle, err)
+	}
+}
+
+func TestSystemdDropIn(t *testing.T) {
+	commands := fakeSystemd(t)
+	unitDir := t.TempDir()
+	base := filepath.Join(unitDir, "test.service")
+	if err := ioutil.WriteFile(base, []byte("[Service]\nExecStart=/usr/bin/packaged\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: unitDir, DropIn: "override"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.InstallOrUpdate()
+	if err != nil || !result.Installed {
+		t.Fatalf("InstallOrUpdate() = %+v, %v", result, err)
+	}
+	dropIn := filepath.Join(unitDir, "test.service.d", "override.conf")
+	if result.ConfigPath != dropIn {
+		t.Errorf("ConfigPath = %q, want %q", result.ConfigPath, dropIn)
+	}
+	out, err := ioutil.ReadFile(dropIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "\nExecStart=\nExecStart=\"/usr/bin/test\"\n") || strings.Contains(string(out), "[Install]") {
+		t.Errorf("drop-in:\n%s", out)
+	}
+	for _, unset := range []string{"Description=", "StartLimitIntervalSec=", "StartLimitBurst=", "Restart=", "WantedBy=", "\n\n\n"} {
+		if strings.Contains(string(out), unset) {
+			t.Errorf("drop-in has %q:\n%s", unset, out)
+		}
+	}
+	if data, _ := ioutil.ReadFile(base); string(data) != "[Service]\nExecStart=/usr/bin/packaged\n" {
+		t.Errorf("base unit changed:\n%s", data)
+	}
+
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(dropIn)); !os.IsNotExist(err) {
+		t.Errorf("drop-in directory not removed: %v", err)
+	}
+	if _, err := os.Stat(base); err != nil {
+		t.Errorf("base unit removed: %v", err)
+	}
+	want := []string{"systemctl daemon-reload", "systemctl daemon-reload"}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+}
+
+func TestSystemdDropInOnlySetFields(t *testing.T) {
+	fakeSystemd(t)
+	oldExecutable := executable
+	defer func() { executable = oldExecutable }()
+	executable = func() (string, error) { return "/usr/bin/test", nil }
+	tests := []struct {
+		c    Config
+		want string
+	}{
+		{
+			Config{Name: "test", Description: "Test", StdoutPath: "/var/log/test.log"},
+			"[Unit]\nDescription=Test\n\n[Service]\nStandardOutput=append:/var/log/test.log\nStandardError=append:/var/log/test.log\n",
+		},
+		{
+			Config{Name: "test", Version: "2", EnvVars: map[string]string{"A": "1"}},
+			";; version=2\n[Service]\nEnvironment=\"A=1\"\n",
+		},
+		{
+			Config{Name: "test", Arguments: []string{"-v"}, Oneshot: true},
+			`[Unit]
+ConditionFileIsExecutable="/usr/bin/test"` + "\n\n[Service]\nType=oneshot\nExecStart=\n" + `ExecStart="/usr/bin/test" "-v"` + "\nRestart=no\n",
+		},
+	}
+	for i, tt := range tests {
+		tt.c.DropIn = "override"
+		if out := renderSystemd(t, tt.c); out != tt.want {
+			t.Errorf("%d: drop-in:\n%s\nwant:\n%s", i, out, tt.want)
+		}
+	}
+}
+
+func TestRootDir(t *testing.T) {
+	commands := fakeSystemd(t)
+	root := t.TempDir()
+	unitDir := filepath.Join(root, defaultUnitDir)
+	if err := os.MkdirAll(unitDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "/lib/systemd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "/lib/systemd/systemd"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{Name: "test", Program: "/usr/bin/test", RootDir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := filepath.Join(unitDir, "test.service")
+	if result.ConfigPath != unit {
+		t.Errorf("ConfigPath = %q, want %q", result.ConfigPath, unit)
+	}
+	if _, err := os.Stat(unit); err != nil {
+		t.Errorf("unit not written below the root: %v", err)
+	}
+	if required, err := s.InstallOrUpdateRequired(); err != nil || required {
+		t.Errorf("InstallOrUpdateRequired() after install = %v, %v", required, err)
+	}
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(unit); !os.IsNotExist(err) {
+		t.Errorf("unit not removed: %v", err)
+	}
+	want := []string{"systemctl --root=" + root + " enable test.service", "systemctl --root=" + root + " disable test.service"}
+	if !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+}
+
+// TestRootDirSystemV installs into a System V root from a systemd host.
+func TestRootDirSystemV(t *testing.T) {
+	commands := fakeSystemd(t)
+	root := t.TempDir()
+	for _, dir := range []string{"/etc/init.d", "/etc/rc2.d"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := New(Config{Name: "test", Program: "/usr/bin/test", RootDir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "/etc/init.d/test")); err != nil {
+		t.Errorf("script not written below the root: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "/etc/rc2.d/S50test")); err != nil || target != "/etc/init.d/test" {
+		t.Errorf("runlevel link = %q, %v, want a link to /etc/init.d/test", target, err)
+	}
+	if len(*commands) != 0 {
+		t.Errorf("commands = %q, want none", *commands)
+	}
+}
+
+// TestRootDirOpenRC installs into an OpenRC root from a systemd host.
+func TestRootDirOpenRC(t *testing.T) {
+	commands := fakeSystemd(t)
+	root := t.TempDir()
+	for _, dir := range []string{"/etc/init.d", "/sbin"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "/sbin/openrc"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{Name: "test", Program: "/usr/bin/test", RootDir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(root, "/etc/init.d/test")
+	if result.ConfigPath != script {
+		t.Errorf("ConfigPath = %q, want %q", result.ConfigPath, script)
+	}
+	b, err := ioutil.ReadFile(script)
+	if err != nil {
+		t.Fatalf("script not written below the root: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "#!/sbin/openrc-run\n") {
+		t.Errorf("not an OpenRC script:\n%s", b)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "/etc/runlevels/default/test")); err != nil || target != "/etc/init.d/test" {
+		t.Errorf("runlevel link = %q, %v, want a link to /etc/init.d/test", target, err)
+	}
+	if len(*commands) != 0 {
+		t.Errorf("commands = %q, want none", *commands)
+	}
+}
+
+func TestControlNotInstalled(t *testing.T) {
+	fakeSystemd(t)
+	failed := errors.New("exit status 5: Unit test.service not found.")
+	runCommand = func(name string, args ...string) error {
+		return failed
+	}
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, op := range map[string]func() error{"Start": s.Start, "Stop": s.Stop, "Restart": s.Restart} {
+		if err := op(); err != ErrNotInstalled {
+			t.Errorf("%s() = %v, want ErrNotInstalled", name, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(s.configPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != failed {
+		t.Errorf("Start() of an installed service = %v, want %v", err, failed)
+	}
+}
+
+func TestSupported(t *testing.T) {
+	fakeSystemd(t)
+	c := Config{Name: "test", Hardening: Hardening{PrivateTmp: true}, WantedBy: []string{"graphical.target"}}
+	if err := Supported(c); err != nil {
+		t.Errorf("systemd config = %v", err)
+	}
+	c.Sockets = []LaunchdSocket{{Name: "Listener", ServiceName: "8080"}}
+	c.RecoveryActions = []RecoveryAction{{Type: RecoveryRestart}}
+	err := Supported(c)
+	if err == nil || !strings.Contains(err.Error(), "Sockets requires launchd; RecoveryActions requires Windows") {
+		t.Errorf("launchd and Windows fields = %v", err)
+	}
+
+	flavor = initSystemV
+	err = Supported(Config{Name: "test", Schedule: Schedule{Interval: time.Hour}, StdoutPath: "/var/log/test.log", LogMaxSize: 1 << 20})
+	if err == nil || err.Error() != "Config is not supported by System-V: Schedule requires systemd or launchd" {
+		t.Errorf("System-V schedule = %v", err)
+	}
+	if err := Supported(Config{}); err != errNameFieldRequired {
+		t.Errorf("empty config = %v", err)
+	}
+}
+
+func TestSystemdOOMScoreAdjust(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "OOMScoreAdjust=") {
+		t.Errorf("unexpected OOMScoreAdjust in:\n%s", out)
+	}
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", OOMScoreAdjust: -900})
+	if !strings.Contains(out, "\nOOMScoreAdjust=-900\n") {
+		t.Errorf("OOMScoreAdjust missing:\n%s", out)
+	}
+	if _, err := New(Config{Name: "test", OOMScoreAdjust: -1001}); err == nil {
+		t.Error("New accepted an OOMScoreAdjust below -1000")
+	}
+}
+
+func TestRunOOMScoreAdjust(t *testing.T) {
+	oldFlavor, oldPath := flavor, oomScoreAdjPath
+	defer func() { flavor, oomScoreAdjPath = oldFlavor, oldPath }()
+	flavor = initSystemV
+	oomScoreAdjPath = filepath.Join(t.TempDir(), "oom_score_adj")
+
+	var written string
+	s, err := newService(Config{
+		Name:                "test",
+		AllowInteractiveRun: true,
+		OOMScoreAdjust:      -500,
+		Start: func() error {
+			b, err := ioutil.ReadFile(oomScoreAdjPath)
+			if err != nil {
+				return err
+			}
+			written = string(b)
+			return syscall.Kill(os.Getpid(), syscall.SIGINT)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if written != "-500\n" {
+		t.Errorf("oom_score_adj before Start = %q, want -500", written)
+	}
+}
+
+func TestSystemdExtraDirectives(t *testing.T) {
+	fakeSystemd(t)
+	out := renderSystemd(t, Config{
+		Name:    "test",
+		Program: "/usr/bin/test",
+		ExtraDirectives: map[string][]string{
+			"Unit":    {"Documentation=https://example.com"},
+			"Service": {"LimitNOFILE=65536", "ExecStartPre=/usr/bin/true"},
+			"Install": {"Alias=test-alias.service"},
+			"X-Zeta":  {"Z=1"},
+			"X-Alpha": {"A=1"},
+		},
+	})
+	for _, want := range []string{
+		"\nStartLimitBurst=10\nDocumentation=https://example.com\n\n[Service]\n",
+		"\nRestartSec=120\nLimitNOFILE=65536\nExecStartPre=/usr/bin/true\n\n[Install]\n",
+		"\nWantedBy=multi-user.target\nAlias=test-alias.service\n\n[X-Alpha]\nA=1\n\n[X-Zeta]\nZ=1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", DropIn: "override", ExtraDirectives: map[string][]string{"Install": {"Also=other.service"}}})
+	if !strings.HasSuffix(out, "\n[Install]\nAlso=other.service\n") {
+		t.Errorf("drop-in Install directives missing:\n%s", out)
+	}
+	if _, err := New(Config{Name: "test", ExtraDirectives: map[string][]string{"Service]\n[Unit": {"A=1"}}}); err == nil {
+		t.Error("New accepted an invalid section name")
+	}
+}
+
+func TestNoEscalatePermissionDenied(t *testing.T) {
+	fakeSystemd(t)
+	oldRename := rename
+	defer func() { rename = oldRename }()
+	rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EACCES}
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.InstallOrUpdate()
+	if !errors.Is(err, os.ErrPermission) || strings.Contains(err.Error(), "NoEscalate is set") {
+		t.Errorf("without NoEscalate = %v, want the plain error", err)
+	}
+
+	s.NoEscalate = true
+	_, err = s.InstallOrUpdate()
+	if err == nil || !strings.Contains(err.Error(), "NoEscalate is set; run as root") {
+		t.Errorf("with NoEscalate = %v", err)
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("error doesn't wrap the permission error: %v", err)
+	}
+}
+
+// fakeProc writes /proc/<pid>/stat and status files for a process with the
+// given CPU times in clock ticks and resident memory in kB.
+func fakeProc(t *testing.T, pid string, utime, stime, rssKB int) {
+	// Calls in the same test share one fake /proc.
+	if procDir == "/proc" {
+		procDir = t.TempDir()
+		t.Cleanup(func() { procDir = "/proc" })
+	}
+	dir := filepath.Join(procDir, pid)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stat := fmt.Sprintf("%s (my daemon) S 1 %s %s 0 -1 4194560 1024 0 0 0 %d %d 0 0 20 0 4 0 12345 104857600 2048 18446744073709551615\n", pid, pid, pid, utime, stime)
+	status := fmt.Sprintf("Name:\tmy daemon\nState:\tS (sleeping)\nPid:\t%s\nVmPeak:\t  110000 kB\nVmRSS:\t%8d kB\nThreads:\t4\n", pid, rssKB)
+	if err := ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "status"), []byte(status), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResourceUsageSystemd(t *testing.T) {
+	fakeSystemd(t)
+	oldOutput := commandOutput
+	t.Cleanup(func() { commandOutput = oldOutput })
+	var show string
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return []byte(show), nil
+	}
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	show = "ActiveState=active\nMainPID=4242\nMemoryCurrent=15728640\nCPUUsageNSec=2500000000\n"
+	usage, err := s.ResourceUsage()
+	want := ResourceUsage{PID: 4242, RSS: 15728640, CPUTime: 2500 * time.Millisecond}
+	if err != nil || usage != want {
+		t.Errorf("ResourceUsage = %+v, %v, want %+v", usage, err, want)
+	}
+
+	// Without accounting the process is measured through /proc.
+	fakeProc(t, "4242", 150, 50, 8192)
+	show = "ActiveState=active\nMainPID=4242\nMemoryCurrent=[not set]\nCPUUsageNSec=[not set]\n"
+	usage, err = s.ResourceUsage()
+	want = ResourceUsage{PID: 4242, RSS: 8192 * 1024, CPUTime: 2 * time.Second}
+	if err != nil || usage != want {
+		t.Errorf("ResourceUsage without accounting = %+v, %v, want %+v", usage, err, want)
+	}
+
+	show = "ActiveState=inactive\nMainPID=0\nMemoryCurrent=[not set]\nCPUUsageNSec=[not set]\n"
+	usage, err = s.ResourceUsage()
+	if err != ErrNotRunning || usage != (ResourceUsage{}) {
+		t.Errorf("ResourceUsage when stopped = %+v, %v, want ErrNotRunning", usage, err)
+	}
+}
+
+func TestResourceUsagePIDFile(t *testing.T) {
+	oldFlavor := flavor
+	t.Cleanup(func() { flavor = oldFlavor })
+	flavor = initSystemV
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", PIDFile: pidFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ResourceUsage(); err != ErrNotRunning {
+		t.Errorf("ResourceUsage without a PID file = %v, want ErrNotRunning", err)
+	}
+
+	fakeProc(t, "977", 1234, 66, 2048)
+	if err := ioutil.WriteFile(pidFile, []byte("977\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := s.ResourceUsage()
+	want := ResourceUsage{PID: 977, RSS: 2048 * 1024, CPUTime: 13 * time.Second}
+	if err != nil || usage != want {
+		t.Errorf("ResourceUsage = %+v, %v, want %+v", usage, err, want)
+	}
+
+	// A stale PID file names a process that has exited.
+	if err := ioutil.WriteFile(pidFile, []byte("978\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ResourceUsage(); err != ErrNotRunning {
+		t.Errorf("ResourceUsage with a stale PID file = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestParseCgroupProcs(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []int
+		err  bool
+	}{
+		{"812\n815\n1022\n", []int{812, 815, 1022}, false},
+		{"", nil, false},
+		{"812\nabc\n", nil, true},
+	} {
+		pids, err := parseCgroupProcs([]byte(tt.in))
+		if (err != nil) != tt.err || !reflect.DeepEqual(pids, tt.want) {
+			t.Errorf("parseCgroupProcs(%q) = %v, %v, want %v", tt.in, pids, err, tt.want)
+		}
+	}
+}
+
+func TestProcessesSystemd(t *testing.T) {
+	fakeSystemd(t)
+	oldOutput, oldDirs := commandOutput, cgroupDirs
+	t.Cleanup(func() { commandOutput, cgroupDirs = oldOutput, oldDirs })
+	show := "ControlGroup=/system.slice/test.service\n"
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return []byte(show), nil
+	}
+	root := t.TempDir()
+	// cgroup v1: the unified hierarchy has no cgroup for the unit.
+	cgroupDirs = []string{filepath.Join(root, "unified"), filepath.Join(root, "systemd")}
+	unit := filepath.Join(root, "systemd", "system.slice", "test.service")
+	if err := os.MkdirAll(filepath.Join(unit, "workers"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(unit, "cgroup.procs"), []byte("815\n812\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(unit, "workers", "cgroup.procs"), []byte("901\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pids, err := s.Processes()
+	if want := []int{812, 815, 901}; err != nil || !reflect.DeepEqual(pids, want) {
+		t.Errorf("Processes = %v, %v, want %v", pids, err, want)
+	}
+
+	show = "ControlGroup=\n"
+	if _, err := s.Processes(); err != ErrNotRunning {
+		t.Errorf("Processes when stopped = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestProcessesPIDFile(t *testing.T) {
+	oldFlavor := flavor
+	t.Cleanup(func() { flavor = oldFlavor })
+	flavor = initOpenRC
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", PIDFile: pidFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Processes(); err != ErrNotRunning {
+		t.Errorf("Processes without a PID file = %v, want ErrNotRunning", err)
+	}
+
+	// 977 leads the group of its workers 980 and 981. 990 has a group of
+	// its own.
+	fakeProc(t, "977", 0, 0, 0)
+	fakeProc(t, "990", 0, 0, 0)
+	for _, worker := range []string{"980", "981"} {
+		dir := filepath.Join(procDir, worker)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		stat := worker + " (worker) S 977 977 977 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 12346\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(pidFile, []byte("977\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pids, err := s.Processes()
+	if want := []int{977, 980, 981}; err != nil || !reflect.DeepEqual(pids, want) {
+		t.Errorf("Processes = %v, %v, want %v", pids, err, want)
+	}
+}
+
+func TestCustomTarget(t *testing.T) {
+	commands := fakeSystemd(t)
+	unitDir := t.TempDir()
+	targetPath := filepath.Join(unitDir, "myapp.target")
+	install := func(name string, remove bool) *linuxService {
+		s, err := newService(Config{Name: name, Program: "/usr/bin/" + name, UnitDir: unitDir, CustomTarget: "myapp.target", RemoveCustomTarget: remove})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.InstallOrUpdate(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	api := install("api", false)
+	target, err := ioutil.ReadFile(targetPath)
+	if err != nil {
+		t.Fatalf("target not created: %v", err)
+	}
+	if want := "[Unit]\nDescription=myapp.target\n\n[Install]\nWantedBy=multi-user.target\n"; string(target) != want {
+		t.Errorf("target =\n%s\nwant\n%s", target, want)
+	}
+	if !containsString(*commands, "systemctl enable myapp.target") {
+		t.Errorf("target not enabled: %q", *commands)
+	}
+	unit, err := ioutil.ReadFile(filepath.Join(unitDir, "api.service"))
+	if err != nil || !strings.Contains(string(unit), "\nWantedBy=myapp.target\n") {
+		t.Errorf("unit not wanted by the target:\n%s", unit)
+	}
+
+	// An existing target is left alone.
+	custom := []byte("[Unit]\nDescription=My application\n")
+	if err := ioutil.WriteFile(targetPath, custom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	*commands = nil
+	worker := install("worker", true)
+	if b, _ := ioutil.ReadFile(targetPath); !bytes.Equal(b, custom) {
+		t.Errorf("existing target overwritten:\n%s", b)
+	}
+	if containsString(*commands, "systemctl enable myapp.target") {
+		t.Errorf("existing target enabled again: %q", *commands)
+	}
+
+	// The target is shared, so it outlives services that don't remove it.
+	if err := api.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(targetPath); err != nil {
+		t.Errorf("shared target removed: %v", err)
+	}
+	if err := worker.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("target not removed with RemoveCustomTarget: %v", err)
+	}
+	if !containsString(*commands, "systemctl disable myapp.target") {
+		t.Errorf("target not disabled: %q", *commands)
+	}
+}
+
+func TestCustomTargetWantedBy(t *testing.T) {
+	unit := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", CustomTarget: "myapp.target", WantedBy: []string{"graphical.target"}})
+	if !strings.Contains(unit, "\nWantedBy=graphical.target myapp.target\n") {
+		t.Errorf("unit not wanted by both targets:\n%s", unit)
+	}
+	if _, err := New(Config{Name: "test", CustomTarget: "myapp.service"}); err == nil {
+		t.Error("New accepted a CustomTarget that isn't a target")
+	}
+}
+
+func TestRestartNative(t *testing.T) {
+	commands := fakeSystemd(t)
+	oldSleep := sleep
+	t.Cleanup(func() { sleep = oldSleep })
+	sleep = func(d time.Duration) { t.Errorf("Restart slept for %v", d) }
+
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		flavor initFlavor
+		want   []string
+	}{
+		{initSystemd, []string{"systemctl restart test.service"}},
+		{initOpenRC, []string{"rc-service test restart"}},
+		{initSystemV, []string{"service test restart"}},
+		{initUpstart, []string{"initctl stop test", "initctl start test"}},
+	} {
+		flavor = tt.flavor
+		*commands = nil
+		if err := s.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*commands, tt.want) {
+			t.Errorf("%v: commands = %q, want %q", tt.flavor, *commands, tt.want)
+		}
+	}
+}
+
+func TestKill(t *testing.T) {
+	commands := fakeSystemd(t)
+	oldOutput := commandOutput
+	t.Cleanup(func() { commandOutput = oldOutput })
+	state := "active"
+	commandOutput = func(name string, args ...string) ([]byte, error) {
+		return []byte("ActiveState=" + state + "\nMainPID=4242\nUnitFileState=enabled\n"), nil
+	}
+	unitDir := t.TempDir()
+	s, err := newService(Config{Name: "test", Program: "/usr/bin/test", UnitDir: unitDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Kill(); err != ErrNotInstalled {
+		t.Errorf("Kill when not installed = %v, want ErrNotInstalled", err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	*commands = nil
+	if err := s.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"systemctl kill --signal=SIGKILL test.service"}; !reflect.DeepEqual(*commands, want) {
+		t.Errorf("commands = %q, want %q", *commands, want)
+	}
+	state = "inactive"
+	if err := s.Kill(); err != ErrNotRunning {
+		t.Errorf("Kill when stopped = %v, want ErrNotRunning", err)
+	}
+
+	// Without systemd the process in the PID file is killed.
+	flavor = initSystemV
+	oldKill := killProcess
+	t.Cleanup(func() { killProcess = oldKill })
+	var killed []int
+	killProcess = func(pid int) error {
+		killed = append(killed, pid)
+		return nil
+	}
+	s.PIDFile = filepath.Join(t.TempDir(), "test.pid")
+	if err := s.Kill(); err != ErrNotRunning {
+		t.Errorf("Kill without a PID file = %v, want ErrNotRunning", err)
+	}
+	if err := ioutil.WriteFile(s.PIDFile, []byte("977\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Kill(); err != nil || !reflect.DeepEqual(killed, []int{977}) {
+		t.Errorf("Kill = %v, killed %v, want 977", err, killed)
+	}
+}
+
+func TestSystemdRequireNetwork(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", RequireNetwork: true})
+	unit := out[:strings.Index(out, "[Service]")]
+	if !strings.Contains(unit, "\nWants=network-online.target\nAfter=network-online.target\n") || strings.Contains(unit, "Requires=") {
+		t.Errorf("network dependency missing from [Unit]:\n%s", out)
+	}
+
+	up := true
+	out = renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test", RequireNetwork: true, NetworkState: &up})
+	if strings.Count(out, "After=network-online.target") != 1 || !strings.Contains(out, "\nRequires=network-online.target\n") {
+		t.Errorf("RequireNetwork with NetworkState:\n%s", out)
+	}
+
+	down := false
+	if _, err := New(Config{Name: "test", RequireNetwork: true, NetworkState: &down}); err == nil {
+		t.Error("New accepted RequireNetwork with NetworkState false")
+	}
+}
+
+func TestSystemdServiceDirectories(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "Directory=") {
+		t.Errorf("unexpected directory directive:\n%s", out)
+	}
+	for _, tt := range []struct {
+		c    Config
+		want string
+	}{
+		{Config{RuntimeDirectory: "test"}, "\nRuntimeDirectory=test\n"},
+		{Config{StateDirectory: "test/db"}, "\nStateDirectory=test/db\n"},
+		{Config{CacheDirectory: "test"}, "\nCacheDirectory=test\n"},
+		{Config{LogsDirectory: "test"}, "\nLogsDirectory=test\n"},
+	} {
+		tt.c.Name, tt.c.Program = "test", "/usr/bin/test"
+		out := renderSystemd(t, tt.c)
+		service := out[strings.Index(out, "[Service]"):]
+		if !strings.Contains(service, tt.want) {
+			t.Errorf("missing %q from [Service]:\n%s", tt.want, out)
+		}
+	}
+
+	for _, dir := range []string{"/var/lib/test", "../test", "test/../../etc", ".", "test/"} {
+		if _, err := New(Config{Name: "test", StateDirectory: dir}); err == nil {
+			t.Errorf("New accepted StateDirectory %q", dir)
+		}
+	}
+}
+
+func TestRunCreatesServiceDirectories(t *testing.T) {
+	oldFlavor, oldBases := flavor, serviceDirBases
+	t.Cleanup(func() { flavor, serviceDirBases = oldFlavor, oldBases })
+	flavor = initSystemV
+	root := t.TempDir()
+	serviceDirBases = map[string]string{
+		"RUNTIME_DIRECTORY": filepath.Join(root, "run"),
+		"STATE_DIRECTORY":   filepath.Join(root, "lib"),
+		"CACHE_DIRECTORY":   filepath.Join(root, "cache"),
+		"LOGS_DIRECTORY":    filepath.Join(root, "log"),
+	}
+	t.Setenv("STATE_DIRECTORY", "")
+	t.Setenv("LOGS_DIRECTORY", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := newService(Config{
+		Name:                "test",
+		AllowInteractiveRun: true,
+		StateDirectory:      "test/db",
+		LogsDirectory:       "test",
+		Start:               func() error { cancel(); return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RunContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for env, want := range map[string]string{
+		"STATE_DIRECTORY": filepath.Join(root, "lib", "test", "db"),
+		"LOGS_DIRECTORY":  filepath.Join(root, "log", "test"),
+	} {
+		if info, err := os.Stat(want); err != nil || !info.IsDir() {
+			t.Errorf("%s not created: %v", want, err)
+		}
+		if got := os.Getenv(env); got != want {
+			t.Errorf("$%s = %q, want %q", env, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "run")); !os.IsNotExist(err) {
+		t.Errorf("unset RuntimeDirectory created: %v", err)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	oldFlavor := flavor
+	t.Cleanup(func() { flavor = oldFlavor })
+	s, err := newService(Config{
+		Name:      "test",
+		Program:   "/opt/my app/test",
+		Arguments: []string{"-v", `--name="quoted"`, "a b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		flavor initFlavor
+		want   string
+	}{
+		{initSystemd, `"/opt/my app/test" "-v" "--name=\"quoted\"" "a b"`},
+		{initOpenRC, `"/opt/my app/test" "-v" "--name=\"quoted\"" "a b"`},
+		{initUpstart, `/opt/my app/test "-v" "--name=\"quoted\"" "a b"`},
+		{initSystemV, `/opt/my app/test`},
+	} {
+		s.flavor = tt.flavor
+		got, err := s.CommandLine()
+		if err != nil || got != tt.want {
+			t.Errorf("%v: CommandLine() = %s, %v, want %s", tt.flavor, got, err, tt.want)
+		}
+	}
+
+	// The systemd command line is the one in ExecStart.
+	flavor, s.flavor = initSystemd, initSystemd
+	unit := renderSystemd(t, s.Config)
+	cmd, _ := s.CommandLine()
+	if !strings.Contains(unit, "\nExecStart="+cmd+"\n") {
+		t.Errorf("ExecStart is not %s:\n%s", cmd, unit)
+	}
+}
+
+func TestSystemdUnneededAndManual(t *testing.T) {
+	out := renderSystemd(t, Config{Name: "test", Program: "/usr/bin/test"})
+	if strings.Contains(out, "Unneeded") || strings.Contains(out, "RefuseManual") {
+		t.Errorf("unexpected directives:\n%s", out)
+	}
+	for _, tt := range []struct {
+		c    Config
+		want string
+	}{
+		{Config{StopWhenUnneeded: true}, "\nStopWhenUnneeded=yes\n"},
+		{Config{RefuseManualStart: true}, "\nRefuseManualStart=yes\n"},
+		{Config{RefuseManualStop: true}, "\nRefuseManualStop=yes\n"},
+	} {
+		tt.c.Name, tt.c.Program = "test", "/usr/bin/test"
+		out := renderSystemd(t, tt.c)
+		unit := out[:strings.Index(out, "[Service]")]
+		if !strings.Contains(unit, tt.want) {
+			t.Errorf("missing %q from [Unit]:\n%s", tt.want, out)
+		}
+	}
+}
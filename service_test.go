@@ -0,0 +1,516 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateWantedBy(t *testing.T) {
+	c := Config{Name: "test", WantedBy: []string{"multi-user.target", "network"}}
+	if err := c.validate(); err == nil {
+		t.Error("expected an error for a WantedBy entry without the .target suffix")
+	}
+	c.WantedBy = []string{"graphical.target"}
+	if err := c.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+	runAtLoad := true
+	c := Config{
+		Name:      "test",
+		Arguments: []string{"-a"},
+		WantedBy:  []string{"multi-user.target"},
+		EnvVars:   map[string]string{"A": "1"},
+		RunAtLoad: &runAtLoad,
+	}
+	clone := c.Clone()
+	c.Arguments[0] = "-b"
+	c.WantedBy[0] = "graphical.target"
+	c.EnvVars["A"] = "2"
+	*c.RunAtLoad = false
+
+	if clone.Arguments[0] != "-a" || clone.WantedBy[0] != "multi-user.target" || clone.EnvVars["A"] != "1" || !*clone.RunAtLoad {
+		t.Errorf("clone shares state with the original: %+v", clone)
+	}
+	if empty := (Config{}).Clone(); empty.Arguments != nil || empty.EnvVars != nil {
+		t.Errorf("clone of empty config should keep nil fields: %+v", empty)
+	}
+}
+
+func TestConfigEqual(t *testing.T) {
+	c := Config{
+		Name:      "test",
+		Arguments: []string{"-a", "-b"},
+		WantedBy:  []string{"multi-user.target", "graphical.target"},
+		EnvVars:   map[string]string{"A": "1", "B": "2"},
+		Schedule:  Schedule{Calendar: []CalendarInterval{{Weekdays: []time.Weekday{time.Monday, time.Friday}}}},
+	}
+	reordered := c.Clone()
+	reordered.WantedBy = []string{"graphical.target", "multi-user.target"}
+	reordered.Schedule.Calendar[0].Weekdays = []time.Weekday{time.Friday, time.Monday}
+	reordered.Start = func() error { return nil }
+	if !c.Equal(reordered) {
+		t.Error("reordered WantedBy and Weekdays should be equal")
+	}
+	if c.WantedBy[0] != "multi-user.target" || reordered.WantedBy[0] != "graphical.target" {
+		t.Error("Equal modified its operands")
+	}
+
+	empty := Config{Name: "test", Arguments: []string{}, OnFailure: []string{}, EnvVars: map[string]string{}}
+	if !empty.Equal(Config{Name: "test"}) {
+		t.Error("nil and empty fields should be equal")
+	}
+
+	swapped := c.Clone()
+	swapped.Arguments = []string{"-b", "-a"}
+	if c.Equal(swapped) {
+		t.Error("Arguments in a different order should not be equal")
+	}
+	changed := c.Clone()
+	changed.EnvVars["B"] = "3"
+	if c.Equal(changed) {
+		t.Error("different EnvVars should not be equal")
+	}
+}
+
+func TestValidateSockets(t *testing.T) {
+	c := Config{Name: "test", Sockets: []LaunchdSocket{{Name: "Listener"}}}
+	if err := c.validate(); err == nil {
+		t.Error("expected an error for a socket without an address")
+	}
+	c.Sockets[0].ServiceName = "8080"
+	if err := c.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckWorkingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{WorkingDirectory: filepath.Join(dir, "missing")}
+	if err := c.checkWorkingDirectory(); err == nil {
+		t.Error("expected an error for a missing working directory")
+	}
+
+	c.WorkingDirectory = file
+	if err := c.checkWorkingDirectory(); err == nil {
+		t.Error("expected an error for a working directory that is a file")
+	}
+	c.CreateWorkingDirectory = true
+	if err := c.checkWorkingDirectory(); err == nil {
+		t.Error("expected an error for a working directory that is a file, even with CreateWorkingDirectory")
+	}
+
+	c.WorkingDirectory = filepath.Join(dir, "created", "nested")
+	if err := c.checkWorkingDirectory(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info, err := os.Stat(c.WorkingDirectory); err != nil || !info.IsDir() {
+		t.Errorf("working directory not created: %v", err)
+	}
+}
+
+func TestValidateOnFailure(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"notify@test.service": true,
+		"alert.target":        true,
+		"notify":              false,
+		"bad name.service":    false,
+	} {
+		c := Config{Name: "test", OnFailure: []string{name}}
+		if err := c.validate(); (err == nil) != valid {
+			t.Errorf("validate(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestValidateScheduling(t *testing.T) {
+	for _, c := range []struct {
+		policy, class string
+		valid         bool
+	}{
+		{"idle", "idle", true},
+		{"batch", "best-effort", true},
+		{"", "", true},
+		{"lowest", "", false},
+		{"", "background", false},
+	} {
+		cfg := Config{Name: "test", CPUSchedulingPolicy: c.policy, IOSchedulingClass: c.class}
+		if err := cfg.validate(); (err == nil) != c.valid {
+			t.Errorf("validate(%q, %q) = %v", c.policy, c.class, err)
+		}
+	}
+}
+
+func TestValidateKillMode(t *testing.T) {
+	for mode, valid := range map[string]bool{
+		"":              true,
+		"control-group": true,
+		"mixed":         true,
+		"process":       true,
+		"none":          true,
+		"group":         false,
+		"Mixed":         false,
+	} {
+		c := Config{Name: "test", KillMode: mode}
+		if err := c.validate(); (err == nil) != valid {
+			t.Errorf("validate(%q) = %v", mode, err)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	for _, c := range []struct {
+		schedule Schedule
+		valid    bool
+	}{
+		{Schedule{}, true},
+		{Schedule{Interval: time.Minute}, true},
+		{Schedule{Interval: time.Millisecond}, false},
+		{Schedule{Calendar: []CalendarInterval{{Month: 12, Day: 31, Hour: 23, Minute: 59}}}, true},
+		{Schedule{Calendar: []CalendarInterval{{Hour: 24}}}, false},
+		{Schedule{Calendar: []CalendarInterval{{Month: 13}}}, false},
+		{Schedule{Calendar: []CalendarInterval{{Weekdays: []time.Weekday{7}}}}, false},
+	} {
+		cfg := Config{Name: "test", Schedule: c.schedule}
+		if err := cfg.validate(); (err == nil) != c.valid {
+			t.Errorf("validate(%+v) = %v", c.schedule, err)
+		}
+	}
+}
+
+func TestRunUntilSignalConditions(t *testing.T) {
+	dir := t.TempDir()
+	started := false
+	c := &Config{
+		Name:                "test",
+		Start:               func() error { started = true; return errors.New("started") },
+		ConditionPathExists: []string{dir, "!" + filepath.Join(dir, "missing"), filepath.Join(dir, "license")},
+	}
+	if err := runUntilSignal(context.Background(), c); err != nil || started {
+		t.Errorf("runUntilSignal with an unmet condition = %v, started = %v", err, started)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "license"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUntilSignal(context.Background(), c); err == nil || !started {
+		t.Errorf("runUntilSignal with met conditions = %v, started = %v", err, started)
+	}
+
+	c.ConditionPathExists = []string{"relative/path"}
+	if err := c.validate(); err == nil {
+		t.Error("expected an error for a relative condition path")
+	}
+}
+
+func TestValidateSlice(t *testing.T) {
+	for _, tt := range []struct {
+		c     Config
+		valid bool
+	}{
+		{Config{Slice: "batch.slice", CPUQuota: "50%", TasksMax: 64}, true},
+		{Config{CPUQuota: "150.5%"}, true},
+		{Config{Slice: "batch"}, false},
+		{Config{Slice: "batch.service"}, false},
+		{Config{CPUQuota: "50"}, false},
+		{Config{TasksMax: -1}, false},
+	} {
+		tt.c.Name = "test"
+		if err := tt.c.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%q, %q, %d) = %v", tt.c.Slice, tt.c.CPUQuota, tt.c.TasksMax, err)
+		}
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(log.New(&buf, "svc: ", 0))
+	defer SetLogger(nil)
+
+	logf("configuration at %v differs", "/tmp/test")
+	if got := buf.String(); got != "svc: configuration at /tmp/test differs\n" {
+		t.Errorf("logged %q", got)
+	}
+}
+
+func TestProgram(t *testing.T) {
+	oldExecutable := executable
+	defer func() { executable = oldExecutable }()
+	executable = func() (string, error) {
+		return "/opt/current/program", nil
+	}
+
+	c := Config{Name: "test"}
+	if program, err := c.program(); err != nil || program != "/opt/current/program" {
+		t.Errorf("default program = %q, %v", program, err)
+	}
+	c.Program = "/usr/bin/other"
+	if program, err := c.program(); err != nil || program != "/usr/bin/other" {
+		t.Errorf("explicit program = %q, %v", program, err)
+	}
+
+	executable = func() (string, error) {
+		return "", errors.New("no executable")
+	}
+	c.Program = ""
+	if _, err := c.program(); err == nil {
+		t.Error("expected an error when the executable can't be determined")
+	}
+}
+
+func TestRunUntilSignalContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	c := &Config{
+		Name:  "test",
+		Start: func() error { cancel(); return nil },
+		Stop:  func() error { close(stopped); return nil },
+	}
+	if err := runUntilSignal(ctx, c); err != nil {
+		t.Errorf("runUntilSignal = %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("Stop was not called after the context was cancelled")
+	}
+}
+
+// fakeFileInfo is the os.FileInfo of a file that only exists in a fake stat.
+type fakeFileInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return 0 }
+func (fi fakeFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fakeFileInfo) Sys() interface{}   { return nil }
+
+// fakeStat makes stat report the files in files and nothing else.
+func fakeStat(t *testing.T, files map[string]os.FileMode) {
+	oldStat := stat
+	t.Cleanup(func() { stat = oldStat })
+	stat = func(path string) (os.FileInfo, error) {
+		mode, ok := files[path]
+		if !ok {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+		return fakeFileInfo{filepath.Base(path), mode}, nil
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake paths are Unix paths")
+	}
+	fakeStat(t, map[string]os.FileMode{
+		"/opt/app/bin":  0755,
+		"/opt/app/data": 0644,
+		"/opt/app/conf": 0600,
+		"/opt/app":      os.ModeDir | 0755,
+		"/var/lib/app":  os.ModeDir | 0755,
+	})
+	for _, tt := range []struct {
+		c    Config
+		errs int
+	}{
+		{Config{Program: "/opt/app/bin", WorkingDirectory: "/var/lib/app"}, 0},
+		{Config{Program: "/opt/app/missing"}, 1},
+		{Config{Program: "/opt/app/conf"}, 1},
+		{Config{Program: "/opt/app"}, 1},
+		{Config{Program: "/opt/app/bin", WorkingDirectory: "/var/lib/missing"}, 1},
+		{Config{Program: "/opt/app/bin", WorkingDirectory: "/var/lib/missing", CreateWorkingDirectory: true}, 0},
+		{Config{Program: "/opt/app/bin", WorkingDirectory: "/opt/app/data"}, 1},
+		{Config{Program: "/opt/app/missing", WorkingDirectory: "/var/lib/missing"}, 2},
+	} {
+		if errs := tt.c.preflight(); len(errs) != tt.errs {
+			t.Errorf("preflight(%q, %q) = %v, want %d errors", tt.c.Program, tt.c.WorkingDirectory, errs, tt.errs)
+		}
+	}
+}
+
+func TestCheckOwner(t *testing.T) {
+	if err := checkOwner("test", "", "/opt/app/bin"); err != nil {
+		t.Errorf("service not installed: %v", err)
+	}
+	if err := checkOwner("test", "/opt/app/bin", "/opt/app/bin"); err != nil {
+		t.Errorf("service installed for the same program: %v", err)
+	}
+	if err := checkOwner("test", "/opt/other/bin", "/opt/app/bin"); err == nil {
+		t.Error("expected an error for a service installed for another program")
+	}
+}
+
+// fakeOwners makes chown record its calls and the user and group lookups
+// know only app:staff.
+func fakeOwners(t *testing.T) *[]string {
+	oldChown, oldUser, oldGroup := chown, lookupUser, lookupGroup
+	t.Cleanup(func() { chown, lookupUser, lookupGroup = oldChown, oldUser, oldGroup })
+
+	var calls []string
+	chown = func(path string, uid, gid int) error {
+		calls = append(calls, fmt.Sprintf("%s %d:%d", filepath.Base(path), uid, gid))
+		return nil
+	}
+	lookupUser = func(name string) (*user.User, error) {
+		if name != "app" {
+			return nil, user.UnknownUserError(name)
+		}
+		return &user.User{Username: name, Uid: "501"}, nil
+	}
+	lookupGroup = func(name string) (*user.Group, error) {
+		if name != "staff" {
+			return nil, user.UnknownGroupError(name)
+		}
+		return &user.Group{Name: name, Gid: "20"}, nil
+	}
+	return &calls
+}
+
+func TestConfigFileOwner(t *testing.T) {
+	fakeOwners(t)
+	for _, tc := range []struct {
+		owner, group string
+		uid, gid     int
+		valid        bool
+	}{
+		{"", "", -1, -1, true},
+		{"app", "staff", 501, 20, true},
+		{"0", "", 0, -1, true},
+		{"", "20", -1, 20, true},
+		{"nobody-here", "", -1, -1, false},
+		{"", "nogroup-here", -1, -1, false},
+	} {
+		c := Config{ConfigOwner: tc.owner, ConfigGroup: tc.group}
+		uid, gid, err := c.configFileOwner()
+		if (err == nil) != tc.valid || uid != tc.uid || gid != tc.gid {
+			t.Errorf("configFileOwner(%q, %q) = %d, %d, %v", tc.owner, tc.group, uid, gid, err)
+		}
+	}
+}
+
+func TestValidateConfigFileMode(t *testing.T) {
+	for mode, valid := range map[os.FileMode]bool{
+		0:                    true,
+		0600:                 true,
+		0640:                 true,
+		0200:                 false,
+		os.ModeSetuid | 0644: false,
+		os.ModeDir | 0755:    false,
+	} {
+		c := Config{Name: "test", ConfigFileMode: mode}
+		if err := c.validate(); (err == nil) != valid {
+			t.Errorf("validate(%v) = %v", mode, err)
+		}
+	}
+}
+
+func TestRequireTool(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	toolLookups.Lock()
+	toolLookups.err = make(map[string]error)
+	toolLookups.Unlock()
+	lookups := 0
+	oldLookPath := lookPath
+	defer func() { lookPath = oldLookPath }()
+	lookPath = func(name string) (string, error) {
+		lookups++
+		return oldLookPath(name)
+	}
+
+	err := requireTool("launchctl")
+	if err == nil || !strings.Contains(err.Error(), "launchctl") || !strings.Contains(err.Error(), system.String()) {
+		t.Errorf("requireTool = %v, want an error naming launchctl and %v", err, system)
+	}
+	if err2 := requireTool("launchctl"); err2 == nil || err2.Error() != err.Error() || lookups != 1 {
+		t.Errorf("second requireTool = %v after %d lookups, want the cached error", err2, lookups)
+	}
+}
+
+func TestToolPath(t *testing.T) {
+	if got := toolPath("systemctl"); got != "systemctl" {
+		t.Errorf("toolPath before SetSystemctlPath = %q", got)
+	}
+	SetSystemctlPath("/run/current-system/sw/bin/systemctl")
+	if got := toolPath("systemctl"); got != "/run/current-system/sw/bin/systemctl" {
+		t.Errorf("toolPath after SetSystemctlPath = %q", got)
+	}
+	if got := toolPath("launchctl"); got != "launchctl" {
+		t.Errorf("SetSystemctlPath changed launchctl to %q", got)
+	}
+	SetSystemctlPath("")
+	if got := toolPath("systemctl"); got != "systemctl" {
+		t.Errorf("toolPath after resetting = %q", got)
+	}
+}
+
+func TestExpandArguments(t *testing.T) {
+	t.Setenv("SERVICE_TEST_DIR", "/srv")
+	args := []string{"--data-dir=$SERVICE_TEST_DIR/data", "--name=${NAME}", "literal"}
+
+	c := Config{}
+	if got := c.expandArguments(args); !reflect.DeepEqual(got, args) {
+		t.Errorf("without ExpandArguments = %q, want %q", got, args)
+	}
+
+	c.ExpandArguments = true
+	want := []string{"--data-dir=/srv/data", "--name=", "literal"}
+	if got := c.expandArguments(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("from environment = %q, want %q", got, want)
+	}
+
+	c.ArgumentVariables = map[string]string{"NAME": "app"}
+	want = []string{"--data-dir=/data", "--name=app", "literal"}
+	if got := c.expandArguments(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("from ArgumentVariables = %q, want %q", got, want)
+	}
+}
+
+func TestTemplatedDisplayName(t *testing.T) {
+	s, err := New(Config{
+		Name:        "myapp-prod",
+		Program:     "/usr/bin/test",
+		Version:     "1.2",
+		DisplayName: "MyApp (instance {{.Name}})",
+		Description: "MyApp {{.Version}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.EffectiveConfig()
+	if c.DisplayName != "MyApp (instance myapp-prod)" || c.Description != "MyApp 1.2" {
+		t.Errorf("DisplayName, Description = %q, %q", c.DisplayName, c.Description)
+	}
+
+	for _, name := range []string{"MyApp {{.Name", "MyApp {{.InstanceID}}"} {
+		if _, err := New(Config{Name: "test", Program: "/usr/bin/test", DisplayName: name}); err == nil {
+			t.Errorf("New with DisplayName %q succeeded", name)
+		}
+	}
+}
@@ -6,16 +6,22 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"reflect"
+	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/winsvc/eventlog"
 	"github.com/getlantern/winsvc/mgr"
 	"github.com/getlantern/winsvc/svc"
-	"github.com/kardianos/osext"
+	"github.com/getlantern/winsvc/winapi"
 )
 
 const version = "Windows Service"
@@ -25,6 +31,10 @@ type windowsService struct {
 
 	errSync      sync.Mutex
 	stopStartErr error
+
+	// ctx is the context RunContext was called with. Execute stops the
+	// service when it is cancelled.
+	ctx context.Context
 }
 
 type windowsSystem struct{}
@@ -35,7 +45,21 @@ func (windowsSystem) String() string {
 
 var system = windowsSystem{}
 
-func newService(c Config) (*windowsService, error) {
+func isInteractive() (bool, error) {
+	return svc.IsAnInteractiveSession()
+}
+
+func managerName() string {
+	return managerWindows
+}
+
+func newService(c Config) (Service, error) {
+	if c.Agent || c.Schedule.scheduled() || c.RootDir != "" {
+		return nil, ErrNotSupported
+	}
+	if c.UserSession {
+		return &windowsTaskService{Config: c}, nil
+	}
 	ws := &windowsService{
 		Config: c,
 	}
@@ -59,21 +83,53 @@ func (ws *windowsService) getError() error {
 }
 
 func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
-	changes <- svc.Status{State: svc.StartPending}
+	cmdsAccepted := svc.AcceptStop | svc.AcceptShutdown
+	if ws.Config.Drain != nil || ws.Config.Undrain != nil {
+		cmdsAccepted |= svc.AcceptPauseAndContinue
+	}
 
-	if err := ws.Config.Start(); err != nil {
+	if !ws.conditionsMet() {
+		return false, 0
+	}
+
+	if err := ws.start(changes); err != nil {
 		ws.setError(err)
 		return true, 1
 	}
 
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+	unhealthy, stopHealthcheck := startHealthcheck(&ws.Config, feedWatchdog)
+	defer stopHealthcheck()
+	var cancelled <-chan struct{}
+	if ws.ctx != nil {
+		cancelled = ws.ctx.Done()
+	}
 loop:
 	for {
-		c := <-r
+		var c svc.ChangeRequest
+		select {
+		case c = <-r:
+		case <-cancelled:
+			// Handle a cancelled RunContext as if the service manager
+			// had asked the service to stop.
+			c = svc.ChangeRequest{Cmd: svc.Stop}
+		case err := <-unhealthy:
+			changes <- svc.Status{State: svc.StopPending}
+			if ws.Config.Stop != nil {
+				ws.Config.Stop()
+			}
+			ws.setError(err)
+			return true, 3
+		}
 		switch c.Cmd {
 		case svc.Interrogate:
 			changes <- c.CurrentStatus
+		case svc.Pause:
+			ws.Config.drain(true)
+			changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
+		case svc.Continue:
+			ws.Config.drain(false)
+			changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 		case svc.Stop, svc.Shutdown:
 			changes <- svc.Status{State: svc.StopPending}
 			if ws.Config.Stop != nil {
@@ -91,11 +147,45 @@ loop:
 	return false, 0
 }
 
-func (ws *windowsService) InstallOrUpdateRequired() (bool, error) {
-	if true {
-		return true, nil
+// defaultStartupTimeout is used when Config.StartupTimeout is not set.
+const defaultStartupTimeout = 30 * time.Second
+
+// start runs Config.Start, reporting StartPending with an increasing
+// CheckPoint while it runs so the service manager doesn't consider the
+// service hung. It gives up once Config.StartupTimeout has passed.
+func (ws *windowsService) start(changes chan<- svc.Status) error {
+	timeout := ws.StartupTimeout
+	if timeout == 0 {
+		timeout = defaultStartupTimeout
+	}
+	waitHint := uint32(timeout / time.Millisecond)
+	changes <- svc.Status{State: svc.StartPending, WaitHint: waitHint}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ws.Config.Start()
+	}()
+	progress := time.NewTicker(timeout / 4)
+	defer progress.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var checkPoint uint32
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-progress.C:
+			checkPoint++
+			changes <- svc.Status{State: svc.StartPending, CheckPoint: checkPoint, WaitHint: waitHint}
+		case <-deadline.C:
+			return fmt.Errorf("Start did not return within %v", timeout)
+		}
 	}
-	m, err := mgr.Connect()
+}
+
+func (ws *windowsService) InstallOrUpdateRequired() (bool, error) {
+	m, err := connect(ws.Host)
 	if err != nil {
 		return false, err
 	}
@@ -108,70 +198,480 @@ func (ws *windowsService) InstallOrUpdateRequired() (bool, error) {
 	if s == nil {
 		return true, nil
 	}
+	defer s.Close()
 
 	cfg, err := ws.buildConfig()
 	if err != nil {
 		return false, err
 	}
+	cfg.BinaryPathName, err = ws.binaryPath()
+	if err != nil {
+		return false, err
+	}
 
-	return !reflect.DeepEqual(cfg, oldCfg), nil
+	upToDate, err := ws.upToDate(s, cfg, oldCfg)
+	return !upToDate, err
 }
 
-func (ws *windowsService) InstallOrUpdate() (bool, error) {
-	m, err := mgr.Connect()
+// UpdateWillRestart compares the binary path and account of the installed
+// service with those InstallOrUpdate would set.
+func (ws *windowsService) UpdateWillRestart() (bool, error) {
+	m, err := connect(ws.Host)
 	if err != nil {
-		return false, fmt.Errorf("Unable to connect to service manager: %v", err)
+		return false, err
 	}
 	defer m.Disconnect()
 
+	s, oldCfg, err := ws.existingSvcAndConfig(m)
+	if err != nil || s == nil {
+		return false, err
+	}
+	defer s.Close()
 	cfg, err := ws.buildConfig()
 	if err != nil {
-		return false, fmt.Errorf("Unable to build config: %v", err)
+		return false, err
+	}
+	cfg.BinaryPathName, err = ws.binaryPath()
+	if err != nil {
+		return false, err
 	}
+	return cfg.BinaryPathName != oldCfg.BinaryPathName || accountName(cfg.ServiceStartName) != accountName(oldCfg.ServiceStartName), nil
+}
 
-	s, oldCfg, err := ws.existingSvcAndConfig(m)
+// InstallOrUpdateWithRollback rolls back the settings buildConfig
+// controls, such as the binary path and start type, by restoring the
+// config the service manager reported before the update.
+func (ws *windowsService) InstallOrUpdateWithRollback(healthy func() error, timeout time.Duration) error {
+	return installWithRollback(ws, ws.snapshot, healthy, timeout)
+}
+
+// snapshot saves the config of the installed service and returns a
+// function that restores it, or nil if the service isn't installed.
+func (ws *windowsService) snapshot() (func() error, error) {
+	m, err := connect(ws.Host)
 	if err != nil {
-		return false, fmt.Errorf("Unable to get existing service and config: %v", err)
+		return nil, err
 	}
-	if s != nil && reflect.DeepEqual(cfg, oldCfg) {
-		// Service already exists and doesn't need updating
-		return false, nil
+	defer m.Disconnect()
+
+	s, saved, err := ws.existingSvcAndConfig(m)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	s.Close()
+	return func() error {
+		m, err := connect(ws.Host)
+		if err != nil {
+			return err
+		}
+		defer m.Disconnect()
+		s, err := m.OpenService(ws.Name)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		return s.UpdateConfig(saved)
+	}, nil
+}
+
+// errAccessDenied is ERROR_ACCESS_DENIED, returned when connecting to the
+// service manager from a process that isn't elevated.
+const errAccessDenied = syscall.Errno(5)
+
+// NeedsElevation reports whether the service manager refuses full access
+// to the current process, which happens when it isn't elevated.
+func (ws *windowsService) NeedsElevation() bool {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return needsElevation(err)
 	}
+	m.Disconnect()
+	return false
+}
 
-	if s == nil {
-		exepath, err := osext.Executable()
+func needsElevation(connectErr error) bool {
+	return connectErr == errAccessDenied
+}
+
+// InstallOrUpdate installs or updates the service. Without elevation it
+// returns an error wrapping ERROR_ACCESS_DENIED, so errors.Is(err,
+// os.ErrPermission) holds; the caller can check NeedsElevation first and
+// relaunch itself elevated.
+func (ws *windowsService) InstallOrUpdate() (InstallResult, error) {
+	if ws.NeedsElevation() {
+		return InstallResult{}, fmt.Errorf("Installing service %v requires elevation; run as Administrator: %w", ws.Name, errAccessDenied)
+	}
+
+	var result InstallResult
+	err := ws.ControlRetry.retry(func() (err error) {
+		result, err = ws.installOrUpdate(false)
+		return err
+	})
+	return result, ws.noEscalateError(err)
+}
+
+func (ws *windowsService) ForceReinstall() error {
+	_, err := ws.installOrUpdate(true)
+	if err != nil {
+		return err
+	}
+	return ws.Restart()
+}
+
+// installOrUpdate creates the service or updates its configuration if it
+// differs from the installed one, or unconditionally if force is set.
+func (ws *windowsService) installOrUpdate(force bool) (InstallResult, error) {
+	var result InstallResult
+	// The working directory of a remote service is on that computer.
+	if ws.Host == "" {
+		err := ws.checkWorkingDirectory()
 		if err != nil {
-			return false, fmt.Errorf("Unable to determine executable: %v", err)
+			return result, err
 		}
+	}
+
+	m, err := connect(ws.Host)
+	if err != nil {
+		return result, fmt.Errorf("Unable to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
 
-		binPath := &bytes.Buffer{}
-		// Quote exe path in case it contains a string.
-		binPath.WriteRune('"')
-		binPath.WriteString(exepath)
-		binPath.WriteRune('"')
+	cfg, err := ws.buildConfig()
+	if err != nil {
+		return result, fmt.Errorf("Unable to build config: %v", err)
+	}
 
-		// Arguments are encoded with the binary path to service.
-		// Enclose arguments in quotes. Escape quotes with a backslash.
-		for _, arg := range ws.Arguments {
-			binPath.WriteRune(' ')
-			binPath.WriteString(`"`)
-			binPath.WriteString(strings.Replace(arg, `"`, `\"`, -1))
-			binPath.WriteString(`"`)
+	s, oldCfg, err := ws.existingSvcAndConfig(m)
+	if err != nil {
+		return result, fmt.Errorf("Unable to get existing service and config: %v", err)
+	}
+	if s != nil {
+		defer s.Close()
+	}
+	binPath, err := ws.binaryPath()
+	if err != nil {
+		return result, err
+	}
+	cfg.BinaryPathName = binPath
+	if s != nil && !force {
+		upToDate, err := ws.upToDate(s, cfg, oldCfg)
+		if err != nil {
+			return result, err
 		}
-		s, err = m.CreateService(ws.Name, binPath.String(), cfg)
+		if upToDate {
+			// Service already exists and doesn't need updating
+			return result, nil
+		}
+	}
+	if s == nil {
+		s, err = m.CreateService(ws.Name, binPath, cfg)
 		if err != nil {
-			return false, fmt.Errorf("Unable to create service: %v", err)
+			return result, fmt.Errorf("Unable to create service: %v", err)
 		}
 		defer s.Close()
-		return false, ws.doStart(m)
+		result.Installed = true
+		err = ws.setRecoveryActions(s)
+		if err != nil {
+			return result, err
+		}
+		if len(ws.triggers()) > 0 {
+			err = ws.setTriggers(s)
+			if err != nil {
+				return result, err
+			}
+		}
+		if ws.ServiceSidType != SidTypeNone {
+			err = ws.setSidType(s)
+			if err != nil {
+				return result, err
+			}
+		}
+		err = ws.doStart(m)
+		if err != nil {
+			return result, err
+		}
+		result.Started = true
+		return result, nil
 	} else {
-		defer s.Close()
-		err = s.UpdateConfig(cfg)
+		err = updateConfig(s, cfg, oldCfg)
 		if err != nil {
-			return false, fmt.Errorf("Unable to update config: %v", err)
+			return result, err
 		}
-		return true, nil
+		err = ws.setRecoveryActions(s)
+		if err != nil {
+			return result, err
+		}
+		err = ws.setTriggers(s)
+		if err != nil {
+			return result, err
+		}
+		err = ws.setSidType(s)
+		if err != nil {
+			return result, err
+		}
+		result.Updated = true
+		return result, nil
+	}
+}
+
+// binaryPath returns the command line the service manager starts the
+// service with.
+func (ws *windowsService) binaryPath() (string, error) {
+	exepath, err := ws.program()
+	if err != nil {
+		return "", err
+	}
+
+	binPath := &bytes.Buffer{}
+	// Quote exe path in case it contains a string.
+	binPath.WriteRune('"')
+	binPath.WriteString(exepath)
+	binPath.WriteRune('"')
+
+	binPath.WriteString(quoteArguments(ws.Arguments))
+	return binPath.String(), nil
+}
+
+// CommandLine returns the binary path of the service.
+func (ws *windowsService) CommandLine() (string, error) {
+	return ws.binaryPath()
+}
+
+// quoteArguments encodes arguments for appending to the binary path of a
+// service. Each is enclosed in quotes, with quotes escaped with a
+// backslash.
+func quoteArguments(args []string) string {
+	b := &bytes.Buffer{}
+	for _, arg := range args {
+		b.WriteRune(' ')
+		b.WriteString(`"`)
+		b.WriteString(strings.Replace(arg, `"`, `\"`, -1))
+		b.WriteString(`"`)
+	}
+	return b.String()
+}
+
+// EffectiveConfig resolves the Program the service is installed with and
+// StartupTimeout.
+func (ws *windowsService) EffectiveConfig() Config {
+	c := ws.Config.Clone()
+	if program, err := ws.program(); err == nil {
+		c.Program = program
+	}
+	if c.StartupTimeout == 0 {
+		c.StartupTimeout = defaultStartupTimeout
+	}
+	return c
+}
+
+// WriteConfig writes the settings InstallOrUpdate would apply to w, one
+// per line, in the style of sc qc.
+func (ws *windowsService) WriteConfig(w io.Writer) error {
+	cfg, err := ws.buildConfig()
+	if err != nil {
+		return fmt.Errorf("Unable to build config: %v", err)
+	}
+	binPath, err := ws.binaryPath()
+	if err != nil {
+		return err
 	}
+	b := &bytes.Buffer{}
+	cfg.BinaryPathName = binPath
+	writeServiceConfig(b, ws.Name, cfg)
+	for i, action := range ws.RecoveryActions {
+		fmt.Fprintf(b, "FAILURE_ACTION_%d: %s after %v\n", i+1, action.Type, action.Delay)
+	}
+	if len(ws.RecoveryActions) > 0 {
+		fmt.Fprintf(b, "RESET_PERIOD: %v\n", ws.RecoveryResetPeriod)
+		if ws.RecoveryCommand != "" {
+			fmt.Fprintf(b, "COMMAND: %s\n", ws.RecoveryCommand)
+		}
+	}
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// writeServiceConfig writes the settings of cfg that InstallOrUpdate
+// manages to b, in the style of sc qc.
+func writeServiceConfig(b *bytes.Buffer, name string, cfg mgr.Config) {
+	startType := "DEMAND_START"
+	switch cfg.StartType {
+	case mgr.StartAutomatic:
+		startType = "AUTO_START"
+	case mgr.StartDisabled:
+		startType = "DISABLED"
+	}
+	fmt.Fprintf(b, "SERVICE_NAME: %s\n", name)
+	fmt.Fprintf(b, "DISPLAY_NAME: %s\n", cfg.DisplayName)
+	fmt.Fprintf(b, "DESCRIPTION: %s\n", cfg.Description)
+	fmt.Fprintf(b, "START_TYPE: %s\n", startType)
+	fmt.Fprintf(b, "BINARY_PATH_NAME: %s\n", cfg.BinaryPathName)
+	fmt.Fprintf(b, "SERVICE_START_NAME: %s\n", cfg.ServiceStartName)
+}
+
+// InstalledConfig lists the settings the service manager reports for the
+// installed service, in the format of WriteConfig. Recovery actions can't
+// be read back and aren't listed.
+func (ws *windowsService) InstalledConfig() ([]byte, error) {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return nil, ErrNotInstalled
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	cfg, err := s.Config()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read service configuration: %v", err)
+	}
+	b := &bytes.Buffer{}
+	writeServiceConfig(b, ws.Name, cfg)
+	return b.Bytes(), nil
+}
+
+// updateConfig changes the configuration of s to cfg and reads it back to
+// check it was applied. On failure it restores oldCfg, so a partial update
+// doesn't leave the service half configured.
+func updateConfig(s managedService, cfg, oldCfg mgr.Config) error {
+	err := s.UpdateConfig(cfg)
+	if err == nil {
+		err = verifyConfig(s, cfg)
+	}
+	if err == nil {
+		return nil
+	}
+	rollbackErr := s.UpdateConfig(oldCfg)
+	if rollbackErr != nil {
+		return fmt.Errorf("Unable to update config: %v; restoring the previous config also failed: %v", err, rollbackErr)
+	}
+	return fmt.Errorf("Unable to update config, previous config restored: %v", err)
+}
+
+// verifyConfig checks that the settings buildConfig controls are in effect.
+func verifyConfig(s managedService, want mgr.Config) error {
+	got, err := s.Config()
+	if err != nil {
+		return fmt.Errorf("Unable to read back config: %v", err)
+	}
+	if !configApplied(want, got) {
+		return errors.New("Service manager did not apply the config.")
+	}
+	return nil
+}
+
+// configApplied reports whether the installed config got has the settings
+// of want, the config buildConfig produced. It is the one definition of an
+// unchanged service: both are normalized and every field want sets must
+// match. Fields want leaves unset, such as ServiceType and ErrorControl
+// which the service manager fills in, are ignored.
+func configApplied(want, got mgr.Config) bool {
+	w, g := reflect.ValueOf(&want).Elem(), reflect.ValueOf(&got).Elem()
+	for i := 0; i < w.NumField(); i++ {
+		if w.Field(i).IsZero() {
+			g.Field(i).Set(w.Field(i))
+		}
+	}
+	return normalizedServiceConfig(want) == normalizedServiceConfig(got)
+}
+
+// normalizedServiceConfig returns c with the write-only Password cleared
+// and the account in the form the service manager reports it.
+func normalizedServiceConfig(c mgr.Config) mgr.Config {
+	c.Password = ""
+	c.ServiceStartName = accountName(c.ServiceStartName)
+	return c
+}
+
+// accountName returns the account a service runs as the way the service
+// manager reports it, which is LocalSystem where .\LocalSystem or nothing
+// was written. Account names are case-insensitive, so it is lower-cased.
+func accountName(name string) string {
+	name = strings.TrimPrefix(name, `.\`)
+	if name == "" {
+		name = "LocalSystem"
+	}
+	return strings.ToLower(name)
+}
+
+// setRecoveryActions configures what the service manager does when the
+// service fails, if Config.RecoveryActions is set.
+func (ws *windowsService) setRecoveryActions(s managedService) error {
+	if len(ws.RecoveryActions) == 0 {
+		return nil
+	}
+	err := s.SetRecoveryActions(ws.RecoveryActions, ws.RecoveryResetPeriod, ws.RecoveryCommand)
+	if err != nil {
+		return fmt.Errorf("Unable to set recovery actions: %v", err)
+	}
+	return nil
+}
+
+// triggers returns a new list of Config.Triggers, with
+// TriggerNetworkAvailable added for RequireNetwork.
+func (ws *windowsService) triggers() []Trigger {
+	triggers := append([]Trigger(nil), ws.Triggers...)
+	if ws.RequireNetwork && !containsTrigger(triggers, TriggerNetworkAvailable) {
+		triggers = append(triggers, TriggerNetworkAvailable)
+	}
+	return triggers
+}
+
+func containsTrigger(triggers []Trigger, t Trigger) bool {
+	for _, trigger := range triggers {
+		if trigger == t {
+			return true
+		}
+	}
+	return false
+}
+
+// setTriggers replaces the start triggers of s with triggers, so an empty
+// list removes triggers set by an earlier install.
+func (ws *windowsService) setTriggers(s managedService) error {
+	err := s.SetTriggers(ws.triggers())
+	if err != nil {
+		return fmt.Errorf("Unable to set triggers: %v", err)
+	}
+	return nil
+}
+
+// setSidType sets the per-service SID of s to Config.ServiceSidType.
+func (ws *windowsService) setSidType(s managedService) error {
+	err := s.SetSidType(ws.ServiceSidType)
+	if err != nil {
+		return fmt.Errorf("Unable to set service SID type: %v", err)
+	}
+	return nil
+}
+
+// upToDate reports whether the installed service s, with config oldCfg,
+// already has the config cfg, its triggers and
+// Config.ServiceSidType.
+func (ws *windowsService) upToDate(s managedService, cfg, oldCfg mgr.Config) (bool, error) {
+	if !configApplied(cfg, oldCfg) {
+		return false, nil
+	}
+	sidType, err := s.SidType()
+	if err != nil {
+		return false, fmt.Errorf("Unable to read service SID type: %v", err)
+	}
+	if sidType != ws.ServiceSidType {
+		return false, nil
+	}
+	triggers, err := s.Triggers()
+	if err != nil {
+		return false, fmt.Errorf("Unable to read triggers: %v", err)
+	}
+	want := sortedTriggers(ws.triggers())
+	return reflect.DeepEqual(sortedTriggers(append([]Trigger(nil), triggers...)), want), nil
 }
 
 func (ws *windowsService) buildConfig() (mgr.Config, error) {
@@ -181,11 +681,23 @@ func (ws *windowsService) buildConfig() (mgr.Config, error) {
 		StartType:        mgr.StartAutomatic,
 		ServiceStartName: ".\\LocalSystem",
 	}
+	if ws.DisplayName != "" {
+		cfg.DisplayName = ws.DisplayName
+	}
+	if ws.Description != "" {
+		cfg.Description = ws.Description
+	}
+	if ws.Oneshot || len(ws.triggers()) > 0 {
+		cfg.StartType = mgr.StartManual
+	}
+	if ws.Version != "" {
+		cfg.Description += " (version " + ws.Version + ")"
+	}
 
 	return cfg, nil
 }
 
-func (ws *windowsService) existingSvcAndConfig(m *mgr.Mgr) (*mgr.Service, mgr.Config, error) {
+func (ws *windowsService) existingSvcAndConfig(m serviceManager) (managedService, mgr.Config, error) {
 	s, err := m.OpenService(ws.Name)
 	if err != nil {
 		return nil, mgr.Config{}, nil
@@ -193,14 +705,15 @@ func (ws *windowsService) existingSvcAndConfig(m *mgr.Mgr) (*mgr.Service, mgr.Co
 
 	oldCfg, err := s.Config()
 	if err != nil {
-		return s, mgr.Config{}, err
+		s.Close()
+		return nil, mgr.Config{}, err
 	}
 
 	return s, oldCfg, nil
 }
 
 func (ws *windowsService) Uninstall() error {
-	m, err := mgr.Connect()
+	m, err := connect(ws.Host)
 	if err != nil {
 		return err
 	}
@@ -221,8 +734,76 @@ func (ws *windowsService) Uninstall() error {
 	return nil
 }
 
+// errServiceDoesNotExist is ERROR_SERVICE_DOES_NOT_EXIST, returned by the
+// service manager when opening a service that is not installed.
+const errServiceDoesNotExist = syscall.Errno(1060)
+
+func (ws *windowsService) UninstallIfPresent() error {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to open service %s: %v", ws.Name, err)
+	}
+	s.Close()
+	return ws.Uninstall()
+}
+
+// EditConfig is not supported because Windows keeps service configuration
+// in the service manager rather than in a file.
+func (ws *windowsService) EditConfig(edit func(current []byte) ([]byte, error)) error {
+	return ErrNotSupported
+}
+
 func (ws *windowsService) Run() error {
+	return ws.RunContext(context.Background())
+}
+
+func (ws *windowsService) RunContext(ctx context.Context) error {
+	interactive, err := isInteractive()
+	if err != nil {
+		return err
+	}
+	if interactive && !ws.AllowInteractiveRun {
+		return ErrNotRunningAsService
+	}
+	err = ws.checkRunsHere()
+	if err != nil {
+		return err
+	}
+
+	// The service manager discards the output of services.
+	if ws.StdoutPath != "" {
+		restore, err := redirectOutput(&ws.Config)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	if ws.StdinPath != "" {
+		restore, err := redirectInput(&ws.Config)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	err = loadEnvironmentFiles(ws.EnvironmentFiles)
+	if err != nil {
+		return err
+	}
+
+	if interactive {
+		return runUntilSignal(ctx, &ws.Config)
+	}
+
 	ws.setError(nil)
+	ws.ctx = ctx
 
 	// Return error messages from start and stop routines
 	// that get executed in the Execute method.
@@ -239,45 +820,637 @@ func (ws *windowsService) Run() error {
 	return nil
 }
 
-func (ws *windowsService) Start() error {
-	m, err := mgr.Connect()
+func (ws *windowsService) LastExitStatus() (int, error) {
+	m, err := connect(ws.Host)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer m.Disconnect()
-	return nil
-}
 
-func (ws *windowsService) doStart(m *mgr.Mgr) error {
 	s, err := m.OpenService(ws.Name)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer s.Close()
-	return s.Start([]string{})
-}
 
-func (ws *windowsService) Stop() error {
-	m, err := mgr.Connect()
+	status, err := s.QueryStatus()
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("Unable to query service status: %v", err)
 	}
-	defer m.Disconnect()
+	return exitStatusFromServiceStatus(status)
+}
 
-	s, err := m.OpenService(ws.Name)
-	if err != nil {
-		return err
-	}
+const (
+	errServiceSpecificError = 1066 // ERROR_SERVICE_SPECIFIC_ERROR
+	errServiceNeverStarted  = 1077 // ERROR_SERVICE_NEVER_STARTED
+)
+
+// exitStatusFromServiceStatus picks the exit code out of a service status.
+// Services report their own codes through ServiceSpecificExitCode.
+func exitStatusFromServiceStatus(status winapi.SERVICE_STATUS) (int, error) {
+	switch status.Win32ExitCode {
+	case errServiceNeverStarted:
+		return 0, ErrNoExitStatus
+	case errServiceSpecificError:
+		return int(status.ServiceSpecificExitCode), nil
+	default:
+		return int(status.Win32ExitCode), nil
+	}
+}
+
+func (ws *windowsService) Validate() error {
+	errs := ws.preflight()
+	installed, err := ws.installedProgram()
+	if err == nil {
+		err = ws.checkOwner(installed)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// installedProgram returns the program in the binary path of the installed
+// service, or "" if the service isn't installed.
+func (ws *windowsService) installedProgram() (string, error) {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	c, err := s.Config()
+	if err != nil {
+		return "", err
+	}
+	program, _ := splitBinaryPath(c.BinaryPathName)
+	return strings.Trim(program, `"`), nil
+}
+
+// checkOwner is like the shared checkOwner, but compares paths without
+// regard to case as Windows does.
+func (ws *windowsService) checkOwner(installed string) error {
+	program, err := ws.program()
+	if err != nil {
+		// Already reported by preflight.
+		return nil
+	}
+	if strings.EqualFold(installed, program) {
+		return nil
+	}
+	return checkOwner(ws.Name, installed, program)
+}
+
+// IsEnabled reports whether the installed service starts automatically,
+// with or without a delay.
+func (ws *windowsService) IsEnabled() (bool, error) {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return false, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+
+	c, err := s.Config()
+	if err != nil {
+		return false, err
+	}
+	return c.StartType == mgr.StartAutomatic, nil
+}
+
+// descriptionVersionPattern matches the version buildConfig appends to the
+// service description.
+var descriptionVersionPattern = regexp.MustCompile(` \(version (.*)\)$`)
+
+func (ws *windowsService) InstalledVersion() (string, error) {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return "", ErrNotInstalled
+	}
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	c, err := s.Config()
+	if err != nil {
+		return "", err
+	}
+	v := descriptionVersionPattern.FindStringSubmatch(c.Description)
+	if v == nil {
+		return "", nil
+	}
+	return v[1], nil
+}
+
+func (ws *windowsService) Export() (ServiceDefinition, error) {
+	def := ServiceDefinition{Config: ws.Config.Clone()}
+	m, err := connect(ws.Host)
+	if err != nil {
+		return def, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		if err == errServiceDoesNotExist {
+			return def, nil
+		}
+		return def, err
+	}
+	defer s.Close()
+	def.Installed = true
+
+	c, err := s.Config()
+	if err != nil {
+		return def, err
+	}
+	def.Enabled = c.StartType == mgr.StartAutomatic
+
+	status, err := s.Query()
+	if err != nil {
+		return def, err
+	}
+	switch status.State {
+	case svc.Running:
+		def.Status = StatusRunning
+		pid, err := s.ProcessID()
+		if err != nil {
+			return def, err
+		}
+		def.PID = int(pid)
+	case svc.Stopped:
+		def.Status = StatusStopped
+	}
+	return def, nil
+}
+
+// ResourceUsage measures the service process with GetProcessMemoryInfo and
+// GetProcessTimes. RSS is the working set. It is not supported with Host,
+// as the process is on another computer.
+func (ws *windowsService) ResourceUsage() (ResourceUsage, error) {
+	if ws.Host != "" {
+		return ResourceUsage{}, ErrNotSupported
+	}
+	def, err := ws.Export()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	if !def.Installed {
+		return ResourceUsage{}, ErrNotInstalled
+	}
+	if def.Status != StatusRunning || def.PID == 0 {
+		return ResourceUsage{}, ErrNotRunning
+	}
+	return processUsage(uint32(def.PID))
+}
+
+// StartAndCapture reads the output Run writes to StdoutPath. Without it,
+// Run logs to the event log, and with Host the file is on another
+// computer, so ErrNotSupported is returned.
+func (ws *windowsService) StartAndCapture(ctx context.Context, d time.Duration) (string, error) {
+	if ws.StdoutPath == "" || ws.Host != "" {
+		return "", ErrNotSupported
+	}
+	read, err := fileOutput(ws.StdoutPath)
+	if err != nil {
+		return "", err
+	}
+	return captureStart(ctx, ws, d, read)
+}
+
+// Processes returns the process of the service and its descendants. It is
+// not supported with Host.
+func (ws *windowsService) Processes() ([]int, error) {
+	if ws.Host != "" {
+		return nil, ErrNotSupported
+	}
+	def, err := ws.Export()
+	if err != nil {
+		return nil, err
+	}
+	if !def.Installed {
+		return nil, ErrNotInstalled
+	}
+	if def.Status != StatusRunning || def.PID == 0 {
+		return nil, ErrNotRunning
+	}
+	return processTree(def.PID)
+}
+
+// RotateLogs rotates the file Run writes StdoutPath to. Records sent to the
+// event log are written as they are logged, so there is no buffer to flush
+// and ErrNotSupported is returned without StdoutPath.
+func (ws *windowsService) RotateLogs() error {
+	return rotateActiveLog()
+}
+
+// PlatformHandle opens the installed service and returns its *mgr.Service,
+// which the caller must Close.
+func (ws *windowsService) PlatformHandle() (interface{}, error) {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open service %v: %v", ws.Name, err)
+	}
+	if sc, ok := s.(scService); ok {
+		return sc.Service, nil
+	}
+	return s, nil
+}
+
+// WatchStatus polls the status Export reports.
+func (ws *windowsService) WatchStatus(ctx context.Context) (<-chan Status, error) {
+	return watchStatus(ctx, ws.Export)
+}
+
+// Wait waits on the service's process, then for the service manager to
+// report the service stopped, so the exit status has been recorded. With
+// Host, the process is on another computer and only the status is polled.
+func (ws *windowsService) Wait(ctx context.Context) (int, error) {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return 0, ErrNotInstalled
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	pid, err := s.ProcessID()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to query service: %v", err)
+	}
+	if pid != 0 && ws.Host == "" {
+		err = waitProcess(ctx, pid)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = waitStopped(s)
+	if err != nil {
+		return 0, err
+	}
+	status, err := s.QueryStatus()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to query service status: %v", err)
+	}
+	return exitStatusFromServiceStatus(status)
+}
+
+// Capabilities reports CapPauseContinue only with Config.Drain or
+// Config.Undrain, as Execute accepts pause and continue only then.
+func (ws *windowsService) Capabilities() Capability {
+	if ws.Config.Drain != nil || ws.Config.Undrain != nil {
+		return CapPauseContinue
+	}
+	return 0
+}
+
+// openEventSink logs to the Windows event log under the given source name.
+// It is a variable so tests can substitute a fake backend.
+var openEventSink = func(name string) (eventSink, error) {
+	l, err := eventlog.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open event log: %v", err)
+	}
+	return eventLogSink{l}, nil
+}
+
+type eventLogSink struct {
+	*eventlog.Log
+}
+
+func (s eventLogSink) info(msg string) error {
+	return s.Info(1, msg)
+}
+
+// feedWatchdog does nothing; the service manager has no watchdog.
+func feedWatchdog() {}
+
+// retryableErrors are the messages of service manager failures that are
+// worth retrying.
+var retryableErrors = []string{
+	syscall.Errno(1055).Error(), // ERROR_SERVICE_DATABASE_LOCKED
+	syscall.Errno(1061).Error(), // ERROR_SERVICE_CANNOT_ACCEPT_CTRL
+}
+
+// UpdateProgram replaces the program in the service's binary path, keeping
+// its arguments.
+func (ws *windowsService) UpdateProgram(newPath string) error {
+	if ws.Host == "" {
+		err := checkExecutable(newPath)
+		if err != nil {
+			return err
+		}
+	}
+	err := ws.editBinaryPath(func(binPath string) string {
+		return replaceProgram(binPath, newPath)
+	})
+	if err != nil {
+		return err
+	}
+	ws.Program = newPath
+	return nil
+}
+
+// UpdateArguments replaces the arguments in the binary path of the
+// installed service.
+func (ws *windowsService) UpdateArguments(args []string) error {
+	args = ws.expandArguments(args)
+	err := ws.editBinaryPath(func(binPath string) string {
+		return replaceArguments(binPath, args)
+	})
+	if err != nil {
+		return err
+	}
+	ws.Arguments = append([]string(nil), args...)
+	return nil
+}
+
+// editBinaryPath applies edit to the binary path of the installed service.
+func (ws *windowsService) editBinaryPath(edit func(binPath string) string) error {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	oldCfg, err := s.Config()
+	if err != nil {
+		return err
+	}
+	cfg := oldCfg
+	cfg.BinaryPathName = edit(oldCfg.BinaryPathName)
+	return updateConfig(s, cfg, oldCfg)
+}
+
+// splitBinaryPath splits a service binary path into the program, quoted or
+// not, and the arguments that follow it.
+func splitBinaryPath(binPath string) (program, rest string) {
+	if strings.HasPrefix(binPath, `"`) {
+		if i := strings.IndexByte(binPath[1:], '"'); i >= 0 {
+			return binPath[:i+2], binPath[i+2:]
+		}
+		return binPath, ""
+	}
+	if i := strings.IndexByte(binPath, ' '); i >= 0 {
+		return binPath[:i], binPath[i:]
+	}
+	return binPath, ""
+}
+
+// replaceProgram replaces the program, quoted or not, at the start of a
+// service binary path.
+func replaceProgram(binPath, program string) string {
+	_, rest := splitBinaryPath(binPath)
+	return `"` + program + `"` + rest
+}
+
+// replaceArguments replaces the arguments that follow the program in a
+// service binary path.
+func replaceArguments(binPath string, args []string) string {
+	program, _ := splitBinaryPath(binPath)
+	return program + quoteArguments(args)
+}
+
+// Enable sets the service to start automatically at boot. Neither Enable
+// nor Disable changes a service that is already set that way.
+func (ws *windowsService) Enable() error {
+	return ws.setStartType(mgr.StartAutomatic)
+}
+
+// Disable sets the service to start only when started by hand.
+func (ws *windowsService) Disable() error {
+	return ws.setStartType(mgr.StartManual)
+}
+
+func (ws *windowsService) setStartType(startType uint32) error {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, err := s.Config()
+	if err != nil {
+		return err
+	}
+	if (c.StartType == mgr.StartAutomatic) == (startType == mgr.StartAutomatic) {
+		return nil
+	}
+	c.StartType = startType
+	return s.UpdateConfig(c)
+}
+
+func (ws *windowsService) Start() error {
+	return ws.ControlRetry.retry(func() error {
+		m, err := connect(ws.Host)
+		if err != nil {
+			return err
+		}
+		defer m.Disconnect()
+		return ws.doStart(m)
+	})
+}
+
+func (ws *windowsService) doStart(m serviceManager) error {
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return ErrNotInstalled
+	}
+	if err != nil {
+		return err
+	}
 	defer s.Close()
-	_, err = s.Control(svc.Stop)
+	return s.Start([]string{})
+}
+
+func (ws *windowsService) Stop() error {
+	return ws.ControlRetry.retry(ws.stop)
+}
+
+func (ws *windowsService) stop() error {
+	return ws.sendControl(svc.Stop)
+}
+
+// sendControl sends a change request to the installed service.
+func (ws *windowsService) sendControl(cmd svc.Cmd) error {
+	m, err := connect(ws.Host)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return ErrNotInstalled
+	}
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	_, err = s.Control(cmd)
 	return err
 }
 
+// Drain pauses the service, which Execute handles by calling Config.Drain.
+func (ws *windowsService) Drain() error {
+	return ws.sendControl(svc.Pause)
+}
+
+// Undrain continues the paused service, which Execute handles by calling
+// Config.Undrain.
+func (ws *windowsService) Undrain() error {
+	return ws.sendControl(svc.Continue)
+}
+
+// Kill terminates the service process with TerminateProcess. The service
+// manager sees the process exit as a failure and takes the
+// RecoveryActions. It is not supported with Host.
+func (ws *windowsService) Kill() error {
+	if ws.Host != "" {
+		return ErrNotSupported
+	}
+	m, err := connect(ws.Host)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return ErrNotInstalled
+	}
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	pid, err := s.ProcessID()
+	if err != nil {
+		return fmt.Errorf("Unable to query service: %v", err)
+	}
+	if pid == 0 {
+		return ErrNotRunning
+	}
+	return terminateProcess(pid)
+}
+
+// drainSignal and undrainSignal are nil, as Windows has no signals to
+// drain with. The service manager's pause and continue are used instead.
+var drainSignal, undrainSignal os.Signal
+
+func (ws *windowsService) ResetFailed() error {
+	return ErrNotSupported
+}
+
+// stopPollInterval is how often Restart queries a stopping service.
+// stopTimeout is how long it waits for the service to stop.
+var (
+	stopPollInterval = 100 * time.Millisecond
+	stopTimeout      = 30 * time.Second
+)
+
+// Restart stops the service, waits until the service manager reports it
+// stopped and starts it again. The service manager has no restart of its
+// own. A stopped service is just started.
 func (ws *windowsService) Restart() error {
-	err := ws.Stop()
+	m, err := connect(ws.Host)
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ws.Name)
+	if err == errServiceDoesNotExist {
+		return ErrNotInstalled
+	}
 	if err != nil {
 		return err
 	}
-	time.Sleep(50 * time.Millisecond)
-	return ws.Start()
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("Unable to query service: %v", err)
+	}
+	if status.State != svc.Stopped && status.State != svc.StopPending {
+		err = ws.ControlRetry.retry(func() error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = waitStopped(s)
+	if err != nil {
+		return err
+	}
+	return ws.ControlRetry.retry(func() error {
+		return s.Start([]string{})
+	})
+}
+
+// waitStopped polls s until it is stopped or stopTimeout has passed.
+func waitStopped(s managedService) error {
+	deadline := now().Add(stopTimeout)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("Unable to query service: %v", err)
+		}
+		if status.State == svc.Stopped {
+			return nil
+		}
+		if now().After(deadline) {
+			return fmt.Errorf("Service did not stop within %v", stopTimeout)
+		}
+		sleep(stopPollInterval)
+	}
 }
@@ -0,0 +1,1122 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/winsvc/mgr"
+	"github.com/getlantern/winsvc/svc"
+	"github.com/getlantern/winsvc/winapi"
+)
+
+func TestCapabilities(t *testing.T) {
+	ws := &windowsService{}
+	if caps := ws.Capabilities(); caps != 0 {
+		t.Errorf("Windows capabilities without Drain = %b", caps)
+	}
+	ws.Config.Drain = func() error { return nil }
+	if caps := ws.Capabilities(); caps != CapPauseContinue {
+		t.Errorf("Windows capabilities with Drain = %b", caps)
+	}
+}
+
+func TestExitStatusFromServiceStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status winapi.SERVICE_STATUS
+		code   int
+		err    error
+	}{
+		{winapi.SERVICE_STATUS{Win32ExitCode: errServiceNeverStarted}, 0, ErrNoExitStatus},
+		{winapi.SERVICE_STATUS{Win32ExitCode: 0}, 0, nil},
+		{winapi.SERVICE_STATUS{Win32ExitCode: 5}, 5, nil},
+		{winapi.SERVICE_STATUS{Win32ExitCode: errServiceSpecificError, ServiceSpecificExitCode: 2}, 2, nil},
+	} {
+		code, err := exitStatusFromServiceStatus(tt.status)
+		if code != tt.code || err != tt.err {
+			t.Errorf("%+v: got %v, %v; want %v, %v", tt.status, code, err, tt.code, tt.err)
+		}
+	}
+}
+
+func TestNeedsElevation(t *testing.T) {
+	if !needsElevation(errAccessDenied) {
+		t.Error("access denied not treated as needing elevation")
+	}
+	if needsElevation(syscall.Errno(1060)) {
+		t.Error("other connect errors treated as needing elevation")
+	}
+}
+
+// fakeManager is an in-memory service manager.
+type fakeManager struct {
+	services map[string]*fakeService
+	// host is the computer the last connect was for.
+	host string
+}
+
+func (m *fakeManager) CreateService(name, exepath string, c mgr.Config) (managedService, error) {
+	c.BinaryPathName = exepath
+	s := &fakeService{config: c, handles: 1}
+	m.services[name] = s
+	return s, nil
+}
+
+func (m *fakeManager) OpenService(name string) (managedService, error) {
+	s, ok := m.services[name]
+	if !ok {
+		return nil, errServiceDoesNotExist
+	}
+	s.handles++
+	return s, nil
+}
+
+func (m *fakeManager) Disconnect() error {
+	return nil
+}
+
+type fakeService struct {
+	config      mgr.Config
+	state       svc.State
+	status      winapi.SERVICE_STATUS
+	actions     []RecoveryAction
+	resetPeriod time.Duration
+	command     string
+	triggers    []Trigger
+	stopPolls   int // Queries a stopping service stays pending for; -1 forever
+	sidType     SidType
+	handles     int // Handles returned by the manager and not closed
+
+	updates     []mgr.Config // Every config passed to UpdateConfig
+	failUpdates int          // Number of UpdateConfig calls left to fail
+}
+
+func (s *fakeService) Config() (mgr.Config, error) {
+	return s.config, nil
+}
+
+func (s *fakeService) UpdateConfig(c mgr.Config) error {
+	s.updates = append(s.updates, c)
+	if s.failUpdates > 0 {
+		s.failUpdates--
+		return errors.New("update failed")
+	}
+	s.config = c
+	return nil
+}
+
+func (s *fakeService) SetRecoveryActions(actions []RecoveryAction, resetPeriod time.Duration, command string) error {
+	s.actions, s.resetPeriod, s.command = actions, resetPeriod, command
+	return nil
+}
+
+func (s *fakeService) Triggers() ([]Trigger, error) {
+	return s.triggers, nil
+}
+
+func (s *fakeService) SetTriggers(triggers []Trigger) error {
+	s.triggers = append([]Trigger(nil), triggers...)
+	return nil
+}
+
+func (s *fakeService) SidType() (SidType, error) {
+	return s.sidType, nil
+}
+
+func (s *fakeService) SetSidType(t SidType) error {
+	s.sidType = t
+	return nil
+}
+
+func (s *fakeService) Start(args []string) error {
+	s.state = svc.Running
+	return nil
+}
+
+func (s *fakeService) Control(c svc.Cmd) (svc.Status, error) {
+	if c == svc.Stop {
+		s.state = svc.Stopped
+		if s.stopPolls != 0 {
+			s.state = svc.StopPending
+		}
+	}
+	return svc.Status{State: s.state}, nil
+}
+
+func (s *fakeService) Query() (svc.Status, error) {
+	if s.state == svc.StopPending && s.stopPolls > 0 {
+		s.stopPolls--
+		if s.stopPolls == 0 {
+			s.state = svc.Stopped
+		}
+	}
+	return svc.Status{State: s.state}, nil
+}
+
+func (s *fakeService) QueryStatus() (winapi.SERVICE_STATUS, error) {
+	return s.status, nil
+}
+
+func (s *fakeService) ProcessID() (uint32, error) {
+	if s.state != svc.Running {
+		return 0, nil
+	}
+	return 1234, nil
+}
+
+func (s *fakeService) Delete() error {
+	return nil
+}
+
+func (s *fakeService) Close() error {
+	s.handles--
+	return nil
+}
+
+// useFakeManager makes the package connect to a new fakeManager.
+func useFakeManager(t *testing.T) *fakeManager {
+	m := &fakeManager{services: make(map[string]*fakeService)}
+	oldConnect := connect
+	t.Cleanup(func() { connect = oldConnect })
+	connect = func(host string) (serviceManager, error) {
+		m.host = host
+		return m, nil
+	}
+	return m
+}
+
+func TestRecoveryActions(t *testing.T) {
+	m := useFakeManager(t)
+	actions := []RecoveryAction{
+		{Type: RecoveryRestart, Delay: time.Minute},
+		{Type: RecoveryRunCommand, Delay: 5 * time.Minute},
+		{Type: RecoveryReboot, Delay: time.Hour},
+	}
+	ws := &windowsService{Config: Config{
+		Name:                "test",
+		RecoveryActions:     actions,
+		RecoveryResetPeriod: 24 * time.Hour,
+		RecoveryCommand:     `C:\notify.exe`,
+	}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := m.services["test"]
+	if !reflect.DeepEqual(s.actions, actions) || s.resetPeriod != 24*time.Hour || s.command != `C:\notify.exe` {
+		t.Errorf("recovery = %v, %v, %q", s.actions, s.resetPeriod, s.command)
+	}
+
+	noRecovery := &windowsService{Config: Config{Name: "other"}}
+	if _, err := noRecovery.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if m.services["other"].actions != nil {
+		t.Error("recovery actions configured without Config.RecoveryActions")
+	}
+}
+
+func TestExport(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	def, err := ws.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Installed {
+		t.Errorf("missing service exported as %+v", def)
+	}
+
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	m.services["test"].config.StartType = mgr.StartAutomatic
+	def, err = ws.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !def.Installed || !def.Enabled || def.Status != StatusRunning || def.PID != 1234 {
+		t.Errorf("running service exported as %+v", def)
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	oldCfg := s.config
+
+	// An unchanged service isn't updated, so change the description.
+	ws.Version = "2"
+	s.failUpdates = 1
+	_, err := ws.InstallOrUpdate()
+	if err == nil || !strings.Contains(err.Error(), "previous config restored") {
+		t.Fatalf("err = %v, want a restored error", err)
+	}
+	if len(s.updates) != 2 || !reflect.DeepEqual(s.updates[1], oldCfg) {
+		t.Errorf("updates = %+v, want the failed update followed by %+v", s.updates, oldCfg)
+	}
+	if !reflect.DeepEqual(s.config, oldCfg) {
+		t.Errorf("config = %+v, want %+v", s.config, oldCfg)
+	}
+
+	s.updates = nil
+	ws.Version = "3"
+	s.failUpdates = 2
+	_, err = ws.InstallOrUpdate()
+	if err == nil || !strings.Contains(err.Error(), "update failed; restoring the previous config also failed: update failed") {
+		t.Fatalf("err = %v, want both failures", err)
+	}
+	if len(s.updates) != 2 {
+		t.Errorf("updates = %+v, want an update and a rollback", s.updates)
+	}
+}
+
+func TestInstallResult(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	result, err := ws.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{Installed: true, Started: true}); result != want {
+		t.Errorf("fresh install = %+v, want %+v", result, want)
+	}
+	if m.services["test"].state != svc.Running {
+		t.Error("service not started after install")
+	}
+
+	result, err = ws.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{}); result != want {
+		t.Errorf("unchanged = %+v, want %+v", result, want)
+	}
+
+	ws.Version = "2"
+	result, err = ws.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{Updated: true}); result != want {
+		t.Errorf("update = %+v, want %+v", result, want)
+	}
+}
+
+func TestInstallOrUpdateRequired(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", Arguments: []string{"-v"}}}
+	if required, err := ws.InstallOrUpdateRequired(); err != nil || !required {
+		t.Errorf("before install = %v, %v", required, err)
+	}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	// The service manager reports settings buildConfig leaves unset, and
+	// the account without the .\ it was written with.
+	m.services["test"].config.ServiceType = 0x10
+	m.services["test"].config.ErrorControl = 1
+	m.services["test"].config.ServiceStartName = "LocalSystem"
+	if required, err := ws.InstallOrUpdateRequired(); err != nil || required {
+		t.Errorf("after install = %v, %v", required, err)
+	}
+	if result, err := ws.InstallOrUpdate(); err != nil || result != (InstallResult{}) {
+		t.Errorf("reinstall of an unchanged service = %+v, %v", result, err)
+	}
+	ws.Arguments = []string{"-v", "-debug"}
+	if required, err := ws.InstallOrUpdateRequired(); err != nil || !required {
+		t.Errorf("after changing arguments = %v, %v", required, err)
+	}
+	if handles := m.services["test"].handles; handles != 0 {
+		t.Errorf("%d service handles left open", handles)
+	}
+}
+
+func TestEnableDisable(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	if err := ws.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if s.config.StartType != mgr.StartManual {
+		t.Errorf("StartType after Disable = %d", s.config.StartType)
+	}
+	if err := ws.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if s.config.StartType != mgr.StartAutomatic {
+		t.Errorf("StartType after Enable = %d", s.config.StartType)
+	}
+
+	s.updates = nil
+	if err := ws.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.updates) != 0 {
+		t.Errorf("Enable on an enabled service updated it: %+v", s.updates)
+	}
+}
+
+func TestReplaceProgram(t *testing.T) {
+	for _, tt := range []struct{ binPath, want string }{
+		{`"C:\old\app.exe" "-v"`, `"C:\new app\app.exe" "-v"`},
+		{`"C:\old\app.exe"`, `"C:\new app\app.exe"`},
+		{`C:\old\app.exe -v`, `"C:\new app\app.exe" -v`},
+	} {
+		if got := replaceProgram(tt.binPath, `C:\new app\app.exe`); got != tt.want {
+			t.Errorf("replaceProgram(%q) = %q, want %q", tt.binPath, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateProgram(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", Arguments: []string{"-v"}}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	newProgram := filepath.Join(t.TempDir(), "new.exe")
+	if err := ioutil.WriteFile(newProgram, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := m.services["test"]
+	want := s.config
+	want.BinaryPathName = `"` + newProgram + `" "-v"`
+	if err := ws.UpdateProgram(newProgram); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.config, want) {
+		t.Errorf("config = %+v, want %+v", s.config, want)
+	}
+}
+
+func TestUpdateArguments(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", Arguments: []string{"-v"}}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	s.config.BinaryPathName = `C:\app\app.exe "-v"`
+	want := s.config
+	want.BinaryPathName = `C:\app\app.exe "-config" "C:\my \"app\".toml"`
+	if err := ws.UpdateArguments([]string{"-config", `C:\my "app".toml`}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.config, want) {
+		t.Errorf("config = %+v, want %+v", s.config, want)
+	}
+	if len(ws.Arguments) != 2 {
+		t.Errorf("Arguments = %q", ws.Arguments)
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	oldExecutable := executable
+	defer func() { executable = oldExecutable }()
+	executable = func() (string, error) {
+		return `C:\Program Files\test\test.exe`, nil
+	}
+	oldConnect := connect
+	defer func() { connect = oldConnect }()
+	connect = func(host string) (serviceManager, error) {
+		t.Fatal("WriteConfig connected to the service manager")
+		return nil, nil
+	}
+
+	ws := &windowsService{Config: Config{
+		Name:            "test",
+		Arguments:       []string{"-v"},
+		RecoveryActions: []RecoveryAction{{Type: RecoveryRestart, Delay: time.Minute}},
+	}}
+	var buf bytes.Buffer
+	if err := ws.WriteConfig(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"SERVICE_NAME: test\n",
+		"START_TYPE: AUTO_START\n",
+		`BINARY_PATH_NAME: "C:\Program Files\test\test.exe" "-v"` + "\n",
+		"FAILURE_ACTION_1: restart after 1m0s\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestInstalledConfig(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.InstalledConfig(); err != ErrNotInstalled {
+		t.Errorf("InstalledConfig before install = %v, want ErrNotInstalled", err)
+	}
+	m.services["test"] = &fakeService{config: mgr.Config{
+		DisplayName:      "Test",
+		StartType:        mgr.StartDisabled,
+		BinaryPathName:   `"C:\test\test.exe" "-v"`,
+		ServiceStartName: "LocalSystem",
+	}}
+	got, err := ws.InstalledConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SERVICE_NAME: test\nDISPLAY_NAME: Test\nDESCRIPTION: \nSTART_TYPE: DISABLED\n" +
+		`BINARY_PATH_NAME: "C:\test\test.exe" "-v"` + "\nSERVICE_START_NAME: LocalSystem\n"
+	if string(got) != want {
+		t.Errorf("InstalledConfig =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUpdateWillRestart(t *testing.T) {
+	m := useFakeManager(t)
+	oldExecutable := executable
+	defer func() { executable = oldExecutable }()
+	executable = func() (string, error) {
+		return `C:\test\test.exe`, nil
+	}
+	ws := &windowsService{Config: Config{Name: "test", Arguments: []string{"-v"}}}
+	if restart, err := ws.UpdateWillRestart(); err != nil || restart {
+		t.Errorf("UpdateWillRestart before install = %v, %v", restart, err)
+	}
+	cfg, err := ws.buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BinaryPathName, _ = ws.binaryPath()
+	m.services["test"] = &fakeService{config: cfg}
+
+	ws.Description = "Test service"
+	if restart, err := ws.UpdateWillRestart(); err != nil || restart {
+		t.Errorf("UpdateWillRestart for a new description = %v, %v", restart, err)
+	}
+	ws.Arguments = []string{"-debug"}
+	if restart, err := ws.UpdateWillRestart(); err != nil || !restart {
+		t.Errorf("UpdateWillRestart for new arguments = %v, %v", restart, err)
+	}
+	ws.Arguments = []string{"-v"}
+	m.services["test"].config.ServiceStartName = `NT AUTHORITY\LocalService`
+	if restart, err := ws.UpdateWillRestart(); err != nil || !restart {
+		t.Errorf("UpdateWillRestart for another account = %v, %v", restart, err)
+	}
+	if handles := m.services["test"].handles; handles != 0 {
+		t.Errorf("%d service handles left open", handles)
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	parents := map[int]int{
+		0:    0, // System Idle Process
+		4:    0,
+		1234: 600,
+		1300: 1234,
+		1301: 1234,
+		1400: 1300,
+		1500: 600,
+		1600: 1400,
+	}
+	if got, want := descendants(parents, 1234), []int{1234, 1300, 1301, 1400, 1600}; !reflect.DeepEqual(got, want) {
+		t.Errorf("descendants = %v, want %v", got, want)
+	}
+	// Reused IDs can make processes each other's parent.
+	if got, want := descendants(map[int]int{2000: 2001, 2001: 2000}, 2000), []int{2000, 2001}; !reflect.DeepEqual(got, want) {
+		t.Errorf("descendants with a cycle = %v, want %v", got, want)
+	}
+}
+
+func TestExecuteSlowStart(t *testing.T) {
+	ws := &windowsService{Config: Config{
+		Name: "test",
+		Start: func() error {
+			time.Sleep(160 * time.Millisecond)
+			return nil
+		},
+		StartupTimeout: 200 * time.Millisecond,
+	}}
+	r := make(chan svc.ChangeRequest)
+	changes := make(chan svc.Status, 100)
+	exited := make(chan uint32)
+	go func() {
+		_, code := ws.Execute(nil, r, changes)
+		exited <- code
+	}()
+
+	var pending []svc.Status
+	for status := range changes {
+		if status.State == svc.Running {
+			break
+		}
+		if status.State != svc.StartPending || status.WaitHint != 200 {
+			t.Fatalf("unexpected status %+v", status)
+		}
+		pending = append(pending, status)
+	}
+	r <- svc.ChangeRequest{Cmd: svc.Stop}
+	if code := <-exited; code != 0 {
+		t.Errorf("exit code = %d", code)
+	}
+
+	if len(pending) < 3 {
+		t.Fatalf("got %d StartPending updates, want at least 3", len(pending))
+	}
+	for i, status := range pending {
+		if status.CheckPoint != uint32(i) {
+			t.Errorf("update %d has CheckPoint %d", i, status.CheckPoint)
+		}
+	}
+}
+
+func TestExecuteStartTimeout(t *testing.T) {
+	ws := &windowsService{Config: Config{
+		Name: "test",
+		Start: func() error {
+			time.Sleep(time.Second)
+			return nil
+		},
+		StartupTimeout: 40 * time.Millisecond,
+	}}
+	changes := make(chan svc.Status, 100)
+	if _, code := ws.Execute(nil, nil, changes); code == 0 {
+		t.Error("Execute succeeded although Start timed out")
+	}
+	if ws.getError() == nil {
+		t.Error("timeout not reported")
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	ws := &windowsService{Config: Config{Name: "test"}}
+	exe, err := executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := ws.EffectiveConfig()
+	if c.Program != exe || c.StartupTimeout != defaultStartupTimeout {
+		t.Errorf("defaults not applied: %+v", c)
+	}
+	ws.Program = `C:\other.exe`
+	if c := ws.EffectiveConfig(); c.Program != ws.Program {
+		t.Errorf("Program = %q, want %q", c.Program, ws.Program)
+	}
+}
+
+func TestInstalledVersion(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", Version: "1.4.2"}}
+	if _, err := ws.InstalledVersion(); err != ErrNotInstalled {
+		t.Errorf("InstalledVersion before installing = %v, want ErrNotInstalled", err)
+	}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.services["test"].config.Description; got != "test (version 1.4.2)" {
+		t.Errorf("Description = %q", got)
+	}
+	if version, err := ws.InstalledVersion(); err != nil || version != "1.4.2" {
+		t.Errorf("InstalledVersion = %q, %v", version, err)
+	}
+
+	ws.Version = ""
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := ws.InstalledVersion(); err != nil || version != "" {
+		t.Errorf("InstalledVersion without a version = %q, %v", version, err)
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := false
+	ws := &windowsService{ctx: ctx, Config: Config{
+		Name:  "test",
+		Start: func() error { return nil },
+		Stop:  func() error { stopped = true; return nil },
+	}}
+	changes := make(chan svc.Status, 100)
+	exited := make(chan uint32)
+	go func() {
+		_, code := ws.Execute(nil, make(chan svc.ChangeRequest), changes)
+		exited <- code
+	}()
+	for status := range changes {
+		if status.State == svc.Running {
+			break
+		}
+	}
+	cancel()
+	if code := <-exited; code != 0 || !stopped {
+		t.Errorf("exit code = %d, stopped = %v", code, stopped)
+	}
+}
+
+func TestOneshotStartType(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", Oneshot: true}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.services["test"].config.StartType; got != mgr.StartManual {
+		t.Errorf("StartType = %d, want manual", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if err := ws.Validate(); err != nil {
+		t.Errorf("Validate before installing = %v", err)
+	}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Validate(); err != nil {
+		t.Errorf("Validate after installing = %v", err)
+	}
+	m.services["test"].config.BinaryPathName = `"C:\other\other.exe" "-v"`
+	if err := ws.Validate(); err == nil || !strings.Contains(err.Error(), `already installed for C:\other\other.exe`) {
+		t.Errorf("Validate for another program = %v", err)
+	}
+}
+
+func TestExternalProgram(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "helper", Program: `C:\Program Files\app\helper.exe`, Arguments: []string{"-serve"}}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	want := `"C:\Program Files\app\helper.exe" "-serve"`
+	if got := m.services["helper"].config.BinaryPathName; got != want {
+		t.Errorf("BinaryPathName = %q, want %q", got, want)
+	}
+
+	ws.Program = `C:\Program Files\app\helper2.exe`
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	want = `"C:\Program Files\app\helper2.exe" "-serve"`
+	if got := m.services["helper"].config.BinaryPathName; got != want {
+		t.Errorf("BinaryPathName after update = %q, want %q", got, want)
+	}
+}
+
+func TestIsEnabled(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if enabled, err := ws.IsEnabled(); err != nil || enabled {
+		t.Errorf("IsEnabled before installing = %v, %v", enabled, err)
+	}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	for startType, want := range map[uint32]bool{
+		mgr.StartAutomatic: true,
+		mgr.StartManual:    false,
+		mgr.StartDisabled:  false,
+	} {
+		m.services["test"].config.StartType = startType
+		if enabled, err := ws.IsEnabled(); err != nil || enabled != want {
+			t.Errorf("IsEnabled with start type %d = %v, %v", startType, enabled, err)
+		}
+	}
+}
+
+func TestExecuteDrain(t *testing.T) {
+	var calls []string
+	ws := &windowsService{Config: Config{
+		Name:    "test",
+		Start:   func() error { return nil },
+		Drain:   func() error { calls = append(calls, "drain"); return nil },
+		Undrain: func() error { calls = append(calls, "undrain"); return nil },
+	}}
+	r := make(chan svc.ChangeRequest)
+	changes := make(chan svc.Status, 100)
+	exited := make(chan uint32)
+	go func() {
+		_, code := ws.Execute(nil, r, changes)
+		exited <- code
+	}()
+	for status := range changes {
+		if status.State == svc.Running {
+			if status.Accepts&svc.AcceptPauseAndContinue == 0 {
+				t.Error("service doesn't accept pause and continue")
+			}
+			break
+		}
+	}
+	r <- svc.ChangeRequest{Cmd: svc.Pause}
+	if status := <-changes; status.State != svc.Paused {
+		t.Errorf("status after pause = %+v", status)
+	}
+	r <- svc.ChangeRequest{Cmd: svc.Continue}
+	if status := <-changes; status.State != svc.Running {
+		t.Errorf("status after continue = %+v", status)
+	}
+	r <- svc.ChangeRequest{Cmd: svc.Stop}
+	if code := <-exited; code != 0 {
+		t.Errorf("exit code = %d", code)
+	}
+	if want := []string{"drain", "undrain"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestAgentNotSupported(t *testing.T) {
+	if _, err := New(Config{Name: "test", Agent: true}); err != ErrNotSupported {
+		t.Errorf("New = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestScheduleNotSupported(t *testing.T) {
+	if _, err := New(Config{Name: "test", Schedule: Schedule{Interval: time.Hour}}); err != ErrNotSupported {
+		t.Errorf("New = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestPlatformHandle(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.PlatformHandle(); err == nil {
+		t.Error("expected an error for a service that isn't installed")
+	}
+
+	m.services["test"] = &fakeService{}
+	handle, err := ws.PlatformHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle != m.services["test"] {
+		t.Errorf("PlatformHandle() = %T, want the opened service", handle)
+	}
+}
+
+func TestControlNotInstalled(t *testing.T) {
+	useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	for name, op := range map[string]func() error{"Start": ws.Start, "Stop": ws.Stop, "Restart": ws.Restart} {
+		if err := op(); err != ErrNotInstalled {
+			t.Errorf("%s() = %v, want ErrNotInstalled", name, err)
+		}
+	}
+}
+
+func TestTemplatedDisplayNameConfig(t *testing.T) {
+	s, err := New(Config{Name: "myapp-prod", DisplayName: "MyApp (instance {{.Name}})", Version: "1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := s.(*windowsService).buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DisplayName != "MyApp (instance myapp-prod)" || cfg.Description != "myapp-prod (version 1.2)" {
+		t.Errorf("DisplayName, Description = %q, %q", cfg.DisplayName, cfg.Description)
+	}
+}
+
+func TestSupported(t *testing.T) {
+	c := Config{Name: "test", StartupTimeout: time.Minute, RecoveryActions: []RecoveryAction{{Type: RecoveryRestart}}}
+	if err := Supported(c); err != nil {
+		t.Errorf("Windows config = %v", err)
+	}
+	c.PIDFile = `C:\test.pid`
+	c.EnvVars = map[string]string{"A": "1"}
+	err := Supported(c)
+	want := "Config is not supported by Windows: PIDFile requires systemd, Upstart, OpenRC, System-V or launchd; EnvVars requires systemd or launchd"
+	if err == nil || err.Error() != want {
+		t.Errorf("Supported = %v, want %v", err, want)
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", Triggers: []Trigger{TriggerNetworkAvailable, TriggerDomainJoin}}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	if want := []Trigger{TriggerNetworkAvailable, TriggerDomainJoin}; !reflect.DeepEqual(s.triggers, want) {
+		t.Errorf("triggers = %v, want %v", s.triggers, want)
+	}
+	if s.config.StartType != mgr.StartManual {
+		t.Errorf("StartType = %d, want demand start", s.config.StartType)
+	}
+
+	ws.Triggers = []Trigger{TriggerDomainJoin, TriggerNetworkAvailable}
+	if required, err := ws.InstallOrUpdateRequired(); err != nil || required {
+		t.Errorf("reordered triggers = %v, %v", required, err)
+	}
+	ws.Triggers = []Trigger{TriggerDomainJoin}
+	result, err := ws.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Updated || !reflect.DeepEqual(s.triggers, []Trigger{TriggerDomainJoin}) {
+		t.Errorf("after update: %+v, triggers %v", result, s.triggers)
+	}
+
+	ws.Triggers = nil
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.triggers) != 0 || s.config.StartType != mgr.StartAutomatic {
+		t.Errorf("after removing triggers: %v, StartType %d", s.triggers, s.config.StartType)
+	}
+}
+
+func TestResourceUsageStopped(t *testing.T) {
+	useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.ResourceUsage(); err != ErrNotInstalled {
+		t.Errorf("ResourceUsage when not installed = %v, want ErrNotInstalled", err)
+	}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := ws.ResourceUsage()
+	if err != ErrNotRunning || usage != (ResourceUsage{}) {
+		t.Errorf("ResourceUsage when stopped = %+v, %v, want ErrNotRunning", usage, err)
+	}
+}
+
+func TestRestartWaitsForStop(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	s.stopPolls = 3
+	var sleeps []time.Duration
+	oldSleep := sleep
+	t.Cleanup(func() { sleep = oldSleep })
+	sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	if err := ws.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if s.state != svc.Running {
+		t.Errorf("state after Restart = %v, want running", s.state)
+	}
+	// The service is polled until it stops rather than given a fixed time.
+	if want := []time.Duration{stopPollInterval, stopPollInterval}; !reflect.DeepEqual(sleeps, want) {
+		t.Errorf("sleeps = %v, want %v", sleeps, want)
+	}
+
+	// A stopped service is started without waiting.
+	s.state, sleeps = svc.Stopped, nil
+	if err := ws.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if s.state != svc.Running || len(sleeps) != 0 {
+		t.Errorf("restart of a stopped service: state %v, sleeps %v", s.state, sleeps)
+	}
+}
+
+func TestRestartStopTimeout(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	m.services["test"].stopPolls = -1
+	oldSleep, oldNow := sleep, now
+	t.Cleanup(func() { sleep, now = oldSleep, oldNow })
+	current := time.Now()
+	now = func() time.Time { return current }
+	sleep = func(d time.Duration) { current = current.Add(d) }
+
+	if err := ws.Restart(); err == nil || !strings.Contains(err.Error(), "did not stop") {
+		t.Errorf("Restart of a hung service = %v", err)
+	}
+	if m.services["test"].state != svc.StopPending {
+		t.Errorf("hung service was started")
+	}
+}
+
+func TestServiceSidType(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", ServiceSidType: SidTypeRestricted}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	if s.sidType != SidTypeRestricted {
+		t.Errorf("SID type = %v, want restricted", s.sidType)
+	}
+	if required, err := ws.InstallOrUpdateRequired(); err != nil || required {
+		t.Errorf("InstallOrUpdateRequired after install = %v, %v", required, err)
+	}
+
+	// Going back to the default clears the SID type of an earlier install.
+	ws.ServiceSidType = SidTypeNone
+	result, err := ws.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Updated || s.sidType != SidTypeNone {
+		t.Errorf("after update: %+v, SID type %v", result, s.sidType)
+	}
+}
+
+func TestWait(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	oldWait := waitProcess
+	t.Cleanup(func() { waitProcess = oldWait })
+	var waited uint32
+	waitProcess = func(ctx context.Context, pid uint32) error {
+		// The process exits with a service-specific code.
+		waited = pid
+		s.state = svc.Stopped
+		s.status = winapi.SERVICE_STATUS{Win32ExitCode: errServiceSpecificError, ServiceSpecificExitCode: 3}
+		return nil
+	}
+	code, err := ws.Wait(context.Background())
+	if err != nil || code != 3 {
+		t.Errorf("Wait = %d, %v, want 3", code, err)
+	}
+	if waited != 1234 {
+		t.Errorf("waited on process %d, want 1234", waited)
+	}
+
+	// A stopped service returns at once.
+	waited = 0
+	if code, err := ws.Wait(context.Background()); err != nil || code != 3 || waited != 0 {
+		t.Errorf("Wait on a stopped service = %d, %v, waited on %d", code, err, waited)
+	}
+}
+
+func TestKill(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test"}}
+	if err := ws.Kill(); err != ErrNotInstalled {
+		t.Errorf("Kill when not installed = %v, want ErrNotInstalled", err)
+	}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	oldTerminate := terminateProcess
+	t.Cleanup(func() { terminateProcess = oldTerminate })
+	var terminated []uint32
+	terminateProcess = func(pid uint32) error {
+		terminated = append(terminated, pid)
+		m.services["test"].state = svc.Stopped
+		return nil
+	}
+	if err := ws.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{1234}; !reflect.DeepEqual(terminated, want) {
+		t.Errorf("terminated %v, want %v", terminated, want)
+	}
+	if err := ws.Kill(); err != ErrNotRunning {
+		t.Errorf("Kill when stopped = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestRequireNetwork(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{Name: "test", RequireNetwork: true, Triggers: []Trigger{TriggerDomainJoin}}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	s := m.services["test"]
+	if want := []Trigger{TriggerDomainJoin, TriggerNetworkAvailable}; !reflect.DeepEqual(s.triggers, want) {
+		t.Errorf("triggers = %v, want %v", s.triggers, want)
+	}
+	if s.config.StartType != mgr.StartManual {
+		t.Errorf("StartType = %d, want demand start", s.config.StartType)
+	}
+	if required, err := ws.InstallOrUpdateRequired(); err != nil || required {
+		t.Errorf("InstallOrUpdateRequired after install = %v, %v", required, err)
+	}
+	if len(ws.Triggers) != 1 {
+		t.Errorf("Config.Triggers changed: %v", ws.Triggers)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	ws := &windowsService{Config: Config{
+		Name:      "test",
+		Program:   `C:\Program Files\My App\app.exe`,
+		Arguments: []string{"-v", `--name="quoted"`, "a b"},
+	}}
+	got, err := ws.CommandLine()
+	want := `"C:\Program Files\My App\app.exe" "-v" "--name=\"quoted\"" "a b"`
+	if err != nil || got != want {
+		t.Errorf("CommandLine() = %s, %v, want %s", got, err, want)
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	m := useFakeManager(t)
+	ws := &windowsService{Config: Config{
+		Name:             "test",
+		Host:             "buildhost",
+		Program:          `D:\agent\agent.exe`,
+		WorkingDirectory: `D:\agent`,
+	}}
+	if _, err := ws.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if m.host != "buildhost" {
+		t.Errorf("connected to %q, want buildhost", m.host)
+	}
+	if got := m.services["test"].config.BinaryPathName; got != `"D:\agent\agent.exe"` {
+		t.Errorf("binary path = %s", got)
+	}
+	if err := ws.Kill(); err != ErrNotSupported {
+		t.Errorf("Kill = %v, want ErrNotSupported", err)
+	}
+	if _, err := ws.Processes(); err != ErrNotSupported {
+		t.Errorf("Processes = %v, want ErrNotSupported", err)
+	}
+	if _, err := New(Config{Name: "test", Host: "buildhost"}); err == nil {
+		t.Error("New accepted Host without Program")
+	}
+}
+
+func TestInstallWithoutElevation(t *testing.T) {
+	oldConnect := connect
+	defer func() { connect = oldConnect }()
+	connect = func(host string) (serviceManager, error) {
+		return nil, errAccessDenied
+	}
+	ws := &windowsService{Config: Config{Name: "test"}}
+	result, err := ws.InstallOrUpdate()
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("InstallOrUpdate without elevation = %v, want a permission error", err)
+	}
+	if result != (InstallResult{}) {
+		t.Errorf("InstallOrUpdate without elevation reported %+v", result)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// serviceDirBases maps the environment variable systemd passes each
+// service directory in to the directory it is created below. It is a
+// variable so tests can use temporary directories.
+var serviceDirBases = map[string]string{
+	"RUNTIME_DIRECTORY": "/run",
+	"STATE_DIRECTORY":   "/var/lib",
+	"CACHE_DIRECTORY":   "/var/cache",
+	"LOGS_DIRECTORY":    "/var/log",
+}
+
+func init() {
+	if runtime.GOOS == "darwin" {
+		serviceDirBases["RUNTIME_DIRECTORY"] = "/var/run"
+	}
+}
+
+// serviceDirs returns the set service directory fields, keyed by the
+// environment variable systemd passes each in.
+func (c *Config) serviceDirs() map[string]string {
+	dirs := make(map[string]string)
+	for env, dir := range map[string]string{
+		"RUNTIME_DIRECTORY": c.RuntimeDirectory,
+		"STATE_DIRECTORY":   c.StateDirectory,
+		"CACHE_DIRECTORY":   c.CacheDirectory,
+		"LOGS_DIRECTORY":    c.LogsDirectory,
+	} {
+		if dir != "" {
+			dirs[env] = dir
+		}
+	}
+	return dirs
+}
+
+// validServiceDir reports whether dir is a relative path that stays below
+// the directory it is joined to.
+func validServiceDir(dir string) bool {
+	return dir == "" || !filepath.IsAbs(dir) && dir == filepath.Clean(dir) && dir != "." && dir != ".." && !strings.HasPrefix(dir, "../")
+}
+
+// createServiceDirs does for Run what systemd does for the service
+// directories: it creates them, owned by the user Run runs as, and sets
+// the environment variables that name them.
+func createServiceDirs(c *Config) error {
+	for env, dir := range c.serviceDirs() {
+		path := filepath.Join(serviceDirBases[env], dir)
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			return fmt.Errorf("Unable to create %s: %v", path, err)
+		}
+		err = os.Setenv(env, path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Names of the service managers, as returned by managerName. On Linux the
+// name is that of the init system in use.
+const (
+	managerSystemd = "systemd"
+	managerUpstart = "Upstart"
+	managerOpenRC  = "OpenRC"
+	managerSystemV = "System-V"
+	managerLaunchd = "launchd"
+	managerWindows = "Windows"
+)
+
+var (
+	// unixManagers are the service managers that install from a
+	// configuration file.
+	unixManagers = []string{managerSystemd, managerUpstart, managerOpenRC, managerSystemV, managerLaunchd}
+	// runManagers are the service managers that leave log rotation to Run.
+	runManagers = []string{managerUpstart, managerOpenRC, managerSystemV, managerLaunchd, managerWindows}
+)
+
+// configFeatures lists the Config fields that only some service managers
+// support, and which ones.
+var configFeatures = []struct {
+	field    string
+	set      func(c *Config) bool
+	managers []string
+}{
+	{"LogMaxSize", func(c *Config) bool { return c.LogMaxSize != 0 || c.LogMaxBackups != 0 }, runManagers},
+	{"PIDFile", func(c *Config) bool { return c.PIDFile != "" }, unixManagers},
+	{"StartupTimeout", func(c *Config) bool { return c.StartupTimeout != 0 }, []string{managerWindows}},
+	{"NetworkState", func(c *Config) bool { return c.NetworkState != nil && *c.NetworkState }, []string{managerSystemd, managerLaunchd}},
+	{"NetworkState false", func(c *Config) bool { return c.NetworkState != nil && !*c.NetworkState }, []string{managerLaunchd}},
+	{"RequireNetwork", func(c *Config) bool { return c.RequireNetwork }, []string{managerSystemd, managerLaunchd, managerWindows}},
+	{"Architecture", func(c *Config) bool { return c.Architecture != "" }, []string{managerLaunchd}},
+	{"OtherJobEnabled", func(c *Config) bool { return len(c.OtherJobEnabled) != 0 }, []string{managerLaunchd}},
+	{"EnvVars", func(c *Config) bool { return len(c.EnvVars) != 0 }, []string{managerSystemd, managerLaunchd}},
+	{"MachServices", func(c *Config) bool { return len(c.MachServices) != 0 }, []string{managerLaunchd}},
+	{"Sockets", func(c *Config) bool { return len(c.Sockets) != 0 }, []string{managerLaunchd}},
+	{"RunAtLoad", func(c *Config) bool { return c.RunAtLoad != nil }, []string{managerLaunchd}},
+	{"RemainAfterExit", func(c *Config) bool { return c.RemainAfterExit }, []string{managerSystemd}},
+	{"Schedule", func(c *Config) bool { return c.Schedule.scheduled() }, []string{managerSystemd, managerLaunchd}},
+	{"Agent", func(c *Config) bool { return c.Agent }, []string{managerLaunchd}},
+	{"Host", func(c *Config) bool { return c.Host != "" }, []string{managerWindows}},
+	{"UserSession", func(c *Config) bool { return c.UserSession }, []string{managerWindows}},
+	{"UnitDir", func(c *Config) bool { return c.UnitDir != "" }, []string{managerSystemd}},
+	{"DropIn", func(c *Config) bool { return c.DropIn != "" }, []string{managerSystemd}},
+	{"RuntimeDirectory", func(c *Config) bool {
+		return c.RuntimeDirectory != "" || c.StateDirectory != "" || c.CacheDirectory != "" || c.LogsDirectory != ""
+	}, unixManagers},
+	{"RootDir", func(c *Config) bool { return c.RootDir != "" }, unixManagers},
+	{"ConfigFileMode", func(c *Config) bool { return c.ConfigFileMode != 0 }, unixManagers},
+	{"ConfigOwner", func(c *Config) bool { return c.ConfigOwner != "" || c.ConfigGroup != "" }, unixManagers},
+	{"OnFailure", func(c *Config) bool { return len(c.OnFailure) != 0 }, []string{managerSystemd}},
+	{"StartLimitBurst", func(c *Config) bool { return c.StartLimitIntervalSec != 0 || c.StartLimitBurst != 0 }, []string{managerSystemd}},
+	{"AutoResetFailed", func(c *Config) bool { return c.AutoResetFailed }, []string{managerSystemd}},
+	{"StopWhenUnneeded", func(c *Config) bool { return c.StopWhenUnneeded }, []string{managerSystemd}},
+	{"RefuseManualStart", func(c *Config) bool { return c.RefuseManualStart || c.RefuseManualStop }, []string{managerSystemd}},
+	{"MaxRestarts", func(c *Config) bool { return c.MaxRestarts != 0 }, []string{managerLaunchd}},
+	{"Hardening", func(c *Config) bool {
+		h := c.Hardening
+		return h.NoNewPrivileges || h.ProtectSystem != "" || h.PrivateTmp || len(h.ReadWritePaths) != 0
+	}, []string{managerSystemd}},
+	{"CPUSchedulingPolicy", func(c *Config) bool { return c.CPUSchedulingPolicy != "" }, []string{managerSystemd}},
+	{"IOSchedulingClass", func(c *Config) bool { return c.IOSchedulingClass != "" }, []string{managerSystemd}},
+	{"KillMode", func(c *Config) bool { return c.KillMode != "" }, []string{managerSystemd}},
+	{"Slice", func(c *Config) bool { return c.Slice != "" }, []string{managerSystemd}},
+	{"CPUQuota", func(c *Config) bool { return c.CPUQuota != "" }, []string{managerSystemd}},
+	{"TasksMax", func(c *Config) bool { return c.TasksMax != 0 }, []string{managerSystemd}},
+	{"OOMScoreAdjust", func(c *Config) bool { return c.OOMScoreAdjust != 0 }, []string{managerSystemd, managerUpstart, managerOpenRC, managerSystemV}},
+	{"RecoveryActions", func(c *Config) bool {
+		return len(c.RecoveryActions) != 0 || c.RecoveryResetPeriod != 0 || c.RecoveryCommand != ""
+	}, []string{managerWindows}},
+	{"Triggers", func(c *Config) bool { return len(c.Triggers) != 0 }, []string{managerWindows}},
+	{"ServiceSidType", func(c *Config) bool { return c.ServiceSidType != SidTypeNone }, []string{managerWindows}},
+	{"WantedBy", func(c *Config) bool { return len(c.WantedBy) != 0 }, []string{managerSystemd}},
+	{"CustomTarget", func(c *Config) bool { return c.CustomTarget != "" }, []string{managerSystemd}},
+	{"ExtraDirectives", func(c *Config) bool { return len(c.ExtraDirectives) != 0 }, []string{managerSystemd}},
+}
+
+// Supported reports whether c can be installed on the current platform. It
+// returns the error New would return for an invalid Config, or an error
+// listing each configured field the service manager doesn't support, such
+// as "Sockets requires launchd", or nil. Fields that would be ignored
+// count as unsupported, so a cross-platform installer can fail fast.
+func Supported(c Config) error {
+	if len(c.Name) == 0 {
+		return errNameFieldRequired
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return c.checkSupported()
+}
+
+// checkSupported returns the error of Supported for the fields of c the
+// service manager doesn't support.
+func (c *Config) checkSupported() error {
+	manager := managerName()
+	var problems []string
+	for _, f := range configFeatures {
+		if f.set(c) && !containsString(f.managers, manager) {
+			problems = append(problems, fmt.Sprintf("%s requires %s", f.field, joinOr(f.managers)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Config is not supported by %s: %s", manager, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// joinOr joins names as "a, b or c".
+func joinOr(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
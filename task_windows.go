@@ -0,0 +1,518 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schtasks runs the Task Scheduler command line tool and returns its
+// output. It is a variable so tests can substitute a fake.
+var schtasks = func(args ...string) ([]byte, error) {
+	if err := requireTool("schtasks"); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("schtasks", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("schtasks %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// taskHasNotRun is SCHED_S_TASK_HAS_NOT_RUN, the last result of a task that
+// hasn't run yet.
+const taskHasNotRun = 0x41303
+
+// windowsTaskService is the Service for Config.UserSession. The program is
+// a Task Scheduler task started at logon that runs only while the
+// installing user is logged on, in their interactive session.
+type windowsTaskService struct {
+	Config
+}
+
+func (t *windowsTaskService) String() string {
+	return t.Name
+}
+
+// taskToRun returns the command line the task runs.
+func (t *windowsTaskService) taskToRun() (string, error) {
+	program, err := t.program()
+	if err != nil {
+		return "", err
+	}
+	return `"` + program + `"` + quoteArguments(t.Arguments), nil
+}
+
+// CommandLine returns the command line the task runs.
+func (t *windowsTaskService) CommandLine() (string, error) {
+	return t.taskToRun()
+}
+
+// createArgs returns the schtasks arguments that create the task, or
+// replace it if it exists.
+func (t *windowsTaskService) createArgs() ([]string, error) {
+	tr, err := t.taskToRun()
+	if err != nil {
+		return nil, err
+	}
+	runLevel := "LIMITED"
+	if t.Privileged {
+		runLevel = "HIGHEST"
+	}
+	// /IT runs the task only when the user is logged on, in their session.
+	return []string{"/Create", "/TN", t.Name, "/TR", tr, "/SC", "ONLOGON", "/IT", "/RL", runLevel, "/F"}, nil
+}
+
+// query returns the properties schtasks lists for the task, or nil if it
+// isn't installed. schtasks fails the same way for a missing task as for
+// one it may not read, so any failure counts as not installed.
+func (t *windowsTaskService) query() map[string]string {
+	out, err := schtasks("/Query", "/TN", t.Name, "/FO", "LIST", "/V")
+	if err != nil {
+		return nil
+	}
+	return parseTaskList(out)
+}
+
+// parseTaskList parses the "Key: Value" lines of schtasks /FO LIST output.
+// Keys that repeat, such as those of additional schedules, keep their first
+// value.
+func parseTaskList(out []byte) map[string]string {
+	info := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if _, seen := info[key]; !seen {
+			info[key] = strings.TrimSpace(value)
+		}
+	}
+	return info
+}
+
+func (t *windowsTaskService) Start() error {
+	err := t.ControlRetry.retry(func() error {
+		_, err := schtasks("/Run", "/TN", t.Name)
+		return err
+	})
+	if err != nil && t.query() == nil {
+		return ErrNotInstalled
+	}
+	return err
+}
+
+// Stop ends the task, which terminates the program without calling
+// Config.Stop.
+func (t *windowsTaskService) Stop() error {
+	err := t.ControlRetry.retry(func() error {
+		_, err := schtasks("/End", "/TN", t.Name)
+		return err
+	})
+	if err != nil && t.query() == nil {
+		return ErrNotInstalled
+	}
+	return err
+}
+
+// Kill is Stop, as ending a task already terminates the program.
+func (t *windowsTaskService) Kill() error {
+	return t.Stop()
+}
+
+// Restart ends the task and runs it again. schtasks /End returns once the
+// program has been terminated.
+func (t *windowsTaskService) Restart() error {
+	err := t.Stop()
+	if err != nil {
+		return err
+	}
+	return t.Start()
+}
+
+func (t *windowsTaskService) ResetFailed() error {
+	return ErrNotSupported
+}
+
+func (t *windowsTaskService) InstallOrUpdateRequired() (bool, error) {
+	info := t.query()
+	if info == nil {
+		return true, nil
+	}
+	tr, err := t.taskToRun()
+	if err != nil {
+		return false, err
+	}
+	return info["Task To Run"] != tr, nil
+}
+
+// UpdateWillRestart reports whether the task would run another command
+// line. Other settings of a task aren't updated.
+func (t *windowsTaskService) UpdateWillRestart() (bool, error) {
+	info := t.query()
+	if info == nil {
+		return false, nil
+	}
+	tr, err := t.taskToRun()
+	if err != nil {
+		return false, err
+	}
+	return info["Task To Run"] != tr, nil
+}
+
+// NeedsElevation reports whether a Privileged task, which runs with the
+// highest privileges of the user, is installed from a process that isn't
+// elevated. Other tasks don't need elevation.
+func (t *windowsTaskService) NeedsElevation() bool {
+	return t.Privileged && (&windowsService{Config: t.Config}).NeedsElevation()
+}
+
+func (t *windowsTaskService) InstallOrUpdate() (InstallResult, error) {
+	return t.installOrUpdate(false)
+}
+
+func (t *windowsTaskService) InstallOrUpdateWithRollback(healthy func() error, timeout time.Duration) error {
+	return installWithRollback(t, t.snapshot, healthy, timeout)
+}
+
+// snapshot exports the definition of the installed task and returns a
+// function that recreates the task from it, or nil if it isn't installed.
+func (t *windowsTaskService) snapshot() (func() error, error) {
+	saved, err := t.InstalledConfig()
+	if err == ErrNotInstalled {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		f, err := ioutil.TempFile("", "task*.xml")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(saved)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		_, err = schtasks("/Create", "/TN", t.Name, "/XML", f.Name(), "/F")
+		return err
+	}, nil
+}
+
+func (t *windowsTaskService) ForceReinstall() error {
+	_, err := t.installOrUpdate(true)
+	if err != nil {
+		return err
+	}
+	return t.Restart()
+}
+
+// installOrUpdate creates the task and starts it, or replaces it if it
+// runs another command line, or unconditionally if force is set.
+func (t *windowsTaskService) installOrUpdate(force bool) (InstallResult, error) {
+	var result InstallResult
+	err := t.checkWorkingDirectory()
+	if err != nil {
+		return result, err
+	}
+	tr, err := t.taskToRun()
+	if err != nil {
+		return result, err
+	}
+	info := t.query()
+	if info != nil && !force && info["Task To Run"] == tr {
+		return result, nil
+	}
+	args, err := t.createArgs()
+	if err != nil {
+		return result, err
+	}
+	_, err = schtasks(args...)
+	if err != nil {
+		return result, fmt.Errorf("Unable to create task: %v", err)
+	}
+	if info != nil {
+		result.Updated = true
+		return result, nil
+	}
+	result.Installed = true
+	err = t.Start()
+	if err != nil {
+		return result, err
+	}
+	result.Started = true
+	return result, nil
+}
+
+func (t *windowsTaskService) Uninstall() error {
+	if t.query() == nil {
+		return ErrNotInstalled
+	}
+	// The task may not be running.
+	schtasks("/End", "/TN", t.Name)
+	_, err := schtasks("/Delete", "/TN", t.Name, "/F")
+	if err != nil {
+		return fmt.Errorf("Unable to delete task: %v", err)
+	}
+	return nil
+}
+
+func (t *windowsTaskService) UninstallIfPresent() error {
+	if t.query() == nil {
+		return nil
+	}
+	return t.Uninstall()
+}
+
+// UpdateProgram replaces the program the installed task runs, keeping its
+// arguments.
+func (t *windowsTaskService) UpdateProgram(newPath string) error {
+	err := checkExecutable(newPath)
+	if err != nil {
+		return err
+	}
+	oldPath := t.Program
+	t.Program = newPath
+	err = t.recreate()
+	if err != nil {
+		t.Program = oldPath
+	}
+	return err
+}
+
+// UpdateArguments replaces the arguments the installed task runs the
+// program with.
+func (t *windowsTaskService) UpdateArguments(args []string) error {
+	oldArgs := t.Arguments
+	t.Arguments = append([]string(nil), t.expandArguments(args)...)
+	err := t.recreate()
+	if err != nil {
+		t.Arguments = oldArgs
+	}
+	return err
+}
+
+// recreate replaces the installed task with one for the current Config.
+func (t *windowsTaskService) recreate() error {
+	if t.query() == nil {
+		return ErrNotInstalled
+	}
+	args, err := t.createArgs()
+	if err != nil {
+		return err
+	}
+	_, err = schtasks(args...)
+	if err != nil {
+		return fmt.Errorf("Unable to update task: %v", err)
+	}
+	return nil
+}
+
+func (t *windowsTaskService) EffectiveConfig() Config {
+	return t.Config.Clone()
+}
+
+func (t *windowsTaskService) Validate() error {
+	return errors.Join(t.preflight()...)
+}
+
+// InstalledVersion is not supported, as a task has nowhere to keep the
+// version.
+func (t *windowsTaskService) InstalledVersion() (string, error) {
+	return "", ErrNotSupported
+}
+
+// WriteConfig writes the schtasks command line InstallOrUpdate creates the
+// task with.
+func (t *windowsTaskService) WriteConfig(w io.Writer) error {
+	args, err := t.createArgs()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "schtasks%s\n", quoteArguments(args))
+	return err
+}
+
+// InstalledConfig returns the XML definition schtasks exports for the
+// task.
+func (t *windowsTaskService) InstalledConfig() ([]byte, error) {
+	if t.query() == nil {
+		return nil, ErrNotInstalled
+	}
+	return schtasks("/Query", "/TN", t.Name, "/XML")
+}
+
+// Enable and Disable allow or prevent the task from starting at logon.
+func (t *windowsTaskService) Enable() error {
+	return t.setEnabled(true)
+}
+
+func (t *windowsTaskService) Disable() error {
+	return t.setEnabled(false)
+}
+
+func (t *windowsTaskService) setEnabled(enabled bool) error {
+	info := t.query()
+	if info == nil {
+		return ErrNotInstalled
+	}
+	if (info["Scheduled Task State"] == "Enabled") == enabled {
+		return nil
+	}
+	flag := "/DISABLE"
+	if enabled {
+		flag = "/ENABLE"
+	}
+	_, err := schtasks("/Change", "/TN", t.Name, flag)
+	return err
+}
+
+func (t *windowsTaskService) IsEnabled() (bool, error) {
+	info := t.query()
+	return info != nil && info["Scheduled Task State"] == "Enabled", nil
+}
+
+func (t *windowsTaskService) Drain() error {
+	return ErrNotSupported
+}
+
+func (t *windowsTaskService) Undrain() error {
+	return ErrNotSupported
+}
+
+func (t *windowsTaskService) Run() error {
+	return t.RunContext(context.Background())
+}
+
+// RunContext calls Start and waits for ctx to be cancelled or an interrupt.
+// The task always runs in an interactive session, so AllowInteractiveRun
+// isn't needed.
+func (t *windowsTaskService) RunContext(ctx context.Context) error {
+	err := t.checkRunsHere()
+	if err != nil {
+		return err
+	}
+	if t.StdoutPath != "" {
+		restore, err := redirectOutput(&t.Config)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	if t.StdinPath != "" {
+		restore, err := redirectInput(&t.Config)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	err = loadEnvironmentFiles(t.EnvironmentFiles)
+	if err != nil {
+		return err
+	}
+	return runUntilSignal(ctx, &t.Config)
+}
+
+// LastExitStatus returns the last result schtasks reports for the task.
+func (t *windowsTaskService) LastExitStatus() (int, error) {
+	info := t.query()
+	if info == nil {
+		return 0, ErrNotInstalled
+	}
+	result, err := strconv.Atoi(info["Last Result"])
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse last result %q: %v", info["Last Result"], err)
+	}
+	if result == taskHasNotRun {
+		return 0, ErrNoExitStatus
+	}
+	return result, nil
+}
+
+func (t *windowsTaskService) EditConfig(edit func(current []byte) ([]byte, error)) error {
+	return ErrNotSupported
+}
+
+func (t *windowsTaskService) Capabilities() Capability {
+	return 0
+}
+
+func (t *windowsTaskService) Export() (ServiceDefinition, error) {
+	def := ServiceDefinition{Config: t.Config.Clone()}
+	info := t.query()
+	if info == nil {
+		return def, nil
+	}
+	def.Installed = true
+	def.Enabled = info["Scheduled Task State"] == "Enabled"
+	switch info["Status"] {
+	case "Running":
+		def.Status = StatusRunning
+	case "Ready", "Disabled":
+		def.Status = StatusStopped
+	}
+	return def, nil
+}
+
+// WatchStatus polls the status Export reports.
+func (t *windowsTaskService) WatchStatus(ctx context.Context) (<-chan Status, error) {
+	return watchStatus(ctx, t.Export)
+}
+
+// Wait polls schtasks until the task is no longer running.
+func (t *windowsTaskService) Wait(ctx context.Context) (int, error) {
+	return waitExit(ctx, t.Export, t.LastExitStatus)
+}
+
+// PlatformHandle returns the name of the task.
+func (t *windowsTaskService) PlatformHandle() (interface{}, error) {
+	return t.Name, nil
+}
+
+// ResourceUsage is not supported, as schtasks doesn't report the process of
+// a task.
+func (t *windowsTaskService) ResourceUsage() (ResourceUsage, error) {
+	return ResourceUsage{}, ErrNotSupported
+}
+
+// Processes is not supported, for the same reason as ResourceUsage.
+func (t *windowsTaskService) Processes() ([]int, error) {
+	return nil, ErrNotSupported
+}
+
+// StartAndCapture reads the output Run writes to StdoutPath, and returns
+// ErrNotSupported without it.
+func (t *windowsTaskService) StartAndCapture(ctx context.Context, d time.Duration) (string, error) {
+	if t.StdoutPath == "" {
+		return "", ErrNotSupported
+	}
+	read, err := fileOutput(t.StdoutPath)
+	if err != nil {
+		return "", err
+	}
+	return captureStart(ctx, t, d, read)
+}
+
+// RotateLogs rotates the file Run writes StdoutPath to.
+func (t *windowsTaskService) RotateLogs() error {
+	return rotateActiveLog()
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeTask is a task created through the fake schtasks.
+type fakeTask struct {
+	taskToRun string
+	enabled   bool
+	running   bool
+}
+
+// fakeSchtasks replaces schtasks with an in-memory Task Scheduler. It
+// records each command it is given.
+func fakeSchtasks(t *testing.T) (map[string]*fakeTask, *[]string) {
+	tasks := make(map[string]*fakeTask)
+	var commands []string
+	oldSchtasks, oldExecutable := schtasks, executable
+	t.Cleanup(func() { schtasks, executable = oldSchtasks, oldExecutable })
+	executable = func() (string, error) {
+		return `C:\Program Files\tray\tray.exe`, nil
+	}
+	schtasks = func(args ...string) ([]byte, error) {
+		commands = append(commands, strings.Join(args, " "))
+		name := args[2]
+		task := tasks[name]
+		if args[0] != "/Create" && task == nil {
+			return nil, errors.New("ERROR: The system cannot find the file specified.")
+		}
+		switch args[0] {
+		case "/Create":
+			tasks[name] = &fakeTask{taskToRun: args[4], enabled: true}
+		case "/Query":
+			state, status := "Disabled", "Disabled"
+			if task.enabled {
+				state, status = "Enabled", "Ready"
+			}
+			if task.running {
+				status = "Running"
+			}
+			return []byte(fmt.Sprintf("\r\nHostName:                             PC\r\nTaskName:                             \\%s\r\nStatus:                               %s\r\nLast Result:                          267011\r\nTask To Run:                          %s\r\nScheduled Task State:                 %s\r\n", name, status, task.taskToRun, state)), nil
+		case "/Run":
+			task.running = true
+		case "/End":
+			task.running = false
+		case "/Delete":
+			delete(tasks, name)
+		case "/Change":
+			task.enabled = args[3] == "/ENABLE"
+		}
+		return nil, nil
+	}
+	return tasks, &commands
+}
+
+func TestUserSessionTask(t *testing.T) {
+	tasks, commands := fakeSchtasks(t)
+	s, err := New(Config{Name: "tray", UserSession: true, Arguments: []string{"-tray"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.InstallOrUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (InstallResult{Installed: true, Started: true}); result != want {
+		t.Errorf("install = %+v, want %+v", result, want)
+	}
+	create := `/Create /TN tray /TR "C:\Program Files\tray\tray.exe" "-tray" /SC ONLOGON /IT /RL LIMITED /F`
+	if !containsString(*commands, create) {
+		t.Errorf("task not created with the session flag: %q", *commands)
+	}
+	if task := tasks["tray"]; task == nil || !task.running {
+		t.Fatalf("task not started: %+v", task)
+	}
+
+	if required, err := s.InstallOrUpdateRequired(); err != nil || required {
+		t.Errorf("InstallOrUpdateRequired after install = %v, %v", required, err)
+	}
+	def, err := s.Export()
+	if err != nil || !def.Installed || !def.Enabled || def.Status != StatusRunning {
+		t.Errorf("Export = %+v, %v", def, err)
+	}
+	if _, err := s.LastExitStatus(); err != ErrNoExitStatus {
+		t.Errorf("LastExitStatus before the task ran = %v", err)
+	}
+
+	if err := s.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := s.IsEnabled(); err != nil || enabled {
+		t.Errorf("IsEnabled after Disable = %v, %v", enabled, err)
+	}
+
+	if err := s.Uninstall(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 0 {
+		t.Errorf("task left after Uninstall: %v", tasks)
+	}
+	if err := s.Start(); err != ErrNotInstalled {
+		t.Errorf("Start after Uninstall = %v, want ErrNotInstalled", err)
+	}
+}
+
+func TestUserSessionPrivileged(t *testing.T) {
+	_, commands := fakeSchtasks(t)
+	s, err := New(Config{Name: "tray", UserSession: true, Privileged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InstallOrUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains((*commands)[1], " /RL HIGHEST ") {
+		t.Errorf("privileged task not run with the highest privileges: %q", *commands)
+	}
+}
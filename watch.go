@@ -0,0 +1,75 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// statusPollInterval is how often WatchStatus queries the service manager.
+var statusPollInterval = time.Second
+
+// watchStatus sends the status reported by export, then every change to
+// it, until ctx is cancelled, when the channel is closed. It polls every
+// statusPollInterval. A failing first query is returned as the error;
+// later failures are skipped, keeping the last known status.
+func watchStatus(ctx context.Context, export func() (ServiceDefinition, error)) (<-chan Status, error) {
+	def, err := export()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(chan Status, 1)
+	statuses <- def.Status
+	go func() {
+		defer close(statuses)
+		ticker := time.NewTicker(statusPollInterval)
+		defer ticker.Stop()
+		last := def.Status
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			def, err := export()
+			if err != nil || def.Status == last {
+				continue
+			}
+			last = def.Status
+			select {
+			case statuses <- last:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return statuses, nil
+}
+
+// waitExit waits until the status reported by export is StatusStopped and
+// returns the exit status from lastExit. A service that is already stopped
+// returns at once.
+func waitExit(ctx context.Context, export func() (ServiceDefinition, error), lastExit func() (int, error)) (int, error) {
+	def, err := export()
+	if err != nil {
+		return 0, err
+	}
+	if !def.Installed {
+		return 0, ErrNotInstalled
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	statuses, err := watchStatus(ctx, export)
+	if err != nil {
+		return 0, err
+	}
+	for status := range statuses {
+		if status == StatusStopped {
+			return lastExit()
+		}
+	}
+	return 0, ctx.Err()
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.package service
+
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchStatus(t *testing.T) {
+	oldInterval := statusPollInterval
+	defer func() { statusPollInterval = oldInterval }()
+	statusPollInterval = time.Millisecond
+
+	// The backend reports each state twice and fails once in between, all
+	// of which must be collapsed into the transitions.
+	backend := []Status{StatusStopped, StatusStopped, StatusRunning, "", StatusRunning, StatusStopped}
+	var mu sync.Mutex
+	export := func() (ServiceDefinition, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(backend) == 0 {
+			return ServiceDefinition{Status: StatusStopped}, nil
+		}
+		status := backend[0]
+		backend = backend[1:]
+		if status == "" {
+			return ServiceDefinition{}, errors.New("query failed")
+		}
+		return ServiceDefinition{Status: status}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statuses, err := watchStatus(ctx, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Status
+	for len(got) < 3 {
+		got = append(got, <-statuses)
+	}
+	want := []Status{StatusStopped, StatusRunning, StatusStopped}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statuses = %q, want %q", got, want)
+	}
+
+	cancel()
+	select {
+	case status, ok := <-statuses:
+		if ok {
+			t.Errorf("unexpected status %q after cancel", status)
+		}
+	case <-time.After(time.Second):
+		t.Error("channel not closed after cancel")
+	}
+}
+
+func TestWatchStatusError(t *testing.T) {
+	failed := errors.New("query failed")
+	_, err := watchStatus(context.Background(), func() (ServiceDefinition, error) {
+		return ServiceDefinition{}, failed
+	})
+	if err != failed {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+}
+
+func TestWaitExit(t *testing.T) {
+	oldInterval := statusPollInterval
+	defer func() { statusPollInterval = oldInterval }()
+	statusPollInterval = time.Millisecond
+
+	var mu sync.Mutex
+	status, exited := StatusRunning, false
+	export := func() (ServiceDefinition, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ServiceDefinition{Installed: true, Status: status}, nil
+	}
+	lastExit := func() (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !exited {
+			return 0, ErrNoExitStatus
+		}
+		return 3, nil
+	}
+	time.AfterFunc(10*time.Millisecond, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		status, exited = StatusStopped, true
+	})
+	code, err := waitExit(context.Background(), export, lastExit)
+	if err != nil || code != 3 {
+		t.Errorf("waitExit = %d, %v, want 3", code, err)
+	}
+
+	// A service that doesn't stop waits until ctx is cancelled.
+	mu.Lock()
+	status = StatusRunning
+	mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := waitExit(ctx, export, lastExit); err != context.DeadlineExceeded {
+		t.Errorf("waitExit of a running service = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	_, err = waitExit(context.Background(), func() (ServiceDefinition, error) {
+		return ServiceDefinition{}, nil
+	}, lastExit)
+	if err != ErrNotInstalled {
+		t.Errorf("waitExit of a missing service = %v, want ErrNotInstalled", err)
+	}
+}